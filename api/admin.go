@@ -0,0 +1,258 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/geocoding"
+	"github.com/Sraiti/vesselTracker/seeder"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+// Upper bound on the codes one refresh request can queue
+const maxRefreshCodes = 500
+
+type refreshRequest struct {
+	UnLoCodes []string `json:"unlocodes"`
+}
+
+type refreshResponse struct {
+	Queued  []string `json:"queued"`
+	Pending []string `json:"pending"` // already waiting in the queue
+}
+
+// RefreshMaerskIDsHandler queues a Maersk ID lookup for the given
+// UN/LOCODEs, ignoring stored IDs and cached misses.
+func RefreshMaerskIDsHandler(enricher *MaerskIDEnricher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := normalizeUnLoCodes(req.UnLoCodes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		queued, pending := enricher.Refresh(codes)
+		writeJSON(w, http.StatusAccepted, refreshResponse{Queued: queued, Pending: pending})
+	}
+}
+
+type geocodeRequest struct {
+	UnLoCodes  []string `json:"unlocodes"`
+	AllMissing bool     `json:"allMissing"`
+}
+
+// GeocodeLocationsHandler queues locations without coordinates on the
+// geocoding worker, either the given ones or all of them.
+func GeocodeLocationsHandler(geocoder *geocoding.Worker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req geocodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var queued int64
+		var err error
+		if req.AllMissing {
+			queued, err = geocoder.EnqueueAllMissing()
+		} else {
+			codes, verr := normalizeUnLoCodes(req.UnLoCodes)
+			if verr != nil {
+				http.Error(w, verr.Error(), http.StatusBadRequest)
+				return
+			}
+			queued, err = geocoder.Enqueue(codes)
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, map[string]int64{"queued": queued})
+	}
+}
+
+type seedRequest struct {
+	Release string `json:"release"`
+	Force   bool   `json:"force"`
+}
+
+// SeedLocationsHandler applies the UN/LOCODE file named by UNLOCODE_FILE
+// (code-list.csv by default) and answers with the recorded run. The body is
+// optional.
+func SeedLocationsHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req seedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		_, run, err := seeder.Seed(database, seeder.Options{
+			File:    os.Getenv("UNLOCODE_FILE"),
+			Release: req.Release,
+			Force:   req.Force,
+		})
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, run)
+	}
+}
+
+// SeedingRunsHandler lists the seeding history, most recent first.
+func SeedingRunsHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, _, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		runs, err := seeder.ListRuns(database, limit)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, runs)
+	}
+}
+
+// Polygon files beyond this are better imported with the CLI
+const maxAreasBodyBytes = 32 << 20
+
+// ImportWPIHandler imports the World Port Index file named by WPI_FILE.
+func ImportWPIHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := seeder.ImportWPI(database, os.Getenv("WPI_FILE"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
+
+// ImportAreasHandler imports the GeoJSON FeatureCollection in the body as
+// location polygons, tagged with the source query parameter.
+func ImportAreasHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := http.MaxBytesReader(w, r.Body, maxAreasBodyBytes)
+
+		stats, err := seeder.ImportAreas(database, body, r.URL.Query().Get("source"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
+
+// normalizeUnLoCodes upper-cases, validates and dedupes a list of codes.
+func normalizeUnLoCodes(unLoCodes []string) ([]string, error) {
+	if len(unLoCodes) == 0 {
+		return nil, fmt.Errorf("unlocodes is required")
+	}
+	if len(unLoCodes) > maxRefreshCodes {
+		return nil, fmt.Errorf("at most %d unlocodes per request", maxRefreshCodes)
+	}
+
+	seen := make(map[string]bool)
+	codes := make([]string, 0, len(unLoCodes))
+	for _, code := range unLoCodes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !unLoCodePattern.MatchString(code) {
+			return nil, fmt.Errorf("invalid UN/LOCODE: %q", code)
+		}
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	return codes, nil
+}
+
+// ScheduleWritesHandler reports on the background schedule writer.
+func ScheduleWritesHandler(writer *services.ScheduleWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, writer.Status())
+	}
+}
+
+// UpdateVesselParticularsHandler records particulars entered by hand, DWT,
+// TEU and build year usually, since neither AIS nor carriers send them.
+// Fields left out keep their value.
+func UpdateVesselParticularsHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vessel, err := resolveVessel(database, r.PathValue("id"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		var req db.VesselParticulars
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateParticulars(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := db.UpdateVesselParticulars(database, vessel.ID, req); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		particulars, err := db.GetVesselParticulars(database, vessel.ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, particulars)
+	}
+}
+
+func validateParticulars(p db.VesselParticulars) error {
+	for name, v := range map[string]*int{"ship_type": p.ShipType, "dwt": p.DWT, "teu": p.TEU} {
+		if v != nil && *v <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	for name, v := range map[string]*float64{"length_m": p.LengthM, "beam_m": p.BeamM, "draught_m": p.DraughtM} {
+		if v != nil && *v <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if p.BuildYear != nil && (*p.BuildYear < 1900 || *p.BuildYear > time.Now().Year()+5) {
+		return fmt.Errorf("invalid build_year: %d", *p.BuildYear)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+// annotateConnections computes the transshipment windows of each product,
+// then moves them with the live ETA of inbound vessels already under way
+// whose AIS data quality can be trusted.
+// It runs on every answer, cached ones included, so the flags follow the
+// tracking data rather than the time of the carrier fetch.
+func annotateConnections(database *sql.DB, products []models.ReducedOceanProduct, policy services.ConnectionPolicy) {
+	portSet := make(map[string]struct{})
+	for i := range products {
+		services.AnalyzeConnections(&products[i], policy)
+		for _, c := range products[i].Connections {
+			portSet[c.PortUnLoCode] = struct{}{}
+		}
+	}
+	if len(portSet) == 0 {
+		return
+	}
+
+	ports := make([]string, 0, len(portSet))
+	for p := range portSet {
+		ports = append(ports, p)
+	}
+	coordinates, err := db.GetLocationCoordinates(database, ports)
+	if err != nil {
+		log.Printf("Error getting transshipment port coordinates: %v", err)
+		return
+	}
+
+	var mmsis []string
+	for _, product := range products {
+		for _, leg := range product.TransportLegs {
+			if leg.VesselMMSI != "" && len(leg.LastKnownPosition) >= 2 {
+				mmsis = append(mmsis, leg.VesselMMSI)
+			}
+		}
+	}
+	quality, err := db.GetDataQualities(database, mmsis)
+	if err != nil {
+		log.Printf("Error getting inbound vessel data quality: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range products {
+		services.UpdateConnectionETAs(&products[i], policy, coordinates, quality, now)
+	}
+}
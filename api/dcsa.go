@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+// Carriers page large answers with the Next-Page-Cursor header
+const dcsaMaxPages = 5
+
+// DCSAProvider serves schedules from a carrier implementing the DCSA
+// Commercial Schedules API.
+type DCSAProvider struct {
+	CarrierCode string // SCAC of the carrier, e.g. HLCU
+	BaseURL     string // up to and excluding /point-to-point-routes
+	APIKey      string
+	AuthHeader  string
+	Client      *http.Client
+}
+
+// dcsaProvidersFromEnv reads DCSA_CARRIERS, a comma separated list of
+// CODE=BASE_URL pairs. Each carrier takes its key from DCSA_<CODE>_API_KEY,
+// sent in the DCSA_<CODE>_AUTH_HEADER header (API-Key by default).
+func dcsaProvidersFromEnv() []DCSAProvider {
+	var providers []DCSAProvider
+	for _, entry := range strings.Split(os.Getenv("DCSA_CARRIERS"), ",") {
+		code, baseURL, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			if entry != "" {
+				log.Printf("Invalid DCSA_CARRIERS entry %q, expected CODE=BASE_URL", entry)
+			}
+			continue
+		}
+		code = strings.ToUpper(strings.TrimSpace(code))
+
+		authHeader := os.Getenv("DCSA_" + code + "_AUTH_HEADER")
+		if authHeader == "" {
+			authHeader = "API-Key"
+		}
+
+		providers = append(providers, DCSAProvider{
+			CarrierCode: code,
+			BaseURL:     strings.TrimRight(strings.TrimSpace(baseURL), "/"),
+			APIKey:      os.Getenv("DCSA_" + code + "_API_KEY"),
+			AuthHeader:  authHeader,
+			Client:      &http.Client{Timeout: providerTimeout},
+		})
+	}
+	return providers
+}
+
+func (p DCSAProvider) Name() string { return "dcsa:" + p.CarrierCode }
+
+func (p DCSAProvider) Search(ctx context.Context, params FetchParams, origin, destination db.Location) ([]models.ReducedOceanProduct, error) {
+	query := url.Values{}
+	query.Set("placeOfReceipt", origin.Unlocode)
+	query.Set("placeOfDelivery", destination.Unlocode)
+
+	if start, end, onArrival := params.window(); !start.IsZero() {
+		prefix := "departure"
+		if onArrival {
+			prefix = "arrival"
+		}
+		query.Set(prefix+"StartDate", start.Format("2006-01-02"))
+		query.Set(prefix+"EndDate", end.Format("2006-01-02"))
+	}
+
+	var products []models.ReducedOceanProduct
+	for page := 0; page < dcsaMaxPages; page++ {
+		routes, cursor, err := p.fetchRoutes(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p.buildReducedProducts(routes)...)
+
+		if cursor == "" {
+			break
+		}
+		query = url.Values{"cursor": {cursor}}
+	}
+
+	return products, nil
+}
+
+func (p DCSAProvider) fetchRoutes(ctx context.Context, query url.Values) ([]models.DCSAPointToPointRoute, string, error) {
+	endpoint := p.BaseURL + "/point-to-point-routes?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("API-Version", "1")
+	req.Header.Set("Accept", "application/json")
+	if p.APIKey != "" {
+		req.Header.Set(p.AuthHeader, p.APIKey)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent:
+		return nil, "", nil
+	case res.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("%s API error: status %d, body: %s", p.Name(), res.StatusCode, string(body))
+	}
+
+	routes, err := models.UnmarshalDCSAPointToPoint(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: decoding routes: %w", p.Name(), err)
+	}
+
+	return routes, res.Header.Get("Next-Page-Cursor"), nil
+}
+
+// buildReducedProducts maps DCSA routes onto the normalized schedule. The
+// first vessel leg provides the departure vessel.
+func (p DCSAProvider) buildReducedProducts(routes []models.DCSAPointToPointRoute) []models.ReducedOceanProduct {
+	products := make([]models.ReducedOceanProduct, 0, len(routes))
+
+	for _, route := range routes {
+		product := models.ReducedOceanProduct{
+			CarrierProductID: route.RoutingReference,
+			CarrierCode:      p.CarrierCode,
+			//origin
+			OriginName:             route.PlaceOfReceipt.Location.LocationName,
+			OriginCity:             route.PlaceOfReceipt.Location.LocationName,
+			OriginCountry:          countryOf(route.PlaceOfReceipt.Location.UNLocationCode),
+			OriginPortUnLoCode:     route.PlaceOfReceipt.Location.UNLocationCode,
+			OriginCarrierSiteGeoID: route.PlaceOfReceipt.Location.FacilityCode,
+			//destination
+			DestinationName:             route.PlaceOfDelivery.Location.LocationName,
+			DestinationCity:             route.PlaceOfDelivery.Location.LocationName,
+			DestinationCountry:          countryOf(route.PlaceOfDelivery.Location.UNLocationCode),
+			DestinationPortUnLoCode:     route.PlaceOfDelivery.Location.UNLocationCode,
+			DestinationCarrierSiteGeoID: route.PlaceOfDelivery.Location.FacilityCode,
+			//time
+			DepartureDateTime: route.PlaceOfReceipt.DateTime,
+			ArrivalDateTime:   route.PlaceOfDelivery.DateTime,
+			// DCSA counts days, Maersk and our storage count minutes
+			TransitTime:   int32(route.TransitTime * 24 * 60),
+			TransportLegs: []models.ReducedTransportLeg{},
+		}
+
+		if product.TransitTime == 0 && !product.DepartureDateTime.IsZero() {
+			product.TransitTime = int32(product.ArrivalDateTime.Sub(product.DepartureDateTime.Time) / time.Minute)
+		}
+
+		for _, leg := range route.Legs {
+			partner := p.servicePartner(leg.Transport.ServicePartners)
+
+			reducedLeg := models.ReducedTransportLeg{
+				DepartureDateTime: leg.Departure.DateTime,
+				ArrivalDateTime:   leg.Arrival.DateTime,
+				//vessel
+				VesselName:      leg.Transport.Vessel.Name,
+				VesselIMONumber: leg.Transport.Vessel.VesselIMONumber,
+				VesselFlag:      leg.Transport.Vessel.Flag,
+				VesselCallSign:  leg.Transport.Vessel.CallSign,
+				//service
+				TransportMode:                leg.Transport.ModeOfTransport,
+				CarrierServiceCode:           partner.CarrierServiceCode,
+				CarrierServiceName:           partner.CarrierServiceName,
+				CarrierDepartureVoyageNumber: partner.CarrierExportVoyageNumber,
+				//origin
+				OriginName:             leg.Departure.Location.LocationName,
+				OriginCity:             leg.Departure.Location.LocationName,
+				OriginCountry:          countryOf(leg.Departure.Location.UNLocationCode),
+				OriginPortUnLoCode:     leg.Departure.Location.UNLocationCode,
+				OriginCarrierSiteGeoID: leg.Departure.Location.FacilityCode,
+				//destination
+				DestinationName:             leg.Arrival.Location.LocationName,
+				DestinationCity:             leg.Arrival.Location.LocationName,
+				DestinationCountry:          countryOf(leg.Arrival.Location.UNLocationCode),
+				DestinationPortUnLoCode:     leg.Arrival.Location.UNLocationCode,
+				DestinationCarrierSiteGeoID: leg.Arrival.Location.FacilityCode,
+				//coordinates
+				OriginCoordinates:      dcsaCoordinates(leg.Departure.Location),
+				DestinationCoordinates: dcsaCoordinates(leg.Arrival.Location),
+			}
+			product.TransportLegs = append(product.TransportLegs, reducedLeg)
+
+			if product.DepartureVesselIMONumber == "" && leg.Transport.ModeOfTransport == "VESSEL" {
+				product.DepartureVesselName = leg.Transport.Vessel.Name
+				product.DepartureVesselIMONumber = leg.Transport.Vessel.VesselIMONumber
+			}
+		}
+
+		products = append(products, product)
+	}
+
+	return products
+}
+
+// servicePartner picks the partner entry of the queried carrier, falling
+// back to the first one for legs run by another carrier.
+func (p DCSAProvider) servicePartner(partners []models.DCSAServicePartner) models.DCSAServicePartner {
+	for _, partner := range partners {
+		if strings.EqualFold(partner.CarrierCode, p.CarrierCode) {
+			return partner
+		}
+	}
+	if len(partners) > 0 {
+		return partners[0]
+	}
+	return models.DCSAServicePartner{}
+}
+
+// dcsaCoordinates parses the optional latitude and longitude of a DCSA
+// location, nil when missing or malformed.
+func dcsaCoordinates(loc models.DCSALocation) []float64 {
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(loc.Latitude), 64)
+	lon, errLon := strconv.ParseFloat(strings.TrimSpace(loc.Longitude), 64)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil
+	}
+	return []float64{lat, lon}
+}
+
+func countryOf(unlocode string) string {
+	if len(unlocode) < 2 {
+		return ""
+	}
+	return unlocode[:2]
+}
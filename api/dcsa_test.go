@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+// dcsaFixture serves the recorded DCSA answer. With pages > 1 every page
+// but the last sends a Next-Page-Cursor; pages < 0 never stops paging.
+func dcsaFixture(t *testing.T, pages int) (*httptest.Server, *[]*http.Request) {
+	fixture, err := os.ReadFile("../dcsaPointToPointExample.json")
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+
+	var mu sync.Mutex
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		page := len(requests)
+		mu.Unlock()
+
+		if r.URL.Path != "/v1/point-to-point-routes" {
+			http.NotFound(w, r)
+			return
+		}
+		if pages < 0 || page < pages {
+			w.Header().Set("Next-Page-Cursor", "page-"+strconv.Itoa(page))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(fixture)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func dcsaTestProvider(baseURL string) DCSAProvider {
+	return DCSAProvider{
+		CarrierCode: "HLCU",
+		BaseURL:     baseURL + "/v1",
+		APIKey:      "secret",
+		AuthHeader:  "API-Key",
+		Client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func TestDCSAProviderMapsFixture(t *testing.T) {
+	srv, requests := dcsaFixture(t, 1)
+	provider := dcsaTestProvider(srv.URL)
+
+	products, err := provider.Search(context.Background(), FetchParams{},
+		db.Location{Unlocode: "NLRTM"}, db.Location{Unlocode: "CNSHA"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+
+	if len(*requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*requests))
+	}
+	req := (*requests)[0]
+	if got := req.URL.Query().Get("placeOfReceipt"); got != "NLRTM" {
+		t.Errorf("placeOfReceipt = %q", got)
+	}
+	if got := req.URL.Query().Get("placeOfDelivery"); got != "CNSHA" {
+		t.Errorf("placeOfDelivery = %q", got)
+	}
+	if got := req.Header.Get("API-Key"); got != "secret" {
+		t.Errorf("API-Key header = %q", got)
+	}
+
+	if len(products) != 1 {
+		t.Fatalf("got %d products, want 1", len(products))
+	}
+	p := products[0]
+	if p.CarrierCode != "HLCU" || p.CarrierProductID != "HLCU-NLRTM-CNSHA-001" {
+		t.Errorf("carrier = %q, product = %q", p.CarrierCode, p.CarrierProductID)
+	}
+	if p.OriginPortUnLoCode != "NLRTM" || p.OriginCountry != "NL" || p.DestinationPortUnLoCode != "CNSHA" || p.DestinationCountry != "CN" {
+		t.Errorf("route = %s (%s) -> %s (%s)", p.OriginPortUnLoCode, p.OriginCountry, p.DestinationPortUnLoCode, p.DestinationCountry)
+	}
+	// 36 days
+	if p.TransitTime != 36*24*60 {
+		t.Errorf("transit time = %d minutes, want %d", p.TransitTime, 36*24*60)
+	}
+	wantDeparture := time.Date(2024, 5, 3, 8, 0, 0, 0, time.UTC)
+	if !p.DepartureDateTime.Time.Equal(wantDeparture) {
+		t.Errorf("departure = %v, want %v", p.DepartureDateTime.Time, wantDeparture)
+	}
+	if p.DepartureVesselIMONumber != "9776183" || p.DepartureVesselName != "BERLIN EXPRESS" {
+		t.Errorf("departure vessel = %s %s", p.DepartureVesselIMONumber, p.DepartureVesselName)
+	}
+
+	if len(p.TransportLegs) != 1 {
+		t.Fatalf("got %d legs, want 1", len(p.TransportLegs))
+	}
+	leg := p.TransportLegs[0]
+	if leg.TransportMode != "VESSEL" || leg.VesselIMONumber != "9776183" || leg.VesselName != "BERLIN EXPRESS" {
+		t.Errorf("leg vessel = %s %s %s", leg.TransportMode, leg.VesselIMONumber, leg.VesselName)
+	}
+	if leg.VesselFlag != "DE" || leg.VesselCallSign != "DCPP2" {
+		t.Errorf("leg flag = %q, call sign = %q", leg.VesselFlag, leg.VesselCallSign)
+	}
+	if leg.CarrierServiceCode != "FE4" || leg.CarrierServiceName != "Far East Loop 4" || leg.CarrierDepartureVoyageNumber != "2418W" {
+		t.Errorf("leg service = %s %q, voyage %s", leg.CarrierServiceCode, leg.CarrierServiceName, leg.CarrierDepartureVoyageNumber)
+	}
+	if leg.OriginPortUnLoCode != "NLRTM" || leg.OriginCarrierSiteGeoID != "ECTDE" || leg.DestinationPortUnLoCode != "CNSHA" || leg.DestinationCarrierSiteGeoID != "SGHWG" {
+		t.Errorf("leg ports = %s/%s -> %s/%s", leg.OriginPortUnLoCode, leg.OriginCarrierSiteGeoID, leg.DestinationPortUnLoCode, leg.DestinationCarrierSiteGeoID)
+	}
+	if len(leg.OriginCoordinates) != 2 || leg.OriginCoordinates[0] != 51.9496 || leg.OriginCoordinates[1] != 4.1453 {
+		t.Errorf("leg origin coordinates = %v", leg.OriginCoordinates)
+	}
+}
+
+func TestDCSAProviderFollowsCursor(t *testing.T) {
+	srv, requests := dcsaFixture(t, 3)
+
+	products, err := dcsaTestProvider(srv.URL).Search(context.Background(), FetchParams{},
+		db.Location{Unlocode: "NLRTM"}, db.Location{Unlocode: "CNSHA"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(*requests) != 3 || len(products) != 3 {
+		t.Fatalf("got %d requests and %d products, want 3 of each", len(*requests), len(products))
+	}
+
+	next := (*requests)[1].URL.Query()
+	if next.Get("cursor") != "page-1" || next.Get("placeOfReceipt") != "" {
+		t.Errorf("second page query = %v, want the cursor alone", next)
+	}
+}
+
+func TestDCSAProviderStopsAtPageCap(t *testing.T) {
+	srv, requests := dcsaFixture(t, -1)
+
+	products, err := dcsaTestProvider(srv.URL).Search(context.Background(), FetchParams{},
+		db.Location{Unlocode: "NLRTM"}, db.Location{Unlocode: "CNSHA"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(*requests) != dcsaMaxPages {
+		t.Errorf("got %d requests, want the cap of %d", len(*requests), dcsaMaxPages)
+	}
+	if len(products) != dcsaMaxPages {
+		t.Errorf("got %d products, want one per page", len(products))
+	}
+}
@@ -3,16 +3,19 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"log"
 	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/geocoding"
 	"github.com/Sraiti/vesselTracker/models"
+	"github.com/Sraiti/vesselTracker/services"
 	"github.com/Sraiti/vesselTracker/utils"
 )
 
@@ -21,7 +24,19 @@ type FetchParams struct {
 	DestinationPortUnLoCode string
 	Destination             string
 	Origin                  string
-	DepartureDate           models.CustomTime
+	// Start of the search window, on departure or on arrival (not both)
+	DepartureDate models.CustomTime
+	ArrivalDate   models.CustomTime
+	// Length of the search window in weeks, carrier default when zero
+	SearchRangeWeeks int
+	// DRY or REEF
+	CargoType string
+	// ISO 6346 size/type code, e.g. 42G1
+	ISOEquipmentCode string
+	// departure (default), arrival or transitTime
+	SortBy string
+	// Skip the lane cache and fetch from the carrier
+	ForceRefresh bool
 }
 
 type VesselsMessagesSummary struct {
@@ -36,129 +51,140 @@ type VesselMessageSummary struct {
 	TimeStamp  models.CustomTime
 }
 
-func saveScheduleToDB(db *sql.DB, data []models.ReducedOceanProduct) {
-
-	for _, product := range data {
-
-		validTo := product.ProductValidToDate.Time
-		validFrom := product.ProductValidFromDate.Time
-		var oceanProductID int
-
-		err := db.QueryRow(`
-				INSERT INTO ocean_products (
-					carrier_product_id, product_valid_to_date, product_valid_from_date,
-					origin_city, origin_name, origin_country, origin_port_un_lo_code,
-					origin_carrier_site_geo_id, origin_carrier_city_geo_id,
-					destination_city, destination_name, destination_country,
-					destination_port_un_lo_code, destination_carrier_site_geo_id,
-					destination_carrier_city_geo_id, departure_vessel_carrier_code,
-					departure_vessel_name, departure_vessel_imo_number,
-					departure_vessel_mmsi, departure_date_time, arrival_date_time,
-					transit_time
-				) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, 
-						  $15, $16, $17, $18, $19, $20, $21, $22)
-				ON CONFLICT ( origin_port_un_lo_code, destination_port_un_lo_code, 
-							departure_vessel_imo_number, departure_date_time, arrival_date_time) 
-				DO UPDATE SET
-					carrier_product_id = $1,
-					product_valid_to_date = $2,
-					product_valid_from_date = $3,
-					origin_city = $4,
-					origin_name = $5, 
-					origin_country = $6,
-					origin_carrier_site_geo_id = $8,
-					origin_carrier_city_geo_id = $9,
-					destination_city = $10,
-					destination_name = $11,
-					destination_country = $12,
-					destination_carrier_site_geo_id = $14,
-					destination_carrier_city_geo_id = $15,
-					departure_vessel_carrier_code = $16,
-					departure_vessel_name = $17,
-					departure_vessel_mmsi = $19,
-					transit_time = $22
-				RETURNING id`,
-			product.CarrierProductID, validTo, validFrom, product.OriginCity,
-			product.OriginName, product.OriginCountry, product.OriginPortUnLoCode,
-			product.OriginCarrierSiteGeoID, product.OriginCarrierCityGeoID,
-			product.DestinationCity, product.DestinationName,
-			product.DestinationCountry, product.DestinationPortUnLoCode,
-			product.DestinationCarrierSiteGeoID, product.DestinationCarrierCityGeoID,
-			product.DepartureVesselCarrierCode, product.DepartureVesselName,
-			product.DepartureVesselIMONumber, product.DepartureVesselMMSI,
-			product.DepartureDateTime.Time, product.ArrivalDateTime.Time,
-			product.TransitTime).Scan(&oceanProductID)
+const (
+	defaultAutoCompleteLimit = 10
+	maxAutoCompleteLimit     = 50
+)
 
-		if err != nil {
-			log.Printf("Error inserting ocean product: %v", err)
-			continue
+// AutoCompleteHandler searches locations by text, optionally narrowed to a
+// country and to functions, e.g. ?text=tanger&function=port,rail&country=MA.
+func AutoCompleteHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		text := strings.TrimSpace(query.Get("text"))
+		log.Println("AutoCompleteHandler:", text)
+
+		filter := db.LocationFilter{
+			Text:        text,
+			CountryCode: query.Get("country"),
+			Subdivision: query.Get("subdivision"),
+			Status:      query.Get("status"),
+			Limit:       defaultAutoCompleteLimit,
+		}
+		if v := query.Get("function"); v != "" {
+			filter.Functions = strings.Split(v, ",")
 		}
 
-		for _, leg := range product.TransportLegs {
-			// Insert ocean product first
-
-			// Insert transport leg linked to ocean product
-			_, err = db.Exec(`
-				INSERT INTO transport_legs (
-					ocean_product_id, departure_date_time, arrival_date_time,
-					vessel_carrier_code, vessel_name, vessel_imo_number, vessel_mmsi,
-					origin_city, origin_name, origin_country, origin_port_un_lo_code,
-					origin_carrier_site_geo_id, origin_carrier_city_geo_id,
-					destination_city, destination_name, destination_country,
-					destination_port_un_lo_code, destination_carrier_site_geo_id,
-					destination_carrier_city_geo_id
-				) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
-						  $14, $15, $16, $17, $18, $19)
-				ON CONFLICT ( vessel_imo_number, departure_date_time, arrival_date_time)
-				DO UPDATE SET	
-					vessel_carrier_code = $4,
-					vessel_name = $5,
-					vessel_mmsi = $7,
-					origin_city = $8,
-					origin_name = $9,
-					origin_country = $10,
-					origin_carrier_site_geo_id = $12,
-					origin_carrier_city_geo_id = $13,
-					destination_city = $14,
-					destination_name = $15,
-					destination_country = $16,
-					destination_carrier_site_geo_id = $18,
-					destination_carrier_city_geo_id = $19`,
-				oceanProductID, leg.DepartureDateTime.Time, leg.ArrivalDateTime.Time,
-				leg.VesselCarrierCode, leg.VesselName, leg.VesselIMONumber,
-				leg.VesselMMSI, leg.OriginCity, leg.OriginName, leg.OriginCountry,
-				leg.OriginPortUnLoCode, leg.OriginCarrierSiteGeoID,
-				leg.OriginCarrierCityGeoID, leg.DestinationCity, leg.DestinationName,
-				leg.DestinationCountry, leg.DestinationPortUnLoCode,
-				leg.DestinationCarrierSiteGeoID, leg.DestinationCarrierCityGeoID)
-
-			if err != nil {
-				log.Printf("Error inserting transport leg: %v", err)
+		// Without text the filters alone must narrow the list down
+		if text == "" && (filter.CountryCode == "" || filter.Functions == nil && filter.Subdivision == "") {
+			writeJSON(w, http.StatusOK, []db.Location{})
+			return
+		}
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxAutoCompleteLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAutoCompleteLimit), http.StatusBadRequest)
+				return
 			}
+			filter.Limit = limit
+		}
+
+		locations, err := db.AutoComplete(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
 		}
+
+		writeJSON(w, http.StatusOK, locations)
 	}
+}
 
+// laneFetcher returns the carrier fetch behind the lane cache. Locations
+// still missing their Maersk ID or coordinates are queued on the background
+// workers along the way.
+func laneFetcher(enricher *MaerskIDEnricher, geocoder *geocoding.Worker) laneFetchFunc {
+	return func(database *sql.DB, params FetchParams) ([]models.ReducedOceanProduct, []ProviderResult, error) {
+		return fetchLane(database, enricher, geocoder, params)
+	}
 }
 
-func AutoCompleteHandler(database *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// fetchLane asks the enabled schedule providers for a lane and returns the
+// merged result with a per provider report; the lane cache stores it.
+// Missing Maersk IDs and coordinates of the two locations are enriched in
+// the background.
+func fetchLane(database *sql.DB, enricher *MaerskIDEnricher, geocoder *geocoding.Worker, params FetchParams) ([]models.ReducedOceanProduct, []ProviderResult, error) {
+	locations, err := db.GetLocations(database, []string{params.OriginPortUnLoCode, params.DestinationPortUnLoCode})
 
-		text := r.URL.Query().Get("text")
+	if err != nil {
 
-		log.Println("AutoCompleteHandler:", text)
+		log.Println("Error getting locations")
+		log.Println(err)
+		return nil, nil, err
+	}
 
-		locations, err := db.AutoComplete(database, text)
+	var withoutMaerskID []string
+	for _, loc := range locations {
+		if loc.MaerskID == "" {
+			withoutMaerskID = append(withoutMaerskID, loc.Unlocode)
+		}
+	}
+	if len(withoutMaerskID) > 0 {
+		enricher.Enqueue(withoutMaerskID)
+	}
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	var withoutCoordinates []string
+	for _, loc := range locations {
+		if len(loc.Location) == 0 {
+			withoutCoordinates = append(withoutCoordinates, loc.Unlocode)
+		}
+	}
+	if len(withoutCoordinates) > 0 {
+		if _, err := geocoder.Enqueue(withoutCoordinates); err != nil {
+			log.Println(err)
 		}
+	}
 
-		json.NewEncoder(w).Encode(locations)
+	var origin, destination db.Location
+	for _, loc := range locations {
+		switch loc.Unlocode {
+		case params.OriginPortUnLoCode:
+			origin = loc
+		case params.DestinationPortUnLoCode:
+			destination = loc
+		}
+	}
+	if origin.Unlocode == "" || destination.Unlocode == "" {
+		return nil, nil, fmt.Errorf("location %w: %s or %s", db.ErrNotFound, params.OriginPortUnLoCode, params.DestinationPortUnLoCode)
 	}
+
+	// Fan out to the carriers
+	providersStart := time.Now()
+	reducedProducts, results, err := searchProviders(enabledProviders(), params, origin, destination)
+	log.Printf("Schedule providers fetch took: %v", time.Since(providersStart))
+
+	if err != nil {
+		return nil, results, err
+	}
+
+	// Extract and process data
+	processingStart := time.Now()
+	enrichVesselData(database, reducedProducts)
+	log.Printf("Data processing took: %v", time.Since(processingStart))
+
+	recordCarrierLocations(database, reducedProducts)
+
+	return reducedProducts, results, nil
 }
 
-func FetchHandler(database *sql.DB) http.HandlerFunc {
+// FetchHandler serves /search. Fetched schedules are written by writer in
+// the background, so the products of a fetch carry no ID yet.
+func FetchHandler(database *sql.DB, enricher *MaerskIDEnricher, geocoder *geocoding.Worker, writer *services.ScheduleWriter) http.HandlerFunc {
+	cache := newLaneCache(database, laneFetcher(enricher, geocoder), writer)
+	connectionPolicy := services.ConnectionPolicyFromEnv()
+	badges := newReliabilityBadges(database)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		totalStart := time.Now()
 
@@ -170,86 +196,61 @@ func FetchHandler(database *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		locations, err := db.GetLocations(database, []string{params.OriginPortUnLoCode, params.DestinationPortUnLoCode})
-
-		if err != nil {
-
-			log.Println("Error getting locations")
-			log.Println(err)
-		} else if len(locations) != 2 || locations[0].MaerskID == "" || locations[1].MaerskID == "" {
-			log.Println("Invalid number of locations")
-			go func() {
-				locationsWithoutMaerskID := []string{}
-
-				for _, location := range locations {
-					log.Println("location")
-					log.Println(location.MaerskID)
-					if location.MaerskID == "" {
-						locationsWithoutMaerskID = append(locationsWithoutMaerskID, location.Unlocode)
-					}
-				}
-				GetMaerskLocations(database, locationsWithoutMaerskID)
-				if err != nil {
-					log.Println("Error getting Maersk locations")
-					log.Println(err)
-				}
-			}()
-		}
-
-		if len(locations[0].Location) == 0 || len(locations[1].Location) == 0 {
-			log.Println("Missing coordinates in background")
-			go func() {
-				log.Println("Enriching missing coordinates in background")
-				for _, loc := range locations {
-					if len(loc.Location) == 0 {
-						lat, lon, err := GetLocationCoordinates(loc)
-						if err != nil {
-							log.Printf("Error getting coordinates for %s: %v", loc.Unlocode, err)
-							continue
-						}
-
-						if err := db.UpdateLocationCoordinates(database, loc.Unlocode, lat, lon); err != nil {
-							log.Printf("Error updating coordinates for %s: %v", loc.Unlocode, err)
-						}
-					}
-				}
-			}()
+		if err := params.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
+		// Superseded and reference codes search, and cache, as their live code
+		resolved, err := db.ResolveUnLoCodes(database, []string{params.OriginPortUnLoCode, params.DestinationPortUnLoCode})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
+		if code, ok := resolved[params.OriginPortUnLoCode]; ok {
+			params.OriginPortUnLoCode = code
+		}
+		if code, ok := resolved[params.DestinationPortUnLoCode]; ok {
+			params.DestinationPortUnLoCode = code
+		}
 
-		// Fetch data from Maersk API
-		maerskStart := time.Now()
-		data, err := GetMaerskPointToPoint(params, locations)
-		log.Printf("Maersk API fetch took: %v", time.Since(maerskStart))
+		// Cache-Control: no-cache is the HTTP way of asking for a fresh answer
+		force := params.ForceRefresh || strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
 
+		reducedProducts, providers, cacheStatus, err := cache.Search(params, force)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			status := errorStatus(err)
+			if errors.Is(err, errProvidersFailed) {
+				status = http.StatusBadGateway
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
-		if data.OceanProducts == nil {
+		w.Header().Set("X-Cache", cacheStatus.Status)
+
+		reducedProducts = filterAndSortProducts(reducedProducts, params)
+
+		if len(reducedProducts) == 0 {
 			http.Error(w, "No data found", http.StatusNotFound)
 			return
 		}
 
-		// Extract and process data
-		processingStart := time.Now()
-		reducedProducts := extractReducedOceanProducts(database, data)
-		log.Printf("Data processing took: %v", time.Since(processingStart))
-
-		saveScheduleToDB(database, reducedProducts)
+		annotateConnections(database, reducedProducts, connectionPolicy)
+		badges.annotate(reducedProducts)
 
 		// Prepare response
 		response := struct {
 			Schedules        []models.ReducedOceanProduct `json:"schedules"`
 			VesselsMMSI      []string                     `json:"vesselsMMSI"`
 			VesselsIMONumber []string                     `json:"vesselsIMONumber"`
+			Cache            CacheStatus                  `json:"cache"`
+			Providers        []ProviderResult             `json:"providers"`
 		}{
 			Schedules: reducedProducts,
+			Cache:     cacheStatus,
+			Providers: providers,
 			VesselsIMONumber: func() []string {
 				imoSet := make(map[string]struct{})
 				for _, product := range reducedProducts {
@@ -301,87 +302,61 @@ func FetchHandler(database *sql.DB) http.HandlerFunc {
 
 func GetVesselLastKnownPosition(database *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		mmsi := r.URL.Query().Get("mmsi")
-
-		log.Println("Getting last known position for mmsi:", mmsi)
-
-		var vessel db.Vessel
-
-		vessel, err := db.GetVesselByMMSI(database, mmsi)
-
-		log.Println("Vessel found:", vessel)
-		log.Println("vessel last known position:", vessel.LastKnownPosition)
+		vessel, err := requestedVessel(database, r)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
 
-		json.NewEncoder(w).Encode(vessel.LastKnownPosition)
+		writeJSON(w, http.StatusOK, vessel.LastKnownPosition)
 	}
 }
 func updateVesselsInDB(database *sql.DB, vessels map[string]db.Vessel) {
 	for _, vessel := range vessels {
 		if err := db.UpsertVessel(database, vessel); err != nil {
 			log.Printf("Error upserting vessel: %v", err)
+			continue
+		}
+		if err := db.LinkVesselRoutes(database, vessel.IMONumber); err != nil {
+			log.Println(err)
 		}
 	}
 }
 
-type NominatimResponse struct {
-	Lat string `json:"lat"`
-	Lon string `json:"lon"`
-}
-
-func GetLocationCoordinates(location db.Location) (float64, float64, error) {
-	// Build search query using location name and country
-	searchQuery := url.QueryEscape(fmt.Sprintf("%s, %s", location.Name, location.CountryCode))
-	url := fmt.Sprintf("https://nominatim.openstreetmap.org/search?q=%s&format=json&limit=1", searchQuery)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	// Required by Nominatim's terms of use
-	req.Header.Set("User-Agent", "VesselTracker/1.0")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer resp.Body.Close()
-
-	var results []NominatimResponse
-	log.Println("GetLocationCoordinates")
-	log.Println("Response:", resp.Body)
-	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
-		return 0, 0, err
-	}
-
-	if len(results) == 0 {
-		return 0, 0, fmt.Errorf("no coordinates found for location")
-	}
-
-	lat, err := strconv.ParseFloat(results[0].Lat, 64)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	lon, err := strconv.ParseFloat(results[0].Lon, 64)
-	if err != nil {
-		return 0, 0, err
+// recordCarrierLocations keeps the coordinates carriers sent with the legs,
+// which the carrier geocoder falls back on for locations seeded without any.
+func recordCarrierLocations(database *sql.DB, products []models.ReducedOceanProduct) {
+	seen := make(map[string]bool)
+	for _, product := range products {
+		for _, leg := range product.TransportLegs {
+			for _, point := range []struct {
+				unlocode    string
+				coordinates []float64
+			}{
+				{leg.OriginPortUnLoCode, leg.OriginCoordinates},
+				{leg.DestinationPortUnLoCode, leg.DestinationCoordinates},
+			} {
+				key := product.CarrierCode + "|" + point.unlocode
+				if point.unlocode == "" || len(point.coordinates) != 2 || seen[key] {
+					continue
+				}
+				seen[key] = true
+				if err := db.RecordCarrierLocation(database, product.CarrierCode, point.unlocode, point.coordinates[0], point.coordinates[1]); err != nil {
+					log.Println(err)
+				}
+			}
+		}
 	}
-
-	return lat, lon, nil
 }
-func extractReducedOceanProducts(database *sql.DB, data models.MaerskPointToPoint) []models.ReducedOceanProduct {
+
+// enrichVesselData fills the MMSI and last known position of every vessel
+// in the products, from the database first and the web for unknown IMOs.
+func enrichVesselData(database *sql.DB, products []models.ReducedOceanProduct) {
 	collectionStart := time.Now()
 
 	// Collect unique IMO numbers
-	imoSet := utils.CollectUniqueVessels(data)
+	imoSet := utils.CollectUniqueVessels(products)
 
 	log.Printf("IMO collection took: %v, Found %d unique IMOs", time.Since(collectionStart), len(imoSet))
 	mmsiStart := time.Now()
@@ -394,27 +369,41 @@ func extractReducedOceanProducts(database *sql.DB, data models.MaerskPointToPoin
 
 	log.Printf("Vessel data fetching took: %v", time.Since(mmsiStart))
 
-	go updateVesselsInDB(database, mmsiCache)
-
-	// Build and return products
-	buildStart := time.Now()
-
-	products := buildReducedProducts(data, mmsiCache)
-
-	log.Printf("Product building took: %v", time.Since(buildStart))
-
-	return products
+	// what the carriers reported, with the MMSI we know or looked up
+	observed := make(map[string]db.Vessel, len(imoSet))
+	for imo, vessel := range imoSet {
+		vessel.MMSI = mmsiCache[imo].MMSI
+		observed[imo] = vessel
+	}
+	go updateVesselsInDB(database, observed)
 
+	for i := range products {
+		if vessel, exists := mmsiCache[products[i].DepartureVesselIMONumber]; exists {
+			products[i].DepartureVesselMMSI = vessel.MMSI
+			products[i].LastKnownPosition = vessel.LastKnownPosition
+		}
+		for j := range products[i].TransportLegs {
+			if vessel, exists := mmsiCache[products[i].TransportLegs[j].VesselIMONumber]; exists {
+				products[i].TransportLegs[j].VesselMMSI = vessel.MMSI
+				products[i].TransportLegs[j].LastKnownPosition = vessel.LastKnownPosition
+			}
+		}
+	}
 }
 
 func GetVesselRoute(database *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		mmsi := r.URL.Query().Get("mmsi")
+		vessel, err := requestedVessel(database, r)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
 
-		log.Println("Getting route for mmsi:", mmsi)
+		log.Println("Getting route for mmsi:", vessel.MMSI)
 
-		route, err := db.GetVesselRoute(database, mmsi)
+		route, err := db.GetVesselRoute(database, vessel.MMSI)
 
 		if err != nil {
 			log.Println(err)
@@ -430,9 +419,13 @@ func GetVesselRoute(database *sql.DB) http.HandlerFunc {
 
 func GetVesselRouteGeoJSON(database *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		mmsi := r.URL.Query().Get("mmsi")
+		vessel, err := requestedVessel(database, r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
 
-		positions, err := db.GetVesselRoute(database, mmsi)
+		positions, err := db.GetVesselRoute(database, vessel.MMSI)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -470,109 +463,6 @@ func GetVesselRouteGeoJSON(database *sql.DB) http.HandlerFunc {
 	}
 }
 
-func buildReducedProducts(data models.MaerskPointToPoint, mmsiCache map[string]db.Vessel) []models.ReducedOceanProduct {
-	var reducedProducts []models.ReducedOceanProduct
-
-	getVesselInfo := func(imo string) struct {
-		MMSI     string
-		Position []float64
-	} {
-		if vessel, exists := mmsiCache[imo]; exists {
-			return struct {
-				MMSI     string
-				Position []float64
-			}{
-				MMSI:     vessel.MMSI,
-				Position: vessel.LastKnownPosition,
-			}
-		}
-		return struct {
-			MMSI     string
-			Position []float64
-		}{
-			MMSI:     "",
-			Position: nil,
-		}
-	}
-
-	for _, product := range data.OceanProducts {
-		for _, schedule := range product.TransportSchedules {
-			reduced := models.ReducedOceanProduct{
-
-				// valid to date
-				ProductValidToDate: models.CustomTime{Time: product.ProductValidToDate.Time},
-				// valid from date
-				ProductValidFromDate: models.CustomTime{Time: product.ProductValidFromDate.Time},
-
-				CarrierProductID:  product.CarrierProductID,
-				DepartureDateTime: models.CustomTime{Time: schedule.DepartureDateTime.Time},
-				ArrivalDateTime:   models.CustomTime{Time: schedule.ArrivalDateTime.Time},
-				// Origin
-				OriginName:             (schedule.Facilities.CollectionOrigin.LocationName),
-				OriginCity:             (schedule.Facilities.CollectionOrigin.CityName),
-				OriginCountry:          (schedule.Facilities.CollectionOrigin.CountryCode),
-				OriginPortUnLoCode:     schedule.Facilities.CollectionOrigin.UNLocationCode,
-				OriginCarrierSiteGeoID: schedule.Facilities.CollectionOrigin.CarrierSiteGeoID,
-				OriginCarrierCityGeoID: schedule.Facilities.CollectionOrigin.CarrierCityGeoID,
-				// Destination
-				DestinationCity:             schedule.Facilities.DeliveryDestination.CityName,
-				DestinationName:             schedule.Facilities.DeliveryDestination.LocationName,
-				DestinationCountry:          schedule.Facilities.DeliveryDestination.CountryCode,
-				DestinationPortUnLoCode:     schedule.Facilities.DeliveryDestination.UNLocationCode,
-				DestinationCarrierSiteGeoID: schedule.Facilities.DeliveryDestination.CarrierSiteGeoID,
-				DestinationCarrierCityGeoID: schedule.Facilities.DeliveryDestination.CarrierCityGeoID,
-				//Vessel
-				DepartureVesselName:        schedule.FirstDepartureVessel.VesselName,
-				DepartureVesselIMONumber:   schedule.FirstDepartureVessel.VesselIMONumber,
-				DepartureVesselCarrierCode: schedule.FirstDepartureVessel.CarrierVesselCode,
-				DepartureVesselMMSI:        getVesselInfo(schedule.FirstDepartureVessel.VesselIMONumber).MMSI,
-				LastKnownPosition:          getVesselInfo(schedule.FirstDepartureVessel.VesselIMONumber).Position,
-				//Transit time
-				TransitTime: func() int32 {
-					if t, err := strconv.Atoi(schedule.TransitTime); err == nil {
-						return int32(t)
-					}
-					return 0
-				}(),
-				TransportLegs: func() []models.ReducedTransportLeg {
-					legs := []models.ReducedTransportLeg{}
-					for _, leg := range schedule.TransportLegs {
-						legs = append(legs, models.ReducedTransportLeg{
-							//time
-							DepartureDateTime: models.CustomTime{Time: leg.DepartureDateTime.Time},
-							ArrivalDateTime:   models.CustomTime{Time: leg.ArrivalDateTime.Time},
-							//vessel
-							VesselCarrierCode: leg.Transport.Vessel.CarrierVesselCode,
-							VesselName:        leg.Transport.Vessel.VesselName,
-							VesselIMONumber:   leg.Transport.Vessel.VesselIMONumber,
-							VesselMMSI:        getVesselInfo(leg.Transport.Vessel.VesselIMONumber).MMSI,
-							LastKnownPosition: getVesselInfo(leg.Transport.Vessel.VesselIMONumber).Position,
-							//origin
-							OriginCity:             leg.Facilities.StartLocation.CityName,
-							OriginName:             leg.Facilities.StartLocation.LocationName,
-							OriginCountry:          leg.Facilities.StartLocation.CountryCode,
-							OriginPortUnLoCode:     leg.Facilities.StartLocation.UNLocationCode,
-							OriginCarrierCityGeoID: leg.Facilities.StartLocation.CarrierCityGeoID,
-							OriginCarrierSiteGeoID: leg.Facilities.StartLocation.CarrierSiteGeoID,
-							//destination
-							DestinationCity:             leg.Facilities.EndLocation.CityName,
-							DestinationName:             leg.Facilities.EndLocation.LocationName,
-							DestinationCountry:          leg.Facilities.EndLocation.CountryCode,
-							DestinationPortUnLoCode:     leg.Facilities.EndLocation.UNLocationCode,
-							DestinationCarrierCityGeoID: leg.Facilities.EndLocation.CarrierCityGeoID,
-							DestinationCarrierSiteGeoID: leg.Facilities.EndLocation.CarrierSiteGeoID,
-						})
-					}
-					return legs
-				}(),
-			}
-			reducedProducts = append(reducedProducts, reduced)
-		}
-	}
-
-	return reducedProducts
-}
-
 func GetTrackedVesselsHandler(database *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vessels, err := db.GetTopVessels(database, 40)
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+func GetLocationHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unlocode := strings.ToUpper(r.PathValue("unlocode"))
+
+		location, err := db.GetLocation(database, unlocode)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		location.Port, err = db.GetPortDetails(database, location.Unlocode)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Println(err)
+		}
+
+		writeJSON(w, http.StatusOK, location)
+	}
+}
+
+// GetLocationAreasHandler serves the polygons of a location as a GeoJSON
+// FeatureCollection.
+func GetLocationAreasHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		location, err := db.GetLocation(database, strings.ToUpper(r.PathValue("unlocode")))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		areas, err := db.GetLocationAreas(database, location.Unlocode)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		features := make([]map[string]interface{}, 0, len(areas))
+		for _, a := range areas {
+			features = append(features, map[string]interface{}{
+				"type":     "Feature",
+				"id":       a.ID,
+				"geometry": a.Geometry,
+				"properties": map[string]interface{}{
+					"unlocode":   a.Unlocode,
+					"kind":       a.Kind,
+					"name":       a.Name,
+					"source":     a.Source,
+					"attributes": a.Properties,
+				},
+			})
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"type":     "FeatureCollection",
+			"features": features,
+		})
+	}
+}
+
+// GetPortCongestionHandler reports the vessels waiting at anchor off a port
+// and the average wait and berth dwell of its arrivals between from and to,
+// by default the last 30 days.
+func GetPortCongestionHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, err := parseTimeParam(r, "from")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeParam(r, "to")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to.IsZero() {
+			to = time.Now().UTC()
+		}
+		if from.IsZero() {
+			from = to.AddDate(0, 0, -30)
+		}
+		if !from.Before(to) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		location, err := db.GetLocation(database, strings.ToUpper(r.PathValue("unlocode")))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		// A vessel silent for longer is no longer counted as waiting
+		activeSince := time.Now().UTC().Add(-6 * time.Hour)
+		congestion, err := db.GetPortCongestion(database, location.Unlocode, from, to, activeSince)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, congestion)
+	}
+}
@@ -1,142 +1,235 @@
 package api
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/maersk"
 	"github.com/Sraiti/vesselTracker/models"
 )
 
-func GetMaerskPointToPoint(params FetchParams, locations []db.Location) (models.MaerskPointToPoint, error) {
+// MaerskProvider serves schedules from the Maersk ocean-products API.
+type MaerskProvider struct{}
 
-	log.Println("Getting Maersk point to point")
+func (MaerskProvider) Name() string { return "maersk" }
 
-	if len(locations) != 2 {
-		return models.MaerskPointToPoint{}, fmt.Errorf("invalid number of locations: expected 2, got %d", len(locations))
+func (MaerskProvider) Search(ctx context.Context, params FetchParams, origin, destination db.Location) ([]models.ReducedOceanProduct, error) {
+	data, err := GetMaerskPointToPoint(ctx, params, origin, destination)
+	if err != nil {
+		return nil, err
 	}
+	return buildReducedProducts(data), nil
+}
 
-	baseUrl := "https://api.maersk.com/products/ocean-products?vesselOperatorCarrierCode=MAEU"
+func GetMaerskPointToPoint(ctx context.Context, params FetchParams, origin, destination db.Location) (models.MaerskPointToPoint, error) {
 
-	var url string
+	log.Println("Getting Maersk point to point")
+
+	query := url.Values{}
+	query.Set("vesselOperatorCarrierCode", "MAEU")
 
-	if locations[0].MaerskID != "" && locations[1].MaerskID != "" {
+	if origin.MaerskID != "" && destination.MaerskID != "" {
 		log.Println("Fetching using Maersk IDs")
-		url = fmt.Sprintf("%s&carrierDeliveryDestinationGeoID=%s&carrierCollectionOriginGeoID=%s",
-			baseUrl,
-			locations[1].MaerskID,
-			locations[0].MaerskID,
-		)
+		query.Set("carrierCollectionOriginGeoID", origin.MaerskID)
+		query.Set("carrierDeliveryDestinationGeoID", destination.MaerskID)
 	} else {
 		log.Println("Fetching using unlocodes")
-		url = fmt.Sprintf("%s&collectionOriginCountryCode=%s&collectionOriginCityName=%s&deliveryDestinationCountryCode=%s&deliveryDestinationCityName=%s",
-			baseUrl,
-			params.OriginPortUnLoCode[:2],
-			(params.Origin),
-			params.DestinationPortUnLoCode[:2],
-			(params.Destination),
-		)
+		query.Set("collectionOriginCountryCode", params.OriginPortUnLoCode[:2])
+		query.Set("collectionOriginCityName", params.Origin)
+		query.Set("deliveryDestinationCountryCode", params.DestinationPortUnLoCode[:2])
+		query.Set("deliveryDestinationCityName", params.Destination)
 	}
 
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Consumer-Key", os.Getenv("CONSUMER_KEY"))
-
-	res, err := http.DefaultClient.Do(req)
-
-	if err != nil {
-		log.Println(err)
-		return models.MaerskPointToPoint{}, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		if res.StatusCode == http.StatusNotFound {
-			return models.MaerskPointToPoint{}, nil
+	// Search window: startDateType D searches on departure, A on arrival
+	if start, _, onArrival := params.window(); !start.IsZero() {
+		query.Set("startDate", start.Format("2006-01-02"))
+		query.Set("startDateType", "D")
+		if onArrival {
+			query.Set("startDateType", "A")
 		}
-
-		body, _ := io.ReadAll(res.Body)
-		return models.MaerskPointToPoint{}, fmt.Errorf("maersk API error: status %d, body: %s", res.StatusCode, string(body))
 	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return models.MaerskPointToPoint{}, err
+	if params.SearchRangeWeeks > 0 {
+		query.Set("dateRange", fmt.Sprintf("P%dW", params.SearchRangeWeeks))
+	}
+	if params.CargoType != "" {
+		query.Set("cargoType", params.CargoType)
+	}
+	if params.ISOEquipmentCode != "" {
+		query.Set("ISOEquipmentCode", params.ISOEquipmentCode)
 	}
 
-	var data models.MaerskPointToPoint
+	return maersk.Default().OceanProducts(ctx, query)
+}
 
-	data, err = models.UnmarshalMaerskPointToPoint(body)
-	if err != nil {
-		return models.MaerskPointToPoint{}, err
+// MaerskMetricsHandler reports the state of the Maersk client: circuit
+// breaker and per-endpoint call counters.
+func MaerskMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := maersk.Default()
+		writeJSON(w, http.StatusOK, struct {
+			Breaker   string                            `json:"breaker"`
+			Endpoints map[string]maersk.EndpointMetrics `json:"endpoints"`
+		}{
+			Breaker:   client.BreakerState(),
+			Endpoints: client.Metrics(),
+		})
 	}
-
-	return data, nil
 }
 
+// GetMaerskLocations looks up the Maersk city IDs of the given UN/LOCODEs
+// and stores them. Codes Maersk does not know are recorded as misses; codes
+// whose lookup failed are left untouched so they are tried again.
 func GetMaerskLocations(database *sql.DB, unLoCodes []string) ([]models.MaerskLocation, error) {
+	locations := make([]models.MaerskLocation, 0, len(unLoCodes))
+	var misses []string
+	var lastErr error
 
-	var locations = make([]models.MaerskLocation, len(unLoCodes))
-
-	log.Println("Getting Maersk locations")
-	log.Println(unLoCodes)
+	log.Printf("Getting Maersk locations for %v", unLoCodes)
 	for _, unLoCode := range unLoCodes {
+		query := url.Values{}
+		query.Set("vesselOperatorCarrierCode", "MAEU")
+		query.Set("locationType", "CITY")
+		query.Set("UNLocationCode", unLoCode)
+
+		found, err := maersk.Default().Locations(context.Background(), query)
+		if err != nil && !maersk.IsNotFound(err) {
+			log.Printf("Error getting Maersk location %s: %v", unLoCode, err)
+			lastErr = err
+			continue
+		}
 
-		r, err := func() ([]models.MaerskLocation, error) {
-
-			url := fmt.Sprintf("https://api.maersk.com/reference-data/locations?vesselOperatorCarrierCode=MAEU&locationType=CITY&UNLocationCode=%s", unLoCode)
-
-			log.Println(url)
-
-			req, _ := http.NewRequest("GET", url, nil)
-			req.Header.Add("Consumer-Key", os.Getenv("CONSUMER_KEY"))
-
-			res, err := http.DefaultClient.Do(req)
-
-			if err != nil {
-				log.Println(err)
-				return []models.MaerskLocation{}, err
-			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusOK {
-				body, _ := io.ReadAll(res.Body)
-				log.Printf("Maersk API error for unLoCode %s: status %d, body: %s", unLoCode, res.StatusCode, string(body))
-				return []models.MaerskLocation{}, fmt.Errorf("maersk API error: status %d, body: %s", res.StatusCode, string(body))
+		matched := false
+		for _, loc := range found {
+			if loc.UNLocationCode == unLoCode && loc.CarrierGeoID != "" {
+				locations = append(locations, loc)
+				matched = true
+				break
 			}
+		}
+		if !matched {
+			misses = append(misses, unLoCode)
+		}
+	}
 
-			body, err := io.ReadAll(res.Body)
+	if err := db.UpsertLocations(database, locations); err != nil {
+		return locations, err
+	}
+	if err := db.RecordMaerskIDMisses(database, misses); err != nil {
+		return locations, err
+	}
 
-			if err != nil {
-				log.Println("Error reading body")
-				log.Println(err)
-				return []models.MaerskLocation{}, err
-			}
+	if len(locations) == 0 && len(misses) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return locations, nil
+}
 
-			var r []models.MaerskLocation
-			err = json.Unmarshal(body, &r)
-			if err != nil {
-				log.Println("Error unmarshalling body")
-				log.Println(err)
-				return []models.MaerskLocation{}, err
+// buildReducedProducts normalizes a Maersk response. Vessel MMSIs and
+// positions are filled afterwards by enrichVesselData.
+func buildReducedProducts(data models.MaerskPointToPoint) []models.ReducedOceanProduct {
+	var reducedProducts []models.ReducedOceanProduct
+
+	for _, product := range data.OceanProducts {
+		for _, schedule := range product.TransportSchedules {
+			reduced := models.ReducedOceanProduct{
+
+				// valid to date
+				ProductValidToDate: models.CustomTime{Time: product.ProductValidToDate.Time},
+				// valid from date
+				ProductValidFromDate: models.CustomTime{Time: product.ProductValidFromDate.Time},
+
+				CarrierProductID:  product.CarrierProductID,
+				CarrierCode:       product.VesselOperatorCarrierCode,
+				DepartureDateTime: models.CustomTime{Time: schedule.DepartureDateTime.Time},
+				ArrivalDateTime:   models.CustomTime{Time: schedule.ArrivalDateTime.Time},
+				// Origin
+				OriginName:             (schedule.Facilities.CollectionOrigin.LocationName),
+				OriginCity:             (schedule.Facilities.CollectionOrigin.CityName),
+				OriginCountry:          (schedule.Facilities.CollectionOrigin.CountryCode),
+				OriginPortUnLoCode:     schedule.Facilities.CollectionOrigin.UNLocationCode,
+				OriginCarrierSiteGeoID: schedule.Facilities.CollectionOrigin.CarrierSiteGeoID,
+				OriginCarrierCityGeoID: schedule.Facilities.CollectionOrigin.CarrierCityGeoID,
+				// Destination
+				DestinationCity:             schedule.Facilities.DeliveryDestination.CityName,
+				DestinationName:             schedule.Facilities.DeliveryDestination.LocationName,
+				DestinationCountry:          schedule.Facilities.DeliveryDestination.CountryCode,
+				DestinationPortUnLoCode:     schedule.Facilities.DeliveryDestination.UNLocationCode,
+				DestinationCarrierSiteGeoID: schedule.Facilities.DeliveryDestination.CarrierSiteGeoID,
+				DestinationCarrierCityGeoID: schedule.Facilities.DeliveryDestination.CarrierCityGeoID,
+				//Vessel
+				DepartureVesselName:        schedule.FirstDepartureVessel.VesselName,
+				DepartureVesselIMONumber:   schedule.FirstDepartureVessel.VesselIMONumber,
+				DepartureVesselCarrierCode: schedule.FirstDepartureVessel.CarrierVesselCode,
+				//Transit time
+				TransitTime: func() int32 {
+					if t, err := strconv.Atoi(schedule.TransitTime); err == nil {
+						return int32(t)
+					}
+					return 0
+				}(),
+				TransportLegs: func() []models.ReducedTransportLeg {
+					legs := []models.ReducedTransportLeg{}
+					for _, leg := range schedule.TransportLegs {
+						legs = append(legs, models.ReducedTransportLeg{
+							//time
+							DepartureDateTime: models.CustomTime{Time: leg.DepartureDateTime.Time},
+							ArrivalDateTime:   models.CustomTime{Time: leg.ArrivalDateTime.Time},
+							//vessel
+							VesselCarrierCode: leg.Transport.Vessel.CarrierVesselCode,
+							VesselName:        leg.Transport.Vessel.VesselName,
+							VesselIMONumber:   leg.Transport.Vessel.VesselIMONumber,
+							//service
+							TransportMode:                normalizeMaerskTransportMode(leg.Transport.TransportMode),
+							CarrierServiceCode:           leg.Transport.CarrierServiceCode,
+							CarrierServiceName:           leg.Transport.CarrierServiceName,
+							CarrierDepartureVoyageNumber: leg.Transport.CarrierDepartureVoyageNumber,
+							CarrierTradeLaneName:         leg.Transport.CarrierTradeLaneName,
+							LinkDirection:                leg.Transport.LinkDirection,
+							//origin
+							OriginCity:             leg.Facilities.StartLocation.CityName,
+							OriginName:             leg.Facilities.StartLocation.LocationName,
+							OriginCountry:          leg.Facilities.StartLocation.CountryCode,
+							OriginPortUnLoCode:     leg.Facilities.StartLocation.UNLocationCode,
+							OriginCarrierCityGeoID: leg.Facilities.StartLocation.CarrierCityGeoID,
+							OriginCarrierSiteGeoID: leg.Facilities.StartLocation.CarrierSiteGeoID,
+							//destination
+							DestinationCity:             leg.Facilities.EndLocation.CityName,
+							DestinationName:             leg.Facilities.EndLocation.LocationName,
+							DestinationCountry:          leg.Facilities.EndLocation.CountryCode,
+							DestinationPortUnLoCode:     leg.Facilities.EndLocation.UNLocationCode,
+							DestinationCarrierCityGeoID: leg.Facilities.EndLocation.CarrierCityGeoID,
+							DestinationCarrierSiteGeoID: leg.Facilities.EndLocation.CarrierSiteGeoID,
+						})
+					}
+					return legs
+				}(),
 			}
-
-			return r, nil
-		}()
-
-		if err != nil {
-			log.Println(err)
-			continue
+			reducedProducts = append(reducedProducts, reduced)
 		}
-
-		locations = append(locations, r...)
 	}
 
-	db.UpsertLocations(database, locations)
+	return reducedProducts
+}
 
-	return locations, nil
+// normalizeMaerskTransportMode maps Maersk transport modes onto the DCSA
+// vocabulary shared by all providers. Unknown modes are kept as sent.
+func normalizeMaerskTransportMode(mode string) string {
+	switch strings.ToUpper(mode) {
+	case "MVS", "FEF", "FEO", "VSF", "VSL", "VSM":
+		return "VESSEL"
+	case "BAR", "BCO":
+		return "BARGE"
+	case "RR", "RCO", "RAIL":
+		return "RAIL"
+	case "TRK", "TRUCK":
+		return "TRUCK"
+	}
+	return mode
 }
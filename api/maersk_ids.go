@@ -0,0 +1,98 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+const (
+	maerskIDWorkers   = 3
+	maerskIDQueueSize = 1000
+	// Maersk adds cities rarely, a miss is worth retrying after a week
+	defaultMaerskIDMissTTL = 7 * 24 * time.Hour
+)
+
+// MaerskIDEnricher looks up Maersk location IDs in the background. A code
+// is queued at most once at a time, and codes with a recent miss are skipped
+// unless the refresh is forced.
+type MaerskIDEnricher struct {
+	database *sql.DB
+	missTTL  time.Duration
+	queue    chan string
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func NewMaerskIDEnricher(database *sql.DB) *MaerskIDEnricher {
+	return &MaerskIDEnricher{
+		database: database,
+		missTTL:  services.EnvDuration("MAERSK_ID_MISS_TTL", defaultMaerskIDMissTTL),
+		queue:    make(chan string, maerskIDQueueSize),
+		pending:  make(map[string]bool),
+	}
+}
+
+func (e *MaerskIDEnricher) Start() {
+	for i := 0; i < maerskIDWorkers; i++ {
+		go e.work()
+	}
+}
+
+// Enqueue queues the codes that have no Maersk ID and no recent miss.
+func (e *MaerskIDEnricher) Enqueue(unLoCodes []string) {
+	codes, err := db.LocationsNeedingMaerskID(e.database, unLoCodes, e.missTTL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	e.push(codes)
+}
+
+// Refresh queues the codes regardless of what is stored. It returns the
+// codes queued and the ones already waiting.
+func (e *MaerskIDEnricher) Refresh(unLoCodes []string) (queued, pending []string) {
+	return e.push(unLoCodes)
+}
+
+func (e *MaerskIDEnricher) push(unLoCodes []string) (queued, pending []string) {
+	queued, pending = []string{}, []string{}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, code := range unLoCodes {
+		if e.pending[code] {
+			pending = append(pending, code)
+			continue
+		}
+		select {
+		case e.queue <- code:
+			e.pending[code] = true
+			queued = append(queued, code)
+		default:
+			log.Printf("Maersk ID queue full, dropping %s", code)
+		}
+	}
+	if len(queued) > 0 {
+		log.Printf("Queued Maersk ID lookups: %v", queued)
+	}
+	return queued, pending
+}
+
+func (e *MaerskIDEnricher) work() {
+	for code := range e.queue {
+		if _, err := GetMaerskLocations(e.database, []string{code}); err != nil {
+			log.Printf("Error enriching Maersk ID for %s: %v", code, err)
+		}
+
+		e.mu.Lock()
+		delete(e.pending, code)
+		e.mu.Unlock()
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"strings"
+)
+
+// buildOpenAPI generates an OpenAPI 3.0 document from the v1 route table.
+// Path parameters are read from the pattern wildcards, so a new route only
+// has to be added to v1Routes to be documented.
+func buildOpenAPI(routes []route) map[string]interface{} {
+	paths := map[string]interface{}{}
+
+	for _, rt := range routes {
+		item, ok := paths[rt.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[rt.Path] = item
+		}
+
+		parameters := []interface{}{}
+		for _, name := range pathParams(rt.Path) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range rt.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        q.Name,
+				"in":          "query",
+				"required":    q.Required,
+				"description": q.Description,
+				"schema":      map[string]interface{}{"type": q.Type},
+			})
+		}
+
+		responses := map[string]interface{}{
+			"200": map[string]interface{}{"description": "OK"},
+			"405": map[string]interface{}{"description": "Method not allowed"},
+			"500": map[string]interface{}{"description": "Internal error"},
+		}
+		if len(pathParams(rt.Path)) > 0 {
+			responses["404"] = map[string]interface{}{"description": "Not found"}
+		}
+
+		operation := map[string]interface{}{
+			"summary":     rt.Summary,
+			"operationId": operationID(rt),
+			"parameters":  parameters,
+			"responses":   responses,
+		}
+		if rt.Description != "" {
+			operation["description"] = rt.Description
+		}
+		if rt.Admin {
+			operation["security"] = []interface{}{
+				map[string]interface{}{"adminToken": []interface{}{}},
+			}
+			responses["401"] = map[string]interface{}{"description": "Missing or wrong admin token"}
+			responses["403"] = map[string]interface{}{"description": "Admin endpoints are disabled"}
+		}
+		if rt.Body != "" {
+			operation["requestBody"] = map[string]interface{}{
+				"required":    true,
+				"description": rt.Body,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"type": "object"},
+					},
+				},
+			}
+			responses["400"] = map[string]interface{}{"description": "Invalid request body"}
+		}
+
+		item[strings.ToLower(rt.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Vessel Tracker API",
+			"version": "1.0.0",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": apiPrefix},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The ADMIN_TOKEN of the server",
+				},
+			},
+		},
+	}
+}
+
+// pathParams returns the wildcard names of a pattern such as /vessels/{id}/track.
+func pathParams(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, strings.TrimSuffix(strings.Trim(segment, "{}"), "..."))
+		}
+	}
+	return names
+}
+
+// operationID turns GET /vessels/{id}/track into getVesselsByIdTrack.
+func operationID(rt route) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.Method))
+	for _, segment := range strings.Split(rt.Path, "/") {
+		if segment == "" {
+			continue
+		}
+		if strings.HasPrefix(segment, "{") {
+			b.WriteString("By")
+			segment = strings.Trim(segment, "{}.")
+		}
+		segment = strings.NewReplacer(".", "", "-", "").Replace(segment)
+		b.WriteString(strings.ToUpper(segment[:1]) + segment[1:])
+	}
+	return b.String()
+}
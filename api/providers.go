@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+// Time budget of one provider call during a search
+const providerTimeout = 30 * time.Second
+
+var errProvidersFailed = errors.New("no schedule provider succeeded")
+
+// ScheduleProvider is a carrier schedule source. Implementations normalize
+// their responses into ReducedOceanProduct; vessel MMSIs and positions are
+// filled later for all providers at once.
+type ScheduleProvider interface {
+	Name() string
+	Search(ctx context.Context, params FetchParams, origin, destination db.Location) ([]models.ReducedOceanProduct, error)
+}
+
+// ProviderResult reports how one provider did during a search.
+type ProviderResult struct {
+	Provider   string `json:"provider"`
+	Count      int    `json:"count"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// enabledProviders reads the comma separated SCHEDULE_PROVIDERS list,
+// Maersk only when unset. "dcsa" enables every carrier of DCSA_CARRIERS,
+// "dcsa:CODE" a single one.
+func enabledProviders() []ScheduleProvider {
+	names := os.Getenv("SCHEDULE_PROVIDERS")
+	if names == "" {
+		names = "maersk"
+	}
+
+	dcsa := dcsaProvidersFromEnv()
+
+	var providers []ScheduleProvider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "maersk":
+			providers = append(providers, MaerskProvider{})
+		case name == "dcsa":
+			for _, p := range dcsa {
+				providers = append(providers, p)
+			}
+		case strings.HasPrefix(name, "dcsa:"):
+			found := false
+			for _, p := range dcsa {
+				if strings.EqualFold(p.Name(), name) {
+					providers = append(providers, p)
+					found = true
+				}
+			}
+			if !found {
+				log.Printf("Schedule provider %q is not configured in DCSA_CARRIERS, skipping", name)
+			}
+		default:
+			log.Printf("Unknown schedule provider %q, skipping", name)
+		}
+	}
+	return providers
+}
+
+// searchProviders queries every provider concurrently and merges their
+// products. It only fails when every provider failed; partial failures are
+// reported in the results.
+func searchProviders(providers []ScheduleProvider, params FetchParams, origin, destination db.Location) ([]models.ReducedOceanProduct, []ProviderResult, error) {
+	results := make([]ProviderResult, len(providers))
+	found := make([][]models.ReducedOceanProduct, len(providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider ScheduleProvider) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+			defer cancel()
+
+			start := time.Now()
+			products, err := provider.Search(ctx, params, origin, destination)
+
+			results[i] = ProviderResult{
+				Provider:   provider.Name(),
+				Count:      len(products),
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				log.Printf("Schedule provider %s failed: %v", provider.Name(), err)
+				results[i].Error = err.Error()
+				return
+			}
+			log.Printf("Schedule provider %s returned %d products in %v", provider.Name(), len(products), time.Since(start))
+			found[i] = products
+		}(i, provider)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if len(providers) == 0 || failed == len(providers) {
+		return nil, results, fmt.Errorf("%w (%d configured)", errProvidersFailed, len(providers))
+	}
+
+	return mergeProducts(found...), results, nil
+}
+
+// mergeProducts concatenates provider results, dropping a sailing a carrier
+// reported twice, e.g. across pages or through two providers; the first
+// provider in SCHEDULE_PROVIDERS wins. Partners of a vessel sharing
+// agreement selling the same sailing are kept apart, as are products
+// stored under ocean_products_identity_key.
+func mergeProducts(lists ...[]models.ReducedOceanProduct) []models.ReducedOceanProduct {
+	seen := make(map[string]bool)
+	merged := []models.ReducedOceanProduct{}
+
+	for _, products := range lists {
+		for _, p := range products {
+			key := strings.Join([]string{
+				p.CarrierCode,
+				p.OriginPortUnLoCode,
+				p.DestinationPortUnLoCode,
+				p.DepartureVesselIMONumber,
+				p.DepartureDateTime.UTC().Format(time.RFC3339),
+				p.ArrivalDateTime.UTC().Format(time.RFC3339),
+			}, "|")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+const (
+	defaultOnTimeTolerance = 24 * time.Hour
+	// History the search badges are computed on
+	badgeHistory = 365 * 24 * time.Hour
+	// Fewer observed arrivals than this say nothing about a service
+	minBadgeSamples = 5
+	defaultBadgeTTL = time.Hour
+)
+
+// ReliabilityHandler serves on-time statistics of carrier schedules, from
+// the voyages linked to the transport legs they fulfilled. groupBy takes a
+// comma-separated list of carrier, service, lane, vessel and month.
+func ReliabilityHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		filter := db.ReliabilityFilter{
+			GroupBy:     splitList(query.Get("groupBy"), false),
+			Carriers:    splitList(query.Get("carrier"), true),
+			Services:    splitList(query.Get("service"), true),
+			Origin:      strings.ToUpper(query.Get("origin")),
+			Destination: strings.ToUpper(query.Get("destination")),
+			IMONumber:   strings.TrimPrefix(strings.ToUpper(query.Get("vessel")), "IMO"),
+			Tolerance:   defaultOnTimeTolerance,
+		}
+
+		var err error
+		for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+			if *target, err = parseTimeParam(r, name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("toleranceHours"); v != "" {
+			hours, err := strconv.ParseFloat(v, 64)
+			if err != nil || hours < 0 {
+				http.Error(w, "invalid toleranceHours: "+v, http.StatusBadRequest)
+				return
+			}
+			filter.Tolerance = time.Duration(hours * float64(time.Hour))
+		}
+		if v := query.Get("minSamples"); v != "" {
+			if filter.MinSamples, err = strconv.Atoi(v); err != nil || filter.MinSamples < 1 {
+				http.Error(w, "invalid minSamples: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+
+		stats, err := db.GetReliability(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"toleranceHours": filter.Tolerance.Hours(),
+			"stats":          stats,
+		})
+	}
+}
+
+func splitList(v string, upper bool) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if upper {
+			item = strings.ToUpper(item)
+		}
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// reliabilityBadges caches the search badges of each carrier: they sum a
+// year of history, which moves little within badgeTTL, and a search
+// would otherwise aggregate it on every request, cache hits included.
+type reliabilityBadges struct {
+	database *sql.DB
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	carriers map[string]carrierBadges
+}
+
+// carrierBadges holds the badges of one carrier, by service code, and the
+// badge of the carrier itself when it has enough history.
+type carrierBadges struct {
+	computedAt time.Time
+	services   map[string]*models.ReliabilityBadge
+	carrier    *models.ReliabilityBadge
+}
+
+func newReliabilityBadges(database *sql.DB) *reliabilityBadges {
+	return &reliabilityBadges{
+		database: database,
+		ttl:      services.EnvDuration("RELIABILITY_BADGE_TTL", defaultBadgeTTL),
+		carriers: make(map[string]carrierBadges),
+	}
+}
+
+// annotate sets the reliability badge of each product from the history of
+// the service of its first vessel leg, or of its carrier when the service
+// has too little. Only carriers without fresh badges are aggregated.
+func (b *reliabilityBadges) annotate(products []models.ReducedOceanProduct) {
+	now := time.Now()
+
+	b.mu.Lock()
+	var stale []string
+	seen := make(map[string]bool)
+	for _, p := range products {
+		if p.CarrierCode == "" || seen[p.CarrierCode] {
+			continue
+		}
+		seen[p.CarrierCode] = true
+		if cached, ok := b.carriers[p.CarrierCode]; !ok || now.Sub(cached.computedAt) >= b.ttl {
+			stale = append(stale, p.CarrierCode)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(stale) > 0 {
+		computed, err := computeBadges(b.database, stale, now)
+		if err != nil {
+			log.Println(err)
+		} else {
+			b.mu.Lock()
+			for carrier, badges := range computed {
+				b.carriers[carrier] = badges
+			}
+			b.mu.Unlock()
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range products {
+		p := &products[i]
+		cached, ok := b.carriers[p.CarrierCode]
+		if !ok {
+			continue
+		}
+		if badge, ok := cached.services[mainServiceCode(*p)]; ok {
+			p.Reliability = badge
+		} else if cached.carrier != nil {
+			p.Reliability = cached.carrier
+		}
+	}
+}
+
+// computeBadges aggregates the badge history of the carriers. Every carrier
+// asked for gets an entry, so one without history is not queried again
+// before the TTL runs out.
+func computeBadges(database *sql.DB, carriers []string, now time.Time) (map[string]carrierBadges, error) {
+	filter := db.ReliabilityFilter{
+		Carriers:   carriers,
+		From:       now.Add(-badgeHistory),
+		Tolerance:  defaultOnTimeTolerance,
+		MinSamples: minBadgeSamples,
+	}
+
+	filter.GroupBy = []string{"carrier", "service"}
+	byService, err := db.GetReliability(database, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error computing service reliability: %w", err)
+	}
+	filter.GroupBy = []string{"carrier"}
+	byCarrier, err := db.GetReliability(database, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error computing carrier reliability: %w", err)
+	}
+
+	computed := make(map[string]carrierBadges, len(carriers))
+	for _, c := range carriers {
+		computed[c] = carrierBadges{computedAt: now, services: make(map[string]*models.ReliabilityBadge)}
+	}
+	for _, s := range byService {
+		if badges, ok := computed[s.Group["carrier"]]; ok {
+			badges.services[s.Group["service"]] = reliabilityBadge(s, "SERVICE")
+		}
+	}
+	for _, s := range byCarrier {
+		if badges, ok := computed[s.Group["carrier"]]; ok {
+			badges.carrier = reliabilityBadge(s, "CARRIER")
+			computed[s.Group["carrier"]] = badges
+		}
+	}
+	return computed, nil
+}
+
+func mainServiceCode(product models.ReducedOceanProduct) string {
+	for _, leg := range product.TransportLegs {
+		if (leg.TransportMode == "" || leg.TransportMode == "VESSEL") && leg.CarrierServiceCode != "" {
+			return leg.CarrierServiceCode
+		}
+	}
+	return ""
+}
+
+func reliabilityBadge(s db.ReliabilityStats, basis string) *models.ReliabilityBadge {
+	level := models.ReliabilityLow
+	switch {
+	case s.OnTimePercent >= 80:
+		level = models.ReliabilityHigh
+	case s.OnTimePercent >= 60:
+		level = models.ReliabilityMedium
+	}
+	return &models.ReliabilityBadge{
+		Level:         level,
+		OnTimePercent: s.OnTimePercent,
+		Samples:       s.Samples,
+		Basis:         basis,
+	}
+}
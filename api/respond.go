@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/seeder"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// errorStatus maps lookup misses to 404, rejected filters to 400 and
+// everything else to 500.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrInvalidFilter):
+		return http.StatusBadRequest
+	case errors.Is(err, seeder.ErrSeedInProgress), errors.Is(err, seeder.ErrTooManyDeletes):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// paginated wraps one page of a list endpoint.
+type paginated struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// parsePagination reads limit and offset from the query string, defaulting
+// to the first page and capping the page size.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid limit: %s", v)
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset: %s", v)
+		}
+	}
+	return limit, offset, nil
+}
+
+// parseOptionalBool returns nil when the parameter is absent.
+func parseOptionalBool(r *http.Request, name string) (*bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return &b, nil
+}
+
+// parseTimeParam accepts a date (2006-01-02) or an RFC 3339 timestamp and
+// returns the zero time when the parameter is absent.
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return t, nil
+}
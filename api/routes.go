@@ -0,0 +1,393 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/Sraiti/vesselTracker/geocoding"
+	"github.com/Sraiti/vesselTracker/middleware"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+const apiPrefix = "/api/v1"
+
+// route describes one /api/v1 endpoint. The same table registers the
+// handlers on the mux and generates the OpenAPI document, so the two
+// cannot drift apart.
+type route struct {
+	Method      string
+	Path        string // relative to apiPrefix, using net/http pattern wildcards
+	Summary     string // a short phrase, details go in Description
+	Description string
+	Query       []queryParam
+	// Body describes the JSON request body, empty when the endpoint takes none.
+	Body string
+	// Admin routes take the ADMIN_TOKEN bearer token.
+	Admin   bool
+	Handler http.HandlerFunc
+}
+
+type queryParam struct {
+	Name        string
+	Type        string // OpenAPI scalar type: string, integer, number, boolean
+	Description string
+	Required    bool
+}
+
+// v1Routes takes the search handler from NewRouter so /search and
+// /api/v1/schedules share one lane cache.
+func v1Routes(database *sql.DB, search http.HandlerFunc, enricher *MaerskIDEnricher, geocoder *geocoding.Worker, writer *services.ScheduleWriter) []route {
+	return []route{
+		{
+			Method:  http.MethodPost,
+			Path:    "/schedules",
+			Summary: "Search point-to-point schedules for a lane",
+			Body:    "FetchParams: origin/destination UN/LOCODEs and city names; DepartureDate or ArrivalDate with SearchRangeWeeks; CargoType (DRY, REEF); ISOEquipmentCode; SortBy (departure, arrival, transitTime); ForceRefresh to bypass the lane cache (as does Cache-Control: no-cache)",
+			Handler: search,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/schedules",
+			Summary: "Browse schedules stored by previous searches",
+			Query: []queryParam{
+				{Name: "origin", Type: "string", Description: "Origin UN/LOCODE"},
+				{Name: "destination", Type: "string", Description: "Destination UN/LOCODE"},
+				{Name: "departureFrom", Type: "string", Description: "Earliest departure, date or RFC 3339"},
+				{Name: "departureTo", Type: "string", Description: "Latest departure (exclusive), date or RFC 3339"},
+				{Name: "vesselImo", Type: "string", Description: "IMO number of the departure vessel or of any leg vessel"},
+				{Name: "carrier", Type: "string", Description: "Vessel operator carrier code, e.g. MAEU"},
+				{Name: "maxTransitDays", Type: "integer", Description: "Maximum transit time in days"},
+				{Name: "changedSince", Type: "string", Description: "Only products that changed after this time; with a lane, also lists dropped products"},
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: QuerySchedulesHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/schedules/changes",
+			Summary:     "List schedule changes",
+			Description: "New versions of sailings with their field-level diffs, latest first.",
+			Query: []queryParam{
+				{Name: "since", Type: "string", Description: "Only changes observed after this time, date or RFC 3339"},
+				{Name: "carrier", Type: "string", Description: "Carrier code, e.g. MAEU"},
+				{Name: "origin", Type: "string", Description: "Origin UN/LOCODE"},
+				{Name: "destination", Type: "string", Description: "Destination UN/LOCODE"},
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: ScheduleChangesHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/schedules/{id}/history",
+			Summary:     "Get the version history of a schedule",
+			Description: "Every observed version of the sailing of a stored schedule, with its ETA, vessel and changed fields.",
+			Handler:     GetScheduleHistoryHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/lanes/{origin}/{destination}/vessels",
+			Summary:     "List the vessels serving a lane",
+			Description: "Vessels of the stored schedules of a lane, soonest departing first, with their next departures.",
+			Query: []queryParam{
+				{Name: "from", Type: "string", Description: "Earliest departure, date or RFC 3339 (default now)"},
+				{Name: "to", Type: "string", Description: "Latest departure (exclusive), date or RFC 3339"},
+				{Name: "departures", Type: "integer", Description: "Departures listed per vessel, default 5, max 50"},
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: GetLaneVesselsHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/services",
+			Summary:     "List service loops",
+			Description: "Carrier service loops with port rotations derived from stored schedules.",
+			Query: []queryParam{
+				{Name: "carrier", Type: "string", Description: "Carrier code, e.g. MAEU"},
+				{Name: "code", Type: "string", Description: "Carrier service code"},
+				{Name: "port", Type: "string", Description: "UN/LOCODE of a port the loop calls at"},
+				{Name: "tradeLane", Type: "string", Description: "Carrier trade lane name, e.g. EUR/FEA"},
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: SearchServicesHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/services/{carrier}/{code}",
+			Summary:     "Get a service loop",
+			Description: "The loop a carrier runs under a service code; carriers do not coordinate their codes.",
+			Handler:     GetServiceHandler(database),
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/vessels/tracked",
+			Summary: "List the vessels followed on the AIS stream",
+			Handler: GetTrackedVesselsHandler(database),
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/vessels",
+			Summary: "Search vessels",
+			Query: []queryParam{
+				{Name: "name", Type: "string", Description: "Name prefix, or fuzzy match with fuzzy=true"},
+				{Name: "fuzzy", Type: "boolean", Description: "Use trigram similarity on name"},
+				{Name: "imo", Type: "string", Description: "IMO number"},
+				{Name: "mmsi", Type: "string", Description: "MMSI"},
+				{Name: "carrier", Type: "string", Description: "Carrier vessel code"},
+				{Name: "tracked", Type: "boolean", Description: "Only vessels followed (or not) on the AIS stream"},
+				{Name: "seenWithin", Type: "string", Description: "Last seen within a duration, e.g. 72h"},
+				{Name: "hasPosition", Type: "boolean", Description: "Only vessels with (or without) a known position"},
+				{Name: "sort", Type: "string", Description: "name, last_seen, appearance_count or created_at; prefix with - for descending"},
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: SearchVesselsHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}",
+			Summary:     "Get a vessel",
+			Description: "The vessel by MMSI, IMO number or id, with its last position, port calls and schedules.",
+			Handler:     GetVesselDetailHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}/identities",
+			Summary:     "List the identities of a vessel",
+			Description: "MMSIs, names, call signs and flags the vessel went by, current first, with the time each was valid and whether AIS or a carrier reported it.",
+			Handler:     GetVesselIdentitiesHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}/track",
+			Summary:     "Get the track of a vessel",
+			Description: "Recorded positions of the vessel by MMSI, IMO number or id, oldest first.",
+			Query: []queryParam{
+				{Name: "format", Type: "string", Description: "Set to geojson for a FeatureCollection"},
+			},
+			Handler: GetVesselTrackHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}/data-quality",
+			Summary:     "Get the AIS data quality of a vessel",
+			Description: "Data-quality score of the vessel, whether its ETA can be trusted, and its recent AIS gaps.",
+			Handler:     GetVesselDataQualityHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}/voyages",
+			Summary:     "List the voyages of a vessel",
+			Description: "Voyages between port berths, with distance, speed and the transport leg each fulfilled.",
+			Query: []queryParam{
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: GetVesselVoyagesHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}/schedules",
+			Summary:     "List the schedules of a vessel",
+			Description: "Stored schedules the vessel serves, as departure vessel or on a leg, in the order it sails them, with the legs it carries.",
+			Query: []queryParam{
+				{Name: "from", Type: "string", Description: "Earliest departure of the vessel, date or RFC 3339 (default now)"},
+				{Name: "to", Type: "string", Description: "Latest departure of the vessel (exclusive), date or RFC 3339"},
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+				{Name: "offset", Type: "integer", Description: "Page offset"},
+			},
+			Handler: GetVesselSchedulesHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/vessels/{id}/position",
+			Summary:     "Get the last position of a vessel",
+			Description: "Last known position of the vessel by MMSI, IMO number or id.",
+			Handler:     GetVesselLastKnownPosition(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/providers/maersk/metrics",
+			Summary:     "Get Maersk client metrics",
+			Description: "Circuit breaker state and per-endpoint counters.",
+			Handler:     MaerskMetricsHandler(),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/locations",
+			Summary:     "Search locations",
+			Description: "Autocomplete by UN/LOCODE, name or alternate name, ranked. Without text, lists the locations of a country by function or subdivision.",
+			Query: []queryParam{
+				{Name: "text", Type: "string", Description: "UN/LOCODE, code prefix or name, accents and typos tolerated"},
+				{Name: "country", Type: "string", Description: "ISO country code, required without text"},
+				{Name: "subdivision", Type: "string", Description: "ISO 3166-2 subdivision without the country prefix, e.g. HH"},
+				{Name: "status", Type: "string", Description: "UN/LOCODE status, e.g. AI"},
+				{Name: "function", Type: "string", Description: "Comma separated functions, any of: port, rail, road, airport, postal, multimodal, icd, fixed, inland_port, border"},
+				{Name: "limit", Type: "integer", Description: "Maximum results, default 10, max 50"},
+			},
+			Handler: AutoCompleteHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/locations/{unlocode}",
+			Summary:     "Get a location",
+			Description: "Reference and superseded UN/LOCODEs resolve to the live location, named in resolved_from.",
+			Handler:     GetLocationHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/locations/{unlocode}/areas",
+			Summary:     "Get the areas of a location",
+			Description: "Port, terminal, berth and anchorage polygons as a GeoJSON FeatureCollection.",
+			Handler:     GetLocationAreasHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/ports/{unlocode}/congestion",
+			Summary:     "Get port congestion",
+			Description: "Vessels waiting at anchor off the port now, and the average anchorage wait and berth dwell of its arrivals.",
+			Query: []queryParam{
+				{Name: "from", Type: "string", Description: "Start of the arrival window, date or RFC 3339 (default 30 days before to)"},
+				{Name: "to", Type: "string", Description: "End of the arrival window, date or RFC 3339 (default now)"},
+			},
+			Handler: GetPortCongestionHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/analytics/reliability",
+			Summary:     "Get schedule reliability",
+			Description: "On-time performance of carrier schedules against the voyages that fulfilled them.",
+			Query: []queryParam{
+				{Name: "groupBy", Type: "string", Description: "Comma-separated: carrier, service, lane, vessel, month"},
+				{Name: "carrier", Type: "string", Description: "Carrier codes, comma-separated"},
+				{Name: "service", Type: "string", Description: "Carrier service codes, comma-separated"},
+				{Name: "origin", Type: "string", Description: "Leg origin UN/LOCODE"},
+				{Name: "destination", Type: "string", Description: "Leg destination UN/LOCODE"},
+				{Name: "vessel", Type: "string", Description: "Vessel IMO number"},
+				{Name: "from", Type: "string", Description: "Earliest scheduled arrival, date or RFC 3339"},
+				{Name: "to", Type: "string", Description: "Latest scheduled arrival, date or RFC 3339"},
+				{Name: "toleranceHours", Type: "number", Description: "Arrival within this many hours of the schedule is on time (default 24)"},
+				{Name: "minSamples", Type: "integer", Description: "Leave out groups with fewer arrivals (default 1)"},
+			},
+			Handler: ReliabilityHandler(database),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/locations/maersk-ids",
+			Summary:     "Refresh Maersk location IDs",
+			Description: "Queues a lookup of the codes, bypassing stored IDs and cached misses.",
+			Body:        `{"unlocodes": ["CNSHA", "MAPTM"]}, at most 500 codes`,
+			Admin:       true,
+			Handler:     RefreshMaerskIDsHandler(enricher),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/locations/geocode",
+			Summary:     "Geocode locations",
+			Description: "Queues locations without coordinates for geocoding.",
+			Body:        `{"unlocodes": ["CNSHA"]} or {"allMissing": true}`,
+			Admin:       true,
+			Handler:     GeocodeLocationsHandler(geocoder),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/locations/seed",
+			Summary:     "Seed locations",
+			Description: "Applies the UN/LOCODE file (UNLOCODE_FILE) to the locations, writing only the differences. An unchanged file is skipped.",
+			Body:        `optional {"release": "2024-1", "force": true}, force applies an unchanged file or one deleting over 10% of the locations`,
+			Admin:       true,
+			Handler:     SeedLocationsHandler(database),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/locations/wpi",
+			Summary:     "Import the World Port Index",
+			Description: "Imports WPI_FILE and links its ports to UN/LOCODEs.",
+			Admin:       true,
+			Handler:     ImportWPIHandler(database),
+		},
+		{
+			Method:      http.MethodPost,
+			Path:        "/admin/locations/areas",
+			Summary:     "Import location areas",
+			Description: "Imports terminal, berth and anchorage polygons of locations.",
+			Query: []queryParam{
+				{Name: "source", Type: "string", Description: "Where the polygons come from, geojson by default"},
+			},
+			Body:    `GeoJSON FeatureCollection of Polygon or MultiPolygon features with properties unlocode, kind (port, terminal, berth, anchorage) and name`,
+			Admin:   true,
+			Handler: ImportAreasHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/admin/locations/seed/runs",
+			Summary:     "List seeding runs",
+			Description: "Seeding history with the metrics of each run, most recent first.",
+			Query: []queryParam{
+				{Name: "limit", Type: "integer", Description: "Page size, max 200"},
+			},
+			Admin:   true,
+			Handler: SeedingRunsHandler(database),
+		},
+		{
+			Method:      http.MethodGet,
+			Path:        "/admin/schedules/writes",
+			Summary:     "Get schedule writer status",
+			Description: "Queue length, batches written, retries and the last error of the background schedule writer.",
+			Admin:       true,
+			Handler:     ScheduleWritesHandler(writer),
+		},
+		{
+			Method:      http.MethodPut,
+			Path:        "/admin/vessels/{id}/particulars",
+			Summary:     "Update vessel particulars",
+			Description: "Sets the particulars AIS and carriers do not send, such as DWT, TEU and build year.",
+			Body:        `{"dwt": 199000, "teu": 20568, "build_year": 2018}; also ship_type, length_m, beam_m, draught_m; fields left out keep their value`,
+			Admin:       true,
+			Handler:     UpdateVesselParticularsHandler(database),
+		},
+	}
+}
+
+// NewRouter registers the legacy query-string endpoints and the versioned
+// /api/v1 surface. Method-qualified patterns make the mux answer 405 with an
+// Allow header when a v1 path is hit with the wrong method. The background
+// workers are started by the caller.
+func NewRouter(database *sql.DB, enricher *MaerskIDEnricher, geocoder *geocoding.Worker, writer *services.ScheduleWriter) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	search := FetchHandler(database, enricher, geocoder, writer)
+
+	// Legacy endpoints, kept for the current front-end
+	mux.Handle("/search", search)
+	mux.Handle("/autocomplete", AutoCompleteHandler(database))
+	mux.Handle("/vessels/route", GetVesselRoute(database))
+	mux.Handle("/vessels/route/geojson", GetVesselRouteGeoJSON(database))
+	mux.Handle("/vessels/tracked", GetTrackedVesselsHandler(database))
+	mux.Handle("/vessels/last-known-position", GetVesselLastKnownPosition(database))
+	mux.Handle("/files", FilesExaminerHandler(database))
+
+	var spec map[string]interface{}
+	routes := append(v1Routes(database, search, enricher, geocoder, writer), route{
+		Method:  http.MethodGet,
+		Path:    "/openapi.json",
+		Summary: "OpenAPI document for this API",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, spec)
+		},
+	})
+	spec = buildOpenAPI(routes)
+
+	for _, rt := range routes {
+		handler := rt.Handler
+		if rt.Admin {
+			handler = middleware.AdminAuth(handler)
+		}
+		mux.Handle(rt.Method+" "+apiPrefix+rt.Path, handler)
+	}
+
+	return mux
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+type scheduleQueryResponse struct {
+	paginated
+	// Only set when both origin and destination are given
+	LastFetchedAt *time.Time `json:"lastFetchedAt,omitempty"`
+	// Products returned after changedSince that the latest fetch no longer has
+	Dropped []int64 `json:"dropped,omitempty"`
+}
+
+// QuerySchedulesHandler browses the schedules stored by previous searches,
+// without calling the carrier again.
+func QuerySchedulesHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := db.ScheduleFilter{
+			OriginUnLoCode:      strings.ToUpper(query.Get("origin")),
+			DestinationUnLoCode: strings.ToUpper(query.Get("destination")),
+			VesselIMONumber:     query.Get("vesselImo"),
+			CarrierCode:         strings.ToUpper(query.Get("carrier")),
+			Limit:               limit,
+			Offset:              offset,
+		}
+
+		for name, target := range map[string]*time.Time{
+			"departureFrom": &filter.DepartureFrom,
+			"departureTo":   &filter.DepartureTo,
+			"changedSince":  &filter.ChangedSince,
+		} {
+			if *target, err = parseTimeParam(r, name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if v := query.Get("maxTransitDays"); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil || days < 1 {
+				http.Error(w, "invalid maxTransitDays: "+v, http.StatusBadRequest)
+				return
+			}
+			// Carriers report transit time in minutes
+			filter.MaxTransitMinutes = days * 24 * 60
+		}
+
+		products, total, err := db.QueryOceanProducts(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		response := scheduleQueryResponse{
+			paginated: paginated{Items: products, Total: total, Limit: limit, Offset: offset},
+		}
+
+		if filter.OriginUnLoCode != "" && filter.DestinationUnLoCode != "" {
+			lastFetch, err := db.GetLaneLastFetch(database, filter.OriginUnLoCode, filter.DestinationUnLoCode)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !lastFetch.IsZero() {
+				response.LastFetchedAt = &lastFetch
+			}
+
+			if !filter.ChangedSince.IsZero() && !lastFetch.IsZero() {
+				response.Dropped, err = db.GetDroppedOceanProducts(database,
+					filter.OriginUnLoCode, filter.DestinationUnLoCode, filter.ChangedSince, lastFetch)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// GetScheduleHistoryHandler shows every observed version of the sailing an
+// ocean product belongs to, oldest first, so the evolution of its ETA and
+// vessel can be followed along with the fields each version changed.
+func GetScheduleHistoryHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid schedule id: "+r.PathValue("id"), http.StatusBadRequest)
+			return
+		}
+
+		sailingKey, versions, err := db.GetScheduleHistory(database, id)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"sailingKey": sailingKey,
+			"versions":   versions,
+		})
+	}
+}
+
+// ScheduleChangesHandler is the feed of schedule changes, latest first.
+func ScheduleChangesHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := db.ScheduleChangeFilter{
+			CarrierCode: strings.ToUpper(query.Get("carrier")),
+			Origin:      strings.ToUpper(query.Get("origin")),
+			Destination: strings.ToUpper(query.Get("destination")),
+			Limit:       limit,
+			Offset:      offset,
+		}
+		if filter.Since, err = parseTimeParam(r, "since"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		changes, total, err := db.GetScheduleChanges(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, paginated{Items: changes, Total: total, Limit: limit, Offset: offset})
+	}
+}
+
+const (
+	defaultLaneDepartures = 5
+	maxLaneDepartures     = 50
+)
+
+// GetLaneVesselsHandler lists the vessels serving a lane, the soonest
+// departing first, with their next departures on it. Without from, only
+// upcoming departures count.
+func GetLaneVesselsHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := db.LaneVesselFilter{
+			Origin:      strings.ToUpper(r.PathValue("origin")),
+			Destination: strings.ToUpper(r.PathValue("destination")),
+			Departures:  defaultLaneDepartures,
+			Limit:       limit,
+			Offset:      offset,
+		}
+		if filter.From, err = parseTimeParam(r, "from"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.To, err = parseTimeParam(r, "to"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.From.IsZero() {
+			filter.From = time.Now().UTC()
+		}
+		if v := r.URL.Query().Get("departures"); v != "" {
+			filter.Departures, err = strconv.Atoi(v)
+			if err != nil || filter.Departures < 1 || filter.Departures > maxLaneDepartures {
+				http.Error(w, "departures must be between 1 and "+strconv.Itoa(maxLaneDepartures), http.StatusBadRequest)
+				return
+			}
+		}
+
+		vessels, total, err := db.GetLaneVessels(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, paginated{Items: vessels, Total: total, Limit: limit, Offset: offset})
+	}
+}
@@ -0,0 +1,287 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+const (
+	CacheHit    = "HIT"    // fresh stored result
+	CacheStale  = "STALE"  // stored result served while a refresh runs in the background
+	CacheMiss   = "MISS"   // no usable stored result, fetched from the carrier
+	CacheBypass = "BYPASS" // the client forced a refresh
+)
+
+const (
+	defaultSearchFreshFor = time.Hour
+	defaultSearchStaleFor = 24 * time.Hour
+	// Upper bound on the products a lane can hold; carriers return far fewer
+	maxCachedLaneProducts = 1000
+)
+
+type CacheStatus struct {
+	Status     string    `json:"status"`
+	AgeSeconds int64     `json:"ageSeconds"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+}
+
+// laneCache serves /search from stored ocean_products with a
+// stale-while-revalidate policy: results younger than freshFor are served
+// as is, results younger than staleFor are served while a background fetch
+// refreshes them, anything older is fetched synchronously. Concurrent
+// fetches of the same lane share one carrier call. A fetch is stored by the
+// schedule writer and becomes the lane's stored result once written.
+type laneCache struct {
+	database *sql.DB
+	fetch    laneFetchFunc
+	writer   *services.ScheduleWriter
+	freshFor time.Duration
+	staleFor time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*laneFetchCall
+}
+
+type laneFetchFunc func(*sql.DB, FetchParams) ([]models.ReducedOceanProduct, []ProviderResult, error)
+
+type laneFetchCall struct {
+	done      chan struct{}
+	products  []models.ReducedOceanProduct
+	providers []ProviderResult
+	err       error
+}
+
+func newLaneCache(database *sql.DB, fetch laneFetchFunc, writer *services.ScheduleWriter) *laneCache {
+	return &laneCache{
+		database: database,
+		fetch:    fetch,
+		writer:   writer,
+		freshFor: services.EnvDuration("SEARCH_CACHE_FRESH_FOR", defaultSearchFreshFor),
+		staleFor: services.EnvDuration("SEARCH_CACHE_STALE_FOR", defaultSearchStaleFor),
+		inflight: make(map[string]*laneFetchCall),
+	}
+}
+
+// laneKey identifies a search by lane, search window and the cargo options
+// sent to the carrier. Sorting happens after the cache and is not part of it.
+func laneKey(params FetchParams) string {
+	window := "default"
+	if start, _, onArrival := params.window(); !start.IsZero() {
+		window = "D" + start.Format("2006-01-02")
+		if onArrival {
+			window = "A" + start.Format("2006-01-02")
+		}
+	}
+	if params.SearchRangeWeeks > 0 {
+		window += fmt.Sprintf("/P%dW", params.SearchRangeWeeks)
+	}
+	return strings.Join([]string{
+		strings.ToUpper(params.OriginPortUnLoCode),
+		strings.ToUpper(params.DestinationPortUnLoCode),
+		window,
+		params.CargoType,
+		params.ISOEquipmentCode,
+	}, ":")
+}
+
+// Search returns the products of a lane, the provider report of the fetch
+// they come from and how the cache answered.
+func (c *laneCache) Search(params FetchParams, force bool) ([]models.ReducedOceanProduct, []ProviderResult, CacheStatus, error) {
+	key := laneKey(params)
+
+	if !force {
+		fetch, err := db.GetLaneFetch(c.database, key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Printf("Error reading lane cache for %s: %v", key, err)
+		}
+
+		if err == nil && fetch.Age < c.staleFor {
+			products, err := c.stored(fetch)
+			if err == nil {
+				status := CacheStatus{
+					Status:     CacheHit,
+					AgeSeconds: int64(fetch.Age.Seconds()),
+					FetchedAt:  fetch.FetchedAt,
+				}
+				if fetch.Age >= c.freshFor {
+					status.Status = CacheStale
+					go c.do(key, params)
+				}
+				var providers []ProviderResult
+				if err := json.Unmarshal(fetch.Providers, &providers); err != nil {
+					log.Printf("Error decoding provider report for %s: %v", key, err)
+				}
+				log.Printf("Lane cache %s for %s (age %v)", status.Status, key, fetch.Age)
+				return products, providers, status, nil
+			}
+			log.Printf("Error reading stored products for %s: %v", key, err)
+		}
+	}
+
+	status := CacheStatus{Status: CacheMiss}
+	if force {
+		status.Status = CacheBypass
+	}
+
+	products, providers, err := c.do(key, params)
+	if err != nil {
+		return nil, providers, status, err
+	}
+
+	status.FetchedAt = time.Now().UTC()
+	log.Printf("Lane cache %s for %s", status.Status, key)
+	return products, providers, status, nil
+}
+
+// do runs the carrier fetch for a lane, or waits for the one already running.
+// Every caller gets its own copy of the products, which it annotates.
+func (c *laneCache) do(key string, params FetchParams) ([]models.ReducedOceanProduct, []ProviderResult, error) {
+	c.mu.Lock()
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return copyProducts(call.products), call.providers, call.err
+	}
+	call := &laneFetchCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.products, call.providers, call.err = c.fetch(c.database, params)
+	if call.err == nil {
+		c.store(key, params, call.products, call.providers)
+	} else {
+		log.Printf("Error fetching lane %s: %v", key, call.err)
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return copyProducts(call.products), call.providers, call.err
+}
+
+// copyProducts copies the products down to the slices annotations rewrite:
+// their legs and connections.
+func copyProducts(products []models.ReducedOceanProduct) []models.ReducedOceanProduct {
+	if products == nil {
+		return nil
+	}
+	copied := make([]models.ReducedOceanProduct, len(products))
+	for i, p := range products {
+		if p.TransportLegs != nil {
+			p.TransportLegs = append(make([]models.ReducedTransportLeg, 0, len(p.TransportLegs)), p.TransportLegs...)
+		}
+		if p.Connections != nil {
+			p.Connections = append(make([]models.Connection, 0, len(p.Connections)), p.Connections...)
+		}
+		copied[i] = p
+	}
+	return copied
+}
+
+// store queues the products of a fetch on the writer and records the lane
+// fetch once they are written. Until then the previous fetch, if any, is
+// what the lane serves. A fetch without products is not recorded: carriers
+// answer empty when they have a hiccup, and caching that would turn the
+// lane into a 404 until the result goes stale.
+func (c *laneCache) store(key string, params FetchParams, products []models.ReducedOceanProduct, providers []ProviderResult) {
+	if len(products) == 0 {
+		log.Printf("Not caching lane %s: no products", key)
+		return
+	}
+	report, _ := json.Marshal(providers)
+	err := c.writer.Save(products, func(saved []models.ReducedOceanProduct) {
+		seen := make(map[int64]bool)
+		ids := make([]int64, 0, len(saved))
+		for _, p := range saved {
+			if p.ID != 0 && !seen[p.ID] {
+				seen[p.ID] = true
+				ids = append(ids, p.ID)
+			}
+		}
+		err := db.RecordLaneFetch(c.database, key,
+			strings.ToUpper(params.OriginPortUnLoCode), strings.ToUpper(params.DestinationPortUnLoCode),
+			ids, report)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+	if err != nil {
+		log.Printf("Not storing lane %s: %v", key, err)
+	}
+}
+
+// stored reads back the products returned by the last fetch of a lane, in
+// departure order, and attaches the current vessel positions.
+func (c *laneCache) stored(fetch db.LaneFetch) ([]models.ReducedOceanProduct, error) {
+	if len(fetch.ProductIDs) == 0 {
+		return []models.ReducedOceanProduct{}, nil
+	}
+
+	stored, _, err := db.QueryOceanProducts(c.database, db.ScheduleFilter{
+		IDs:   fetch.ProductIDs,
+		Limit: maxCachedLaneProducts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stored) < len(fetch.ProductIDs) {
+		return nil, fmt.Errorf("lane cache for %s holds %d of %d products", fetch.CacheKey, len(stored), len(fetch.ProductIDs))
+	}
+
+	products := make([]models.ReducedOceanProduct, 0, len(stored))
+	for _, p := range stored {
+		products = append(products, p.ReducedOceanProduct)
+	}
+
+	attachVesselPositions(c.database, products)
+
+	return products, nil
+}
+
+// attachVesselPositions fills LastKnownPosition, which is not stored with
+// the schedules, from the vessels table.
+func attachVesselPositions(database *sql.DB, products []models.ReducedOceanProduct) {
+	imoSet := make(map[string]struct{})
+	for _, product := range products {
+		imoSet[product.DepartureVesselIMONumber] = struct{}{}
+		for _, leg := range product.TransportLegs {
+			imoSet[leg.VesselIMONumber] = struct{}{}
+		}
+	}
+	imos := make([]string, 0, len(imoSet))
+	for imo := range imoSet {
+		if imo != "" {
+			imos = append(imos, imo)
+		}
+	}
+
+	vessels, err := db.GetVesselsByIMOs(database, imos)
+	if err != nil {
+		log.Printf("Error fetching vessels from DB: %v", err)
+		return
+	}
+
+	for i := range products {
+		if v, ok := vessels[products[i].DepartureVesselIMONumber]; ok {
+			products[i].LastKnownPosition = v.LastKnownPosition
+		}
+		for j := range products[i].TransportLegs {
+			if v, ok := vessels[products[i].TransportLegs[j].VesselIMONumber]; ok {
+				products[i].TransportLegs[j].LastKnownPosition = v.LastKnownPosition
+			}
+		}
+	}
+}
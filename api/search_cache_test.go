@@ -0,0 +1,80 @@
+package api
+
+import (
+	"database/sql"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+	"github.com/Sraiti/vesselTracker/services"
+)
+
+// TestCoalescedSearchesGetTheirOwnProducts runs concurrent searches of one
+// lane, which share a single fetch, and annotates each answer the way
+// FetchHandler does. Run with -race.
+func TestCoalescedSearchesGetTheirOwnProducts(t *testing.T) {
+	departure := time.Date(2024, 5, 3, 8, 0, 0, 0, time.UTC)
+	fetched := []models.ReducedOceanProduct{{
+		CarrierCode:             "MAEU",
+		OriginPortUnLoCode:      "NLRTM",
+		DestinationPortUnLoCode: "CNSHA",
+		TransportLegs: []models.ReducedTransportLeg{
+			{TransportMode: "VESSEL", VesselIMONumber: "9776183", DestinationPortUnLoCode: "SGSIN",
+				ArrivalDateTime: models.CustomTime{Time: departure.Add(20 * 24 * time.Hour)}},
+			{TransportMode: "VESSEL", VesselIMONumber: "9619907", OriginPortUnLoCode: "SGSIN",
+				DepartureDateTime: models.CustomTime{Time: departure.Add(22 * 24 * time.Hour)}},
+		},
+	}}
+
+	var fetches int
+	var mu sync.Mutex
+	fetch := func(*sql.DB, FetchParams) ([]models.ReducedOceanProduct, []ProviderResult, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		// long enough for every search to join this fetch
+		time.Sleep(100 * time.Millisecond)
+		return fetched, nil, nil
+	}
+	cache := newLaneCache(nil, fetch, services.NewScheduleWriter(nil, nil))
+	params := FetchParams{OriginPortUnLoCode: "NLRTM", DestinationPortUnLoCode: "CNSHA"}
+
+	const searches = 8
+	results := make([][]models.ReducedOceanProduct, searches)
+	var wg sync.WaitGroup
+	for i := 0; i < searches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			products, _, _, err := cache.Search(params, true)
+			if err != nil {
+				t.Errorf("Search: %v", err)
+				return
+			}
+			policy := services.ConnectionPolicy{Default: time.Duration(i) * 24 * time.Hour}
+			for j := range products {
+				services.AnalyzeConnections(&products[j], policy)
+				products[j].TransportLegs[0].VesselMMSI = "search-" + strconv.Itoa(i)
+			}
+			results[i] = products
+		}(i)
+	}
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("ran %d fetches, want the searches to share 1", fetches)
+	}
+	for i, products := range results {
+		if len(products) != 1 || len(products[0].Connections) != 1 {
+			t.Fatalf("search %d got %+v", i, products)
+		}
+		if got, want := products[0].Connections[0].MinimumMinutes, int32(i*24*60); got != want {
+			t.Errorf("search %d carries a minimum of %d minutes, want its own %d", i, got, want)
+		}
+	}
+	if fetched[0].Connections != nil || fetched[0].TransportLegs[0].VesselMMSI != "" {
+		t.Error("annotations reached the fetched products")
+	}
+}
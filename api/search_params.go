@@ -0,0 +1,116 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+const (
+	// Maersk accepts search ranges of one to eight weeks
+	maxSearchRangeWeeks = 8
+	// Window the carrier applies when no range is sent
+	defaultSearchRangeWeeks = 4
+)
+
+var (
+	unLoCodePattern         = regexp.MustCompile(`^[A-Z]{2}[A-Z2-9]{3}$`)
+	isoEquipmentCodePattern = regexp.MustCompile(`^[0-9A-Z]{4}$`)
+)
+
+// validate normalizes the search parameters and rejects combinations the
+// carrier would not accept.
+func (p *FetchParams) validate() error {
+	p.OriginPortUnLoCode = strings.ToUpper(strings.TrimSpace(p.OriginPortUnLoCode))
+	p.DestinationPortUnLoCode = strings.ToUpper(strings.TrimSpace(p.DestinationPortUnLoCode))
+	p.CargoType = strings.ToUpper(strings.TrimSpace(p.CargoType))
+	p.ISOEquipmentCode = strings.ToUpper(strings.TrimSpace(p.ISOEquipmentCode))
+
+	if !unLoCodePattern.MatchString(p.OriginPortUnLoCode) {
+		return fmt.Errorf("invalid origin UN/LOCODE: %q", p.OriginPortUnLoCode)
+	}
+	if !unLoCodePattern.MatchString(p.DestinationPortUnLoCode) {
+		return fmt.Errorf("invalid destination UN/LOCODE: %q", p.DestinationPortUnLoCode)
+	}
+	if !p.DepartureDate.IsZero() && !p.ArrivalDate.IsZero() {
+		return fmt.Errorf("search on either DepartureDate or ArrivalDate, not both")
+	}
+	if p.SearchRangeWeeks < 0 || p.SearchRangeWeeks > maxSearchRangeWeeks {
+		return fmt.Errorf("SearchRangeWeeks must be between 0 and %d (0 = default %d)", maxSearchRangeWeeks, defaultSearchRangeWeeks)
+	}
+	switch p.CargoType {
+	case "", "DRY", "REEF":
+	default:
+		return fmt.Errorf("invalid CargoType: %q", p.CargoType)
+	}
+	if p.ISOEquipmentCode != "" && !isoEquipmentCodePattern.MatchString(p.ISOEquipmentCode) {
+		return fmt.Errorf("invalid ISOEquipmentCode: %q", p.ISOEquipmentCode)
+	}
+	switch p.SortBy {
+	case "", "departure", "arrival", "transitTime":
+	default:
+		return fmt.Errorf("invalid SortBy: %q", p.SortBy)
+	}
+	return nil
+}
+
+// window returns the requested search window and whether it applies to
+// arrival rather than departure. The window is zero when no date was given.
+func (p FetchParams) window() (start, end time.Time, onArrival bool) {
+	start = p.DepartureDate.Time
+	if !p.ArrivalDate.IsZero() {
+		start = p.ArrivalDate.Time
+		onArrival = true
+	}
+	if start.IsZero() {
+		return time.Time{}, time.Time{}, false
+	}
+
+	weeks := p.SearchRangeWeeks
+	if weeks == 0 {
+		weeks = defaultSearchRangeWeeks
+	}
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 7*weeks), onArrival
+}
+
+// filterAndSortProducts drops the products outside the requested window,
+// which carriers do not always honor, and orders the rest.
+func filterAndSortProducts(products []models.ReducedOceanProduct, params FetchParams) []models.ReducedOceanProduct {
+	start, end, onArrival := params.window()
+
+	filtered := make([]models.ReducedOceanProduct, 0, len(products))
+	for _, product := range products {
+		if !start.IsZero() {
+			t := product.DepartureDateTime.Time
+			if onArrival {
+				t = product.ArrivalDateTime.Time
+			}
+			if t.Before(start) || !t.Before(end) {
+				continue
+			}
+		}
+		filtered = append(filtered, product)
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		a, b := filtered[i], filtered[j]
+		switch params.SortBy {
+		case "transitTime":
+			if a.TransitTime != b.TransitTime {
+				return a.TransitTime < b.TransitTime
+			}
+		case "arrival":
+			if !a.ArrivalDateTime.Equal(b.ArrivalDateTime.Time) {
+				return a.ArrivalDateTime.Before(b.ArrivalDateTime.Time)
+			}
+		}
+		return a.DepartureDateTime.Before(b.DepartureDateTime.Time)
+	})
+
+	return filtered
+}
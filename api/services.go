@@ -0,0 +1,56 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+// SearchServicesHandler lists the service loops seen in stored schedules,
+// with their port rotations.
+func SearchServicesHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := db.ServiceFilter{
+			CarrierCode: strings.ToUpper(query.Get("carrier")),
+			ServiceCode: query.Get("code"),
+			Port:        strings.ToUpper(query.Get("port")),
+			TradeLane:   query.Get("tradeLane"),
+			Limit:       limit,
+			Offset:      offset,
+		}
+
+		services, total, err := db.SearchServices(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, paginated{Items: services, Total: total, Limit: limit, Offset: offset})
+	}
+}
+
+// GetServiceHandler serves the loop a carrier runs under a service code.
+func GetServiceHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service, err := db.GetService(database, strings.ToUpper(r.PathValue("carrier")), r.PathValue("code"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, service)
+	}
+}
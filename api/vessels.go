@@ -0,0 +1,322 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+const (
+	recentPortCallsLimit = 10
+	vesselSchedulesLimit = 20
+	recentAISGapsLimit   = 50
+)
+
+type VesselDetail struct {
+	Vessel       db.Vessel            `json:"vessel"`
+	Particulars  db.VesselParticulars `json:"particulars"`
+	LastPosition *db.VesselPosition   `json:"lastPosition"`
+	PortCalls    []db.PortCall        `json:"portCalls"`
+	Schedules    []db.OceanProduct    `json:"schedules"`
+}
+
+// resolveVessel looks a vessel up by any of its identifiers: a 9 digit MMSI,
+// current or former, a 7 digit IMO number (optionally prefixed with "IMO")
+// or the internal id. Anything else is rejected as an invalid filter.
+func resolveVessel(database *sql.DB, id string) (db.Vessel, error) {
+	id = strings.TrimSpace(id)
+	imo := strings.TrimPrefix(strings.ToUpper(id), "IMO")
+
+	if _, err := strconv.Atoi(imo); err == nil && len(imo) == 7 {
+		return db.GetVesselByIMO(database, imo)
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil || (len(id) != 9 && (n <= 0 || n > math.MaxInt32)) {
+		return db.Vessel{}, fmt.Errorf("%w: invalid vessel identifier %q", db.ErrInvalidFilter, id)
+	}
+	if len(id) == 9 {
+		vessel, err := db.GetVesselByMMSI(database, id)
+		if errors.Is(err, db.ErrNotFound) {
+			return db.GetVesselByFormerMMSI(database, id)
+		}
+		return vessel, err
+	}
+	return db.GetVesselByID(database, n)
+}
+
+// requestedVessel returns the vessel at {id} on the versioned API, or the
+// one with the mmsi query parameter on the legacy endpoints.
+func requestedVessel(database *sql.DB, r *http.Request) (db.Vessel, error) {
+	if id := r.PathValue("id"); id != "" {
+		return resolveVessel(database, id)
+	}
+	return db.GetVesselByMMSI(database, r.URL.Query().Get("mmsi"))
+}
+
+func SearchVesselsHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := db.VesselFilter{
+			Name:        query.Get("name"),
+			IMONumber:   query.Get("imo"),
+			MMSI:        query.Get("mmsi"),
+			CarrierCode: query.Get("carrier"),
+			Sort:        query.Get("sort"),
+			Limit:       limit,
+			Offset:      offset,
+		}
+
+		fuzzy, err := parseOptionalBool(r, "fuzzy")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Fuzzy = fuzzy != nil && *fuzzy
+
+		if filter.Tracked, err = parseOptionalBool(r, "tracked"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.HasPosition, err = parseOptionalBool(r, "hasPosition"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := query.Get("seenWithin"); v != "" {
+			window, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "invalid seenWithin: "+v, http.StatusBadRequest)
+				return
+			}
+			filter.SeenSince = time.Now().Add(-window)
+		}
+
+		vessels, total, err := db.SearchVessels(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, paginated{Items: vessels, Total: total, Limit: limit, Offset: offset})
+	}
+}
+
+// GetVesselDetailHandler combines the vessel record with its last position,
+// recent port calls and the stored schedules it appears on.
+func GetVesselDetailHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vessel, err := resolveVessel(database, r.PathValue("id"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		detail := VesselDetail{
+			Vessel:    vessel,
+			PortCalls: []db.PortCall{},
+			Schedules: []db.OceanProduct{},
+		}
+
+		detail.Particulars, err = db.GetVesselParticulars(database, vessel.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if vessel.MMSI != "" {
+			position, err := db.GetLastPosition(database, vessel.MMSI)
+			if err == nil {
+				detail.LastPosition = &position
+			} else if !errors.Is(err, db.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			detail.PortCalls, err = db.GetRecentPortCalls(database, vessel.MMSI, recentPortCallsLimit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		detail.Schedules, err = db.GetOceanProductsForVessel(database, vessel.IMONumber, vesselSchedulesLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, detail)
+	}
+}
+
+// GetVesselIdentitiesHandler lists the MMSIs, names, call signs and flags a
+// vessel went by, current identity first, with the time each was valid.
+func GetVesselIdentitiesHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vessel, err := resolveVessel(database, r.PathValue("id"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		identities, err := db.GetVesselIdentities(database, vessel.ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, identities)
+	}
+}
+
+// GetVesselTrackHandler serves the position history as coordinate pairs, or
+// as a GeoJSON FeatureCollection when format=geojson.
+func GetVesselTrackHandler(database *sql.DB) http.HandlerFunc {
+	route := GetVesselRoute(database)
+	geojson := GetVesselRouteGeoJSON(database)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "geojson" {
+			geojson(w, r)
+			return
+		}
+		route(w, r)
+	}
+}
+
+// VesselDataQuality is the AIS coverage score of a vessel with its latest
+// gaps. Quality is nil until the vessel has been tracked and scored.
+type VesselDataQuality struct {
+	MMSI    string                `json:"mmsi"`
+	Quality *db.VesselDataQuality `json:"quality"`
+	Gaps    []db.AISGap           `json:"gaps"`
+}
+
+// GetVesselDataQualityHandler reports how far the AIS data of a vessel can
+// be trusted: its score, whether it is dark now and its recent gaps, each
+// with the port it started in when the vessel was at berth or anchor.
+func GetVesselDataQualityHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vessel, err := resolveVessel(database, r.PathValue("id"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if vessel.MMSI == "" {
+			http.Error(w, "vessel has no MMSI", http.StatusNotFound)
+			return
+		}
+
+		result := VesselDataQuality{MMSI: vessel.MMSI}
+		result.Quality, err = db.GetDataQuality(database, vessel.MMSI)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result.Gaps, err = db.GetAISGaps(database, vessel.MMSI, recentAISGapsLimit)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// GetVesselVoyagesHandler lists the voyages of a vessel between port berths,
+// latest first, with the scheduled times of the transport legs they fulfilled.
+func GetVesselVoyagesHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		vessel, err := resolveVessel(database, r.PathValue("id"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if vessel.MMSI == "" {
+			http.Error(w, "vessel has no MMSI", http.StatusNotFound)
+			return
+		}
+
+		voyages, total, err := db.GetVoyages(database, vessel.MMSI, limit, offset)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, paginated{Items: voyages, Total: total, Limit: limit, Offset: offset})
+	}
+}
+
+// GetVesselSchedulesHandler lists the stored schedules a vessel serves, as
+// their departure vessel or on one of their legs, in the order it sails
+// them. Without from, only upcoming ones are listed.
+func GetVesselSchedulesHandler(database *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := db.VesselScheduleFilter{Limit: limit, Offset: offset}
+		if filter.From, err = parseTimeParam(r, "from"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.To, err = parseTimeParam(r, "to"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.From.IsZero() {
+			filter.From = time.Now().UTC()
+		}
+
+		vessel, err := resolveVessel(database, r.PathValue("id"))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		filter.VesselID = vessel.ID
+
+		schedules, total, err := db.GetVesselSchedules(database, filter)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, paginated{Items: schedules, Total: total, Limit: limit, Offset: offset})
+	}
+}
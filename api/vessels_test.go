@@ -0,0 +1,21 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+func TestResolveVesselRejectsMalformedIdentifiers(t *testing.T) {
+	for _, id := range []string{"abc", "IMO123", "IMOabcdefg", "0", "-3", "99999999999"} {
+		_, err := resolveVessel(nil, id)
+		if !errors.Is(err, db.ErrInvalidFilter) {
+			t.Errorf("resolveVessel(%q) = %v, want ErrInvalidFilter", id, err)
+		}
+		if status := errorStatus(err); status != http.StatusBadRequest {
+			t.Errorf("resolveVessel(%q) maps to %d, want 400", id, status)
+		}
+	}
+}
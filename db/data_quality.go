@@ -0,0 +1,242 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TrackPoint is a position reduced to what gap, outlier and voyage
+// detection need.
+type TrackPoint struct {
+	Timestamp time.Time
+	Latitude  float64
+	Longitude float64
+	Sog       *float64
+}
+
+// AISGap is a silence between two positions of a vessel, or since its last
+// position when EndedAt is nil.
+type AISGap struct {
+	MMSI           string     `json:"mmsi"`
+	StartedAt      time.Time  `json:"started_at"`
+	EndedAt        *time.Time `json:"ended_at"`
+	StartLatitude  float64    `json:"start_latitude"`
+	StartLongitude float64    `json:"start_longitude"`
+	EndLatitude    *float64   `json:"end_latitude,omitempty"`
+	EndLongitude   *float64   `json:"end_longitude,omitempty"`
+	DistanceNM     *float64   `json:"distance_nm,omitempty"`
+	PortUnlocode   *string    `json:"port_unlocode,omitempty"`
+	Hours          float64    `json:"hours"`
+}
+
+// VesselDataQuality scores the AIS coverage of a vessel over a window.
+type VesselDataQuality struct {
+	MMSI            string     `json:"mmsi"`
+	WindowStart     time.Time  `json:"window_start"`
+	WindowEnd       time.Time  `json:"window_end"`
+	PositionCount   int        `json:"position_count"`
+	MessagesPerHour float64    `json:"messages_per_hour"`
+	GapCount        int        `json:"gap_count"`
+	GapHours        float64    `json:"gap_hours"`
+	GapRatio        float64    `json:"gap_ratio"`
+	OutlierCount    int        `json:"outlier_count"`
+	Score           float64    `json:"score"`
+	DarkSince       *time.Time `json:"dark_since"`
+	TrustETA        bool       `json:"trust_eta"`
+	ComputedAt      time.Time  `json:"computed_at"`
+}
+
+func GetTrackedMMSIs(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT mmsi FROM vessels WHERE is_tracked AND COALESCE(mmsi, '') <> '' ORDER BY mmsi`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tracked vessels: %w", err)
+	}
+	defer rows.Close()
+
+	var mmsis []string
+	for rows.Next() {
+		var mmsi string
+		if err := rows.Scan(&mmsi); err != nil {
+			return nil, err
+		}
+		mmsis = append(mmsis, mmsi)
+	}
+	return mmsis, rows.Err()
+}
+
+// GetTrackPoints returns the positions of a vessel since a time in order,
+// preceded by the last one before it so a gap across since is seen whole.
+func GetTrackPoints(db *sql.DB, mmsi string, since time.Time) ([]TrackPoint, error) {
+	rows, err := db.Query(`
+		(SELECT timestamp, latitude, longitude, sog FROM vessel_positions
+		 WHERE mmsi = $1 AND timestamp < $2
+		 ORDER BY timestamp DESC LIMIT 1)
+		UNION ALL
+		(SELECT timestamp, latitude, longitude, sog FROM vessel_positions
+		 WHERE mmsi = $1 AND timestamp >= $2)
+		ORDER BY timestamp`, mmsi, since)
+	if err != nil {
+		return nil, fmt.Errorf("error getting track points: %w", err)
+	}
+	defer rows.Close()
+
+	var points []TrackPoint
+	for rows.Next() {
+		var p TrackPoint
+		if err := rows.Scan(&p.Timestamp, &p.Latitude, &p.Longitude, &p.Sog); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// SaveDataQuality stores the score of a vessel with the gaps found in its
+// window. An open gap that was not found again has been filled since.
+func SaveDataQuality(db *sql.DB, q VesselDataQuality, gaps []AISGap) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	starts := make([]time.Time, 0, len(gaps))
+	for _, g := range gaps {
+		starts = append(starts, g.StartedAt)
+		_, err := tx.Exec(`
+			INSERT INTO ais_gaps (mmsi, started_at, ended_at, start_latitude, start_longitude,
+				end_latitude, end_longitude, distance_nm, port_unlocode)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, (
+				SELECT unlocode FROM port_stays
+				WHERE mmsi = $1 AND started_at <= $2 AND ended_at >= $2
+				ORDER BY kind = 'berth' DESC
+				LIMIT 1
+			))
+			ON CONFLICT (mmsi, started_at) DO UPDATE SET
+				ended_at = EXCLUDED.ended_at,
+				end_latitude = EXCLUDED.end_latitude,
+				end_longitude = EXCLUDED.end_longitude,
+				distance_nm = EXCLUDED.distance_nm,
+				port_unlocode = COALESCE(EXCLUDED.port_unlocode, ais_gaps.port_unlocode)`,
+			q.MMSI, g.StartedAt, g.EndedAt, g.StartLatitude, g.StartLongitude,
+			g.EndLatitude, g.EndLongitude, g.DistanceNM)
+		if err != nil {
+			return fmt.Errorf("error saving AIS gap: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM ais_gaps
+		WHERE mmsi = $1 AND ended_at IS NULL AND NOT (started_at = ANY ($2::timestamp[]))`,
+		q.MMSI, pq.Array(formatTimestamps(starts)))
+	if err != nil {
+		return fmt.Errorf("error removing filled AIS gaps: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO vessel_data_quality (mmsi, window_start, window_end, position_count, messages_per_hour,
+			gap_count, gap_hours, gap_ratio, outlier_count, score, dark_since, trust_eta, computed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NOW())
+		ON CONFLICT (mmsi) DO UPDATE SET
+			window_start = EXCLUDED.window_start,
+			window_end = EXCLUDED.window_end,
+			position_count = EXCLUDED.position_count,
+			messages_per_hour = EXCLUDED.messages_per_hour,
+			gap_count = EXCLUDED.gap_count,
+			gap_hours = EXCLUDED.gap_hours,
+			gap_ratio = EXCLUDED.gap_ratio,
+			outlier_count = EXCLUDED.outlier_count,
+			score = EXCLUDED.score,
+			dark_since = EXCLUDED.dark_since,
+			trust_eta = EXCLUDED.trust_eta,
+			computed_at = EXCLUDED.computed_at`,
+		q.MMSI, q.WindowStart, q.WindowEnd, q.PositionCount, q.MessagesPerHour,
+		q.GapCount, q.GapHours, q.GapRatio, q.OutlierCount, q.Score, q.DarkSince, q.TrustETA)
+	if err != nil {
+		return fmt.Errorf("error saving data quality: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func formatTimestamps(times []time.Time) []string {
+	formatted := make([]string, len(times))
+	for i, t := range times {
+		formatted[i] = t.Format("2006-01-02 15:04:05.999999")
+	}
+	return formatted
+}
+
+func GetDataQuality(db *sql.DB, mmsi string) (*VesselDataQuality, error) {
+	var q VesselDataQuality
+	err := db.QueryRow(`
+		SELECT mmsi, window_start, window_end, position_count, messages_per_hour, gap_count,
+			   gap_hours, gap_ratio, outlier_count, score, dark_since, trust_eta, computed_at
+		FROM vessel_data_quality
+		WHERE mmsi = $1`, mmsi).Scan(
+		&q.MMSI, &q.WindowStart, &q.WindowEnd, &q.PositionCount, &q.MessagesPerHour, &q.GapCount,
+		&q.GapHours, &q.GapRatio, &q.OutlierCount, &q.Score, &q.DarkSince, &q.TrustETA, &q.ComputedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("data quality %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting data quality: %w", err)
+	}
+	return &q, nil
+}
+
+// GetDataQualities returns the scores of the given vessels by MMSI, leaving
+// out the ones not scored yet.
+func GetDataQualities(db *sql.DB, mmsis []string) (map[string]VesselDataQuality, error) {
+	rows, err := db.Query(`
+		SELECT mmsi, window_start, window_end, position_count, messages_per_hour, gap_count,
+			   gap_hours, gap_ratio, outlier_count, score, dark_since, trust_eta, computed_at
+		FROM vessel_data_quality
+		WHERE mmsi = ANY($1)`, pq.Array(mmsis))
+	if err != nil {
+		return nil, fmt.Errorf("error getting data quality: %w", err)
+	}
+	defer rows.Close()
+
+	qualities := make(map[string]VesselDataQuality, len(mmsis))
+	for rows.Next() {
+		var q VesselDataQuality
+		err := rows.Scan(&q.MMSI, &q.WindowStart, &q.WindowEnd, &q.PositionCount, &q.MessagesPerHour, &q.GapCount,
+			&q.GapHours, &q.GapRatio, &q.OutlierCount, &q.Score, &q.DarkSince, &q.TrustETA, &q.ComputedAt)
+		if err != nil {
+			return nil, err
+		}
+		qualities[q.MMSI] = q
+	}
+	return qualities, rows.Err()
+}
+
+// GetAISGaps returns the latest gaps of a vessel, an open one first.
+func GetAISGaps(db *sql.DB, mmsi string, limit int) ([]AISGap, error) {
+	rows, err := db.Query(`
+		SELECT mmsi, started_at, ended_at, start_latitude, start_longitude,
+			   end_latitude, end_longitude, distance_nm, port_unlocode,
+			   EXTRACT(EPOCH FROM COALESCE(ended_at, NOW() AT TIME ZONE 'UTC') - started_at) / 3600
+		FROM ais_gaps
+		WHERE mmsi = $1
+		ORDER BY started_at DESC
+		LIMIT $2`, mmsi, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting AIS gaps: %w", err)
+	}
+	defer rows.Close()
+
+	gaps := []AISGap{}
+	for rows.Next() {
+		var g AISGap
+		if err := rows.Scan(&g.MMSI, &g.StartedAt, &g.EndedAt, &g.StartLatitude, &g.StartLongitude,
+			&g.EndLatitude, &g.EndLongitude, &g.DistanceNM, &g.PortUnlocode, &g.Hours); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, g)
+	}
+	return gaps, rows.Err()
+}
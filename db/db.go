@@ -2,12 +2,20 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// ErrNotFound is wrapped by lookups that match no row, so handlers can
+// tell a missing record apart from a database failure.
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidFilter is wrapped when a query filter or sort key is rejected.
+var ErrInvalidFilter = errors.New("invalid filter")
+
 func InitDB() (*sql.DB, error) {
 
 	connStr := "user=" + os.Getenv("POSTGRES_USER") +
@@ -20,6 +28,29 @@ func InitDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Trigram matching backs the fuzzy vessel name search
+	_, err = db.Exec(`CREATE EXTENSION IF NOT EXISTS pg_trgm`)
+	if err != nil {
+		return nil, err
+	}
+
+	// unaccent is only STABLE, the wrappers pin the dictionary so they can be
+	// used in generated columns and indexes
+	_, err = db.Exec(`
+		CREATE EXTENSION IF NOT EXISTS unaccent;
+
+		CREATE OR REPLACE FUNCTION immutable_unaccent(text) RETURNS text AS
+		$$ SELECT public.unaccent('public.unaccent'::regdictionary, $1) $$
+		LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT;
+
+		CREATE OR REPLACE FUNCTION location_search_text(name text, alternate_names text[]) RETURNS text AS
+		$$ SELECT immutable_unaccent(lower(name || ' ' || array_to_string(COALESCE(alternate_names, '{}'), ' '))) $$
+		LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+	`)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create table with PostGIS support
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS vessel_locations (
 		id SERIAL PRIMARY KEY,
@@ -59,7 +90,7 @@ func InitDB() (*sql.DB, error) {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			maersk_id TEXT,
 			geofence_radius_meters INTEGER DEFAULT 5000, -- 5km
-			UNIQUE(unlocode, name)  -- composite unique constraint,
+			UNIQUE(unlocode)
 		);
 
 		CREATE TABLE IF NOT EXISTS ocean_products (
@@ -81,23 +112,22 @@ func InitDB() (*sql.DB, error) {
 			destination_carrier_city_geo_id TEXT,
 			departure_vessel_carrier_code TEXT,
 			departure_vessel_name TEXT,
-			departure_vessel_imo_number TEXT REFERENCES vessels(imo_number),
-			departure_vessel_mmsi TEXT REFERENCES vessels(mmsi),
+			departure_vessel_imo_number TEXT,
+			departure_vessel_mmsi TEXT,
 			departure_date_time TIMESTAMP,
 			arrival_date_time TIMESTAMP,
 			transit_time INTEGER,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE (origin_port_un_lo_code, destination_port_un_lo_code, departure_vessel_imo_number, departure_date_time, arrival_date_time)
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);
 		CREATE TABLE IF NOT EXISTS transport_legs (
 			id SERIAL PRIMARY KEY,
-			ocean_product_id INTEGER REFERENCES ocean_products(id),
+			ocean_product_id INTEGER REFERENCES ocean_products(id), -- superseded by ocean_product_legs
 			departure_date_time TIMESTAMP,
 			arrival_date_time TIMESTAMP,
 			vessel_carrier_code TEXT,
 			vessel_name TEXT,
-			vessel_imo_number TEXT REFERENCES vessels(imo_number),
-			vessel_mmsi TEXT REFERENCES vessels(mmsi),
+			vessel_imo_number TEXT,
+			vessel_mmsi TEXT,
 			origin_city TEXT,
 			origin_name TEXT,
 			origin_country TEXT,
@@ -110,8 +140,7 @@ func InitDB() (*sql.DB, error) {
 			destination_port_un_lo_code TEXT,
 			destination_carrier_site_geo_id TEXT,
 			destination_carrier_city_geo_id TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE (vessel_imo_number, departure_date_time, arrival_date_time)
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);
 
 
@@ -130,7 +159,8 @@ func InitDB() (*sql.DB, error) {
 		CREATE INDEX IF NOT EXISTS vessel_positions_mmsi_idx ON vessel_positions(mmsi);
 		CREATE INDEX IF NOT EXISTS vessel_positions_timestamp_idx ON vessel_positions(timestamp);
 		CREATE INDEX IF NOT EXISTS vessels_imo_idx ON vessels(imo_number);
-		CREATE INDEX IF NOT EXISTS vessels_mmsi_idx ON vessels(mmsi);	
+		CREATE INDEX IF NOT EXISTS vessels_mmsi_idx ON vessels(mmsi);
+		CREATE INDEX IF NOT EXISTS vessels_name_trgm_idx ON vessels USING gin (name gin_trgm_ops);
 	`)
 	if err != nil {
 		return nil, err
@@ -149,6 +179,415 @@ func InitDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Columns added after the initial schema
+	_, err = db.Exec(`
+		ALTER TABLE ocean_products ADD COLUMN IF NOT EXISTS carrier_code TEXT;
+		ALTER TABLE ocean_products ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+		ALTER TABLE ocean_products ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+		CREATE INDEX IF NOT EXISTS ocean_products_lane_idx
+			ON ocean_products(origin_port_un_lo_code, destination_port_un_lo_code, departure_date_time);
+		CREATE INDEX IF NOT EXISTS transport_legs_ocean_product_id_idx ON transport_legs(ocean_product_id);
+
+		CREATE TABLE IF NOT EXISTS lane_fetches (
+			cache_key TEXT PRIMARY KEY, -- lane and search window, see api.laneKey
+			origin_un_lo_code TEXT NOT NULL,
+			destination_un_lo_code TEXT NOT NULL,
+			fetched_at TIMESTAMP NOT NULL,
+			product_ids INTEGER[] NOT NULL DEFAULT '{}'
+		);
+		ALTER TABLE lane_fetches ADD COLUMN IF NOT EXISTS providers JSONB;
+
+		ALTER TABLE transport_legs ADD COLUMN IF NOT EXISTS transport_mode TEXT;
+		ALTER TABLE transport_legs ADD COLUMN IF NOT EXISTS carrier_service_code TEXT;
+		ALTER TABLE transport_legs ADD COLUMN IF NOT EXISTS carrier_service_name TEXT;
+		ALTER TABLE transport_legs ADD COLUMN IF NOT EXISTS carrier_departure_voyage_number TEXT;
+		ALTER TABLE transport_legs ADD COLUMN IF NOT EXISTS carrier_trade_lane_name TEXT;
+		ALTER TABLE transport_legs ADD COLUMN IF NOT EXISTS link_direction TEXT;
+		-- service loops are rebuilt from the recent legs of a service
+		DROP INDEX IF EXISTS transport_legs_service_idx;
+		CREATE INDEX IF NOT EXISTS transport_legs_service_departure_idx
+			ON transport_legs(carrier_service_code, departure_date_time);
+
+		-- set on every Maersk lookup, a NULL maersk_id with a recent fetch is a known miss
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS maersk_id_fetched_at TIMESTAMP;
+
+		-- where the coordinates come from: unlocode (seeded), gazetteer, carrier or nominatim
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS coordinates_source TEXT;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS coordinates_confidence REAL;
+		UPDATE locations SET coordinates_source = 'unlocode', coordinates_confidence = 1
+		WHERE location IS NOT NULL AND coordinates_source IS NULL;
+
+		-- other spellings: name without diacritics, carrier city names
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS alternate_names TEXT[] NOT NULL DEFAULT '{}';
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS search_text TEXT
+			GENERATED ALWAYS AS (location_search_text(name, alternate_names)) STORED;
+		CREATE INDEX IF NOT EXISTS locations_search_text_trgm_idx ON locations USING gin (search_text gin_trgm_ops);
+		CREATE INDEX IF NOT EXISTS locations_country_code_idx ON locations(country_code);
+
+		-- remaining UN/LOCODE columns, see seeder.parseFunctions for the function flags
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS subdivision TEXT;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS status TEXT;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS iata_code TEXT;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS remarks TEXT;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS unlocode_date DATE;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS is_road_terminal BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS is_postal_exchange BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS is_multimodal BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS is_fixed_transport BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS is_inland_port BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS is_border_crossing BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE INDEX IF NOT EXISTS locations_country_subdivision_idx ON locations(country_code, subdivision);
+
+		CREATE TABLE IF NOT EXISTS geocode_queue (
+			unlocode TEXT PRIMARY KEY,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS geocode_queue_next_attempt_idx ON geocode_queue(next_attempt_at);
+
+		-- coordinates reported by carriers in their schedules, e.g. DCSA locations
+		CREATE TABLE IF NOT EXISTS carrier_locations (
+			unlocode TEXT NOT NULL,
+			carrier_code TEXT NOT NULL,
+			latitude DOUBLE PRECISION NOT NULL,
+			longitude DOUBLE PRECISION NOT NULL,
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (unlocode, carrier_code)
+		);
+
+		-- one row per UN/LOCODE, reference entries and superseded codes are aliases.
+		-- Duplicates from the former (unlocode, name) key keep the enriched row.
+		DELETE FROM locations l USING locations d
+		WHERE l.unlocode = d.unlocode AND l.id <> d.id
+		AND (d.maersk_id IS NOT NULL, d.location IS NOT NULL, -d.id) > (l.maersk_id IS NOT NULL, l.location IS NOT NULL, -l.id);
+		ALTER TABLE locations DROP CONSTRAINT IF EXISTS locations_unlocode_name_key;
+		CREATE UNIQUE INDEX IF NOT EXISTS locations_unlocode_key ON locations(unlocode);
+
+		CREATE TABLE IF NOT EXISTS location_aliases (
+			alias_code TEXT PRIMARY KEY,
+			unlocode TEXT NOT NULL,
+			reason TEXT NOT NULL, -- reference or superseded
+			alias_name TEXT,
+			release TEXT,
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS location_aliases_unlocode_idx ON location_aliases(unlocode);
+
+		-- NGA World Port Index, linked to a UN/LOCODE by its own column or the nearest port
+		CREATE TABLE IF NOT EXISTS wpi_ports (
+			wpi_number INTEGER PRIMARY KEY,
+			unlocode TEXT,
+			linked_by TEXT, -- unlocode or nearest
+			name TEXT NOT NULL,
+			country TEXT,
+			harbor_size TEXT,
+			harbor_type TEXT,
+			max_draft_m REAL,
+			channel_depth_m REAL,
+			cargo_pier_depth_m REAL,
+			max_vessel_length_m REAL,
+			location GEOGRAPHY(POINT, 4326),
+			imported_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS wpi_ports_unlocode_idx ON wpi_ports(unlocode);
+
+		-- port, terminal, berth and anchorage polygons; geofencing prefers them over the radius
+		CREATE TABLE IF NOT EXISTS location_areas (
+			id SERIAL PRIMARY KEY,
+			unlocode TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			name TEXT NOT NULL,
+			source TEXT NOT NULL,
+			area GEOGRAPHY(MULTIPOLYGON, 4326) NOT NULL,
+			properties JSONB NOT NULL DEFAULT '{}',
+			imported_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (unlocode, kind, name)
+		);
+		CREATE INDEX IF NOT EXISTS location_areas_area_idx ON location_areas USING gist (area);
+		-- centroid of the port and terminal polygons, preferred over the UN/LOCODE point
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS area_centroid GEOGRAPHY(POINT, 4326);
+
+		-- AIS motion, NULL when the message reports it as not available
+		ALTER TABLE vessel_positions ADD COLUMN IF NOT EXISTS nav_status SMALLINT;
+		ALTER TABLE vessel_positions ADD COLUMN IF NOT EXISTS sog REAL;
+		ALTER TABLE vessel_positions ADD COLUMN IF NOT EXISTS cog REAL;
+		ALTER TABLE vessel_positions ADD COLUMN IF NOT EXISTS heading SMALLINT;
+		CREATE INDEX IF NOT EXISTS vessel_positions_mmsi_timestamp_idx ON vessel_positions(mmsi, timestamp);
+
+		-- ring around the port geofence where slow vessels are waiting at anchor
+		ALTER TABLE locations ADD COLUMN IF NOT EXISTS anchorage_radius_meters INTEGER DEFAULT 25000;
+		CREATE INDEX IF NOT EXISTS locations_location_idx ON locations USING gist (location);
+
+		-- anchorage and berth stays detected from positions, see services.PortStayDetector
+		CREATE TABLE IF NOT EXISTS port_stays (
+			id SERIAL PRIMARY KEY,
+			mmsi TEXT NOT NULL,
+			unlocode TEXT NOT NULL,
+			kind TEXT NOT NULL, -- anchorage or berth
+			started_at TIMESTAMP NOT NULL,
+			ended_at TIMESTAMP NOT NULL, -- last position of the stay
+			position_count INTEGER NOT NULL DEFAULT 1,
+			closed BOOLEAN NOT NULL DEFAULT FALSE,
+			berth_stay_id INTEGER REFERENCES port_stays(id) ON DELETE SET NULL, -- arrival after an anchorage stay
+			UNIQUE (mmsi, kind, started_at)
+		);
+		CREATE INDEX IF NOT EXISTS port_stays_unlocode_idx ON port_stays(unlocode, kind, started_at);
+		CREATE INDEX IF NOT EXISTS port_stays_mmsi_idx ON port_stays(mmsi, ended_at);
+
+		CREATE TABLE IF NOT EXISTS port_stay_progress (
+			mmsi TEXT PRIMARY KEY,
+			processed_until TIMESTAMP NOT NULL
+		);
+
+		-- AIS silences longer than AIS_GAP_THRESHOLD, see services.DataQualityMonitor
+		CREATE TABLE IF NOT EXISTS ais_gaps (
+			id SERIAL PRIMARY KEY,
+			mmsi TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL, -- last position before the gap
+			ended_at TIMESTAMP, -- first position after it, NULL while the vessel is still dark
+			start_latitude DOUBLE PRECISION NOT NULL,
+			start_longitude DOUBLE PRECISION NOT NULL,
+			end_latitude DOUBLE PRECISION,
+			end_longitude DOUBLE PRECISION,
+			distance_nm REAL,
+			port_unlocode TEXT, -- port stay the gap started in, a vessel at berth often goes quiet
+			UNIQUE (mmsi, started_at)
+		);
+		CREATE INDEX IF NOT EXISTS ais_gaps_mmsi_idx ON ais_gaps(mmsi, started_at DESC);
+
+		-- passages between berth stays at two ports, see services.VoyageSegmenter
+		CREATE TABLE IF NOT EXISTS voyages (
+			id SERIAL PRIMARY KEY,
+			mmsi TEXT NOT NULL,
+			from_unlocode TEXT NOT NULL,
+			to_unlocode TEXT NOT NULL,
+			from_stay_id INTEGER REFERENCES port_stays(id) ON DELETE SET NULL,
+			to_stay_id INTEGER REFERENCES port_stays(id) ON DELETE SET NULL,
+			departed_at TIMESTAMP NOT NULL, -- end of the berth stay at from_unlocode
+			arrived_at TIMESTAMP NOT NULL, -- start of the berth stay at to_unlocode
+			distance_nm REAL NOT NULL,
+			stopped_hours REAL NOT NULL, -- drifting or at anchor on the way
+			avg_speed_knots REAL, -- over the time under way
+			position_count INTEGER NOT NULL,
+			transport_leg_id INTEGER REFERENCES transport_legs(id) ON DELETE SET NULL,
+			UNIQUE (mmsi, departed_at)
+		);
+		CREATE INDEX IF NOT EXISTS voyages_lane_idx ON voyages(from_unlocode, to_unlocode, departed_at);
+		CREATE INDEX IF NOT EXISTS voyages_transport_leg_idx ON voyages(transport_leg_id);
+
+		CREATE TABLE IF NOT EXISTS vessel_data_quality (
+			mmsi TEXT PRIMARY KEY,
+			window_start TIMESTAMP NOT NULL,
+			window_end TIMESTAMP NOT NULL,
+			position_count INTEGER NOT NULL,
+			messages_per_hour REAL NOT NULL,
+			gap_count INTEGER NOT NULL,
+			gap_hours REAL NOT NULL,
+			gap_ratio REAL NOT NULL,
+			outlier_count INTEGER NOT NULL,
+			score REAL NOT NULL, -- 0 to 100
+			dark_since TIMESTAMP, -- start of the open gap
+			trust_eta BOOLEAN NOT NULL DEFAULT FALSE,
+			computed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- one row per UN/LOCODE seeding attempt, see seeder.Seed
+		CREATE TABLE IF NOT EXISTS seeding_runs (
+			id SERIAL PRIMARY KEY,
+			file_name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			release TEXT,
+			status TEXT NOT NULL, -- applied, unchanged or failed
+			total_records INTEGER NOT NULL DEFAULT 0,
+			valid_coordinates INTEGER NOT NULL DEFAULT 0,
+			invalid_coordinates INTEGER NOT NULL DEFAULT 0,
+			skipped_records INTEGER NOT NULL DEFAULT 0,
+			inserted INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL DEFAULT 0,
+			deleted INTEGER NOT NULL DEFAULT 0,
+			processing_ms BIGINT NOT NULL DEFAULT 0,
+			database_ms BIGINT NOT NULL DEFAULT 0,
+			error TEXT,
+			started_at TIMESTAMP NOT NULL,
+			finished_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS seeding_runs_started_at_idx ON seeding_runs(started_at);
+		ALTER TABLE seeding_runs ADD COLUMN IF NOT EXISTS aliases INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE seeding_runs ADD COLUMN IF NOT EXISTS removed INTEGER NOT NULL DEFAULT 0;
+
+		-- append-only history of each sailing as the carriers returned it, see
+		-- services.ScheduleHistory; a new version is written only on a change
+		ALTER TABLE ocean_products ADD COLUMN IF NOT EXISTS sailing_key TEXT;
+		CREATE INDEX IF NOT EXISTS ocean_products_sailing_key_idx ON ocean_products(sailing_key);
+		CREATE TABLE IF NOT EXISTS schedule_versions (
+			id SERIAL PRIMARY KEY,
+			sailing_key TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			ocean_product_id INTEGER REFERENCES ocean_products(id) ON DELETE SET NULL,
+			carrier_code TEXT,
+			origin_un_lo_code TEXT,
+			destination_un_lo_code TEXT,
+			departure_date_time TIMESTAMP,
+			arrival_date_time TIMESTAMP,
+			vessel_name TEXT,
+			vessel_imo_number TEXT,
+			snapshot JSONB NOT NULL, -- product and legs
+			changes JSONB NOT NULL DEFAULT '[]', -- field-level diff against the previous version
+			observed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (sailing_key, version)
+		);
+		CREATE INDEX IF NOT EXISTS schedule_versions_observed_at_idx ON schedule_versions(observed_at);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	// A transport leg is one movement, shared by every product routed over
+	// it, so products reference their legs through ocean_product_legs. The
+	// legacy ocean_product_id of a leg is moved there once and cleared.
+	// Products are told apart by carrier as well, and legs and products
+	// without a vessel IMO are deduplicated like the others. The vessels a
+	// schedule names are looked up in the background, so they need not be
+	// stored when it is.
+	_, err = db.Exec(`
+		ALTER TABLE ocean_products DROP CONSTRAINT IF EXISTS ocean_products_departure_vessel_imo_number_fkey;
+		ALTER TABLE ocean_products DROP CONSTRAINT IF EXISTS ocean_products_departure_vessel_mmsi_fkey;
+		ALTER TABLE transport_legs DROP CONSTRAINT IF EXISTS transport_legs_vessel_imo_number_fkey;
+		ALTER TABLE transport_legs DROP CONSTRAINT IF EXISTS transport_legs_vessel_mmsi_fkey;
+
+		CREATE TABLE IF NOT EXISTS ocean_product_legs (
+			ocean_product_id INTEGER NOT NULL REFERENCES ocean_products(id) ON DELETE CASCADE,
+			sequence SMALLINT NOT NULL, -- position of the leg in the product, from 0
+			transport_leg_id INTEGER NOT NULL REFERENCES transport_legs(id) ON DELETE CASCADE,
+			PRIMARY KEY (ocean_product_id, sequence)
+		);
+		CREATE INDEX IF NOT EXISTS ocean_product_legs_leg_idx ON ocean_product_legs(transport_leg_id);
+
+		INSERT INTO ocean_product_legs (ocean_product_id, sequence, transport_leg_id)
+		SELECT ocean_product_id,
+			   ROW_NUMBER() OVER (PARTITION BY ocean_product_id ORDER BY departure_date_time, id) - 1,
+			   id
+		FROM transport_legs
+		WHERE ocean_product_id IS NOT NULL
+		ON CONFLICT DO NOTHING;
+		UPDATE transport_legs SET ocean_product_id = NULL WHERE ocean_product_id IS NOT NULL;
+
+		DO $$
+		DECLARE c record;
+		BEGIN
+			IF to_regclass('transport_legs_movement_key') IS NULL THEN
+				FOR c IN SELECT conname FROM pg_constraint WHERE conrelid = 'transport_legs'::regclass AND contype = 'u' LOOP
+					EXECUTE format('ALTER TABLE transport_legs DROP CONSTRAINT %I', c.conname);
+				END LOOP;
+
+				CREATE TEMP TABLE leg_duplicates ON COMMIT DROP AS
+				SELECT id, keep FROM (
+					SELECT id, FIRST_VALUE(id) OVER (
+						PARTITION BY COALESCE(vessel_imo_number, ''), COALESCE(transport_mode, ''),
+							origin_port_un_lo_code, destination_port_un_lo_code, departure_date_time, arrival_date_time
+						ORDER BY id DESC) AS keep
+					FROM transport_legs
+				) d WHERE id <> keep;
+				UPDATE ocean_product_legs pl SET transport_leg_id = d.keep FROM leg_duplicates d WHERE pl.transport_leg_id = d.id;
+				UPDATE voyages v SET transport_leg_id = d.keep FROM leg_duplicates d WHERE v.transport_leg_id = d.id;
+				DELETE FROM transport_legs t USING leg_duplicates d WHERE t.id = d.id;
+
+				CREATE UNIQUE INDEX transport_legs_movement_key ON transport_legs (
+					(COALESCE(vessel_imo_number, '')), (COALESCE(transport_mode, '')),
+					origin_port_un_lo_code, destination_port_un_lo_code, departure_date_time, arrival_date_time);
+			END IF;
+
+			IF to_regclass('ocean_products_identity_key') IS NULL THEN
+				FOR c IN SELECT conname FROM pg_constraint WHERE conrelid = 'ocean_products'::regclass AND contype = 'u' LOOP
+					EXECUTE format('ALTER TABLE ocean_products DROP CONSTRAINT %I', c.conname);
+				END LOOP;
+
+				CREATE TEMP TABLE product_duplicates ON COMMIT DROP AS
+				SELECT id, keep FROM (
+					SELECT id, FIRST_VALUE(id) OVER (
+						PARTITION BY COALESCE(carrier_code, ''), origin_port_un_lo_code, destination_port_un_lo_code,
+							COALESCE(departure_vessel_imo_number, ''), departure_date_time, arrival_date_time
+						ORDER BY id DESC) AS keep
+					FROM ocean_products
+				) d WHERE id <> keep;
+				UPDATE vessel_routes r SET ocean_product_id = d.keep FROM product_duplicates d WHERE r.ocean_product_id = d.id;
+				UPDATE schedule_versions v SET ocean_product_id = d.keep FROM product_duplicates d WHERE v.ocean_product_id = d.id;
+				DELETE FROM ocean_products op USING product_duplicates d WHERE op.id = d.id;
+
+				CREATE UNIQUE INDEX ocean_products_identity_key ON ocean_products (
+					(COALESCE(carrier_code, '')), origin_port_un_lo_code, destination_port_un_lo_code,
+					(COALESCE(departure_vessel_imo_number, '')), departure_date_time, arrival_date_time);
+			END IF;
+		END $$;
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	// vessel_routes links stored vessels to the products they serve, as the
+	// departure vessel or on a leg; filled when either side is written and
+	// backfilled here the first time
+	_, err = db.Exec(`
+		ALTER TABLE vessel_routes ADD COLUMN IF NOT EXISTS transport_leg_id INTEGER REFERENCES transport_legs(id) ON DELETE CASCADE;
+		CREATE INDEX IF NOT EXISTS vessel_routes_vessel_idx ON vessel_routes(vessel_id);
+		CREATE INDEX IF NOT EXISTS vessel_routes_product_idx ON vessel_routes(ocean_product_id);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	if err := linkVesselRoutes(db, "NOT EXISTS (SELECT 1 FROM vessel_routes)"); err != nil {
+		return nil, err
+	}
+
+	// Vessel particulars, and the history of the MMSIs, names, call signs
+	// and flags a vessel went by. vessels keeps the current identity; the
+	// history is seeded with it the first time. Positions keep the MMSI they
+	// were reported under, so they no longer reference vessels(mmsi).
+	_, err = db.Exec(`
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS call_sign TEXT;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS flag TEXT; -- ISO 3166 alpha-2, from carriers
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS ship_type INTEGER; -- AIS ship and cargo type
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS length_m REAL;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS beam_m REAL;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS draught_m REAL; -- maximum static draught
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS dwt INTEGER;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS teu INTEGER;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS build_year SMALLINT;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS particulars_source TEXT;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS particulars_updated_at TIMESTAMP;
+		ALTER TABLE vessels ADD COLUMN IF NOT EXISTS ais_static_at TIMESTAMP; -- last AIS static report
+
+		ALTER TABLE vessel_positions DROP CONSTRAINT IF EXISTS vessel_positions_mmsi_fkey;
+
+		CREATE TABLE IF NOT EXISTS vessel_identities (
+			id SERIAL PRIMARY KEY,
+			vessel_id INTEGER NOT NULL REFERENCES vessels(id) ON DELETE CASCADE,
+			mmsi TEXT,
+			name TEXT,
+			call_sign TEXT,
+			flag TEXT,
+			source TEXT NOT NULL, -- AIS or CARRIER, whichever reported the change
+			valid_from TIMESTAMP NOT NULL,
+			valid_to TIMESTAMP, -- NULL for the current identity
+			last_seen_at TIMESTAMP NOT NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS vessel_identities_current_idx
+			ON vessel_identities(vessel_id) WHERE valid_to IS NULL;
+		CREATE INDEX IF NOT EXISTS vessel_identities_mmsi_idx ON vessel_identities(mmsi);
+
+		INSERT INTO vessel_identities (vessel_id, mmsi, name, source, valid_from, last_seen_at)
+		SELECT v.id, NULLIF(v.mmsi, ''), NULLIF(v.name, ''), 'CARRIER',
+			COALESCE(v.created_at, CURRENT_TIMESTAMP), COALESCE(v.last_seen, CURRENT_TIMESTAMP)
+		FROM vessels v
+		WHERE NOT EXISTS (SELECT 1 FROM vessel_identities i WHERE i.vessel_id = v.id);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
 	db.SetMaxOpenConns(25)
 
 	// Set a reasonable idle timeout
@@ -165,6 +604,8 @@ type Vessel struct {
 	IMONumber         string    `db:"imo_number"`
 	MMSI              string    `db:"mmsi"`
 	Name              string    `db:"name"`
+	CallSign          string    `db:"call_sign"`
+	Flag              string    `db:"flag"`
 	IsTracked         bool      `db:"is_tracked"`
 	CarrierCode       string    `db:"carrier_code"`
 	AppearanceCount   int       `db:"appearance_count"`
@@ -197,7 +638,10 @@ type OceanProduct struct {
 	DepartureDateTime           time.Time `db:"departure_date_time"`
 	ArrivalDateTime             time.Time `db:"arrival_date_time"`
 	TransitTime                 int       `db:"transit_time"`
+	CarrierCode                 string    `db:"carrier_code"`
 	CreatedAt                   time.Time `db:"created_at"`
+	UpdatedAt                   time.Time `db:"updated_at"`
+	LastSeenAt                  time.Time `db:"last_seen_at"`
 }
 
 type TransportLeg struct {
@@ -232,6 +676,11 @@ type VesselPosition struct {
 	Longitude float64   `db:"longitude"`
 	Timestamp time.Time `db:"timestamp"`
 	CreatedAt time.Time `db:"created_at"`
+	// AIS navigational status, 1 at anchor, 5 moored
+	NavStatus *int     `db:"nav_status"`
+	Sog       *float64 `db:"sog"` // knots
+	Cog       *float64 `db:"cog"`
+	Heading   *int     `db:"heading"`
 }
 
 type VesselRoute struct {
@@ -239,5 +688,6 @@ type VesselRoute struct {
 	VesselID       int       `db:"vessel_id"`
 	OceanProductID int       `db:"ocean_product_id"`
 	RouteType      string    `db:"route_type"`
+	TransportLegID *int      `db:"transport_leg_id"` // set for TRANSPORT_LEG
 	CreatedAt      time.Time `db:"created_at"`
 }
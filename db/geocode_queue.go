@@ -0,0 +1,157 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GeocodeJob is a location waiting for coordinates.
+type GeocodeJob struct {
+	Unlocode    string
+	Name        string
+	CountryCode string
+	Attempts    int
+}
+
+// EnqueueGeocoding queues the given locations that have no coordinates yet.
+// Locations already queued keep their schedule.
+func EnqueueGeocoding(db *sql.DB, unLoCodes []string) (int64, error) {
+	if len(unLoCodes) == 0 {
+		return 0, nil
+	}
+	res, err := db.Exec(`
+		INSERT INTO geocode_queue (unlocode)
+		SELECT DISTINCT unlocode FROM locations
+		WHERE unlocode = ANY ($1) AND location IS NULL
+		ON CONFLICT (unlocode) DO NOTHING`, pq.Array(unLoCodes))
+	if err != nil {
+		return 0, fmt.Errorf("error queueing geocoding: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// EnqueueAllMissingCoordinates queues every location without coordinates.
+func EnqueueAllMissingCoordinates(db *sql.DB) (int64, error) {
+	res, err := db.Exec(`
+		INSERT INTO geocode_queue (unlocode)
+		SELECT DISTINCT unlocode FROM locations
+		WHERE location IS NULL
+		ON CONFLICT (unlocode) DO NOTHING`)
+	if err != nil {
+		return 0, fmt.Errorf("error queueing geocoding: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// PruneGeocodeQueue drops the jobs whose location got coordinates in the
+// meantime, from another geocoder run or the seeder.
+func PruneGeocodeQueue(db *sql.DB) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM geocode_queue q
+		USING locations l
+		WHERE l.unlocode = q.unlocode AND l.location IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("error pruning geocode queue: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// NextGeocodeJob returns the job due the longest, or ErrNotFound when none
+// is due.
+func NextGeocodeJob(db *sql.DB) (GeocodeJob, error) {
+	var job GeocodeJob
+	err := db.QueryRow(`
+		SELECT q.unlocode, l.name, l.country_code, q.attempts
+		FROM geocode_queue q
+		JOIN LATERAL (
+			SELECT name, country_code FROM locations
+			WHERE unlocode = q.unlocode
+			ORDER BY id
+			LIMIT 1
+		) l ON true
+		WHERE q.next_attempt_at <= NOW()
+		ORDER BY q.next_attempt_at
+		LIMIT 1`).Scan(&job.Unlocode, &job.Name, &job.CountryCode, &job.Attempts)
+	if err == sql.ErrNoRows {
+		return GeocodeJob{}, fmt.Errorf("geocode job %w", ErrNotFound)
+	}
+	if err != nil {
+		return GeocodeJob{}, fmt.Errorf("error getting geocode job: %w", err)
+	}
+	return job, nil
+}
+
+// CompleteGeocodeJob stores the coordinates found for a location, with their
+// source and confidence, and removes it from the queue.
+func CompleteGeocodeJob(db *sql.DB, unlocode string, latitude, longitude float64, source string, confidence float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE locations
+		SET location = ST_SetSRID(ST_MakePoint($3, $2), 4326),
+			coordinates_source = $4,
+			coordinates_confidence = $5
+		WHERE unlocode = $1 AND location IS NULL`, unlocode, latitude, longitude, source, confidence)
+	if err != nil {
+		return fmt.Errorf("error storing coordinates: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM geocode_queue WHERE unlocode = $1`, unlocode); err != nil {
+		return fmt.Errorf("error removing geocode job: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// RetryGeocodeJob records a failed attempt and when to try again.
+func RetryGeocodeJob(db *sql.DB, unlocode string, lastError string, next time.Time) error {
+	_, err := db.Exec(`
+		UPDATE geocode_queue
+		SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+		WHERE unlocode = $1`, unlocode, lastError, next)
+	if err != nil {
+		return fmt.Errorf("error rescheduling geocode job: %w", err)
+	}
+	return nil
+}
+
+// RecordCarrierLocation keeps the coordinates a carrier reported for a
+// location, the latest report winning.
+func RecordCarrierLocation(db *sql.DB, carrierCode, unlocode string, latitude, longitude float64) error {
+	_, err := db.Exec(`
+		INSERT INTO carrier_locations (unlocode, carrier_code, latitude, longitude)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (unlocode, carrier_code) DO UPDATE SET
+			latitude = EXCLUDED.latitude,
+			longitude = EXCLUDED.longitude,
+			updated_at = NOW()`, unlocode, carrierCode, latitude, longitude)
+	if err != nil {
+		return fmt.Errorf("error recording carrier location: %w", err)
+	}
+	return nil
+}
+
+// GetCarrierLocation returns the most recent carrier coordinates of a
+// location and the carrier that reported them.
+func GetCarrierLocation(db *sql.DB, unlocode string) (latitude, longitude float64, carrierCode string, err error) {
+	err = db.QueryRow(`
+		SELECT latitude, longitude, carrier_code
+		FROM carrier_locations
+		WHERE unlocode = $1
+		ORDER BY updated_at DESC
+		LIMIT 1`, unlocode).Scan(&latitude, &longitude, &carrierCode)
+	if err == sql.ErrNoRows {
+		return 0, 0, "", fmt.Errorf("carrier location %w", ErrNotFound)
+	}
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error getting carrier location: %w", err)
+	}
+	return latitude, longitude, carrierCode, nil
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LaneFetch records the last time a lane search was answered by the carriers.
+type LaneFetch struct {
+	CacheKey    string
+	Origin      string
+	Destination string
+	FetchedAt   time.Time
+	Age         time.Duration
+	ProductIDs  []int64         // ocean_products returned by the fetch
+	Providers   json.RawMessage // per provider report of the fetch
+}
+
+func GetLaneFetch(db *sql.DB, cacheKey string) (LaneFetch, error) {
+	var f LaneFetch
+	var ageSeconds float64
+	var providers []byte
+	err := db.QueryRow(`
+		SELECT cache_key, origin_un_lo_code, destination_un_lo_code, fetched_at, product_ids,
+			   COALESCE(providers, '[]'::jsonb),
+			   EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - fetched_at)
+		FROM lane_fetches
+		WHERE cache_key = $1`, cacheKey).Scan(
+		&f.CacheKey, &f.Origin, &f.Destination, &f.FetchedAt, pq.Array(&f.ProductIDs), &providers, &ageSeconds)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return LaneFetch{}, fmt.Errorf("lane fetch %w", ErrNotFound)
+		}
+		return LaneFetch{}, fmt.Errorf("error getting lane fetch: %w", err)
+	}
+
+	f.Providers = json.RawMessage(providers)
+	f.Age = time.Duration(ageSeconds * float64(time.Second))
+	return f, nil
+}
+
+func RecordLaneFetch(db *sql.DB, cacheKey, origin, destination string, productIDs []int64, providers json.RawMessage) error {
+	_, err := db.Exec(`
+		INSERT INTO lane_fetches (cache_key, origin_un_lo_code, destination_un_lo_code, fetched_at, product_ids, providers)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4, $5)
+		ON CONFLICT (cache_key) DO UPDATE SET
+			fetched_at = CURRENT_TIMESTAMP,
+			product_ids = EXCLUDED.product_ids,
+			providers = EXCLUDED.providers`,
+		cacheKey, origin, destination, pq.Array(productIDs), []byte(providers))
+	if err != nil {
+		return fmt.Errorf("error recording lane fetch: %w", err)
+	}
+	return nil
+}
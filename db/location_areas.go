@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// PortDetails is the World Port Index entry linked to a location.
+type PortDetails struct {
+	WPINumber        int       `json:"wpi_number"`
+	Name             string    `json:"name"`
+	LinkedBy         string    `json:"linked_by"` // unlocode or nearest
+	HarborSize       string    `json:"harbor_size,omitempty"`
+	HarborType       string    `json:"harbor_type,omitempty"`
+	MaxDraftM        *float64  `json:"max_draft_m,omitempty"`
+	ChannelDepthM    *float64  `json:"channel_depth_m,omitempty"`
+	CargoPierDepthM  *float64  `json:"cargo_pier_depth_m,omitempty"`
+	MaxVesselLengthM *float64  `json:"max_vessel_length_m,omitempty"`
+	Location         []float64 `json:"location"`
+}
+
+// GetPortDetails returns the World Port Index entry of a location, the one
+// linked by its UN/LOCODE before one linked by distance.
+func GetPortDetails(db *sql.DB, unlocode string) (*PortDetails, error) {
+	var p PortDetails
+	var lat, lon float64
+	err := db.QueryRow(`
+		SELECT wpi_number, name, linked_by, COALESCE(harbor_size, ''), COALESCE(harbor_type, ''),
+			   max_draft_m, channel_depth_m, cargo_pier_depth_m, max_vessel_length_m,
+			   ST_Y(location::geometry), ST_X(location::geometry)
+		FROM wpi_ports
+		WHERE unlocode = $1 AND linked_by IS NOT NULL
+		ORDER BY linked_by = 'unlocode' DESC, wpi_number
+		LIMIT 1`, unlocode).Scan(
+		&p.WPINumber, &p.Name, &p.LinkedBy, &p.HarborSize, &p.HarborType,
+		&p.MaxDraftM, &p.ChannelDepthM, &p.CargoPierDepthM, &p.MaxVesselLengthM,
+		&lat, &lon)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("port details %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting port details: %w", err)
+	}
+	p.Location = []float64{lat, lon}
+	return &p, nil
+}
+
+// LocationArea is a port, terminal, berth or anchorage polygon.
+type LocationArea struct {
+	ID         int             `json:"id"`
+	Unlocode   string          `json:"unlocode"`
+	Kind       string          `json:"kind"`
+	Name       string          `json:"name"`
+	Source     string          `json:"source"`
+	Geometry   json.RawMessage `json:"geometry"` // GeoJSON MultiPolygon
+	Properties json.RawMessage `json:"properties"`
+}
+
+func GetLocationAreas(db *sql.DB, unlocode string) ([]LocationArea, error) {
+	rows, err := db.Query(`
+		SELECT id, unlocode, kind, name, source, ST_AsGeoJSON(area), properties
+		FROM location_areas
+		WHERE unlocode = $1
+		ORDER BY array_position(ARRAY['port', 'anchorage', 'terminal', 'berth'], kind), name`, unlocode)
+	if err != nil {
+		return nil, fmt.Errorf("error getting location areas: %w", err)
+	}
+	defer rows.Close()
+
+	areas := []LocationArea{}
+	for rows.Next() {
+		var a LocationArea
+		var geometry, properties string
+		if err := rows.Scan(&a.ID, &a.Unlocode, &a.Kind, &a.Name, &a.Source, &geometry, &properties); err != nil {
+			return nil, err
+		}
+		a.Geometry = json.RawMessage(geometry)
+		a.Properties = json.RawMessage(properties)
+		areas = append(areas, a)
+	}
+	return areas, rows.Err()
+}
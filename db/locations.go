@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/Sraiti/vesselTracker/models"
@@ -21,24 +22,34 @@ func UpsertLocations(db *sql.DB, locations []models.MaerskLocation) error {
 	// Prepare the bulk update query
 	query := `
 		UPDATE locations 
-		SET maersk_id = tmp.maersk_id 
+		SET maersk_id = tmp.maersk_id, maersk_id_fetched_at = NOW(),
+			alternate_names = ARRAY(
+				SELECT DISTINCT n FROM unnest(locations.alternate_names || ARRAY[tmp.city_name, tmp.location_name]) n
+				WHERE n <> '' AND lower(n) <> lower(locations.name)
+			)
 		FROM (
 			SELECT unnest($1::text[]) as unlocode,
-				   unnest($2::text[]) as maersk_id
+				   unnest($2::text[]) as maersk_id,
+				   unnest($3::text[]) as city_name,
+				   unnest($4::text[]) as location_name
 		) tmp 
 		WHERE locations.unlocode = tmp.unlocode`
 
 	// Prepare the parameter arrays
 	unlocodes := make([]string, len(locations))
 	maerskIDs := make([]string, len(locations))
+	cityNames := make([]string, len(locations))
+	locationNames := make([]string, len(locations))
 
 	for i, loc := range locations {
 		unlocodes[i] = loc.UNLocationCode
 		maerskIDs[i] = loc.CarrierGeoID
+		cityNames[i] = loc.CityName
+		locationNames[i] = loc.LocationName
 	}
 
 	// Execute the bulk update
-	_, err := db.Exec(query, pq.Array(unlocodes), pq.Array(maerskIDs))
+	_, err := db.Exec(query, pq.Array(unlocodes), pq.Array(maerskIDs), pq.Array(cityNames), pq.Array(locationNames))
 	if err != nil {
 		log.Printf("Error performing bulk upsert: %v", err)
 		return err
@@ -47,6 +58,51 @@ func UpsertLocations(db *sql.DB, locations []models.MaerskLocation) error {
 	return nil
 }
 
+// RecordMaerskIDMisses marks locations Maersk has no ID for, so they are not
+// looked up again before the negative cache expires. Known IDs are kept.
+func RecordMaerskIDMisses(db *sql.DB, unLoCodes []string) error {
+	if len(unLoCodes) == 0 {
+		return nil
+	}
+	_, err := db.Exec(`
+		UPDATE locations SET maersk_id_fetched_at = NOW()
+		WHERE unlocode = ANY ($1)`, pq.Array(unLoCodes))
+	if err != nil {
+		return fmt.Errorf("error recording Maersk ID misses: %w", err)
+	}
+	return nil
+}
+
+// LocationsNeedingMaerskID filters unLoCodes down to the known locations
+// without a Maersk ID whose last lookup is older than missTTL.
+func LocationsNeedingMaerskID(db *sql.DB, unLoCodes []string, missTTL time.Duration) ([]string, error) {
+	if len(unLoCodes) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT unlocode
+		FROM locations
+		WHERE unlocode = ANY ($1)
+		  AND maersk_id IS NULL
+		  AND (maersk_id_fetched_at IS NULL OR maersk_id_fetched_at < NOW() - make_interval(secs => $2))`,
+		pq.Array(unLoCodes), missTTL.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error getting locations without Maersk ID: %w", err)
+	}
+	defer rows.Close()
+
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
 func GetLocations(db *sql.DB, unLoCodes []string) ([]Location, error) {
 	log.Println("Getting locations")
 
@@ -90,78 +146,264 @@ func GetLocations(db *sql.DB, unLoCodes []string) ([]Location, error) {
 	return locations, nil
 }
 
-func UpdateLocationCoordinates(db *sql.DB, unlocode string, latitude, longitude float64) error {
-	_, err := db.Exec(`
-        UPDATE locations 
-        SET location = ST_SetSRID(ST_MakePoint($3, $2), 4326)
-        WHERE unlocode = $1 AND location IS NULL
-    `, unlocode, latitude, longitude)
+// GetLocationCoordinates returns [lat, lon] by UN/LOCODE for the locations
+// that have been geocoded, the centroid of their polygons first.
+func GetLocationCoordinates(db *sql.DB, unLoCodes []string) (map[string][]float64, error) {
+	coordinates := make(map[string][]float64)
+	if len(unLoCodes) == 0 {
+		return coordinates, nil
+	}
 
+	rows, err := db.Query(`
+		SELECT unlocode,
+			   ST_Y(COALESCE(area_centroid, location)::geometry),
+			   ST_X(COALESCE(area_centroid, location)::geometry)
+		FROM locations
+		WHERE unlocode = ANY ($1) AND COALESCE(area_centroid, location) IS NOT NULL`, pq.Array(unLoCodes))
 	if err != nil {
-		return fmt.Errorf("error updating location coordinates: %w", err)
+		return nil, fmt.Errorf("error getting location coordinates: %w", err)
 	}
-	return nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var unlocode string
+		var lat, lon float64
+		if err := rows.Scan(&unlocode, &lat, &lon); err != nil {
+			return nil, err
+		}
+		coordinates[unlocode] = []float64{lat, lon}
+	}
+	return coordinates, rows.Err()
 }
 
-func AutoComplete(db *sql.DB, text string) ([]Location, error) {
-	query := `
-		SELECT id, unlocode, name, country_code, 
-			   is_airport, is_port, is_train_station, created_at,
-			   CASE 
-                WHEN location IS NOT NULL 
-                THEN ARRAY[ST_Y(location::geometry), ST_X(location::geometry)]
-                 ELSE ARRAY[]::float8[]
-            END as location 
-		FROM locations 
-		WHERE 
-			unlocode ILIKE $1 OR 
-			country_code ILIKE $1 OR 
-			name ILIKE $1 AND is_port = true
-		LIMIT 10
-	`
-
-	// Add % after the search term for prefix matching
-	searchPattern := text + "%"
-
-	rows, err := db.Query(query, searchPattern)
+// locationColumns is the full location row read by GetLocation and
+// AutoComplete, table aliased as l; see scanLocation.
+const locationColumns = `l.id, l.unlocode, l.name, l.country_code,
+	COALESCE(l.subdivision, ''), COALESCE(l.status, ''), COALESCE(l.iata_code, ''), l.unlocode_date,
+	l.is_port, l.is_train_station, l.is_road_terminal, l.is_airport, l.is_postal_exchange,
+	l.is_multimodal, l.is_fixed_transport, l.is_inland_port, l.is_border_crossing,
+	l.created_at, COALESCE(l.maersk_id, ''), l.maersk_id_fetched_at,
+	CASE WHEN l.area_centroid IS NOT NULL THEN 'area' ELSE COALESCE(l.coordinates_source, '') END,
+	CASE WHEN l.area_centroid IS NOT NULL THEN 1 ELSE l.coordinates_confidence END,
+	l.alternate_names, l.area_centroid IS NOT NULL,
+	CASE
+		WHEN COALESCE(l.area_centroid, l.location) IS NOT NULL
+		THEN ARRAY[ST_Y(COALESCE(l.area_centroid, l.location)::geometry), ST_X(COALESCE(l.area_centroid, l.location)::geometry)]
+		ELSE ARRAY[]::float8[]
+	END`
+
+func scanLocation(row rowScanner) (Location, error) {
+	var loc Location
+	err := row.Scan(
+		&loc.ID,
+		&loc.Unlocode,
+		&loc.Name,
+		&loc.CountryCode,
+		&loc.Subdivision,
+		&loc.Status,
+		&loc.IATACode,
+		&loc.UnlocodeDate,
+		&loc.IsPort,
+		&loc.IsTrainStation,
+		&loc.IsRoadTerminal,
+		&loc.IsAirport,
+		&loc.IsPostalExchange,
+		&loc.IsMultimodal,
+		&loc.IsFixedTransport,
+		&loc.IsInlandPort,
+		&loc.IsBorderCrossing,
+		&loc.CreatedAt,
+		&loc.MaerskID,
+		&loc.MaerskIDFetchedAt,
+		&loc.CoordinatesSource,
+		&loc.CoordinatesConfidence,
+		pq.Array(&loc.AlternateNames),
+		&loc.HasArea,
+		pq.Array(&loc.Location),
+	)
+	return loc, err
+}
+
+// GetLocation returns the location of a UN/LOCODE, following aliases; see
+// ResolveUnLoCodes.
+func GetLocation(db *sql.DB, unlocode string) (Location, error) {
+	loc, err := scanLocation(db.QueryRow(`
+		SELECT `+locationColumns+`
+		FROM locations l
+		WHERE l.unlocode = COALESCE((SELECT unlocode FROM location_aliases WHERE alias_code = $1), $1)
+		LIMIT 1`, unlocode))
+
 	if err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			return Location{}, fmt.Errorf("location %w", ErrNotFound)
+		}
+		return Location{}, fmt.Errorf("error getting location: %w", err)
+	}
+	if loc.Unlocode != unlocode {
+		loc.ResolvedFrom = unlocode
+	}
+
+	return loc, nil
+}
+
+// ResolveUnLoCodes maps the codes among unLoCodes that are aliases, from
+// UN/LOCODE reference entries or superseded codes, to their live code.
+// Other codes are left out.
+func ResolveUnLoCodes(db *sql.DB, unLoCodes []string) (map[string]string, error) {
+	resolved := make(map[string]string)
+	if len(unLoCodes) == 0 {
+		return resolved, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT alias_code, unlocode FROM location_aliases
+		WHERE alias_code = ANY ($1)`, pq.Array(unLoCodes))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving location aliases: %w", err)
 	}
 	defer rows.Close()
 
-	var locations []Location
 	for rows.Next() {
-		var loc Location
-		err := rows.Scan(
-			&loc.ID,
-			&loc.Unlocode,
-			&loc.Name,
-			&loc.CountryCode,
-			&loc.IsAirport,
-			&loc.IsPort,
-			&loc.IsTrainStation,
-			&loc.CreatedAt,
-			pq.Array(&loc.Location),
-		)
+		var alias, unlocode string
+		if err := rows.Scan(&alias, &unlocode); err != nil {
+			return nil, err
+		}
+		resolved[alias] = unlocode
+	}
+	return resolved, rows.Err()
+}
+
+// Location functions the autocomplete can filter on, mapped to their column
+var locationFunctionColumns = map[string]string{
+	"port":        "is_port",
+	"rail":        "is_train_station",
+	"road":        "is_road_terminal",
+	"airport":     "is_airport",
+	"postal":      "is_postal_exchange",
+	"multimodal":  "is_multimodal",
+	"icd":         "is_multimodal", // inland container depots are multimodal locations
+	"fixed":       "is_fixed_transport",
+	"inland_port": "is_inland_port",
+	"border":      "is_border_crossing",
+}
+
+type LocationFilter struct {
+	Text        string
+	CountryCode string
+	Subdivision string
+	Status      string
+	// any of the keys of locationFunctionColumns
+	Functions []string
+	Limit     int
+}
+
+// AutoComplete ranks locations against free text: an exact UN/LOCODE first,
+// then code prefixes, name prefixes and trigram similarity over the name and
+// its alternate names, accents ignored, with a bonus for ports.
+func AutoComplete(db *sql.DB, filter LocationFilter) ([]Location, error) {
+	args := []interface{}{filter.Text}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{`(l.unlocode LIKE q.code || '%' ESCAPE '\'
+			OR l.unlocode = q.alias
+			OR q.t <% l.search_text
+			OR l.search_text LIKE '%' || q.pattern || '%' ESCAPE '\')`}
+
+	if filter.CountryCode != "" {
+		where = append(where, "l.country_code = "+arg(strings.ToUpper(filter.CountryCode)))
+	}
+	if filter.Subdivision != "" {
+		where = append(where, "l.subdivision = "+arg(strings.ToUpper(filter.Subdivision)))
+	}
+	if filter.Status != "" {
+		where = append(where, "l.status = "+arg(strings.ToUpper(filter.Status)))
+	}
+	if len(filter.Functions) > 0 {
+		var any []string
+		for _, f := range filter.Functions {
+			column, ok := locationFunctionColumns[strings.ToLower(strings.TrimSpace(f))]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown location function %q", ErrInvalidFilter, f)
+			}
+			any = append(any, "l."+column)
+		}
+		where = append(where, "("+strings.Join(any, " OR ")+")")
+	}
+
+	rows, err := db.Query(`
+		SELECT `+locationColumns+`
+		FROM locations l, (
+			SELECT immutable_unaccent(lower($1)) AS t,
+				   upper(regexp_replace($1, '([%_\\])', '\\\1', 'g')) AS code,
+				   immutable_unaccent(lower(regexp_replace($1, '([%_\\])', '\\\1', 'g'))) AS pattern,
+				   (SELECT unlocode FROM location_aliases WHERE alias_code = upper($1)) AS alias
+		) q
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY
+			(l.unlocode = upper($1) OR l.unlocode IS NOT DISTINCT FROM q.alias) DESC,
+			(CASE WHEN l.unlocode LIKE q.code || '%' ESCAPE '\' THEN 0.5 ELSE 0 END
+			 + CASE WHEN immutable_unaccent(lower(l.name)) LIKE q.pattern || '%' ESCAPE '\' THEN 0.4 ELSE 0 END
+			 + word_similarity(q.t, l.search_text)
+			 + CASE WHEN l.is_port THEN 0.3 ELSE 0 END
+			 + CASE WHEN l.area_centroid IS NOT NULL THEN 0.2 ELSE 0 END) DESC,
+			l.name
+		LIMIT `+arg(filter.Limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching locations: %w", err)
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		loc, err := scanLocation(rows)
 		if err != nil {
 			return nil, err
 		}
 		locations = append(locations, loc)
 	}
 
-	return locations, nil
+	return locations, rows.Err()
 }
 
 // Location struct to match the database schema
 type Location struct {
-	ID             int       `json:"id"`
-	Unlocode       string    `json:"unlocode"`
-	Name           string    `json:"name"`
-	CountryCode    string    `json:"country_code"`
-	Location       []float64 `json:"location"`
-	IsAirport      bool      `json:"is_airport"`
-	IsPort         bool      `json:"is_port"`
-	IsTrainStation bool      `json:"is_train_station"`
-	CreatedAt      time.Time `json:"created_at"`
-	MaerskID       string    `json:"maersk_id"`
+	ID          int       `json:"id"`
+	Unlocode    string    `json:"unlocode"`
+	Name        string    `json:"name"`
+	CountryCode string    `json:"country_code"`
+	Location    []float64 `json:"location"`
+	// ISO 3166-2 subdivision, without the country prefix
+	Subdivision string `json:"subdivision,omitempty"`
+	// UN/LOCODE status, e.g. AI (approved by national agency) or RL (recognised)
+	Status   string `json:"status,omitempty"`
+	IATACode string `json:"iata_code,omitempty"`
+	// month the entry was last changed in UN/LOCODE
+	UnlocodeDate *time.Time `json:"unlocode_date,omitempty"`
+	// UN/LOCODE functions 1 to B
+	IsPort           bool      `json:"is_port"`
+	IsTrainStation   bool      `json:"is_train_station"`
+	IsRoadTerminal   bool      `json:"is_road_terminal"`
+	IsAirport        bool      `json:"is_airport"`
+	IsPostalExchange bool      `json:"is_postal_exchange"`
+	IsMultimodal     bool      `json:"is_multimodal"`
+	IsFixedTransport bool      `json:"is_fixed_transport"`
+	IsInlandPort     bool      `json:"is_inland_port"`
+	IsBorderCrossing bool      `json:"is_border_crossing"`
+	CreatedAt        time.Time `json:"created_at"`
+	MaerskID         string    `json:"maersk_id"`
+	AlternateNames   []string  `json:"alternate_names,omitempty"`
+	// last Maersk lookup, hit or miss
+	MaerskIDFetchedAt *time.Time `json:"maersk_id_fetched_at,omitempty"`
+	// port and terminal polygons are known, Location is then their centroid
+	HasArea bool `json:"has_area"`
+	// unlocode, wpi, gazetteer, carrier or nominatim; area for polygons
+	CoordinatesSource     string   `json:"coordinates_source,omitempty"`
+	CoordinatesConfidence *float64 `json:"coordinates_confidence,omitempty"`
+	// alias code the location was looked up with
+	ResolvedFrom string `json:"resolved_from,omitempty"`
+	// World Port Index entry, only set by the location endpoint
+	Port *PortDetails `json:"port,omitempty"`
 }
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PortCall is a stay of a vessel inside the geofence of a port, derived from
+// its recorded positions.
+type PortCall struct {
+	Unlocode      string    `json:"unlocode"`
+	Name          string    `json:"name"`
+	CountryCode   string    `json:"country_code"`
+	ArrivalTime   time.Time `json:"arrival_time"`
+	DepartureTime time.Time `json:"departure_time"`
+	PositionCount int       `json:"position_count"`
+}
+
+// GetRecentPortCalls matches the positions of a vessel against port
+// geofences and groups consecutive hits on the same port into one call
+// (gaps-and-islands over the ordered hits). A port with polygons is matched
+// on its port, terminal and berth areas, other ports on the radius around
+// their point.
+func GetRecentPortCalls(db *sql.DB, mmsi string, limit int) ([]PortCall, error) {
+	rows, err := db.Query(`
+		WITH positions AS (
+			SELECT p.timestamp, ST_SetSRID(ST_MakePoint(p.longitude, p.latitude), 4326)::geography AS point
+			FROM vessel_positions p
+			WHERE p.mmsi = $1
+		),
+		hits AS (
+			SELECT DISTINCT p.timestamp, l.unlocode, l.name, l.country_code
+			FROM positions p
+			JOIN location_areas a
+			  ON a.kind IN ('port', 'terminal', 'berth')
+			 AND ST_Intersects(a.area, p.point)
+			JOIN locations l ON l.unlocode = a.unlocode
+			UNION ALL
+			SELECT p.timestamp, l.unlocode, l.name, l.country_code
+			FROM positions p
+			JOIN locations l
+			  ON l.is_port = true
+			 AND l.location IS NOT NULL
+			 AND ST_DWithin(l.location, p.point, l.geofence_radius_meters)
+			WHERE NOT EXISTS (
+				SELECT 1 FROM location_areas a
+				WHERE a.unlocode = l.unlocode AND a.kind IN ('port', 'terminal', 'berth')
+			)
+		),
+		grouped AS (
+			SELECT *,
+				ROW_NUMBER() OVER (ORDER BY timestamp) -
+				ROW_NUMBER() OVER (PARTITION BY unlocode ORDER BY timestamp) AS grp
+			FROM hits
+		)
+		SELECT unlocode, name, country_code, MIN(timestamp), MAX(timestamp), COUNT(*)
+		FROM grouped
+		GROUP BY unlocode, name, country_code, grp
+		ORDER BY MIN(timestamp) DESC
+		LIMIT $2`, mmsi, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting port calls: %w", err)
+	}
+	defer rows.Close()
+
+	calls := []PortCall{}
+	for rows.Next() {
+		var c PortCall
+		if err := rows.Scan(&c.Unlocode, &c.Name, &c.CountryCode, &c.ArrivalTime, &c.DepartureTime, &c.PositionCount); err != nil {
+			return nil, err
+		}
+		calls = append(calls, c)
+	}
+	return calls, rows.Err()
+}
@@ -0,0 +1,287 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	StayAnchorage = "anchorage"
+	StayBerth     = "berth"
+
+	// Upper bound on anchorage_radius_meters, lets the ring lookup use the
+	// spatial index on locations
+	maxAnchorageRadiusMeters = 100000
+)
+
+// PortStay is a stretch of consecutive positions of a vessel at berth inside
+// a port geofence, or waiting at anchor in the ring around it.
+type PortStay struct {
+	ID            int       `json:"id"`
+	MMSI          string    `json:"mmsi"`
+	Unlocode      string    `json:"unlocode"`
+	Kind          string    `json:"kind"`
+	StartedAt     time.Time `json:"started_at"`
+	EndedAt       time.Time `json:"ended_at"`
+	PositionCount int       `json:"position_count"`
+	// the vessel has since been seen elsewhere
+	Closed      bool `json:"closed"`
+	BerthStayID *int `json:"berth_stay_id,omitempty"`
+}
+
+// ZonedPosition is a position with the port zone it falls in: Kind is
+// berth, anchorage or empty, regardless of speed.
+type ZonedPosition struct {
+	Timestamp time.Time
+	Sog       *float64
+	NavStatus *int
+	Kind      string
+	Unlocode  string
+}
+
+// PortStayBacklog returns the MMSIs with positions newer than their
+// processed_until mark.
+func PortStayBacklog(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT p.mmsi
+		FROM vessel_positions p
+		LEFT JOIN port_stay_progress s ON s.mmsi = p.mmsi
+		WHERE p.mmsi IS NOT NULL
+		GROUP BY p.mmsi, s.processed_until
+		HAVING MAX(p.timestamp) > COALESCE(s.processed_until, '-infinity')`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting port stay backlog: %w", err)
+	}
+	defer rows.Close()
+
+	var mmsis []string
+	for rows.Next() {
+		var mmsi string
+		if err := rows.Scan(&mmsi); err != nil {
+			return nil, err
+		}
+		mmsis = append(mmsis, mmsi)
+	}
+	return mmsis, rows.Err()
+}
+
+// ZonePositions returns up to limit positions of a vessel after its
+// processed_until mark, in order, each placed in a port zone. Inside a port
+// geofence (its port, terminal and berth polygons, else the radius around
+// its point) is berth; inside an anchorage polygon or the anchorage ring is
+// anchorage, the nearest port winning.
+func ZonePositions(db *sql.DB, mmsi string, limit int) ([]ZonedPosition, error) {
+	rows, err := db.Query(`
+		SELECT p.timestamp, p.sog, p.nav_status, COALESCE(z.kind, ''), COALESCE(z.unlocode, '')
+		FROM vessel_positions p
+		CROSS JOIN LATERAL (
+			SELECT ST_SetSRID(ST_MakePoint(p.longitude, p.latitude), 4326)::geography AS point
+		) pt
+		LEFT JOIN LATERAL (
+			SELECT zone.kind, zone.unlocode FROM (
+				SELECT 'berth' AS kind, a.unlocode, 0 AS rank, 0::float8 AS distance
+				FROM location_areas a
+				WHERE a.kind IN ('port', 'terminal', 'berth') AND ST_Intersects(a.area, pt.point)
+				UNION ALL
+				SELECT 'berth', l.unlocode, 1, ST_Distance(l.location, pt.point)
+				FROM locations l
+				WHERE l.is_port AND ST_DWithin(l.location, pt.point, l.geofence_radius_meters)
+				AND NOT EXISTS (
+					SELECT 1 FROM location_areas a
+					WHERE a.unlocode = l.unlocode AND a.kind IN ('port', 'terminal', 'berth')
+				)
+				UNION ALL
+				SELECT 'anchorage', a.unlocode, 2, 0
+				FROM location_areas a
+				WHERE a.kind = 'anchorage' AND ST_Intersects(a.area, pt.point)
+				UNION ALL
+				SELECT 'anchorage', l.unlocode, 3, ST_Distance(l.location, pt.point)
+				FROM locations l
+				WHERE l.is_port
+				AND ST_DWithin(l.location, pt.point, $3)
+				AND ST_DWithin(l.location, pt.point, l.anchorage_radius_meters)
+			) zone
+			ORDER BY zone.rank, zone.distance
+			LIMIT 1
+		) z ON true
+		WHERE p.mmsi = $1
+		AND p.timestamp > COALESCE((SELECT processed_until FROM port_stay_progress WHERE mmsi = $1), '-infinity')
+		ORDER BY p.timestamp
+		LIMIT $2`, mmsi, limit, maxAnchorageRadiusMeters)
+	if err != nil {
+		return nil, fmt.Errorf("error zoning positions: %w", err)
+	}
+	defer rows.Close()
+
+	var positions []ZonedPosition
+	for rows.Next() {
+		var p ZonedPosition
+		if err := rows.Scan(&p.Timestamp, &p.Sog, &p.NavStatus, &p.Kind, &p.Unlocode); err != nil {
+			return nil, err
+		}
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+// GetOpenPortStay returns the latest stay of a vessel that is not closed,
+// nil when there is none.
+func GetOpenPortStay(db *sql.DB, mmsi string) (*PortStay, error) {
+	var s PortStay
+	err := db.QueryRow(`
+		SELECT id, mmsi, unlocode, kind, started_at, ended_at, position_count, closed, berth_stay_id
+		FROM port_stays
+		WHERE mmsi = $1 AND NOT closed
+		ORDER BY ended_at DESC
+		LIMIT 1`, mmsi).Scan(
+		&s.ID, &s.MMSI, &s.Unlocode, &s.Kind, &s.StartedAt, &s.EndedAt, &s.PositionCount, &s.Closed, &s.BerthStayID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting open port stay: %w", err)
+	}
+	return &s, nil
+}
+
+// SavePortStays writes new and extended stays of a vessel and moves its
+// processed_until mark, in one transaction. A new berth stay is linked to
+// the anchorage stay at the same port that ended shortly before it.
+func SavePortStays(db *sql.DB, mmsi string, stays []PortStay, processedUntil time.Time, arrivalWindow time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, s := range stays {
+		if s.ID != 0 {
+			_, err := tx.Exec(`
+				UPDATE port_stays SET ended_at = $2, position_count = $3, closed = $4
+				WHERE id = $1`, s.ID, s.EndedAt, s.PositionCount, s.Closed)
+			if err != nil {
+				return fmt.Errorf("error updating port stay: %w", err)
+			}
+			continue
+		}
+
+		var id int
+		err := tx.QueryRow(`
+			INSERT INTO port_stays (mmsi, unlocode, kind, started_at, ended_at, position_count, closed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (mmsi, kind, started_at) DO UPDATE SET
+				ended_at = EXCLUDED.ended_at,
+				position_count = EXCLUDED.position_count,
+				closed = EXCLUDED.closed
+			RETURNING id`,
+			mmsi, s.Unlocode, s.Kind, s.StartedAt, s.EndedAt, s.PositionCount, s.Closed).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("error saving port stay: %w", err)
+		}
+
+		if s.Kind == StayBerth {
+			_, err := tx.Exec(`
+				UPDATE port_stays SET berth_stay_id = $1
+				WHERE id = (
+					SELECT id FROM port_stays
+					WHERE mmsi = $2 AND unlocode = $3 AND kind = 'anchorage' AND berth_stay_id IS NULL
+					AND ended_at <= $4 AND ended_at > $5
+					ORDER BY ended_at DESC
+					LIMIT 1
+				)`, id, mmsi, s.Unlocode, s.StartedAt, s.StartedAt.Add(-arrivalWindow))
+			if err != nil {
+				return fmt.Errorf("error linking anchorage stay: %w", err)
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO port_stay_progress (mmsi, processed_until) VALUES ($1, $2)
+		ON CONFLICT (mmsi) DO UPDATE SET processed_until = EXCLUDED.processed_until`, mmsi, processedUntil)
+	if err != nil {
+		return fmt.Errorf("error saving port stay progress: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// WaitingVessel is a vessel at anchor off a port.
+type WaitingVessel struct {
+	MMSI         string    `json:"mmsi"`
+	Name         string    `json:"name"`
+	IMONumber    string    `json:"imo_number,omitempty"`
+	Since        time.Time `json:"since"`
+	LastSeen     time.Time `json:"last_seen"`
+	WaitingHours float64   `json:"waiting_hours"`
+}
+
+// PortCongestion summarizes the anchorage and berth stays of a port. Waiting
+// is about now, the averages about the arrivals between From and To.
+type PortCongestion struct {
+	Unlocode   string          `json:"unlocode"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	WaitingNow int             `json:"waiting_now"`
+	Waiting    []WaitingVessel `json:"waiting"`
+	Arrivals   int             `json:"arrivals"`
+	// arrivals that waited at anchor first
+	ArrivalsAfterWaiting int      `json:"arrivals_after_waiting"`
+	AvgWaitHours         *float64 `json:"avg_wait_hours"`
+	AvgBerthDwellHours   *float64 `json:"avg_berth_dwell_hours"`
+}
+
+// GetPortCongestion computes the congestion of a port. A vessel is waiting
+// when its latest stay is an anchorage stay seen after activeSince; the wait
+// of an arrival runs from the start of its anchorage stay to the start of
+// the berth stay.
+func GetPortCongestion(db *sql.DB, unlocode string, from, to, activeSince time.Time) (PortCongestion, error) {
+	c := PortCongestion{Unlocode: unlocode, From: from, To: to, Waiting: []WaitingVessel{}}
+
+	rows, err := db.Query(`
+		SELECT s.mmsi, COALESCE(v.name, ''), COALESCE(v.imo_number, ''), s.started_at, s.ended_at
+		FROM port_stays s
+		LEFT JOIN vessels v ON v.mmsi = s.mmsi
+		WHERE s.unlocode = $1 AND s.kind = 'anchorage' AND NOT s.closed AND s.ended_at > $2
+		ORDER BY s.started_at`, unlocode, activeSince)
+	if err != nil {
+		return c, fmt.Errorf("error getting waiting vessels: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	for rows.Next() {
+		var w WaitingVessel
+		if err := rows.Scan(&w.MMSI, &w.Name, &w.IMONumber, &w.Since, &w.LastSeen); err != nil {
+			return c, err
+		}
+		w.WaitingHours = now.Sub(w.Since).Hours()
+		c.Waiting = append(c.Waiting, w)
+	}
+	if err := rows.Err(); err != nil {
+		return c, err
+	}
+	c.WaitingNow = len(c.Waiting)
+
+	err = db.QueryRow(`
+		SELECT count(*),
+			   avg(EXTRACT(EPOCH FROM ended_at - started_at) / 3600) FILTER (WHERE closed)
+		FROM port_stays
+		WHERE unlocode = $1 AND kind = 'berth' AND started_at >= $2 AND started_at < $3`,
+		unlocode, from, to).Scan(&c.Arrivals, &c.AvgBerthDwellHours)
+	if err != nil {
+		return c, fmt.Errorf("error getting berth stays: %w", err)
+	}
+
+	err = db.QueryRow(`
+		SELECT count(*), avg(EXTRACT(EPOCH FROM b.started_at - a.started_at) / 3600)
+		FROM port_stays a
+		JOIN port_stays b ON b.id = a.berth_stay_id
+		WHERE a.unlocode = $1 AND a.kind = 'anchorage' AND b.started_at >= $2 AND b.started_at < $3`,
+		unlocode, from, to).Scan(&c.ArrivalsAfterWaiting, &c.AvgWaitHours)
+	if err != nil {
+		return c, fmt.Errorf("error getting anchorage waits: %w", err)
+	}
+
+	return c, nil
+}
@@ -9,14 +9,16 @@ import (
 	aisstream "github.com/aisstream/ais-message-models/golang/aisStream"
 )
 
-// id SERIAL PRIMARY KEY,
-//
-//	vessel_id INTEGER REFERENCES vessels(id),
-//	mmsi TEXT REFERENCES vessels(mmsi),
-//	latitude DECIMAL(10,8),
-//	longitude DECIMAL(11,8),
-//	timestamp TIMESTAMP NOT NULL,
-//	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+// AIS values meaning "not available"
+const (
+	aisNavStatusUnknown = 15
+	aisSogUnknown       = 102.3
+	aisCogUnknown       = 360
+	aisHeadingUnknown   = 511
+)
+
+// InsertPositionReport stores a position with its navigational status,
+// speed and course over ground and heading.
 func InsertPositionReport(db *sql.DB, mmsi string, positionReport aisstream.PositionReport, timestamp models.CustomTime) error {
 	log.Printf("Inserting position report for mmsi %s", mmsi)
 
@@ -35,10 +37,26 @@ func InsertPositionReport(db *sql.DB, mmsi string, positionReport aisstream.Posi
 
 	log.Printf("Position report: %+v", positionReport)
 
+	var navStatus, heading *int32
+	var sog, cog *float64
+	if positionReport.NavigationalStatus != aisNavStatusUnknown {
+		navStatus = &positionReport.NavigationalStatus
+	}
+	if positionReport.Sog < aisSogUnknown {
+		sog = &positionReport.Sog
+	}
+	if positionReport.Cog < aisCogUnknown {
+		cog = &positionReport.Cog
+	}
+	if positionReport.TrueHeading != aisHeadingUnknown {
+		heading = &positionReport.TrueHeading
+	}
+
 	_, err = db.Exec(`
-        INSERT INTO vessel_positions 
-        VALUES (DEFAULT,$1, $2, $3, $4, $5)
-    `, vessel.ID, vessel.MMSI, positionReport.Latitude, positionReport.Longitude, timestamp.Time.Format("2006-01-02 15:04:05"))
+        INSERT INTO vessel_positions (vessel_id, mmsi, latitude, longitude, timestamp, nav_status, sog, cog, heading)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `, vessel.ID, vessel.MMSI, positionReport.Latitude, positionReport.Longitude, timestamp.Time.Format("2006-01-02 15:04:05"),
+		navStatus, sog, cog, heading)
 
 	updateVesselLastKnownPosition(db, vessel.ID, positionReport.Latitude, positionReport.Longitude)
 
@@ -46,3 +64,22 @@ func InsertPositionReport(db *sql.DB, mmsi string, positionReport aisstream.Posi
 
 	return err
 }
+
+func GetLastPosition(db *sql.DB, mmsi string) (VesselPosition, error) {
+	var p VesselPosition
+	err := db.QueryRow(`
+		SELECT id, vessel_id, mmsi, latitude, longitude, timestamp, created_at, nav_status, sog, cog, heading
+		FROM vessel_positions
+		WHERE mmsi = $1
+		ORDER BY timestamp DESC
+		LIMIT 1`, mmsi).Scan(&p.ID, &p.VesselID, &p.MMSI, &p.Latitude, &p.Longitude, &p.Timestamp, &p.CreatedAt,
+		&p.NavStatus, &p.Sog, &p.Cog, &p.Heading)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return VesselPosition{}, fmt.Errorf("position %w", ErrNotFound)
+		}
+		return VesselPosition{}, fmt.Errorf("error getting last position: %w", err)
+	}
+	return p, nil
+}
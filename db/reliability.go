@@ -0,0 +1,180 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Columns of the observed CTE a reliability report can be grouped by; a lane
+// is the origin and destination pair.
+var reliabilityGroups = map[string][]string{
+	"carrier": {"carrier"},
+	"service": {"service"},
+	"lane":    {"origin", "destination"},
+	"vessel":  {"vessel"},
+	"month":   {"month"},
+}
+
+// Arrival delay buckets, in hours, of ReliabilityStats.Distribution
+var delayBuckets = []struct {
+	label    string
+	from, to float64
+}{
+	{"early_over_3d", -1e9, -72},
+	{"early_1d_3d", -72, -24},
+	{"within_1d", -24, 24},
+	{"late_1d_3d", 24, 72},
+	{"late_3d_7d", 72, 168},
+	{"late_over_7d", 168, 1e9},
+}
+
+type ReliabilityFilter struct {
+	// any of carrier, service, lane, vessel and month
+	GroupBy     []string
+	Carriers    []string
+	Services    []string
+	Origin      string
+	Destination string
+	IMONumber   string
+	// scheduled arrival window
+	From, To time.Time
+	// an arrival this close to the schedule, early or late, is on time
+	Tolerance  time.Duration
+	MinSamples int
+}
+
+type DelayBucket struct {
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+// ReliabilityStats compares the scheduled arrivals of transport legs with
+// the arrivals of the voyages that fulfilled them.
+type ReliabilityStats struct {
+	Group            map[string]string `json:"group"`
+	Samples          int               `json:"samples"`
+	OnTime           int               `json:"on_time"`
+	OnTimePercent    float64           `json:"on_time_percent"`
+	MeanDelayHours   float64           `json:"mean_delay_hours"`
+	MedianDelayHours float64           `json:"median_delay_hours"`
+	Distribution     []DelayBucket     `json:"distribution"`
+}
+
+// GetReliability aggregates the arrival delays of the voyages linked to a
+// transport leg, one row per group.
+func GetReliability(db *sql.DB, filter ReliabilityFilter) ([]ReliabilityStats, error) {
+	var groupColumns []string
+	for _, g := range filter.GroupBy {
+		columns, ok := reliabilityGroups[g]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown groupBy %q", ErrInvalidFilter, g)
+		}
+		groupColumns = append(groupColumns, columns...)
+	}
+
+	args := []interface{}{filter.Tolerance.Hours()}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{"TRUE"}
+	if len(filter.Carriers) > 0 {
+		where = append(where, "COALESCE(op.carrier_code, t.vessel_carrier_code) = ANY ("+arg(pq.Array(filter.Carriers))+")")
+	}
+	if len(filter.Services) > 0 {
+		where = append(where, "t.carrier_service_code = ANY ("+arg(pq.Array(filter.Services))+")")
+	}
+	if filter.Origin != "" {
+		where = append(where, "t.origin_port_un_lo_code = "+arg(filter.Origin))
+	}
+	if filter.Destination != "" {
+		where = append(where, "t.destination_port_un_lo_code = "+arg(filter.Destination))
+	}
+	if filter.IMONumber != "" {
+		where = append(where, "t.vessel_imo_number = "+arg(filter.IMONumber))
+	}
+	if !filter.From.IsZero() {
+		where = append(where, "t.arrival_date_time >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "t.arrival_date_time < "+arg(filter.To))
+	}
+
+	buckets := make([]string, len(delayBuckets))
+	for i, b := range delayBuckets {
+		buckets[i] = fmt.Sprintf("COUNT(*) FILTER (WHERE delay_hours >= %g AND delay_hours < %g)", b.from, b.to)
+	}
+
+	selectGroup, groupBy, orderBy := "", "", ""
+	if len(groupColumns) > 0 {
+		selectGroup = strings.Join(groupColumns, ", ") + ", "
+		groupBy = "GROUP BY " + strings.Join(groupColumns, ", ")
+		orderBy = "ORDER BY " + strings.Join(groupColumns, ", ")
+	}
+
+	rows, err := db.Query(`
+		WITH observed AS (
+			SELECT COALESCE(op.carrier_code, t.vessel_carrier_code, '') AS carrier,
+				   COALESCE(t.carrier_service_code, '') AS service,
+				   COALESCE(t.origin_port_un_lo_code, '') AS origin,
+				   COALESCE(t.destination_port_un_lo_code, '') AS destination,
+				   COALESCE(t.vessel_imo_number, '') AS vessel,
+				   to_char(t.arrival_date_time, 'YYYY-MM') AS month,
+				   EXTRACT(EPOCH FROM v.arrived_at - t.arrival_date_time) / 3600 AS delay_hours
+			FROM voyages v
+			JOIN transport_legs t ON t.id = v.transport_leg_id
+			LEFT JOIN LATERAL (
+				SELECT op.carrier_code
+				FROM ocean_product_legs pl
+				JOIN ocean_products op ON op.id = pl.ocean_product_id
+				WHERE pl.transport_leg_id = t.id
+				ORDER BY op.last_seen_at DESC
+				LIMIT 1
+			) op ON true
+			WHERE `+strings.Join(where, " AND ")+`
+		)
+		SELECT `+selectGroup+`COUNT(*),
+			   COUNT(*) FILTER (WHERE abs(delay_hours) <= $1),
+			   AVG(delay_hours),
+			   percentile_cont(0.5) WITHIN GROUP (ORDER BY delay_hours),
+			   `+strings.Join(buckets, ", ")+`
+		FROM observed
+		`+groupBy+`
+		HAVING COUNT(*) >= `+arg(max(filter.MinSamples, 1))+`
+		`+orderBy, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error computing reliability: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []ReliabilityStats{}
+	for rows.Next() {
+		s := ReliabilityStats{Group: map[string]string{}, Distribution: make([]DelayBucket, len(delayBuckets))}
+		groupValues := make([]string, len(groupColumns))
+
+		dest := make([]interface{}, 0, len(groupColumns)+4+len(delayBuckets))
+		for i := range groupValues {
+			dest = append(dest, &groupValues[i])
+		}
+		dest = append(dest, &s.Samples, &s.OnTime, &s.MeanDelayHours, &s.MedianDelayHours)
+		for i := range s.Distribution {
+			s.Distribution[i].Label = delayBuckets[i].label
+			dest = append(dest, &s.Distribution[i].Count)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		for i, key := range groupColumns {
+			s.Group[key] = groupValues[i]
+		}
+		s.OnTimePercent = float64(s.OnTime) / float64(s.Samples) * 100
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,323 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+	"github.com/lib/pq"
+)
+
+// pgTimestamp formats a time the way lib/pq sends one, so a TIMESTAMP array
+// element stores what a single parameter would.
+func pgTimestamp(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05.999999999Z07:00")
+}
+
+// SaveOceanProducts upserts products and their legs in one transaction and
+// returns the id of each product, in order. A leg is stored once however
+// many products use it, and each product's legs are replaced by the ones
+// just returned, as are the vessel routes of the products. Nothing is
+// written when any statement fails.
+func SaveOceanProducts(db *sql.DB, products []models.ReducedOceanProduct) ([]int64, error) {
+	ids := make([]int64, len(products))
+	if len(products) == 0 {
+		return ids, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := upsertOceanProducts(tx, products, ids); err != nil {
+		return nil, err
+	}
+
+	// The last occurrence of a product in the batch is the one stored
+	last := make(map[int64]int, len(products))
+	for i, id := range ids {
+		last[id] = i
+	}
+	var legs []models.ReducedTransportLeg
+	var legProducts, legSequences []int64
+	for i, p := range products {
+		if last[ids[i]] != i {
+			continue
+		}
+		for seq, leg := range p.TransportLegs {
+			legs = append(legs, leg)
+			legProducts = append(legProducts, ids[i])
+			legSequences = append(legSequences, int64(seq))
+		}
+	}
+
+	legIDs := make([]int64, len(legs))
+	if err := upsertTransportLegs(tx, legs, legIDs); err != nil {
+		return nil, err
+	}
+
+	productIDs := make([]int64, 0, len(last))
+	for id := range last {
+		productIDs = append(productIDs, id)
+	}
+	if _, err := tx.Exec(`DELETE FROM ocean_product_legs WHERE ocean_product_id = ANY($1)`, pq.Array(productIDs)); err != nil {
+		return nil, fmt.Errorf("error clearing product legs: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO ocean_product_legs (ocean_product_id, sequence, transport_leg_id)
+		SELECT * FROM unnest($1::int[], $2::smallint[], $3::int[])`,
+		pq.Array(legProducts), pq.Array(legSequences), pq.Array(legIDs))
+	if err != nil {
+		return nil, fmt.Errorf("error saving product legs: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM vessel_routes WHERE ocean_product_id = ANY($1)`, pq.Array(productIDs)); err != nil {
+		return nil, fmt.Errorf("error clearing vessel routes: %w", err)
+	}
+	if err := linkVesselRoutes(tx, "l.ocean_product_id = ANY($1)", pq.Array(productIDs)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing ocean products: %w", err)
+	}
+	return ids, nil
+}
+
+// upsertOceanProducts writes the products in one statement and sets ids[i]
+// to the id of products[i]. Duplicates within the batch collapse onto the
+// last one. updated_at only moves when a stored field actually changes,
+// while last_seen_at records every fetch that returned the product.
+func upsertOceanProducts(tx *sql.Tx, products []models.ReducedOceanProduct, ids []int64) error {
+	n := len(products)
+	carrierProductIDs, validTo, validFrom := make([]string, n), make([]string, n), make([]string, n)
+	originCities, originNames, originCountries := make([]string, n), make([]string, n), make([]string, n)
+	origins, originSites, originCityGeos := make([]string, n), make([]string, n), make([]string, n)
+	destinationCities, destinationNames, destinationCountries := make([]string, n), make([]string, n), make([]string, n)
+	destinations, destinationSites, destinationCityGeos := make([]string, n), make([]string, n), make([]string, n)
+	vesselCarriers, vesselNames, imos, mmsis := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	departures, arrivals := make([]string, n), make([]string, n)
+	transitTimes := make([]int64, n)
+	carriers := make([]string, n)
+	for i, p := range products {
+		carrierProductIDs[i], validTo[i], validFrom[i] = p.CarrierProductID, pgTimestamp(p.ProductValidToDate.Time), pgTimestamp(p.ProductValidFromDate.Time)
+		originCities[i], originNames[i], originCountries[i] = p.OriginCity, p.OriginName, p.OriginCountry
+		origins[i], originSites[i], originCityGeos[i] = p.OriginPortUnLoCode, p.OriginCarrierSiteGeoID, p.OriginCarrierCityGeoID
+		destinationCities[i], destinationNames[i], destinationCountries[i] = p.DestinationCity, p.DestinationName, p.DestinationCountry
+		destinations[i], destinationSites[i], destinationCityGeos[i] = p.DestinationPortUnLoCode, p.DestinationCarrierSiteGeoID, p.DestinationCarrierCityGeoID
+		vesselCarriers[i], vesselNames[i], imos[i], mmsis[i] = p.DepartureVesselCarrierCode, p.DepartureVesselName, p.DepartureVesselIMONumber, p.DepartureVesselMMSI
+		departures[i], arrivals[i] = pgTimestamp(p.DepartureDateTime.Time), pgTimestamp(p.ArrivalDateTime.Time)
+		transitTimes[i] = int64(p.TransitTime)
+		carriers[i] = p.CarrierCode
+	}
+
+	rows, err := tx.Query(`
+		WITH input AS (
+			SELECT * FROM unnest(
+				$1::text[], $2::timestamp[], $3::timestamp[], $4::text[], $5::text[], $6::text[],
+				$7::text[], $8::text[], $9::text[], $10::text[], $11::text[], $12::text[],
+				$13::text[], $14::text[], $15::text[], $16::text[], $17::text[], $18::text[],
+				$19::text[], $20::timestamp[], $21::timestamp[], $22::int[], $23::text[]
+			) WITH ORDINALITY AS i(
+				carrier_product_id, valid_to, valid_from, origin_city, origin_name, origin_country,
+				origin, origin_site, origin_city_geo, destination_city, destination_name, destination_country,
+				destination, destination_site, destination_city_geo, vessel_carrier, vessel_name, imo,
+				mmsi, departure, arrival, transit_time, carrier, n)
+		), upserted AS (
+			INSERT INTO ocean_products (
+				carrier_product_id, product_valid_to_date, product_valid_from_date,
+				origin_city, origin_name, origin_country, origin_port_un_lo_code,
+				origin_carrier_site_geo_id, origin_carrier_city_geo_id,
+				destination_city, destination_name, destination_country,
+				destination_port_un_lo_code, destination_carrier_site_geo_id,
+				destination_carrier_city_geo_id, departure_vessel_carrier_code,
+				departure_vessel_name, departure_vessel_imo_number,
+				departure_vessel_mmsi, departure_date_time, arrival_date_time,
+				transit_time, carrier_code
+			)
+			SELECT DISTINCT ON (i.carrier, i.origin, i.destination, i.imo, i.departure, i.arrival)
+				i.carrier_product_id, i.valid_to, i.valid_from, i.origin_city, i.origin_name, i.origin_country,
+				i.origin, i.origin_site, i.origin_city_geo, i.destination_city, i.destination_name, i.destination_country,
+				i.destination, i.destination_site, i.destination_city_geo, i.vessel_carrier, i.vessel_name,
+				NULLIF(i.imo, ''), NULLIF(i.mmsi, ''),
+				i.departure, i.arrival, i.transit_time, i.carrier
+			FROM input i
+			ORDER BY i.carrier, i.origin, i.destination, i.imo, i.departure, i.arrival, i.n DESC
+			ON CONFLICT ((COALESCE(carrier_code, '')), origin_port_un_lo_code, destination_port_un_lo_code,
+						 (COALESCE(departure_vessel_imo_number, '')), departure_date_time, arrival_date_time)
+			DO UPDATE SET
+				carrier_product_id = EXCLUDED.carrier_product_id,
+				product_valid_to_date = EXCLUDED.product_valid_to_date,
+				product_valid_from_date = EXCLUDED.product_valid_from_date,
+				origin_city = EXCLUDED.origin_city,
+				origin_name = EXCLUDED.origin_name,
+				origin_country = EXCLUDED.origin_country,
+				origin_carrier_site_geo_id = EXCLUDED.origin_carrier_site_geo_id,
+				origin_carrier_city_geo_id = EXCLUDED.origin_carrier_city_geo_id,
+				destination_city = EXCLUDED.destination_city,
+				destination_name = EXCLUDED.destination_name,
+				destination_country = EXCLUDED.destination_country,
+				destination_carrier_site_geo_id = EXCLUDED.destination_carrier_site_geo_id,
+				destination_carrier_city_geo_id = EXCLUDED.destination_carrier_city_geo_id,
+				departure_vessel_carrier_code = EXCLUDED.departure_vessel_carrier_code,
+				departure_vessel_name = EXCLUDED.departure_vessel_name,
+				departure_vessel_mmsi = EXCLUDED.departure_vessel_mmsi,
+				transit_time = EXCLUDED.transit_time,
+				updated_at = CASE
+					WHEN (ocean_products.carrier_product_id, ocean_products.product_valid_to_date,
+						  ocean_products.product_valid_from_date, ocean_products.departure_vessel_name,
+						  ocean_products.departure_vessel_mmsi, ocean_products.transit_time)
+						 IS DISTINCT FROM
+						 (EXCLUDED.carrier_product_id, EXCLUDED.product_valid_to_date,
+						  EXCLUDED.product_valid_from_date, EXCLUDED.departure_vessel_name,
+						  EXCLUDED.departure_vessel_mmsi, EXCLUDED.transit_time)
+					THEN CURRENT_TIMESTAMP
+					ELSE ocean_products.updated_at
+				END,
+				last_seen_at = CURRENT_TIMESTAMP
+			RETURNING id, COALESCE(carrier_code, '') AS carrier, origin_port_un_lo_code AS origin,
+				destination_port_un_lo_code AS destination, COALESCE(departure_vessel_imo_number, '') AS imo,
+				departure_date_time AS departure, arrival_date_time AS arrival
+		)
+		SELECT i.n, u.id
+		FROM input i
+		JOIN upserted u USING (carrier, origin, destination, imo, departure, arrival)`,
+		pq.Array(carrierProductIDs), pq.Array(validTo), pq.Array(validFrom),
+		pq.Array(originCities), pq.Array(originNames), pq.Array(originCountries),
+		pq.Array(origins), pq.Array(originSites), pq.Array(originCityGeos),
+		pq.Array(destinationCities), pq.Array(destinationNames), pq.Array(destinationCountries),
+		pq.Array(destinations), pq.Array(destinationSites), pq.Array(destinationCityGeos),
+		pq.Array(vesselCarriers), pq.Array(vesselNames), pq.Array(imos),
+		pq.Array(mmsis), pq.Array(departures), pq.Array(arrivals), pq.Array(transitTimes), pq.Array(carriers))
+	if err != nil {
+		return fmt.Errorf("error saving ocean products: %w", err)
+	}
+	return scanOrdinalIDs(rows, ids, "ocean product")
+}
+
+// upsertTransportLegs writes the legs in one statement and sets ids[i] to
+// the id of legs[i]. A leg is identified by vessel, mode, ports and times.
+func upsertTransportLegs(tx *sql.Tx, legs []models.ReducedTransportLeg, ids []int64) error {
+	if len(legs) == 0 {
+		return nil
+	}
+
+	n := len(legs)
+	departures, arrivals := make([]string, n), make([]string, n)
+	vesselCarriers, vesselNames, imos, mmsis := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	originCities, originNames, originCountries := make([]string, n), make([]string, n), make([]string, n)
+	origins, originSites, originCityGeos := make([]string, n), make([]string, n), make([]string, n)
+	destinationCities, destinationNames, destinationCountries := make([]string, n), make([]string, n), make([]string, n)
+	destinations, destinationSites, destinationCityGeos := make([]string, n), make([]string, n), make([]string, n)
+	modes, serviceCodes, serviceNames := make([]string, n), make([]string, n), make([]string, n)
+	voyages, tradeLanes, directions := make([]string, n), make([]string, n), make([]string, n)
+	for i, l := range legs {
+		departures[i], arrivals[i] = pgTimestamp(l.DepartureDateTime.Time), pgTimestamp(l.ArrivalDateTime.Time)
+		vesselCarriers[i], vesselNames[i], imos[i], mmsis[i] = l.VesselCarrierCode, l.VesselName, l.VesselIMONumber, l.VesselMMSI
+		originCities[i], originNames[i], originCountries[i] = l.OriginCity, l.OriginName, l.OriginCountry
+		origins[i], originSites[i], originCityGeos[i] = l.OriginPortUnLoCode, l.OriginCarrierSiteGeoID, l.OriginCarrierCityGeoID
+		destinationCities[i], destinationNames[i], destinationCountries[i] = l.DestinationCity, l.DestinationName, l.DestinationCountry
+		destinations[i], destinationSites[i], destinationCityGeos[i] = l.DestinationPortUnLoCode, l.DestinationCarrierSiteGeoID, l.DestinationCarrierCityGeoID
+		modes[i], serviceCodes[i], serviceNames[i] = l.TransportMode, l.CarrierServiceCode, l.CarrierServiceName
+		voyages[i], tradeLanes[i], directions[i] = l.CarrierDepartureVoyageNumber, l.CarrierTradeLaneName, l.LinkDirection
+	}
+
+	rows, err := tx.Query(`
+		WITH input AS (
+			SELECT * FROM unnest(
+				$1::timestamp[], $2::timestamp[], $3::text[], $4::text[], $5::text[], $6::text[],
+				$7::text[], $8::text[], $9::text[], $10::text[], $11::text[], $12::text[],
+				$13::text[], $14::text[], $15::text[], $16::text[], $17::text[], $18::text[],
+				$19::text[], $20::text[], $21::text[], $22::text[], $23::text[], $24::text[]
+			) WITH ORDINALITY AS i(
+				departure, arrival, vessel_carrier, vessel_name, imo, mmsi,
+				origin_city, origin_name, origin_country, origin, origin_site, origin_city_geo,
+				destination_city, destination_name, destination_country, destination, destination_site, destination_city_geo,
+				mode, service_code, service_name, voyage, trade_lane, direction, n)
+		), upserted AS (
+			INSERT INTO transport_legs (
+				departure_date_time, arrival_date_time,
+				vessel_carrier_code, vessel_name, vessel_imo_number, vessel_mmsi,
+				origin_city, origin_name, origin_country, origin_port_un_lo_code,
+				origin_carrier_site_geo_id, origin_carrier_city_geo_id,
+				destination_city, destination_name, destination_country,
+				destination_port_un_lo_code, destination_carrier_site_geo_id,
+				destination_carrier_city_geo_id,
+				transport_mode, carrier_service_code, carrier_service_name,
+				carrier_departure_voyage_number, carrier_trade_lane_name, link_direction
+			)
+			SELECT DISTINCT ON (i.imo, i.mode, i.origin, i.destination, i.departure, i.arrival)
+				i.departure, i.arrival, i.vessel_carrier, i.vessel_name,
+				NULLIF(i.imo, ''), NULLIF(i.mmsi, ''),
+				i.origin_city, i.origin_name, i.origin_country, i.origin, i.origin_site, i.origin_city_geo,
+				i.destination_city, i.destination_name, i.destination_country, i.destination, i.destination_site, i.destination_city_geo,
+				i.mode, i.service_code, i.service_name, i.voyage, i.trade_lane, i.direction
+			FROM input i
+			ORDER BY i.imo, i.mode, i.origin, i.destination, i.departure, i.arrival, i.n DESC
+			ON CONFLICT ((COALESCE(vessel_imo_number, '')), (COALESCE(transport_mode, '')),
+						 origin_port_un_lo_code, destination_port_un_lo_code, departure_date_time, arrival_date_time)
+			DO UPDATE SET
+				vessel_carrier_code = EXCLUDED.vessel_carrier_code,
+				vessel_name = EXCLUDED.vessel_name,
+				vessel_mmsi = EXCLUDED.vessel_mmsi,
+				origin_city = EXCLUDED.origin_city,
+				origin_name = EXCLUDED.origin_name,
+				origin_country = EXCLUDED.origin_country,
+				origin_carrier_site_geo_id = EXCLUDED.origin_carrier_site_geo_id,
+				origin_carrier_city_geo_id = EXCLUDED.origin_carrier_city_geo_id,
+				destination_city = EXCLUDED.destination_city,
+				destination_name = EXCLUDED.destination_name,
+				destination_country = EXCLUDED.destination_country,
+				destination_carrier_site_geo_id = EXCLUDED.destination_carrier_site_geo_id,
+				destination_carrier_city_geo_id = EXCLUDED.destination_carrier_city_geo_id,
+				carrier_service_code = EXCLUDED.carrier_service_code,
+				carrier_service_name = EXCLUDED.carrier_service_name,
+				carrier_departure_voyage_number = EXCLUDED.carrier_departure_voyage_number,
+				carrier_trade_lane_name = EXCLUDED.carrier_trade_lane_name,
+				link_direction = EXCLUDED.link_direction
+			RETURNING id, COALESCE(vessel_imo_number, '') AS imo, COALESCE(transport_mode, '') AS mode,
+				origin_port_un_lo_code AS origin, destination_port_un_lo_code AS destination,
+				departure_date_time AS departure, arrival_date_time AS arrival
+		)
+		SELECT i.n, u.id
+		FROM input i
+		JOIN upserted u USING (imo, mode, origin, destination, departure, arrival)`,
+		pq.Array(departures), pq.Array(arrivals),
+		pq.Array(vesselCarriers), pq.Array(vesselNames), pq.Array(imos), pq.Array(mmsis),
+		pq.Array(originCities), pq.Array(originNames), pq.Array(originCountries),
+		pq.Array(origins), pq.Array(originSites), pq.Array(originCityGeos),
+		pq.Array(destinationCities), pq.Array(destinationNames), pq.Array(destinationCountries),
+		pq.Array(destinations), pq.Array(destinationSites), pq.Array(destinationCityGeos),
+		pq.Array(modes), pq.Array(serviceCodes), pq.Array(serviceNames),
+		pq.Array(voyages), pq.Array(tradeLanes), pq.Array(directions))
+	if err != nil {
+		return fmt.Errorf("error saving transport legs: %w", err)
+	}
+	return scanOrdinalIDs(rows, ids, "transport leg")
+}
+
+// scanOrdinalIDs reads (ordinality, id) rows into ids and checks every
+// input row got one.
+func scanOrdinalIDs(rows *sql.Rows, ids []int64, what string) error {
+	defer rows.Close()
+
+	matched := 0
+	for rows.Next() {
+		var n, id int64
+		if err := rows.Scan(&n, &id); err != nil {
+			return err
+		}
+		ids[n-1] = id
+		matched++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error saving %ss: %w", what, err)
+	}
+	if matched != len(ids) {
+		return fmt.Errorf("saved %d of %d %ss", matched, len(ids), what)
+	}
+	return nil
+}
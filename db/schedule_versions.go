@@ -0,0 +1,237 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldChange is one field of a sailing that differs between two versions,
+// e.g. TransportLegs[1].VesselName. Old or New is nil when the field only
+// exists on one side, as with an added leg.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ScheduleVersion is one observed state of a sailing. The departure,
+// arrival and vessel are copied out of the snapshot for the timeline.
+type ScheduleVersion struct {
+	ID                  int             `json:"id"`
+	SailingKey          string          `json:"sailing_key"`
+	Version             int             `json:"version"`
+	OceanProductID      *int64          `json:"ocean_product_id"`
+	CarrierCode         string          `json:"carrier_code"`
+	OriginUnLoCode      string          `json:"origin_un_lo_code"`
+	DestinationUnLoCode string          `json:"destination_un_lo_code"`
+	DepartureDateTime   *time.Time      `json:"departure_date_time"`
+	ArrivalDateTime     *time.Time      `json:"arrival_date_time"`
+	VesselName          string          `json:"vessel_name"`
+	VesselIMONumber     string          `json:"vessel_imo_number"`
+	Snapshot            json.RawMessage `json:"snapshot,omitempty"`
+	Changes             []FieldChange   `json:"changes"`
+	ObservedAt          time.Time       `json:"observed_at"`
+}
+
+const scheduleVersionColumns = `id, sailing_key, version, ocean_product_id, COALESCE(carrier_code, ''),
+	COALESCE(origin_un_lo_code, ''), COALESCE(destination_un_lo_code, ''),
+	departure_date_time, arrival_date_time, COALESCE(vessel_name, ''), COALESCE(vessel_imo_number, ''),
+	changes, observed_at`
+
+// scanScheduleVersion scans scheduleVersionColumns followed by extra.
+func scanScheduleVersion(row rowScanner, extra ...interface{}) (ScheduleVersion, error) {
+	var v ScheduleVersion
+	var changes []byte
+	dest := []interface{}{&v.ID, &v.SailingKey, &v.Version, &v.OceanProductID, &v.CarrierCode,
+		&v.OriginUnLoCode, &v.DestinationUnLoCode,
+		&v.DepartureDateTime, &v.ArrivalDateTime, &v.VesselName, &v.VesselIMONumber,
+		&changes, &v.ObservedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(changes, &v.Changes); err != nil {
+		return v, fmt.Errorf("invalid schedule changes: %w", err)
+	}
+	return v, nil
+}
+
+// GetLatestScheduleVersion returns the latest version of a sailing with
+// its snapshot.
+func GetLatestScheduleVersion(db *sql.DB, sailingKey string) (*ScheduleVersion, error) {
+	var snapshot []byte
+	v, err := scanScheduleVersion(db.QueryRow(`
+		SELECT `+scheduleVersionColumns+`, snapshot
+		FROM schedule_versions
+		WHERE sailing_key = $1
+		ORDER BY version DESC
+		LIMIT 1`, sailingKey), &snapshot)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("schedule version %w", ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting schedule version: %w", err)
+	}
+	v.Snapshot = snapshot
+	return &v, nil
+}
+
+// InsertScheduleVersion appends a version and points the ocean product at
+// its sailing. It reports false when another fetch wrote the same version
+// first.
+func InsertScheduleVersion(db *sql.DB, v *ScheduleVersion) (bool, error) {
+	changes, err := json.Marshal(v.Changes)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO schedule_versions (sailing_key, version, ocean_product_id, carrier_code,
+			origin_un_lo_code, destination_un_lo_code, departure_date_time, arrival_date_time,
+			vessel_name, vessel_imo_number, snapshot, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (sailing_key, version) DO NOTHING
+		RETURNING id, observed_at`,
+		v.SailingKey, v.Version, v.OceanProductID, v.CarrierCode,
+		v.OriginUnLoCode, v.DestinationUnLoCode, v.DepartureDateTime, v.ArrivalDateTime,
+		v.VesselName, v.VesselIMONumber, []byte(v.Snapshot), changes).Scan(&v.ID, &v.ObservedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error saving schedule version: %w", err)
+	}
+
+	if err := setSailingKey(tx, v.OceanProductID, v.SailingKey); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// SetSailingKey records which sailing an unchanged ocean product belongs to.
+func SetSailingKey(db *sql.DB, productID *int64, sailingKey string) error {
+	return setSailingKey(db, productID, sailingKey)
+}
+
+// execer is a *sql.DB or a *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func setSailingKey(db execer, productID *int64, sailingKey string) error {
+	if productID == nil {
+		return nil
+	}
+	_, err := db.Exec(`
+		UPDATE ocean_products SET sailing_key = $2
+		WHERE id = $1 AND sailing_key IS DISTINCT FROM $2`, *productID, sailingKey)
+	if err != nil {
+		return fmt.Errorf("error setting sailing key: %w", err)
+	}
+	return nil
+}
+
+// GetScheduleHistory returns every version of the sailing an ocean product
+// belongs to, oldest first.
+func GetScheduleHistory(db *sql.DB, productID int64) (string, []ScheduleVersion, error) {
+	var sailingKey sql.NullString
+	err := db.QueryRow(`SELECT sailing_key FROM ocean_products WHERE id = $1`, productID).Scan(&sailingKey)
+	if err == sql.ErrNoRows {
+		return "", nil, fmt.Errorf("ocean product %w", ErrNotFound)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting ocean product: %w", err)
+	}
+	if !sailingKey.Valid {
+		return "", nil, fmt.Errorf("schedule history %w: product %d was stored before history was kept", ErrNotFound, productID)
+	}
+
+	rows, err := db.Query(`
+		SELECT `+scheduleVersionColumns+`
+		FROM schedule_versions
+		WHERE sailing_key = $1
+		ORDER BY version`, sailingKey.String)
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting schedule history: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []ScheduleVersion{}
+	for rows.Next() {
+		v, err := scanScheduleVersion(rows)
+		if err != nil {
+			return "", nil, err
+		}
+		versions = append(versions, v)
+	}
+	return sailingKey.String, versions, rows.Err()
+}
+
+type ScheduleChangeFilter struct {
+	Since       time.Time
+	CarrierCode string
+	Origin      string
+	Destination string
+	Limit       int
+	Offset      int
+}
+
+// GetScheduleChanges returns the versions that changed a sailing, latest
+// first; first sightings are not changes.
+func GetScheduleChanges(db *sql.DB, filter ScheduleChangeFilter) ([]ScheduleVersion, int, error) {
+	where := []string{"version > 1"}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !filter.Since.IsZero() {
+		where = append(where, "observed_at >= "+arg(filter.Since))
+	}
+	if filter.CarrierCode != "" {
+		where = append(where, "carrier_code = "+arg(filter.CarrierCode))
+	}
+	if filter.Origin != "" {
+		where = append(where, "origin_un_lo_code = "+arg(filter.Origin))
+	}
+	if filter.Destination != "" {
+		where = append(where, "destination_un_lo_code = "+arg(filter.Destination))
+	}
+
+	var total int
+	err := db.QueryRow(`SELECT COUNT(*) FROM schedule_versions WHERE `+strings.Join(where, " AND "), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting schedule changes: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT `+scheduleVersionColumns+`
+		FROM schedule_versions
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY observed_at DESC, id DESC
+		LIMIT `+arg(filter.Limit)+` OFFSET `+arg(filter.Offset), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting schedule changes: %w", err)
+	}
+	defer rows.Close()
+
+	changes := []ScheduleVersion{}
+	for rows.Next() {
+		v, err := scanScheduleVersion(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, v)
+	}
+	return changes, total, rows.Err()
+}
@@ -0,0 +1,315 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+	"github.com/lib/pq"
+)
+
+const oceanProductColumns = `op.id, COALESCE(op.carrier_product_id, ''),
+	COALESCE(op.product_valid_to_date, '0001-01-01'), COALESCE(op.product_valid_from_date, '0001-01-01'),
+	COALESCE(op.origin_city, ''), COALESCE(op.origin_name, ''), COALESCE(op.origin_country, ''),
+	COALESCE(op.origin_port_un_lo_code, ''), COALESCE(op.origin_carrier_site_geo_id, ''),
+	COALESCE(op.origin_carrier_city_geo_id, ''),
+	COALESCE(op.destination_city, ''), COALESCE(op.destination_name, ''), COALESCE(op.destination_country, ''),
+	COALESCE(op.destination_port_un_lo_code, ''), COALESCE(op.destination_carrier_site_geo_id, ''),
+	COALESCE(op.destination_carrier_city_geo_id, ''),
+	COALESCE(op.departure_vessel_carrier_code, ''), COALESCE(op.departure_vessel_name, ''),
+	COALESCE(op.departure_vessel_imo_number, ''), COALESCE(op.departure_vessel_mmsi, ''),
+	COALESCE(op.departure_date_time, '0001-01-01'), COALESCE(op.arrival_date_time, '0001-01-01'),
+	COALESCE(op.transit_time, 0), COALESCE(op.carrier_code, ''), op.created_at,
+	COALESCE(op.updated_at, op.created_at), COALESCE(op.last_seen_at, op.created_at)`
+
+func scanOceanProduct(row rowScanner) (OceanProduct, error) {
+	var p OceanProduct
+	err := row.Scan(&p.ID, &p.CarrierProductID, &p.ProductValidToDate, &p.ProductValidFromDate,
+		&p.OriginCity, &p.OriginName, &p.OriginCountry, &p.OriginPortUNLoCode,
+		&p.OriginCarrierSiteGeoID, &p.OriginCarrierCityGeoID,
+		&p.DestinationCity, &p.DestinationName, &p.DestinationCountry, &p.DestinationPortUNLoCode,
+		&p.DestinationCarrierSiteGeoID, &p.DestinationCarrierCityGeoID,
+		&p.DepartureVesselCarrierCode, &p.DepartureVesselName, &p.DepartureVesselIMONumber,
+		&p.DepartureVesselMMSI, &p.DepartureDateTime, &p.ArrivalDateTime, &p.TransitTime, &p.CarrierCode,
+		&p.CreatedAt, &p.UpdatedAt, &p.LastSeenAt)
+	return p, err
+}
+
+// GetOceanProductsForVessel returns the stored schedules a vessel appears on,
+// either as the first departure vessel or on one of the transport legs.
+func GetOceanProductsForVessel(db *sql.DB, imo string, limit int) ([]OceanProduct, error) {
+	rows, err := db.Query(`
+		SELECT `+oceanProductColumns+`
+		FROM ocean_products op
+		WHERE op.departure_vessel_imo_number = $1
+		   OR EXISTS (
+				SELECT 1 FROM ocean_product_legs pl
+				JOIN transport_legs tl ON tl.id = pl.transport_leg_id
+				WHERE pl.ocean_product_id = op.id AND tl.vessel_imo_number = $1
+		   )
+		ORDER BY op.departure_date_time DESC
+		LIMIT $2`, imo, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting ocean products for vessel: %w", err)
+	}
+	defer rows.Close()
+
+	products := []OceanProduct{}
+	for rows.Next() {
+		p, err := scanOceanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+// StoredOceanProduct is a schedule read back from ocean_products, in the
+// same shape /search returns, plus its change tracking timestamps.
+type StoredOceanProduct struct {
+	models.ReducedOceanProduct
+	UpdatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// ScheduleFilter holds the optional criteria of QueryOceanProducts. Zero
+// values leave a criterion out.
+type ScheduleFilter struct {
+	OriginUnLoCode      string
+	DestinationUnLoCode string
+	DepartureFrom       time.Time
+	DepartureTo         time.Time
+	VesselIMONumber     string // departure vessel or any leg vessel
+	CarrierCode         string
+	MaxTransitMinutes   int
+	ChangedSince        time.Time
+	IDs                 []int64
+	Limit               int
+	Offset              int
+}
+
+func QueryOceanProducts(db *sql.DB, filter ScheduleFilter) ([]StoredOceanProduct, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.OriginUnLoCode != "" {
+		conditions = append(conditions, "op.origin_port_un_lo_code = "+addArg(filter.OriginUnLoCode))
+	}
+	if filter.DestinationUnLoCode != "" {
+		conditions = append(conditions, "op.destination_port_un_lo_code = "+addArg(filter.DestinationUnLoCode))
+	}
+	if !filter.DepartureFrom.IsZero() {
+		conditions = append(conditions, "op.departure_date_time >= "+addArg(filter.DepartureFrom))
+	}
+	if !filter.DepartureTo.IsZero() {
+		conditions = append(conditions, "op.departure_date_time < "+addArg(filter.DepartureTo))
+	}
+	if filter.VesselIMONumber != "" {
+		p := addArg(filter.VesselIMONumber)
+		conditions = append(conditions, fmt.Sprintf(`(op.departure_vessel_imo_number = %s OR EXISTS (
+			SELECT 1 FROM ocean_product_legs pl JOIN transport_legs tl ON tl.id = pl.transport_leg_id
+			WHERE pl.ocean_product_id = op.id AND tl.vessel_imo_number = %s))`, p, p))
+	}
+	if filter.CarrierCode != "" {
+		conditions = append(conditions, "op.carrier_code = "+addArg(filter.CarrierCode))
+	}
+	if filter.MaxTransitMinutes > 0 {
+		conditions = append(conditions, "op.transit_time <= "+addArg(filter.MaxTransitMinutes))
+	}
+	if !filter.ChangedSince.IsZero() {
+		conditions = append(conditions, "COALESCE(op.updated_at, op.created_at) > "+addArg(filter.ChangedSince))
+	}
+
+	if filter.IDs != nil {
+		conditions = append(conditions, "op.id = ANY("+addArg(pq.Array(filter.IDs))+")")
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ocean_products op `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting ocean products: %w", err)
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM ocean_products op %s
+		ORDER BY op.departure_date_time, op.id LIMIT %s OFFSET %s`,
+		oceanProductColumns, where, addArg(filter.Limit), addArg(filter.Offset))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying ocean products: %w", err)
+	}
+	defer rows.Close()
+
+	var stored []OceanProduct
+	var ids []int64
+	for rows.Next() {
+		p, err := scanOceanProduct(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		stored = append(stored, p)
+		ids = append(ids, int64(p.ID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	legs, err := getTransportLegs(db, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	products := make([]StoredOceanProduct, 0, len(stored))
+	for _, p := range stored {
+		reduced := p.toReduced()
+		reduced.TransportLegs = legs[int64(p.ID)]
+		if reduced.TransportLegs == nil {
+			reduced.TransportLegs = []models.ReducedTransportLeg{}
+		}
+		products = append(products, StoredOceanProduct{
+			ReducedOceanProduct: reduced,
+			UpdatedAt:           p.UpdatedAt,
+			LastSeenAt:          p.LastSeenAt,
+		})
+	}
+
+	return products, total, nil
+}
+
+// GetLaneLastFetch returns when a lane was last fetched from a carrier, i.e.
+// the most recent time any of its products was seen.
+func GetLaneLastFetch(db *sql.DB, origin, destination string) (time.Time, error) {
+	var lastFetch sql.NullTime
+	err := db.QueryRow(`
+		SELECT MAX(last_seen_at) FROM ocean_products
+		WHERE origin_port_un_lo_code = $1 AND destination_port_un_lo_code = $2`,
+		origin, destination).Scan(&lastFetch)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting lane last fetch: %w", err)
+	}
+	return lastFetch.Time, nil
+}
+
+// GetDroppedOceanProducts returns the ids of lane products that were still
+// returned after since but not by the latest fetch of the lane.
+func GetDroppedOceanProducts(db *sql.DB, origin, destination string, since, lastFetch time.Time) ([]int64, error) {
+	rows, err := db.Query(`
+		SELECT id FROM ocean_products
+		WHERE origin_port_un_lo_code = $1 AND destination_port_un_lo_code = $2
+		  AND last_seen_at > $3 AND last_seen_at < $4
+		ORDER BY id`, origin, destination, since, lastFetch.Add(-laneFetchTolerance))
+	if err != nil {
+		return nil, fmt.Errorf("error getting dropped ocean products: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// laneFetchTolerance absorbs the time it takes to save one fetch, so the
+// products written at the start of the latest fetch are not reported as dropped.
+const laneFetchTolerance = time.Minute
+
+const transportLegColumns = `pl.ocean_product_id,
+	COALESCE(tl.departure_date_time, '0001-01-01'), COALESCE(tl.arrival_date_time, '0001-01-01'),
+	COALESCE(tl.vessel_carrier_code, ''), COALESCE(tl.vessel_name, ''),
+	COALESCE(tl.vessel_imo_number, ''), COALESCE(tl.vessel_mmsi, ''),
+	COALESCE(tl.origin_city, ''), COALESCE(tl.origin_name, ''), COALESCE(tl.origin_country, ''),
+	COALESCE(tl.origin_port_un_lo_code, ''), COALESCE(tl.origin_carrier_site_geo_id, ''),
+	COALESCE(tl.origin_carrier_city_geo_id, ''),
+	COALESCE(tl.destination_city, ''), COALESCE(tl.destination_name, ''), COALESCE(tl.destination_country, ''),
+	COALESCE(tl.destination_port_un_lo_code, ''), COALESCE(tl.destination_carrier_site_geo_id, ''),
+	COALESCE(tl.destination_carrier_city_geo_id, ''),
+	COALESCE(tl.transport_mode, ''), COALESCE(tl.carrier_service_code, ''), COALESCE(tl.carrier_service_name, ''),
+	COALESCE(tl.carrier_departure_voyage_number, ''), COALESCE(tl.carrier_trade_lane_name, ''),
+	COALESCE(tl.link_direction, '')`
+
+// getTransportLegs loads the legs of several products at once, keyed by
+// product id and in the order of the product.
+func getTransportLegs(db *sql.DB, productIDs []int64) (map[int64][]models.ReducedTransportLeg, error) {
+	legs := make(map[int64][]models.ReducedTransportLeg)
+	if len(productIDs) == 0 {
+		return legs, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT `+transportLegColumns+`
+		FROM ocean_product_legs pl
+		JOIN transport_legs tl ON tl.id = pl.transport_leg_id
+		WHERE pl.ocean_product_id = ANY($1)
+		ORDER BY pl.ocean_product_id, pl.sequence`, pq.Array(productIDs))
+	if err != nil {
+		return nil, fmt.Errorf("error getting transport legs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var productID int64
+		var leg models.ReducedTransportLeg
+		var departure, arrival time.Time
+		err := rows.Scan(&productID, &departure, &arrival,
+			&leg.VesselCarrierCode, &leg.VesselName, &leg.VesselIMONumber, &leg.VesselMMSI,
+			&leg.OriginCity, &leg.OriginName, &leg.OriginCountry, &leg.OriginPortUnLoCode,
+			&leg.OriginCarrierSiteGeoID, &leg.OriginCarrierCityGeoID,
+			&leg.DestinationCity, &leg.DestinationName, &leg.DestinationCountry, &leg.DestinationPortUnLoCode,
+			&leg.DestinationCarrierSiteGeoID, &leg.DestinationCarrierCityGeoID,
+			&leg.TransportMode, &leg.CarrierServiceCode, &leg.CarrierServiceName,
+			&leg.CarrierDepartureVoyageNumber, &leg.CarrierTradeLaneName, &leg.LinkDirection)
+		if err != nil {
+			return nil, err
+		}
+		leg.DepartureDateTime = models.CustomTime{Time: departure}
+		leg.ArrivalDateTime = models.CustomTime{Time: arrival}
+		legs[productID] = append(legs[productID], leg)
+	}
+	return legs, rows.Err()
+}
+
+func (p OceanProduct) toReduced() models.ReducedOceanProduct {
+	return models.ReducedOceanProduct{
+		ID:                          int64(p.ID),
+		CarrierProductID:            p.CarrierProductID,
+		CarrierCode:                 p.CarrierCode,
+		ProductValidToDate:          models.CustomTime{Time: p.ProductValidToDate},
+		ProductValidFromDate:        models.CustomTime{Time: p.ProductValidFromDate},
+		OriginCity:                  p.OriginCity,
+		OriginName:                  p.OriginName,
+		OriginCountry:               p.OriginCountry,
+		OriginPortUnLoCode:          p.OriginPortUNLoCode,
+		OriginCarrierSiteGeoID:      p.OriginCarrierSiteGeoID,
+		OriginCarrierCityGeoID:      p.OriginCarrierCityGeoID,
+		DestinationCity:             p.DestinationCity,
+		DestinationName:             p.DestinationName,
+		DestinationCountry:          p.DestinationCountry,
+		DestinationPortUnLoCode:     p.DestinationPortUNLoCode,
+		DestinationCarrierSiteGeoID: p.DestinationCarrierSiteGeoID,
+		DestinationCarrierCityGeoID: p.DestinationCarrierCityGeoID,
+		DepartureVesselCarrierCode:  p.DepartureVesselCarrierCode,
+		DepartureVesselName:         p.DepartureVesselName,
+		DepartureVesselIMONumber:    p.DepartureVesselIMONumber,
+		DepartureVesselMMSI:         p.DepartureVesselMMSI,
+		DepartureDateTime:           models.CustomTime{Time: p.DepartureDateTime},
+		ArrivalDateTime:             models.CustomTime{Time: p.ArrivalDateTime},
+		TransitTime:                 int32(p.TransitTime),
+	}
+}
@@ -0,0 +1,314 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Only the legs departing in the weeks up to the last known departure of a
+// service go into its loop, a couple of rotations of a long loop
+const serviceLoopWindow = 16 * 7 * 24 * time.Hour
+
+// ServiceLoop is a carrier service as seen through the transport legs stored
+// by schedule searches, within serviceLoopWindow of its last departure. The
+// carrier is the one selling the schedules the legs belong to: carriers do
+// not coordinate their service codes, so a loop is a carrier and a code.
+type ServiceLoop struct {
+	CarrierCode   string            `json:"carrier_code"`
+	ServiceCode   string            `json:"service_code"`
+	ServiceName   string            `json:"service_name"`
+	TradeLanes    []string          `json:"trade_lanes"`
+	VoyageCount   int               `json:"voyage_count"`
+	Vessels       []string          `json:"vessels"` // IMO numbers
+	LastDeparture time.Time         `json:"last_departure"`
+	Rotations     []ServiceRotation `json:"rotations"`
+}
+
+// ServiceRotation is the port sequence of a loop in one direction, taken
+// from the voyage that covers the most ports.
+type ServiceRotation struct {
+	Direction       string        `json:"direction"`
+	VoyageNumber    string        `json:"voyage_number"`
+	VesselIMONumber string        `json:"vessel_imo_number"`
+	Ports           []ServicePort `json:"ports"`
+}
+
+type ServicePort struct {
+	Unlocode string `json:"unlocode"`
+	Name     string `json:"name"`
+	Country  string `json:"country"`
+}
+
+type ServiceFilter struct {
+	CarrierCode string
+	ServiceCode string
+	Port        string // UN/LOCODE called at by the loop
+	TradeLane   string
+	Limit       int
+	Offset      int
+}
+
+// serviceLegs joins the transport legs to the carriers of the products they
+// belong to; a leg shared by vessel sharing partners counts for each.
+const serviceLegs = `transport_legs tl
+	JOIN ocean_product_legs pl ON pl.transport_leg_id = tl.id
+	JOIN ocean_products op ON op.id = pl.ocean_product_id`
+
+// SearchServices lists service loops ordered by service code and carrier,
+// with the total count for pagination.
+func SearchServices(db *sql.DB, filter ServiceFilter) ([]ServiceLoop, int, error) {
+	where := []string{"tl.carrier_service_code <> ''", "op.carrier_code <> ''"}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.CarrierCode != "" {
+		where = append(where, "op.carrier_code = "+arg(filter.CarrierCode))
+	}
+	if filter.ServiceCode != "" {
+		where = append(where, "tl.carrier_service_code = "+arg(filter.ServiceCode))
+	}
+	if filter.TradeLane != "" {
+		where = append(where, "tl.carrier_trade_lane_name = "+arg(filter.TradeLane))
+	}
+	if filter.Port != "" {
+		p := arg(filter.Port)
+		where = append(where, fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM transport_legs p
+			JOIN ocean_product_legs ppl ON ppl.transport_leg_id = p.id
+			JOIN ocean_products pop ON pop.id = ppl.ocean_product_id
+			WHERE p.carrier_service_code = tl.carrier_service_code
+			  AND pop.carrier_code = op.carrier_code
+			  AND (p.origin_port_un_lo_code = %s OR p.destination_port_un_lo_code = %s))`, p, p))
+	}
+
+	var total int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT DISTINCT op.carrier_code, tl.carrier_service_code
+			FROM `+serviceLegs+`
+			WHERE `+strings.Join(where, " AND ")+`
+		) services`, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting services: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT op.carrier_code, tl.carrier_service_code
+		FROM `+serviceLegs+`
+		WHERE `+strings.Join(where, " AND ")+`
+		GROUP BY op.carrier_code, tl.carrier_service_code
+		ORDER BY tl.carrier_service_code, op.carrier_code
+		LIMIT `+arg(filter.Limit)+` OFFSET `+arg(filter.Offset), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching services: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []serviceKey
+	for rows.Next() {
+		var key serviceKey
+		if err := rows.Scan(&key.carrier, &key.code); err != nil {
+			return nil, 0, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	services, err := getServiceLoops(db, keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	return services, total, nil
+}
+
+// GetService returns the loop a carrier runs under a service code.
+func GetService(db *sql.DB, carrier, code string) (ServiceLoop, error) {
+	services, err := getServiceLoops(db, []serviceKey{{carrier, code}})
+	if err != nil {
+		return ServiceLoop{}, err
+	}
+	if len(services) == 0 {
+		return ServiceLoop{}, fmt.Errorf("service %w", ErrNotFound)
+	}
+	return services[0], nil
+}
+
+type serviceKey struct {
+	carrier string
+	code    string
+}
+
+type serviceCall struct {
+	port ServicePort
+	at   time.Time
+}
+
+type serviceVoyage struct {
+	direction string
+	voyage    string
+	imo       string
+	calls     []serviceCall
+}
+
+// getServiceLoops rebuilds the loops of the given services from their recent
+// legs.
+// A leg only covers the stretch a product used, so the calls of all legs of a
+// voyage are merged by time to recover its rotation.
+func getServiceLoops(db *sql.DB, keys []serviceKey) ([]ServiceLoop, error) {
+	if len(keys) == 0 {
+		return []ServiceLoop{}, nil
+	}
+	carriers := make([]string, len(keys))
+	codes := make([]string, len(keys))
+	for i, k := range keys {
+		carriers[i], codes[i] = k.carrier, k.code
+	}
+
+	rows, err := db.Query(`
+		WITH legs AS (
+			SELECT DISTINCT op.carrier_code, tl.id, tl.carrier_service_code, tl.departure_date_time
+			FROM `+serviceLegs+`
+			JOIN unnest($1::text[], $2::text[]) AS wanted(carrier_code, service_code)
+				ON wanted.service_code = tl.carrier_service_code AND wanted.carrier_code = op.carrier_code
+		), latest AS (
+			SELECT carrier_code, carrier_service_code, MAX(departure_date_time) AS last_departure
+			FROM legs
+			GROUP BY carrier_code, carrier_service_code
+		)
+		SELECT legs.carrier_code, tl.carrier_service_code, COALESCE(tl.carrier_service_name, ''),
+			COALESCE(tl.carrier_trade_lane_name, ''), COALESCE(tl.link_direction, ''),
+			COALESCE(tl.carrier_departure_voyage_number, ''), COALESCE(tl.vessel_imo_number, ''),
+			COALESCE(tl.origin_port_un_lo_code, ''), COALESCE(tl.origin_name, ''), COALESCE(tl.origin_country, ''),
+			COALESCE(tl.destination_port_un_lo_code, ''), COALESCE(tl.destination_name, ''), COALESCE(tl.destination_country, ''),
+			tl.departure_date_time, tl.arrival_date_time
+		FROM legs
+		JOIN latest ON latest.carrier_code = legs.carrier_code AND latest.carrier_service_code = legs.carrier_service_code
+		JOIN transport_legs tl ON tl.id = legs.id
+		WHERE tl.departure_date_time >= latest.last_departure - $3 * interval '1 second'
+		  AND tl.arrival_date_time IS NOT NULL
+		ORDER BY legs.carrier_code, tl.carrier_service_code, tl.departure_date_time`,
+		pq.Array(carriers), pq.Array(codes), serviceLoopWindow.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error getting service legs: %w", err)
+	}
+	defer rows.Close()
+
+	loops := make(map[serviceKey]*ServiceLoop)
+	voyages := make(map[serviceKey]map[string]*serviceVoyage)
+	for rows.Next() {
+		var carrier, code, name, lane, direction, voyage, imo string
+		var from, to ServicePort
+		var departure, arrival time.Time
+		err := rows.Scan(&carrier, &code, &name, &lane, &direction, &voyage, &imo,
+			&from.Unlocode, &from.Name, &from.Country,
+			&to.Unlocode, &to.Name, &to.Country,
+			&departure, &arrival)
+		if err != nil {
+			return nil, err
+		}
+
+		k := serviceKey{carrier, code}
+		loop, ok := loops[k]
+		if !ok {
+			loop = &ServiceLoop{CarrierCode: carrier, ServiceCode: code, TradeLanes: []string{}, Vessels: []string{}}
+			loops[k] = loop
+			voyages[k] = make(map[string]*serviceVoyage)
+		}
+		if name != "" {
+			loop.ServiceName = name
+		}
+		loop.TradeLanes = appendUnique(loop.TradeLanes, lane)
+		loop.Vessels = appendUnique(loop.Vessels, imo)
+		if departure.After(loop.LastDeparture) {
+			loop.LastDeparture = departure
+		}
+
+		key := direction + "|" + voyage + "|" + imo
+		v, ok := voyages[k][key]
+		if !ok {
+			v = &serviceVoyage{direction: direction, voyage: voyage, imo: imo}
+			voyages[k][key] = v
+		}
+		v.calls = append(v.calls, serviceCall{from, departure}, serviceCall{to, arrival})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	services := make([]ServiceLoop, 0, len(keys))
+	for _, k := range keys {
+		loop, ok := loops[k]
+		if !ok {
+			continue
+		}
+		loop.VoyageCount = len(voyages[k])
+		loop.Rotations = serviceRotations(voyages[k])
+		services = append(services, *loop)
+	}
+	return services, nil
+}
+
+// serviceRotations keeps, per direction, the voyage calling at the most
+// ports, the latest one on ties.
+func serviceRotations(voyages map[string]*serviceVoyage) []ServiceRotation {
+	best := make(map[string]ServiceRotation)
+	bestAt := make(map[string]time.Time)
+
+	for _, v := range voyages {
+		sort.SliceStable(v.calls, func(i, j int) bool { return v.calls[i].at.Before(v.calls[j].at) })
+
+		ports := []ServicePort{}
+		for _, c := range v.calls {
+			if c.port.Unlocode == "" {
+				continue
+			}
+			if len(ports) > 0 && ports[len(ports)-1].Unlocode == c.port.Unlocode {
+				continue
+			}
+			ports = append(ports, c.port)
+		}
+
+		last := v.calls[len(v.calls)-1].at
+		current, ok := best[v.direction]
+		if ok && (len(ports) < len(current.Ports) ||
+			len(ports) == len(current.Ports) && !last.After(bestAt[v.direction])) {
+			continue
+		}
+		best[v.direction] = ServiceRotation{
+			Direction:       v.direction,
+			VoyageNumber:    v.voyage,
+			VesselIMONumber: v.imo,
+			Ports:           ports,
+		}
+		bestAt[v.direction] = last
+	}
+
+	rotations := make([]ServiceRotation, 0, len(best))
+	for _, r := range best {
+		rotations = append(rotations, r)
+	}
+	sort.Slice(rotations, func(i, j int) bool { return rotations[i].Direction < rotations[j].Direction })
+	return rotations
+}
+
+func appendUnique(list []string, v string) []string {
+	if v == "" {
+		return list
+	}
+	for _, s := range list {
+		if s == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
@@ -0,0 +1,338 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+	aisstream "github.com/aisstream/ais-message-models/golang/aisStream"
+)
+
+// Where vessel identities and particulars come from
+const (
+	VesselSourceAIS     = "AIS"
+	VesselSourceCarrier = "CARRIER"
+	VesselSourceManual  = "MANUAL"
+)
+
+// VesselIdentity is what a vessel went by between ValidFrom and ValidTo,
+// nil for its current identity.
+type VesselIdentity struct {
+	MMSI       string     `json:"mmsi,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	CallSign   string     `json:"call_sign,omitempty"`
+	Flag       string     `json:"flag,omitempty"`
+	Source     string     `json:"source"`
+	ValidFrom  time.Time  `json:"valid_from"`
+	ValidTo    *time.Time `json:"valid_to"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+}
+
+// VesselParticulars are the static characteristics of a vessel. Nil fields
+// are unknown.
+type VesselParticulars struct {
+	ShipType  *int       `json:"ship_type"` // AIS ship and cargo type, 70-79 is cargo
+	LengthM   *float64   `json:"length_m"`
+	BeamM     *float64   `json:"beam_m"`
+	DraughtM  *float64   `json:"draught_m"`
+	DWT       *int       `json:"dwt"`
+	TEU       *int       `json:"teu"`
+	BuildYear *int       `json:"build_year"`
+	Source    string     `json:"source,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// normalizeVesselText upper-cases and collapses the spaces of names and call
+// signs, and drops the "@" AIS pads text fields with, so that spelling
+// differences between sources are not taken for a change.
+func normalizeVesselText(s string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(strings.ReplaceAll(s, "@", " ")), " "))
+}
+
+// recordVesselIdentity applies an observed identity to a vessel. Blank
+// fields are unknown and keep the current value. Once AIS has reported the
+// vessel, carrier data only fills in a missing MMSI, name or call sign: AIS
+// is what the ship itself broadcasts, carriers lag behind renames. A change
+// closes the current identity and opens a new one; the same identity only
+// moves its last_seen_at. An MMSI taken over from another vessel is
+// released there first.
+func recordVesselIdentity(tx *sql.Tx, vesselID int, observed VesselIdentity, observedAt time.Time) error {
+	observedAt = observedAt.UTC()
+
+	var aisReported bool
+	var currentID sql.NullInt64
+	var current VesselIdentity
+	err := tx.QueryRow(`
+		SELECT v.ais_static_at IS NOT NULL, i.id,
+			COALESCE(i.mmsi, ''), COALESCE(i.name, ''), COALESCE(i.call_sign, ''), COALESCE(i.flag, '')
+		FROM vessels v
+		LEFT JOIN vessel_identities i ON i.vessel_id = v.id AND i.valid_to IS NULL
+		WHERE v.id = $1
+		FOR UPDATE OF v
+	`, vesselID).Scan(&aisReported, &currentID, &current.MMSI, &current.Name, &current.CallSign, &current.Flag)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("vessel %d %w", vesselID, ErrNotFound)
+		}
+		return err
+	}
+
+	next := current
+	authoritative := observed.Source != VesselSourceCarrier || !aisReported
+	apply := func(field *string, value string, overrides bool) {
+		if value != "" && (overrides || *field == "") {
+			*field = value
+		}
+	}
+	apply(&next.MMSI, strings.TrimSpace(observed.MMSI), authoritative)
+	apply(&next.Name, normalizeVesselText(observed.Name), authoritative)
+	apply(&next.CallSign, normalizeVesselText(observed.CallSign), authoritative)
+	apply(&next.Flag, strings.ToUpper(strings.TrimSpace(observed.Flag)), true)
+
+	if next == current {
+		if !currentID.Valid {
+			return nil
+		}
+		_, err := tx.Exec(`
+			UPDATE vessel_identities SET last_seen_at = GREATEST(last_seen_at, $2) WHERE id = $1
+		`, currentID.Int64, observedAt)
+		return err
+	}
+
+	if next.MMSI != "" && next.MMSI != current.MMSI {
+		_, err := tx.Exec(`
+			WITH released AS (
+				UPDATE vessels SET mmsi = NULL WHERE mmsi = $1 AND id <> $2 RETURNING id
+			), closed AS (
+				UPDATE vessel_identities i SET valid_to = GREATEST(i.valid_from, $3)
+				FROM released r
+				WHERE i.vessel_id = r.id AND i.valid_to IS NULL
+				RETURNING i.vessel_id, i.name, i.call_sign, i.flag, i.source, i.valid_to, i.last_seen_at
+			)
+			INSERT INTO vessel_identities (vessel_id, mmsi, name, call_sign, flag, source, valid_from, last_seen_at)
+			SELECT vessel_id, NULL, name, call_sign, flag, source, valid_to, GREATEST(last_seen_at, valid_to)
+			FROM closed
+		`, next.MMSI, vesselID, observedAt)
+		if err != nil {
+			return fmt.Errorf("error releasing MMSI %s: %w", next.MMSI, err)
+		}
+	}
+
+	validFrom := observedAt
+	if currentID.Valid {
+		err := tx.QueryRow(`
+			UPDATE vessel_identities SET valid_to = GREATEST(valid_from, $2) WHERE id = $1 RETURNING valid_to
+		`, currentID.Int64, observedAt).Scan(&validFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO vessel_identities (vessel_id, mmsi, name, call_sign, flag, source, valid_from, last_seen_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6, $7, $7)
+	`, vesselID, next.MMSI, next.Name, next.CallSign, next.Flag, observed.Source, validFrom)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE vessels
+		SET mmsi = NULLIF($2, ''), name = NULLIF($3, ''), call_sign = NULLIF($4, ''), flag = NULLIF($5, '')
+		WHERE id = $1
+	`, vesselID, next.MMSI, next.Name, next.CallSign, next.Flag)
+	return err
+}
+
+// updateVesselParticulars sets the known fields of p, leaving the others as
+// they are.
+func updateVesselParticulars(db execer, vesselID int, p VesselParticulars, source string, at time.Time) error {
+	_, err := db.Exec(`
+		UPDATE vessels SET
+			ship_type = COALESCE($2, ship_type),
+			length_m = COALESCE($3, length_m),
+			beam_m = COALESCE($4, beam_m),
+			draught_m = COALESCE($5, draught_m),
+			dwt = COALESCE($6, dwt),
+			teu = COALESCE($7, teu),
+			build_year = COALESCE($8, build_year),
+			particulars_source = $9,
+			particulars_updated_at = $10
+		WHERE id = $1
+	`, vesselID, p.ShipType, p.LengthM, p.BeamM, p.DraughtM, p.DWT, p.TEU, p.BuildYear, source, at.UTC())
+	return err
+}
+
+// UpdateVesselParticulars records particulars entered by hand, typically
+// DWT, TEU and build year, which neither AIS nor carriers send.
+func UpdateVesselParticulars(db *sql.DB, vesselID int, p VesselParticulars) error {
+	if err := updateVesselParticulars(db, vesselID, p, VesselSourceManual, time.Now()); err != nil {
+		return fmt.Errorf("error updating particulars of vessel %d: %w", vesselID, err)
+	}
+	return nil
+}
+
+// RecordShipStaticData applies an AIS static report to the vessel with its
+// IMO number, or with the MMSI when the report has no valid IMO number: the
+// name and call sign go through the identity history, type, dimensions and
+// draught into the particulars. Vessels we do not know are ignored.
+func RecordShipStaticData(db *sql.DB, mmsi string, data aisstream.ShipStaticData, timestamp models.CustomTime) error {
+	observedAt := timestamp.Time
+	if observedAt.IsZero() {
+		observedAt = time.Now()
+	}
+
+	var vessel Vessel
+	var err error
+	if data.ImoNumber >= 1000000 && data.ImoNumber <= 9999999 {
+		vessel, err = GetVesselByIMO(db, strconv.Itoa(int(data.ImoNumber)))
+	} else {
+		vessel, err = GetVesselByMMSI(db, mmsi)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var p VesselParticulars
+	if data.Type > 0 {
+		shipType := int(data.Type)
+		p.ShipType = &shipType
+	}
+	if length := float64(data.Dimension.A + data.Dimension.B); length > 0 {
+		p.LengthM = &length
+	}
+	if beam := float64(data.Dimension.C + data.Dimension.D); beam > 0 {
+		p.BeamM = &beam
+	}
+	if data.MaximumStaticDraught > 0 {
+		draught := data.MaximumStaticDraught
+		p.DraughtM = &draught
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	identity := VesselIdentity{
+		MMSI:     mmsi,
+		Name:     data.Name,
+		CallSign: data.CallSign,
+		Source:   VesselSourceAIS,
+	}
+	if err := recordVesselIdentity(tx, vessel.ID, identity, observedAt); err != nil {
+		return fmt.Errorf("error recording identity of vessel %d: %w", vessel.ID, err)
+	}
+	if err := updateVesselParticulars(tx, vessel.ID, p, VesselSourceAIS, observedAt); err != nil {
+		return fmt.Errorf("error updating particulars of vessel %d: %w", vessel.ID, err)
+	}
+	_, err = tx.Exec(`
+		UPDATE vessels SET ais_static_at = GREATEST(ais_static_at, $2) WHERE id = $1
+	`, vessel.ID, observedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func GetVesselParticulars(db *sql.DB, vesselID int) (VesselParticulars, error) {
+	var p VesselParticulars
+	var shipType, dwt, teu, buildYear sql.NullInt64
+	var length, beam, draught sql.NullFloat64
+	var updatedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT ship_type, length_m, beam_m, draught_m, dwt, teu, build_year,
+			COALESCE(particulars_source, ''), particulars_updated_at
+		FROM vessels WHERE id = $1
+	`, vesselID).Scan(&shipType, &length, &beam, &draught, &dwt, &teu, &buildYear, &p.Source, &updatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return VesselParticulars{}, fmt.Errorf("vessel %w", ErrNotFound)
+		}
+		return VesselParticulars{}, fmt.Errorf("error getting vessel particulars: %w", err)
+	}
+
+	p.ShipType = nullIntPtr(shipType)
+	p.DWT = nullIntPtr(dwt)
+	p.TEU = nullIntPtr(teu)
+	p.BuildYear = nullIntPtr(buildYear)
+	p.LengthM = nullFloatPtr(length)
+	p.BeamM = nullFloatPtr(beam)
+	p.DraughtM = nullFloatPtr(draught)
+	if updatedAt.Valid {
+		p.UpdatedAt = &updatedAt.Time
+	}
+	return p, nil
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+func nullFloatPtr(n sql.NullFloat64) *float64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Float64
+}
+
+// GetVesselIdentities returns the identity history of a vessel, the current
+// identity first.
+func GetVesselIdentities(db *sql.DB, vesselID int) ([]VesselIdentity, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(mmsi, ''), COALESCE(name, ''), COALESCE(call_sign, ''), COALESCE(flag, ''),
+			source, valid_from, valid_to, last_seen_at
+		FROM vessel_identities
+		WHERE vessel_id = $1
+		ORDER BY valid_to DESC NULLS FIRST, valid_from DESC
+	`, vesselID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting vessel identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []VesselIdentity{}
+	for rows.Next() {
+		var i VesselIdentity
+		var validTo sql.NullTime
+		if err := rows.Scan(&i.MMSI, &i.Name, &i.CallSign, &i.Flag, &i.Source, &i.ValidFrom, &validTo, &i.LastSeenAt); err != nil {
+			return nil, err
+		}
+		if validTo.Valid {
+			i.ValidTo = &validTo.Time
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// GetVesselByFormerMMSI finds the vessel that last went by an MMSI it no
+// longer uses.
+func GetVesselByFormerMMSI(db *sql.DB, mmsi string) (Vessel, error) {
+	var vesselID int
+	err := db.QueryRow(`
+		SELECT vessel_id FROM vessel_identities
+		WHERE mmsi = $1
+		ORDER BY valid_to DESC NULLS FIRST
+		LIMIT 1
+	`, mmsi).Scan(&vesselID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Vessel{}, fmt.Errorf("vessel %w", ErrNotFound)
+		}
+		return Vessel{}, fmt.Errorf("error getting vessel: %w", err)
+	}
+	return GetVesselByID(db, vesselID)
+}
@@ -0,0 +1,327 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Route types of vessel_routes
+const (
+	RouteDeparture    = "DEPARTURE"     // first vessel of the product
+	RouteTransportLeg = "TRANSPORT_LEG" // vessel of one of its legs
+)
+
+// linkVesselRoutes adds the missing vessel routes matching condition, on
+// l.ocean_product_id and l.imo_number. Products whose vessel is not stored
+// yet are linked when the vessel is.
+func linkVesselRoutes(db execer, condition string, args ...interface{}) error {
+	_, err := db.Exec(`
+		INSERT INTO vessel_routes (vessel_id, ocean_product_id, route_type, transport_leg_id)
+		SELECT DISTINCT l.vessel_id, l.ocean_product_id, l.route_type, l.transport_leg_id
+		FROM (
+			SELECT v.id AS vessel_id, op.id AS ocean_product_id, '`+RouteDeparture+`' AS route_type,
+				   NULL::integer AS transport_leg_id, v.imo_number
+			FROM ocean_products op
+			JOIN vessels v ON v.imo_number = op.departure_vessel_imo_number
+			UNION ALL
+			SELECT v.id, pl.ocean_product_id, '`+RouteTransportLeg+`', tl.id, v.imo_number
+			FROM ocean_product_legs pl
+			JOIN transport_legs tl ON tl.id = pl.transport_leg_id
+			JOIN vessels v ON v.imo_number = tl.vessel_imo_number
+		) l
+		WHERE `+condition+`
+		AND NOT EXISTS (
+			SELECT 1 FROM vessel_routes r
+			WHERE r.vessel_id = l.vessel_id AND r.ocean_product_id = l.ocean_product_id
+			  AND r.route_type = l.route_type AND r.transport_leg_id IS NOT DISTINCT FROM l.transport_leg_id
+		)`, args...)
+	if err != nil {
+		return fmt.Errorf("error linking vessel routes: %w", err)
+	}
+	return nil
+}
+
+// LinkVesselRoutes links a vessel that was just stored to the products
+// naming it by IMO number.
+func LinkVesselRoutes(db *sql.DB, imo string) error {
+	if imo == "" {
+		return nil
+	}
+	return linkVesselRoutes(db, "l.imo_number = $1", imo)
+}
+
+// VesselScheduleLeg is a leg of a product the vessel sails.
+type VesselScheduleLeg struct {
+	TransportLegID      int       `json:"transport_leg_id"`
+	OriginUnLoCode      string    `json:"origin_un_lo_code"`
+	DestinationUnLoCode string    `json:"destination_un_lo_code"`
+	DepartureDateTime   time.Time `json:"departure_date_time"`
+	ArrivalDateTime     time.Time `json:"arrival_date_time"`
+	ServiceCode         string    `json:"service_code"`
+	VoyageNumber        string    `json:"voyage_number"`
+}
+
+// VesselSchedule is a product a vessel serves. VesselDeparture is when the
+// vessel's part of it starts: the first of its legs, else the product
+// departure.
+type VesselSchedule struct {
+	OceanProductID      int                 `json:"ocean_product_id"`
+	CarrierCode         string              `json:"carrier_code"`
+	OriginUnLoCode      string              `json:"origin_un_lo_code"`
+	DestinationUnLoCode string              `json:"destination_un_lo_code"`
+	DepartureDateTime   time.Time           `json:"departure_date_time"`
+	ArrivalDateTime     time.Time           `json:"arrival_date_time"`
+	TransitTime         int                 `json:"transit_time"`
+	RouteTypes          []string            `json:"route_types"`
+	VesselDeparture     time.Time           `json:"vessel_departure"`
+	Legs                []VesselScheduleLeg `json:"legs"`
+}
+
+// VesselScheduleFilter selects the products of one vessel by when its part
+// starts. Zero times leave a bound out.
+type VesselScheduleFilter struct {
+	VesselID int
+	From     time.Time
+	To       time.Time
+	Limit    int
+	Offset   int
+}
+
+// GetVesselSchedules returns the products a vessel serves, in the order it
+// sails them, with the legs it carries.
+func GetVesselSchedules(db *sql.DB, filter VesselScheduleFilter) ([]VesselSchedule, int, error) {
+	args := []interface{}{filter.VesselID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	having := []string{"true"}
+	if !filter.From.IsZero() {
+		having = append(having, "MIN(COALESCE(tl.departure_date_time, op.departure_date_time)) >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		having = append(having, "MIN(COALESCE(tl.departure_date_time, op.departure_date_time)) < "+arg(filter.To))
+	}
+
+	var total int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT op.id
+			FROM vessel_routes r
+			JOIN ocean_products op ON op.id = r.ocean_product_id
+			LEFT JOIN transport_legs tl ON tl.id = r.transport_leg_id
+			WHERE r.vessel_id = $1
+			GROUP BY op.id
+			HAVING `+strings.Join(having, " AND ")+`
+		) s`, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting vessel schedules: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT op.id, COALESCE(op.carrier_code, ''),
+			   COALESCE(op.origin_port_un_lo_code, ''), COALESCE(op.destination_port_un_lo_code, ''),
+			   COALESCE(op.departure_date_time, '0001-01-01'), COALESCE(op.arrival_date_time, '0001-01-01'),
+			   COALESCE(op.transit_time, 0), array_agg(DISTINCT r.route_type),
+			   MIN(COALESCE(tl.departure_date_time, op.departure_date_time, '0001-01-01')) AS vessel_departure
+		FROM vessel_routes r
+		JOIN ocean_products op ON op.id = r.ocean_product_id
+		LEFT JOIN transport_legs tl ON tl.id = r.transport_leg_id
+		WHERE r.vessel_id = $1
+		GROUP BY op.id
+		HAVING `+strings.Join(having, " AND ")+`
+		ORDER BY vessel_departure, op.id
+		LIMIT `+arg(filter.Limit)+` OFFSET `+arg(filter.Offset), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting vessel schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := []VesselSchedule{}
+	var ids []int64
+	for rows.Next() {
+		var s VesselSchedule
+		if err := rows.Scan(&s.OceanProductID, &s.CarrierCode, &s.OriginUnLoCode, &s.DestinationUnLoCode,
+			&s.DepartureDateTime, &s.ArrivalDateTime, &s.TransitTime, pq.Array(&s.RouteTypes),
+			&s.VesselDeparture); err != nil {
+			return nil, 0, err
+		}
+		s.Legs = []VesselScheduleLeg{}
+		schedules = append(schedules, s)
+		ids = append(ids, int64(s.OceanProductID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(ids) == 0 {
+		return schedules, total, nil
+	}
+
+	legRows, err := db.Query(`
+		SELECT r.ocean_product_id, tl.id,
+			   COALESCE(tl.origin_port_un_lo_code, ''), COALESCE(tl.destination_port_un_lo_code, ''),
+			   COALESCE(tl.departure_date_time, '0001-01-01'), COALESCE(tl.arrival_date_time, '0001-01-01'),
+			   COALESCE(tl.carrier_service_code, ''), COALESCE(tl.carrier_departure_voyage_number, '')
+		FROM vessel_routes r
+		JOIN transport_legs tl ON tl.id = r.transport_leg_id
+		WHERE r.vessel_id = $1 AND r.ocean_product_id = ANY($2)
+		ORDER BY tl.departure_date_time`, filter.VesselID, pq.Array(ids))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting vessel schedule legs: %w", err)
+	}
+	defer legRows.Close()
+
+	legs := make(map[int][]VesselScheduleLeg)
+	for legRows.Next() {
+		var productID int
+		var l VesselScheduleLeg
+		if err := legRows.Scan(&productID, &l.TransportLegID, &l.OriginUnLoCode, &l.DestinationUnLoCode,
+			&l.DepartureDateTime, &l.ArrivalDateTime, &l.ServiceCode, &l.VoyageNumber); err != nil {
+			return nil, 0, err
+		}
+		legs[productID] = append(legs[productID], l)
+	}
+	if err := legRows.Err(); err != nil {
+		return nil, 0, err
+	}
+	for i := range schedules {
+		if l, ok := legs[schedules[i].OceanProductID]; ok {
+			schedules[i].Legs = l
+		}
+	}
+	return schedules, total, nil
+}
+
+// LaneDeparture is an upcoming product of a lane on a given vessel.
+type LaneDeparture struct {
+	OceanProductID    int       `json:"ocean_product_id"`
+	CarrierCode       string    `json:"carrier_code"`
+	DepartureDateTime time.Time `json:"departure_date_time"`
+	ArrivalDateTime   time.Time `json:"arrival_date_time"`
+	TransitTime       int       `json:"transit_time"`
+	RouteTypes        []string  `json:"route_types"`
+}
+
+// LaneVessel is a vessel serving a lane, with its next departures on it.
+type LaneVessel struct {
+	VesselID      int             `json:"vessel_id"`
+	IMONumber     string          `json:"imo_number"`
+	MMSI          string          `json:"mmsi"`
+	Name          string          `json:"name"`
+	Carriers      []string        `json:"carriers"`
+	Products      int             `json:"products"`
+	NextDeparture time.Time       `json:"next_departure"`
+	Departures    []LaneDeparture `json:"departures"`
+}
+
+// LaneVesselFilter selects the products of a lane by departure. Zero times
+// leave a bound out.
+type LaneVesselFilter struct {
+	Origin      string
+	Destination string
+	From        time.Time
+	To          time.Time
+	// Departures listed per vessel
+	Departures int
+	Limit      int
+	Offset     int
+}
+
+// GetLaneVessels returns the vessels serving the products of a lane, the
+// soonest departing first, each with its first departures.
+func GetLaneVessels(db *sql.DB, filter LaneVesselFilter) ([]LaneVessel, int, error) {
+	args := []interface{}{filter.Origin, filter.Destination}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{"op.origin_port_un_lo_code = $1", "op.destination_port_un_lo_code = $2"}
+	if !filter.From.IsZero() {
+		where = append(where, "op.departure_date_time >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "op.departure_date_time < "+arg(filter.To))
+	}
+	lane := `
+		FROM vessel_routes r
+		JOIN ocean_products op ON op.id = r.ocean_product_id
+		JOIN vessels v ON v.id = r.vessel_id
+		WHERE ` + strings.Join(where, " AND ")
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(DISTINCT v.id) `+lane, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting lane vessels: %w", err)
+	}
+
+	// Pagination and the departure cap come after the shared arguments
+	filterArgs := len(args)
+	rows, err := db.Query(`
+		SELECT v.id, COALESCE(v.imo_number, ''), COALESCE(v.mmsi, ''), COALESCE(v.name, ''),
+			   array_agg(DISTINCT COALESCE(op.carrier_code, '')), COUNT(DISTINCT op.id),
+			   MIN(COALESCE(op.departure_date_time, '0001-01-01')) AS next_departure
+		`+lane+`
+		GROUP BY v.id
+		ORDER BY next_departure, v.id
+		LIMIT `+arg(filter.Limit)+` OFFSET `+arg(filter.Offset), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting lane vessels: %w", err)
+	}
+	defer rows.Close()
+
+	vessels := []LaneVessel{}
+	index := make(map[int]int)
+	var ids []int64
+	for rows.Next() {
+		var v LaneVessel
+		if err := rows.Scan(&v.VesselID, &v.IMONumber, &v.MMSI, &v.Name, pq.Array(&v.Carriers),
+			&v.Products, &v.NextDeparture); err != nil {
+			return nil, 0, err
+		}
+		v.Departures = []LaneDeparture{}
+		index[v.VesselID] = len(vessels)
+		vessels = append(vessels, v)
+		ids = append(ids, int64(v.VesselID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(ids) == 0 {
+		return vessels, total, nil
+	}
+
+	args = args[:filterArgs]
+	departureRows, err := db.Query(`
+		SELECT vessel_id, id, carrier_code, departure_date_time, arrival_date_time, transit_time, route_types
+		FROM (
+			SELECT v.id AS vessel_id, op.id, COALESCE(op.carrier_code, '') AS carrier_code,
+				   COALESCE(op.departure_date_time, '0001-01-01') AS departure_date_time, COALESCE(op.arrival_date_time, '0001-01-01') AS arrival_date_time,
+				   COALESCE(op.transit_time, 0) AS transit_time, array_agg(DISTINCT r.route_type) AS route_types,
+				   ROW_NUMBER() OVER (PARTITION BY v.id ORDER BY op.departure_date_time, op.id) AS n
+			`+lane+` AND v.id = ANY(`+arg(pq.Array(ids))+`)
+			GROUP BY v.id, op.id
+		) d
+		WHERE n <= `+arg(filter.Departures)+`
+		ORDER BY vessel_id, n`, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting lane departures: %w", err)
+	}
+	defer departureRows.Close()
+
+	for departureRows.Next() {
+		var vesselID int
+		var d LaneDeparture
+		if err := departureRows.Scan(&vesselID, &d.OceanProductID, &d.CarrierCode, &d.DepartureDateTime,
+			&d.ArrivalDateTime, &d.TransitTime, pq.Array(&d.RouteTypes)); err != nil {
+			return nil, 0, err
+		}
+		v := &vessels[index[vesselID]]
+		v.Departures = append(v.Departures, d)
+	}
+	return vessels, total, departureRows.Err()
+}
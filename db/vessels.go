@@ -4,24 +4,48 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/lib/pq"
 )
 
+// UpsertVessel counts an appearance of a vessel in carrier schedules. Its
+// MMSI, name, call sign and flag are an observation from carrier data: they
+// go through the identity history, which decides whether they change the
+// vessel, instead of overwriting it.
 func UpsertVessel(db *sql.DB, vessel Vessel) error {
-	_, err := db.Exec(`
-        INSERT INTO vessels (imo_number, mmsi, name, carrier_code, appearance_count)
-        VALUES ($1, $2, $3, $4, 1)
-        ON CONFLICT (imo_number) 
-        DO UPDATE SET 
-            mmsi = EXCLUDED.mmsi,
-            name = EXCLUDED.name,
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`
+        INSERT INTO vessels (imo_number, carrier_code, appearance_count)
+        VALUES ($1, $2, 1)
+        ON CONFLICT (imo_number)
+        DO UPDATE SET
             carrier_code = EXCLUDED.carrier_code,
             appearance_count = vessels.appearance_count + 1,
             last_seen = CURRENT_TIMESTAMP
-    `, vessel.IMONumber, vessel.MMSI, vessel.Name, vessel.CarrierCode)
+        RETURNING id
+    `, vessel.IMONumber, vessel.CarrierCode).Scan(&id)
+	if err != nil {
+		return err
+	}
 
-	return err
+	identity := VesselIdentity{
+		MMSI:     vessel.MMSI,
+		Name:     vessel.Name,
+		CallSign: vessel.CallSign,
+		Flag:     vessel.Flag,
+		Source:   VesselSourceCarrier,
+	}
+	if err := recordVesselIdentity(tx, id, identity, time.Now()); err != nil {
+		return fmt.Errorf("error recording identity of vessel %s: %w", vessel.IMONumber, err)
+	}
+	return tx.Commit()
 }
 
 func UpdateTrackedVessels(db *sql.DB, mmsis []string) (int64, error) {
@@ -52,7 +76,7 @@ func UpdateTrackedVessels(db *sql.DB, mmsis []string) (int64, error) {
 // GetTopVessels returns the most frequently appearing vessels
 func GetTopVessels(db *sql.DB, limit int) ([]Vessel, error) {
 	rows, err := db.Query(`
-        SELECT id, imo_number, mmsi, name, carrier_code, appearance_count, last_seen, created_at
+        SELECT id, imo_number, COALESCE(mmsi, ''), COALESCE(name, ''), carrier_code, appearance_count, last_seen, created_at
         FROM vessels
         ORDER BY appearance_count DESC, last_seen DESC
         LIMIT $1
@@ -76,77 +100,28 @@ func GetTopVessels(db *sql.DB, limit int) ([]Vessel, error) {
 }
 
 func GetVesselByMMSI(db *sql.DB, mmsi string) (Vessel, error) {
- 
-
-	var vessel Vessel
-	err := db.QueryRow(`
-	SELECT id, imo_number, mmsi, name, is_tracked, carrier_code, appearance_count, last_seen, created_at,
-			CASE 
-                WHEN last_known_position IS NOT NULL 
-                THEN ARRAY[ST_Y(last_known_position::geometry), ST_X(last_known_position::geometry)]
-                 ELSE ARRAY[]::float8[]
-            END as last_known_position 
-	 FROM vessels 
-	 WHERE mmsi = $1`, mmsi).Scan(
-		&vessel.ID,
-		&vessel.IMONumber,
-		&vessel.MMSI,
-		&vessel.Name,
-		&vessel.IsTracked,
-		&vessel.CarrierCode,
-		&vessel.AppearanceCount,
-		&vessel.LastSeen,
-		&vessel.CreatedAt,
-		pq.Array(&vessel.LastKnownPosition),
-	)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return Vessel{}, fmt.Errorf("vessel not found")
-		}
-		return Vessel{}, fmt.Errorf("error getting vessel: %w", err)
-	}
-	return vessel, nil
-
+	return getVesselWhere(db, "mmsi = $1", mmsi)
 }
 
 func GetVesselByIMO(db *sql.DB, imo string) (Vessel, error) {
+	return getVesselWhere(db, "imo_number = $1", imo)
+}
 
-	var vessel Vessel
-	err := db.QueryRow(`SELECT 
-	id, imo_number, mmsi, name, is_tracked, carrier_code, appearance_count,
-	 last_seen, created_at,
-    		CASE 
-                WHEN last_known_position IS NOT NULL 
-                THEN ARRAY[ST_Y(last_known_position::geometry), ST_X(last_known_position::geometry)]
-                 ELSE ARRAY[]::float8[]
-            END as last_known_position 
-	   FROM vessels WHERE imo_number = $1`, imo).Scan(
-		&vessel.ID,
-		&vessel.IMONumber,
-		&vessel.MMSI,
-		&vessel.Name,
-		&vessel.IsTracked,
-		&vessel.CarrierCode,
-		&vessel.AppearanceCount,
-		&vessel.LastSeen,
-		&vessel.CreatedAt,
-		pq.Array(&vessel.LastKnownPosition),
-	)
-
+func getVesselWhere(db *sql.DB, condition string, args ...interface{}) (Vessel, error) {
+	vessel, err := scanVessel(db.QueryRow(`SELECT `+vesselColumns+` FROM vessels WHERE `+condition, args...))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return Vessel{}, fmt.Errorf("vessel not found")
+			return Vessel{}, fmt.Errorf("vessel %w", ErrNotFound)
 		}
 		return Vessel{}, fmt.Errorf("error getting vessel: %w", err)
 	}
 	return vessel, nil
-
 }
+
 func GetVesselsByIMOs(db *sql.DB, imos []string) (map[string]Vessel, error) {
 	// Use a single query with IN clause
 	query := `
-        SELECT imo_number, mmsi, name, carrier_code,         
+        SELECT imo_number, COALESCE(mmsi, ''), COALESCE(name, ''), carrier_code,         
 		CASE 
                 WHEN last_known_position IS NOT NULL 
                 THEN ARRAY[ST_Y(last_known_position::geometry), ST_X(last_known_position::geometry)]
@@ -199,3 +174,140 @@ func GetVesselLastKnownPosition(db *sql.DB, imo string) ([]float64, error) {
 
 	return []float64{lat, lon}, err
 }
+
+const vesselColumns = `id, imo_number, COALESCE(mmsi, ''), COALESCE(name, ''),
+	COALESCE(call_sign, ''), COALESCE(flag, ''), is_tracked,
+	COALESCE(carrier_code, ''), appearance_count, last_seen, created_at,
+	CASE
+		WHEN last_known_position IS NOT NULL
+		THEN ARRAY[ST_Y(last_known_position::geometry), ST_X(last_known_position::geometry)]
+		ELSE ARRAY[]::float8[]
+	END as last_known_position`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanVessel(row rowScanner) (Vessel, error) {
+	var v Vessel
+	err := row.Scan(&v.ID, &v.IMONumber, &v.MMSI, &v.Name, &v.CallSign, &v.Flag, &v.IsTracked, &v.CarrierCode,
+		&v.AppearanceCount, &v.LastSeen, &v.CreatedAt, pq.Array(&v.LastKnownPosition))
+	return v, err
+}
+
+func GetVesselByID(db *sql.DB, id int) (Vessel, error) {
+	return getVesselWhere(db, "id = $1", id)
+}
+
+// VesselFilter holds the optional criteria of SearchVessels. Zero values
+// leave a criterion out.
+type VesselFilter struct {
+	Name        string
+	Fuzzy       bool // trigram similarity on Name instead of a prefix match
+	IMONumber   string
+	MMSI        string
+	CarrierCode string
+	Tracked     *bool
+	SeenSince   time.Time
+	HasPosition *bool
+	Sort        string // one of vesselSortColumns, "-" prefix for descending
+	Limit       int
+	Offset      int
+}
+
+var vesselSortColumns = map[string]string{
+	"name":             "name",
+	"last_seen":        "last_seen",
+	"appearance_count": "appearance_count",
+	"created_at":       "created_at",
+}
+
+// SearchVessels returns one page of vessels matching the filter together
+// with the total number of matches.
+func SearchVessels(db *sql.DB, filter VesselFilter) ([]Vessel, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	orderBy := "appearance_count DESC, last_seen DESC"
+
+	if filter.Name != "" {
+		if filter.Fuzzy {
+			p := addArg(filter.Name)
+			conditions = append(conditions, fmt.Sprintf("(name %% %s OR name ILIKE '%%' || %s || '%%')", p, p))
+			orderBy = fmt.Sprintf("similarity(name, %s) DESC, appearance_count DESC", p)
+		} else {
+			conditions = append(conditions, "name ILIKE "+addArg(filter.Name+"%"))
+		}
+	}
+	if filter.IMONumber != "" {
+		conditions = append(conditions, "imo_number = "+addArg(filter.IMONumber))
+	}
+	if filter.MMSI != "" {
+		conditions = append(conditions, "mmsi = "+addArg(filter.MMSI))
+	}
+	if filter.CarrierCode != "" {
+		conditions = append(conditions, "carrier_code = "+addArg(filter.CarrierCode))
+	}
+	if filter.Tracked != nil {
+		conditions = append(conditions, "is_tracked = "+addArg(*filter.Tracked))
+	}
+	if !filter.SeenSince.IsZero() {
+		conditions = append(conditions, "last_seen >= "+addArg(filter.SeenSince))
+	}
+	if filter.HasPosition != nil {
+		if *filter.HasPosition {
+			conditions = append(conditions, "last_known_position IS NOT NULL")
+		} else {
+			conditions = append(conditions, "last_known_position IS NULL")
+		}
+	}
+
+	if filter.Sort != "" {
+		direction := "ASC"
+		key := filter.Sort
+		if strings.HasPrefix(key, "-") {
+			direction = "DESC"
+			key = key[1:]
+		}
+		column, ok := vesselSortColumns[key]
+		if !ok {
+			return nil, 0, fmt.Errorf("%w: unknown sort field %s", ErrInvalidFilter, key)
+		}
+		orderBy = fmt.Sprintf("%s %s NULLS LAST, id", column, direction)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM vessels `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting vessels: %w", err)
+	}
+
+	query := fmt.Sprintf(`SELECT %s FROM vessels %s ORDER BY %s LIMIT %s OFFSET %s`,
+		vesselColumns, where, orderBy, addArg(filter.Limit), addArg(filter.Offset))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching vessels: %w", err)
+	}
+	defer rows.Close()
+
+	vessels := []Vessel{}
+	for rows.Next() {
+		v, err := scanVessel(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		vessels = append(vessels, v)
+	}
+
+	return vessels, total, rows.Err()
+}
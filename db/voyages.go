@@ -0,0 +1,198 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Voyage is the passage of a vessel from its berth at one port to its berth
+// at the next, with the transport leg it fulfilled when one matches.
+type Voyage struct {
+	ID             int       `json:"id"`
+	MMSI           string    `json:"mmsi"`
+	FromUnlocode   string    `json:"from_unlocode"`
+	ToUnlocode     string    `json:"to_unlocode"`
+	FromStayID     *int      `json:"from_stay_id,omitempty"`
+	ToStayID       *int      `json:"to_stay_id,omitempty"`
+	DepartedAt     time.Time `json:"departed_at"`
+	ArrivedAt      time.Time `json:"arrived_at"`
+	DurationHours  float64   `json:"duration_hours"`
+	DistanceNM     float64   `json:"distance_nm"`
+	StoppedHours   float64   `json:"stopped_hours"`
+	AvgSpeedKnots  *float64  `json:"avg_speed_knots"`
+	PositionCount  int       `json:"position_count"`
+	TransportLegID *int      `json:"transport_leg_id,omitempty"`
+	// schedule of the linked leg
+	ScheduledDeparture *time.Time `json:"scheduled_departure,omitempty"`
+	ScheduledArrival   *time.Time `json:"scheduled_arrival,omitempty"`
+	ServiceCode        *string    `json:"service_code,omitempty"`
+}
+
+// VoyageBacklog returns the MMSIs with a berth stay started after the
+// arrival of their latest voyage.
+func VoyageBacklog(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT s.mmsi
+		FROM port_stays s
+		WHERE s.kind = 'berth'
+		AND s.started_at > COALESCE((SELECT MAX(v.arrived_at) FROM voyages v WHERE v.mmsi = s.mmsi), '-infinity')`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting voyage backlog: %w", err)
+	}
+	defer rows.Close()
+
+	var mmsis []string
+	for rows.Next() {
+		var mmsi string
+		if err := rows.Scan(&mmsi); err != nil {
+			return nil, err
+		}
+		mmsis = append(mmsis, mmsi)
+	}
+	return mmsis, rows.Err()
+}
+
+// GetBerthStaysSinceLastVoyage returns the berth stays of a vessel in order,
+// from the one its latest voyage arrived at.
+func GetBerthStaysSinceLastVoyage(db *sql.DB, mmsi string) ([]PortStay, error) {
+	rows, err := db.Query(`
+		SELECT id, mmsi, unlocode, kind, started_at, ended_at, position_count, closed, berth_stay_id
+		FROM port_stays
+		WHERE mmsi = $1 AND kind = 'berth'
+		AND started_at >= COALESCE((SELECT MAX(arrived_at) FROM voyages WHERE mmsi = $1), '-infinity')
+		ORDER BY started_at`, mmsi)
+	if err != nil {
+		return nil, fmt.Errorf("error getting berth stays: %w", err)
+	}
+	defer rows.Close()
+
+	var stays []PortStay
+	for rows.Next() {
+		var s PortStay
+		if err := rows.Scan(&s.ID, &s.MMSI, &s.Unlocode, &s.Kind, &s.StartedAt, &s.EndedAt,
+			&s.PositionCount, &s.Closed, &s.BerthStayID); err != nil {
+			return nil, err
+		}
+		stays = append(stays, s)
+	}
+	return stays, rows.Err()
+}
+
+// GetTrackBetween returns the positions of a vessel from one time to
+// another, both included, in order.
+func GetTrackBetween(db *sql.DB, mmsi string, from, to time.Time) ([]TrackPoint, error) {
+	rows, err := db.Query(`
+		SELECT timestamp, latitude, longitude, sog
+		FROM vessel_positions
+		WHERE mmsi = $1 AND timestamp BETWEEN $2 AND $3
+		ORDER BY timestamp`, mmsi, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error getting track: %w", err)
+	}
+	defer rows.Close()
+
+	var points []TrackPoint
+	for rows.Next() {
+		var p TrackPoint
+		if err := rows.Scan(&p.Timestamp, &p.Latitude, &p.Longitude, &p.Sog); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func SaveVoyage(db *sql.DB, v Voyage) error {
+	_, err := db.Exec(`
+		INSERT INTO voyages (mmsi, from_unlocode, to_unlocode, from_stay_id, to_stay_id, departed_at, arrived_at,
+			distance_nm, stopped_hours, avg_speed_knots, position_count)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (mmsi, departed_at) DO UPDATE SET
+			to_unlocode = EXCLUDED.to_unlocode,
+			to_stay_id = EXCLUDED.to_stay_id,
+			arrived_at = EXCLUDED.arrived_at,
+			distance_nm = EXCLUDED.distance_nm,
+			stopped_hours = EXCLUDED.stopped_hours,
+			avg_speed_knots = EXCLUDED.avg_speed_knots,
+			position_count = EXCLUDED.position_count,
+			transport_leg_id = CASE
+				WHEN voyages.to_unlocode = EXCLUDED.to_unlocode THEN voyages.transport_leg_id
+			END`,
+		v.MMSI, v.FromUnlocode, v.ToUnlocode, v.FromStayID, v.ToStayID, v.DepartedAt, v.ArrivedAt,
+		v.DistanceNM, v.StoppedHours, v.AvgSpeedKnots, v.PositionCount)
+	if err != nil {
+		return fmt.Errorf("error saving voyage: %w", err)
+	}
+	return nil
+}
+
+// LinkVoyages links the unlinked voyages that departed within lookback to
+// the transport leg of the same vessel between the same ports whose
+// scheduled departure is closest to the actual one, within tolerance. A leg
+// calling at ports in between spans several voyages and is not matched.
+func LinkVoyages(db *sql.DB, tolerance, lookback time.Duration) (int64, error) {
+	result, err := db.Exec(`
+		WITH matches AS (
+			SELECT v.id AS voyage_id, m.id AS leg_id
+			FROM voyages v
+			CROSS JOIN LATERAL (
+				SELECT t.id
+				FROM transport_legs t
+				LEFT JOIN vessels vs ON vs.imo_number = t.vessel_imo_number
+				WHERE (t.vessel_mmsi = v.mmsi OR vs.mmsi = v.mmsi)
+				AND t.origin_port_un_lo_code = v.from_unlocode
+				AND t.destination_port_un_lo_code = v.to_unlocode
+				AND t.departure_date_time BETWEEN v.departed_at - $1 * interval '1 second'
+											  AND v.departed_at + $1 * interval '1 second'
+				ORDER BY abs(EXTRACT(EPOCH FROM t.departure_date_time - v.departed_at)), t.id DESC
+				LIMIT 1
+			) m
+			WHERE v.transport_leg_id IS NULL AND v.departed_at > $2
+		)
+		UPDATE voyages SET transport_leg_id = matches.leg_id
+		FROM matches
+		WHERE voyages.id = matches.voyage_id`,
+		tolerance.Seconds(), time.Now().UTC().Add(-lookback))
+	if err != nil {
+		return 0, fmt.Errorf("error linking voyages: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// GetVoyages returns the voyages of a vessel, latest first, with the
+// schedule of the legs they fulfilled.
+func GetVoyages(db *sql.DB, mmsi string, limit, offset int) ([]Voyage, int, error) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM voyages WHERE mmsi = $1`, mmsi).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting voyages: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT v.id, v.mmsi, v.from_unlocode, v.to_unlocode, v.from_stay_id, v.to_stay_id,
+			   v.departed_at, v.arrived_at, EXTRACT(EPOCH FROM v.arrived_at - v.departed_at) / 3600,
+			   v.distance_nm, v.stopped_hours, v.avg_speed_knots, v.position_count, v.transport_leg_id,
+			   t.departure_date_time, t.arrival_date_time, t.carrier_service_code
+		FROM voyages v
+		LEFT JOIN transport_legs t ON t.id = v.transport_leg_id
+		WHERE v.mmsi = $1
+		ORDER BY v.departed_at DESC
+		LIMIT $2 OFFSET $3`, mmsi, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting voyages: %w", err)
+	}
+	defer rows.Close()
+
+	voyages := []Voyage{}
+	for rows.Next() {
+		var v Voyage
+		if err := rows.Scan(&v.ID, &v.MMSI, &v.FromUnlocode, &v.ToUnlocode, &v.FromStayID, &v.ToStayID,
+			&v.DepartedAt, &v.ArrivedAt, &v.DurationHours,
+			&v.DistanceNM, &v.StoppedHours, &v.AvgSpeedKnots, &v.PositionCount, &v.TransportLegID,
+			&v.ScheduledDeparture, &v.ScheduledArrival, &v.ServiceCode); err != nil {
+			return nil, 0, err
+		}
+		voyages = append(voyages, v)
+	}
+	return voyages, total, rows.Err()
+}
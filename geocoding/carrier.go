@@ -0,0 +1,32 @@
+package geocoding
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+// Carriers place a location on their terminal, which is close to but not
+// the reference point of the UN/LOCODE
+const carrierConfidence = 0.8
+
+// Carrier answers from the coordinates carriers reported in their
+// schedules, see db.RecordCarrierLocation.
+type Carrier struct {
+	Database *sql.DB
+}
+
+func (c Carrier) Name() string { return "carrier" }
+
+func (c Carrier) Geocode(ctx context.Context, q Query) (Result, error) {
+	lat, lon, _, err := db.GetCarrierLocation(c.Database, q.Unlocode)
+	if errors.Is(err, db.ErrNotFound) {
+		return Result{}, ErrNoMatch
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Latitude: lat, Longitude: lon, Confidence: carrierConfidence}, nil
+}
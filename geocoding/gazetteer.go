@@ -0,0 +1,111 @@
+package geocoding
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	gazetteerCodeConfidence = 0.95
+	gazetteerNameConfidence = 0.7
+)
+
+// Gazetteer answers from a local CSV file, loaded once. The header must
+// name latitude and longitude columns plus unlocode, or name and
+// country_code, or all three; a UN/LOCODE match wins over a name match.
+type Gazetteer struct {
+	byCode map[string]Result
+	byName map[string]Result
+}
+
+func LoadGazetteer(path string) (*Gazetteer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("gazetteer %s: reading header: %w", path, err)
+	}
+
+	col := make(map[string]int)
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	latCol, okLat := col["latitude"]
+	lonCol, okLon := col["longitude"]
+	if !okLat || !okLon {
+		return nil, fmt.Errorf("gazetteer %s: latitude and longitude columns are required", path)
+	}
+	codeCol, hasCode := col["unlocode"]
+	nameCol, hasName := col["name"]
+	countryCol, hasCountry := col["country_code"]
+
+	g := &Gazetteer{byCode: make(map[string]Result), byName: make(map[string]Result)}
+	field := func(record []string, i int) string {
+		if i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gazetteer %s: %w", path, err)
+		}
+
+		lat, errLat := strconv.ParseFloat(field(record, latCol), 64)
+		lon, errLon := strconv.ParseFloat(field(record, lonCol), 64)
+		if errLat != nil || errLon != nil {
+			continue
+		}
+
+		if hasCode {
+			if code := strings.ToUpper(field(record, codeCol)); code != "" {
+				g.byCode[code] = Result{Latitude: lat, Longitude: lon, Confidence: gazetteerCodeConfidence}
+			}
+		}
+		if hasName && hasCountry {
+			key := nameKey(field(record, nameCol), field(record, countryCol))
+			if _, dup := g.byName[key]; !dup {
+				g.byName[key] = Result{Latitude: lat, Longitude: lon, Confidence: gazetteerNameConfidence}
+			}
+		}
+	}
+
+	return g, nil
+}
+
+func (g *Gazetteer) Name() string { return "gazetteer" }
+
+func (g *Gazetteer) Geocode(ctx context.Context, q Query) (Result, error) {
+	if r, ok := g.byCode[strings.ToUpper(q.Unlocode)]; ok {
+		return r, nil
+	}
+	if r, ok := g.byName[nameKey(q.Name, q.CountryCode)]; ok {
+		return r, nil
+	}
+	return Result{}, ErrNoMatch
+}
+
+// Size is the number of entries loaded.
+func (g *Gazetteer) Size() int {
+	return len(g.byCode) + len(g.byName)
+}
+
+func nameKey(name, country string) string {
+	return strings.ToUpper(strings.TrimSpace(country)) + "|" + strings.ToLower(strings.TrimSpace(name))
+}
@@ -0,0 +1,31 @@
+// Package geocoding fills in the coordinates of UN/LOCODE locations that
+// were seeded without them, trying a chain of geocoders.
+package geocoding
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoMatch is returned by a geocoder that has no answer for the query.
+var ErrNoMatch = errors.New("no match")
+
+type Query struct {
+	Unlocode    string
+	Name        string
+	CountryCode string
+}
+
+type Result struct {
+	Latitude  float64
+	Longitude float64
+	// 0 to 1, how sure the geocoder is the point is the location
+	Confidence float64
+}
+
+// Geocoder resolves a location to coordinates. Name is stored as the
+// coordinates source.
+type Geocoder interface {
+	Name() string
+	Geocode(ctx context.Context, q Query) (Result, error)
+}
@@ -0,0 +1,123 @@
+package geocoding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNominatimURL = "https://nominatim.openstreetmap.org"
+	// Nominatim's usage policy allows one request per second
+	nominatimInterval = time.Second
+)
+
+type nominatimResult struct {
+	Lat        string  `json:"lat"`
+	Lon        string  `json:"lon"`
+	Importance float64 `json:"importance"`
+}
+
+// Nominatim geocodes by name and country on OpenStreetMap. Calls are spaced
+// by one second across all goroutines.
+type Nominatim struct {
+	BaseURL string
+	client  *http.Client
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func NewNominatim(baseURL string) *Nominatim {
+	if baseURL == "" {
+		baseURL = defaultNominatimURL
+	}
+	return &Nominatim{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *Nominatim) Name() string { return "nominatim" }
+
+func (n *Nominatim) Geocode(ctx context.Context, q Query) (Result, error) {
+	if err := n.wait(ctx); err != nil {
+		return Result{}, err
+	}
+
+	query := url.Values{}
+	query.Set("q", q.Name)
+	query.Set("countrycodes", strings.ToLower(q.CountryCode))
+	query.Set("format", "json")
+	query.Set("limit", "1")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.BaseURL+"/search?"+query.Encode(), nil)
+	if err != nil {
+		return Result{}, err
+	}
+	// Required by Nominatim's terms of use
+	req.Header.Set("User-Agent", "VesselTracker/1.0")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("nominatim error: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var results []nominatimResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		return Result{}, fmt.Errorf("nominatim: decoding body: %w", err)
+	}
+	if len(results) == 0 {
+		return Result{}, ErrNoMatch
+	}
+
+	lat, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return Result{}, err
+	}
+	lon, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// A name search can land on a namesake, importance is the best hint we get
+	confidence := results[0].Importance
+	if confidence <= 0 || confidence > 1 {
+		confidence = 0.5
+	}
+
+	return Result{Latitude: lat, Longitude: lon, Confidence: confidence}, nil
+}
+
+func (n *Nominatim) wait(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if d := nominatimInterval - time.Since(n.last); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	n.last = time.Now()
+	return nil
+}
@@ -0,0 +1,175 @@
+package geocoding
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+const (
+	idlePoll        = time.Minute
+	geocodeTimeout  = 15 * time.Second
+	firstRetryDelay = 15 * time.Minute
+	maxRetryDelay   = 30 * 24 * time.Hour
+)
+
+// Worker drains the geocode_queue table one location at a time, trying
+// each geocoder in order until one matches. The queue lives in the database
+// so pending work survives restarts.
+type Worker struct {
+	database  *sql.DB
+	geocoders []Geocoder
+	wake      chan struct{}
+}
+
+// GeocodersFromEnv builds the chain named by GEOCODERS, by default
+// "gazetteer,carrier,nominatim". The gazetteer reads GAZETTEER_FILE and is
+// skipped when unset; NOMINATIM_URL points at another Nominatim instance.
+func GeocodersFromEnv(database *sql.DB) []Geocoder {
+	names := os.Getenv("GEOCODERS")
+	if names == "" {
+		names = "gazetteer,carrier,nominatim"
+	}
+
+	var geocoders []Geocoder
+	for _, name := range strings.Split(names, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "gazetteer":
+			path := os.Getenv("GAZETTEER_FILE")
+			if path == "" {
+				continue
+			}
+			g, err := LoadGazetteer(path)
+			if err != nil {
+				log.Printf("Error loading gazetteer, skipping: %v", err)
+				continue
+			}
+			log.Printf("Loaded gazetteer %s with %d entries", path, g.Size())
+			geocoders = append(geocoders, g)
+		case "carrier":
+			geocoders = append(geocoders, Carrier{Database: database})
+		case "nominatim":
+			geocoders = append(geocoders, NewNominatim(os.Getenv("NOMINATIM_URL")))
+		default:
+			log.Printf("Unknown geocoder %q, skipping", name)
+		}
+	}
+	return geocoders
+}
+
+func NewWorker(database *sql.DB, geocoders []Geocoder) *Worker {
+	return &Worker{
+		database:  database,
+		geocoders: geocoders,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (w *Worker) Start() {
+	go w.run()
+}
+
+// Enqueue queues the locations among unLoCodes that lack coordinates.
+func (w *Worker) Enqueue(unLoCodes []string) (int64, error) {
+	n, err := db.EnqueueGeocoding(w.database, unLoCodes)
+	if n > 0 {
+		w.notify()
+	}
+	return n, err
+}
+
+// EnqueueAllMissing queues every location that lacks coordinates.
+func (w *Worker) EnqueueAllMissing() (int64, error) {
+	n, err := db.EnqueueAllMissingCoordinates(w.database)
+	if n > 0 {
+		w.notify()
+	}
+	return n, err
+}
+
+func (w *Worker) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run drains the due jobs, then waits for new ones or the next poll. Jobs
+// of locations that got coordinates elsewhere are pruned once per poll.
+func (w *Worker) run() {
+	for {
+		if _, err := db.PruneGeocodeQueue(w.database); err != nil {
+			log.Println(err)
+		}
+
+		for {
+			job, err := db.NextGeocodeJob(w.database)
+			if err != nil {
+				if !errors.Is(err, db.ErrNotFound) {
+					log.Println(err)
+				}
+				break
+			}
+			if err := w.process(job); err != nil {
+				// the job is still due, wait instead of retrying it at once
+				log.Println(err)
+				break
+			}
+		}
+
+		select {
+		case <-w.wake:
+		case <-time.After(idlePoll):
+		}
+	}
+}
+
+// process tries the geocoders in order. A job no geocoder matched, or whose
+// match could not be stored, is retried later so it is not picked up again
+// right away; the error says it could not be rescheduled either.
+func (w *Worker) process(job db.GeocodeJob) error {
+	q := Query{Unlocode: job.Unlocode, Name: job.Name, CountryCode: job.CountryCode}
+
+	var failures []string
+	for _, g := range w.geocoders {
+		ctx, cancel := context.WithTimeout(context.Background(), geocodeTimeout)
+		res, err := g.Geocode(ctx, q)
+		cancel()
+
+		if err == nil {
+			err := db.CompleteGeocodeJob(w.database, job.Unlocode, res.Latitude, res.Longitude, g.Name(), res.Confidence)
+			if err == nil {
+				log.Printf("Geocoded %s with %s (confidence %.2f)", job.Unlocode, g.Name(), res.Confidence)
+				return nil
+			}
+			log.Println(err)
+			failures = append(failures, fmt.Sprintf("storing the %s match: %v", g.Name(), err))
+			break
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", g.Name(), err))
+	}
+
+	next := time.Now().Add(retryDelay(job.Attempts))
+	return db.RetryGeocodeJob(w.database, job.Unlocode, strings.Join(failures, "; "), next)
+}
+
+// retryDelay quadruples from firstRetryDelay, so a location nobody knows
+// is retried a handful of times before settling at maxRetryDelay.
+func retryDelay(attempts int) time.Duration {
+	d := firstRetryDelay
+	for i := 0; i < attempts && d < maxRetryDelay; i++ {
+		d *= 4
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
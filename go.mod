@@ -6,10 +6,8 @@ require (
 	github.com/aisstream/ais-message-models/golang/aisStream v0.0.0-20230628154343-8650fc5bf8c3
 	github.com/cridenour/go-postgis v1.0.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
 )
 
-require (
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/rs/cors v1.11.1 // indirect
-)
+require github.com/rs/cors v1.11.1 // indirect
@@ -0,0 +1,409 @@
+// Package maersk is the HTTP client of the Maersk APIs. All calls go through
+// one shared http.Client, a token-bucket rate limiter and a circuit breaker,
+// and are retried on 429 and 5xx answers.
+package maersk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+const (
+	defaultBaseURL    = "https://api.maersk.com"
+	defaultTimeout    = 30 * time.Second
+	defaultRate       = 5 // requests per second
+	defaultBurst      = 10
+	defaultMaxRetries = 3
+	maxBackoff        = 10 * time.Second
+)
+
+// Endpoint names, as reported in the metrics
+const (
+	EndpointOceanProducts = "ocean-products"
+	EndpointLocations     = "locations"
+	EndpointToken         = "token"
+)
+
+// APIError is a non-2xx answer of the Maersk API.
+type APIError struct {
+	Endpoint string
+	Status   int
+	Body     string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("maersk %s API error: status %d, body: %s", e.Endpoint, e.Status, e.Body)
+}
+
+// IsNotFound reports whether err is a 404 of the Maersk API, which the
+// ocean-products and locations endpoints use for "no result".
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
+
+type Config struct {
+	BaseURL      string
+	ConsumerKey  string
+	ClientSecret string // enables OAuth client-credentials tokens when set
+	Timeout      time.Duration
+	Rate         float64 // requests per second
+	Burst        int
+	MaxRetries   int
+}
+
+// ConfigFromEnv reads MAERSK_BASE_URL, CONSUMER_KEY, MAERSK_CLIENT_SECRET,
+// MAERSK_TIMEOUT, MAERSK_RATE_PER_SECOND, MAERSK_BURST and MAERSK_MAX_RETRIES.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		BaseURL:      os.Getenv("MAERSK_BASE_URL"),
+		ConsumerKey:  os.Getenv("CONSUMER_KEY"),
+		ClientSecret: os.Getenv("MAERSK_CLIENT_SECRET"),
+		Timeout:      defaultTimeout,
+		Rate:         defaultRate,
+		Burst:        defaultBurst,
+		MaxRetries:   defaultMaxRetries,
+	}
+	if v := os.Getenv("MAERSK_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			cfg.Timeout = d
+		} else {
+			log.Printf("Invalid MAERSK_TIMEOUT %q, using %v", v, cfg.Timeout)
+		}
+	}
+	if v := os.Getenv("MAERSK_RATE_PER_SECOND"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			cfg.Rate = f
+		} else {
+			log.Printf("Invalid MAERSK_RATE_PER_SECOND %q, using %v", v, cfg.Rate)
+		}
+	}
+	if v := os.Getenv("MAERSK_BURST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.Burst = n
+		} else {
+			log.Printf("Invalid MAERSK_BURST %q, using %d", v, cfg.Burst)
+		}
+	}
+	if v := os.Getenv("MAERSK_MAX_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.MaxRetries = n
+		} else {
+			log.Printf("Invalid MAERSK_MAX_RETRIES %q, using %d", v, cfg.MaxRetries)
+		}
+	}
+	return cfg
+}
+
+type Client struct {
+	baseURL      string
+	consumerKey  string
+	clientSecret string
+	maxRetries   int
+
+	http    *http.Client
+	limiter *tokenBucket
+	breaker *circuitBreaker
+	metrics *Metrics
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewClient(cfg Config) *Client {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultBaseURL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = defaultRate
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = defaultBurst
+	}
+
+	return &Client{
+		baseURL:      strings.TrimRight(cfg.BaseURL, "/"),
+		consumerKey:  cfg.ConsumerKey,
+		clientSecret: cfg.ClientSecret,
+		maxRetries:   cfg.MaxRetries,
+		http: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+		limiter: newTokenBucket(cfg.Rate, cfg.Burst),
+		breaker: newCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown),
+		metrics: newMetrics(),
+	}
+}
+
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+)
+
+// Default returns the process-wide client configured from the environment.
+func Default() *Client {
+	defaultClientOnce.Do(func() {
+		defaultClient = NewClient(ConfigFromEnv())
+	})
+	return defaultClient
+}
+
+// Metrics returns a snapshot of the per-endpoint counters.
+func (c *Client) Metrics() map[string]EndpointMetrics {
+	return c.metrics.Snapshot()
+}
+
+// BreakerState reports the circuit breaker state: closed, open or half-open.
+func (c *Client) BreakerState() string {
+	return c.breaker.State()
+}
+
+// OceanProducts calls /products/ocean-products. A 404 means no sailings and
+// comes back as an empty result.
+func (c *Client) OceanProducts(ctx context.Context, query url.Values) (models.MaerskPointToPoint, error) {
+	body, err := c.get(ctx, EndpointOceanProducts, "/products/ocean-products", query)
+	if err != nil {
+		if IsNotFound(err) {
+			return models.MaerskPointToPoint{}, nil
+		}
+		return models.MaerskPointToPoint{}, err
+	}
+	return models.UnmarshalMaerskPointToPoint(body)
+}
+
+// Locations calls /reference-data/locations.
+func (c *Client) Locations(ctx context.Context, query url.Values) ([]models.MaerskLocation, error) {
+	body, err := c.get(ctx, EndpointLocations, "/reference-data/locations", query)
+	if err != nil {
+		return nil, err
+	}
+	var locations []models.MaerskLocation
+	if err := json.Unmarshal(body, &locations); err != nil {
+		return nil, fmt.Errorf("maersk %s: decoding body: %w", EndpointLocations, err)
+	}
+	return locations, nil
+}
+
+// get sends a GET with retries. Each attempt waits for the rate limiter and
+// is refused while the breaker is open.
+func (c *Client) get(ctx context.Context, endpoint, path string, query url.Values) ([]byte, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var lastErr error
+	refreshedToken := false
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			c.metrics.retry(endpoint)
+		}
+
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		if !c.breaker.Allow() {
+			c.metrics.rejected(endpoint)
+			return nil, fmt.Errorf("maersk %s: %w", endpoint, ErrCircuitOpen)
+		}
+
+		body, status, retryAfter, err := c.attempt(ctx, endpoint, target)
+		switch {
+		case err == nil && status < 300:
+			c.breaker.Success()
+			return body, nil
+		case err == nil && status == http.StatusUnauthorized && c.clientSecret != "" && !refreshedToken:
+			// Token revoked or expired early, fetch a new one once
+			c.breaker.Success()
+			c.invalidateToken()
+			refreshedToken = true
+			attempt--
+			continue
+		case err == nil && !retryable(status):
+			// The API answered, the request itself is at fault
+			c.breaker.Success()
+			return nil, &APIError{Endpoint: endpoint, Status: status, Body: string(body)}
+		case err == nil:
+			c.breaker.Failure()
+			lastErr = &APIError{Endpoint: endpoint, Status: status, Body: string(body)}
+		default:
+			if ctx.Err() != nil {
+				// The caller gave up, which says nothing about the API
+				c.breaker.Abort()
+				return nil, err
+			}
+			c.breaker.Failure()
+			lastErr = err
+		}
+
+		if attempt == c.maxRetries {
+			break
+		}
+
+		wait := retryAfter
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		log.Printf("Maersk %s attempt %d failed (%v), retrying in %v", endpoint, attempt+1, lastErr, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (c *Client) attempt(ctx context.Context, endpoint, target string) ([]byte, int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Consumer-Key", c.consumerKey)
+
+	if c.clientSecret != "" {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	res, err := c.http.Do(req)
+	if err != nil {
+		c.metrics.record(endpoint, 0, time.Since(start), err)
+		return nil, 0, 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	c.metrics.record(endpoint, res.StatusCode, time.Since(start), err)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return body, res.StatusCode, parseRetryAfter(res.Header.Get("Retry-After")), nil
+}
+
+// accessToken returns a cached OAuth token, fetching a new one with the
+// client-credentials grant a minute before it expires.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", c.consumerKey)
+	form.Set("client_secret", c.clientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.baseURL+"/customer-identity/oauth/v2/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Consumer-Key", c.consumerKey)
+
+	start := time.Now()
+	res, err := c.http.Do(req)
+	if err != nil {
+		c.metrics.record(EndpointToken, 0, time.Since(start), err)
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	c.metrics.record(EndpointToken, res.StatusCode, time.Since(start), err)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", &APIError{Endpoint: EndpointToken, Status: res.StatusCode, Body: string(body)}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("maersk %s: decoding body: %w", EndpointToken, err)
+	}
+
+	c.token = token.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+func (c *Client) invalidateToken() {
+	c.tokenMu.Lock()
+	c.token = ""
+	c.tokenMu.Unlock()
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff is exponential from 500ms with full jitter, capped at maxBackoff.
+func backoff(attempt int) time.Duration {
+	d := 500 * time.Millisecond << attempt
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// parseRetryAfter accepts both forms of the header: delay seconds or an
+// HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
@@ -0,0 +1,262 @@
+package maersk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubAPI answers the Maersk endpoints with the statuses queued per path,
+// then 200, and keeps the time of every call.
+type stubAPI struct {
+	mu       sync.Mutex
+	statuses map[string][]int
+	headers  map[string]http.Header
+	calls    map[string][]time.Time
+}
+
+func newStubAPI(t *testing.T) (*stubAPI, *httptest.Server) {
+	stub := &stubAPI{
+		statuses: map[string][]int{},
+		headers:  map[string]http.Header{},
+		calls:    map[string][]time.Time{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		stub.calls[r.URL.Path] = append(stub.calls[r.URL.Path], time.Now())
+		status := http.StatusOK
+		if queued := stub.statuses[r.URL.Path]; len(queued) > 0 {
+			status, stub.statuses[r.URL.Path] = queued[0], queued[1:]
+			for k, v := range stub.headers[r.URL.Path] {
+				w.Header()[k] = v
+			}
+		}
+		stub.mu.Unlock()
+
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(`[]`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return stub, srv
+}
+
+func (s *stubAPI) queue(path string, statuses ...int) {
+	s.mu.Lock()
+	s.statuses[path] = append(s.statuses[path], statuses...)
+	s.mu.Unlock()
+}
+
+func (s *stubAPI) callTimes(path string) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.calls[path]...)
+}
+
+const locationsPath = "/reference-data/locations"
+
+func TestRetriesRateLimitedHonoringRetryAfter(t *testing.T) {
+	stub, srv := newStubAPI(t)
+	stub.queue(locationsPath, http.StatusTooManyRequests)
+	stub.headers[locationsPath] = http.Header{"Retry-After": []string{"1"}}
+
+	client := NewClient(Config{BaseURL: srv.URL, MaxRetries: 2})
+	if _, err := client.Locations(context.Background(), nil); err != nil {
+		t.Fatalf("Locations: %v", err)
+	}
+
+	calls := stub.callTimes(locationsPath)
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls, want 2", len(calls))
+	}
+	if gap := calls[1].Sub(calls[0]); gap < 900*time.Millisecond {
+		t.Errorf("retried after %v, want the 1s of Retry-After", gap)
+	}
+
+	m := client.Metrics()[EndpointLocations]
+	if m.Requests != 2 || m.RateLimited != 1 || m.Retries != 1 || m.Errors != 1 {
+		t.Errorf("metrics = %+v, want 2 requests, 1 rate limited, 1 retry, 1 error", m)
+	}
+}
+
+func TestRetriesServerErrorsThenGivesUp(t *testing.T) {
+	stub, srv := newStubAPI(t)
+	stub.queue(locationsPath, http.StatusBadGateway, http.StatusServiceUnavailable)
+
+	client := NewClient(Config{BaseURL: srv.URL, MaxRetries: 3})
+	if _, err := client.Locations(context.Background(), nil); err != nil {
+		t.Fatalf("Locations: %v", err)
+	}
+	m := client.Metrics()[EndpointLocations]
+	if m.Requests != 3 || m.ServerErrors != 2 || m.Retries != 2 {
+		t.Errorf("metrics = %+v, want 3 requests, 2 server errors, 2 retries", m)
+	}
+
+	stub.queue(locationsPath, http.StatusInternalServerError, http.StatusInternalServerError)
+	client = NewClient(Config{BaseURL: srv.URL, MaxRetries: 1})
+	_, err := client.Locations(context.Background(), nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusInternalServerError {
+		t.Fatalf("err = %v, want the last 500", err)
+	}
+
+	// a client error is not retried
+	stub.queue(locationsPath, http.StatusBadRequest)
+	client = NewClient(Config{BaseURL: srv.URL, MaxRetries: 3})
+	if _, err := client.Locations(context.Background(), nil); err == nil {
+		t.Fatal("want the 400 back")
+	}
+	if m := client.Metrics()[EndpointLocations]; m.Requests != 1 || m.Retries != 0 {
+		t.Errorf("metrics = %+v, want a single request", m)
+	}
+}
+
+func TestBreakerOpensHalfOpensAndCloses(t *testing.T) {
+	stub, srv := newStubAPI(t)
+	client := NewClient(Config{BaseURL: srv.URL, MaxRetries: 0})
+	client.breaker = newCircuitBreaker(2, 100*time.Millisecond)
+	ctx := context.Background()
+
+	stub.queue(locationsPath, http.StatusInternalServerError, http.StatusInternalServerError)
+	client.Locations(ctx, nil)
+	client.Locations(ctx, nil)
+	if state := client.BreakerState(); state != breakerOpen {
+		t.Fatalf("state after 2 failures = %s, want open", state)
+	}
+
+	_, err := client.Locations(ctx, nil)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if n := len(stub.callTimes(locationsPath)); n != 2 {
+		t.Errorf("open breaker let a call through: %d calls", n)
+	}
+	if m := client.Metrics()[EndpointLocations]; m.CircuitRefused != 1 {
+		t.Errorf("circuit refused = %d, want 1", m.CircuitRefused)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if state := client.BreakerState(); state != breakerHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half-open", state)
+	}
+
+	// a failed probe opens it again
+	stub.queue(locationsPath, http.StatusInternalServerError)
+	client.Locations(ctx, nil)
+	if state := client.BreakerState(); state != breakerOpen {
+		t.Fatalf("state after failed probe = %s, want open", state)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if _, err := client.Locations(ctx, nil); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if state := client.BreakerState(); state != breakerClosed {
+		t.Errorf("state after successful probe = %s, want closed", state)
+	}
+}
+
+func TestRateLimiterSpacesRequests(t *testing.T) {
+	stub, srv := newStubAPI(t)
+	client := NewClient(Config{BaseURL: srv.URL, Rate: 20, Burst: 1})
+
+	for i := 0; i < 4; i++ {
+		if _, err := client.Locations(context.Background(), nil); err != nil {
+			t.Fatalf("Locations: %v", err)
+		}
+	}
+
+	calls := stub.callTimes(locationsPath)
+	for i := 1; i < len(calls); i++ {
+		// 20 per second is one every 50ms, allow for timer slack
+		if gap := calls[i].Sub(calls[i-1]); gap < 40*time.Millisecond {
+			t.Errorf("call %d came %v after the previous one, want ~50ms", i, gap)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newTokenBucket(1, 1).Wait(ctx); err != nil {
+		t.Errorf("a full bucket should not wait: %v", err)
+	}
+	empty := newTokenBucket(1, 1)
+	empty.Wait(context.Background())
+	if err := empty.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestRefreshesTokenAfterUnauthorized(t *testing.T) {
+	var issued int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/customer-identity/oauth/v2/access_token":
+			n := atomic.AddInt32(&issued, 1)
+			w.Write([]byte(`{"access_token": "token-` + strconv.Itoa(int(n)) + `", "expires_in": 3600}`))
+		case locationsPath:
+			// the first token was revoked
+			if r.Header.Get("Authorization") != "Bearer token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+
+	client := NewClient(Config{BaseURL: srv.URL, ConsumerKey: "key", ClientSecret: "secret", MaxRetries: 0})
+	if _, err := client.Locations(context.Background(), nil); err != nil {
+		t.Fatalf("Locations: %v", err)
+	}
+	if n := atomic.LoadInt32(&issued); n != 2 {
+		t.Errorf("issued %d tokens, want 2", n)
+	}
+
+	metrics := client.Metrics()
+	if m := metrics[EndpointToken]; m.Requests != 2 {
+		t.Errorf("token requests = %d, want 2", m.Requests)
+	}
+	if m := metrics[EndpointLocations]; m.Requests != 2 || m.Retries != 0 || m.LastStatus != http.StatusOK {
+		t.Errorf("locations metrics = %+v, want 2 requests, no retry, last 200", m)
+	}
+	if state := client.BreakerState(); state != breakerClosed {
+		t.Errorf("a 401 should not count against the breaker, state = %s", state)
+	}
+}
+
+func TestMetricsPerEndpoint(t *testing.T) {
+	stub, srv := newStubAPI(t)
+	stub.queue("/products/ocean-products", http.StatusNotFound)
+
+	client := NewClient(Config{BaseURL: srv.URL})
+	ctx := context.Background()
+
+	products, err := client.OceanProducts(ctx, nil)
+	if err != nil {
+		t.Fatalf("OceanProducts: %v", err)
+	}
+	if len(products.OceanProducts) != 0 {
+		t.Errorf("a 404 should be no sailings, got %d", len(products.OceanProducts))
+	}
+	for i := 0; i < 3; i++ {
+		client.Locations(ctx, nil)
+	}
+
+	metrics := client.Metrics()
+	if m := metrics[EndpointOceanProducts]; m.Requests != 1 || m.Errors != 1 || m.LastStatus != http.StatusNotFound {
+		t.Errorf("ocean-products metrics = %+v, want 1 request, 1 error, last 404", m)
+	}
+	if m := metrics[EndpointLocations]; m.Requests != 3 || m.Errors != 0 || m.LastStatus != http.StatusOK {
+		t.Errorf("locations metrics = %+v, want 3 requests, no error, last 200", m)
+	}
+	if _, ok := metrics[EndpointToken]; ok {
+		t.Error("no token should be requested without a client secret")
+	}
+}
@@ -0,0 +1,91 @@
+package maersk
+
+import (
+	"sync"
+	"time"
+)
+
+// EndpointMetrics counts the calls made to one Maersk endpoint since start.
+type EndpointMetrics struct {
+	Requests       int64     `json:"requests"`
+	Errors         int64     `json:"errors"` // network errors and non-2xx answers
+	RateLimited    int64     `json:"rateLimited"`
+	ServerErrors   int64     `json:"serverErrors"`
+	Retries        int64     `json:"retries"`
+	CircuitRefused int64     `json:"circuitRefused"`
+	AvgLatencyMs   int64     `json:"avgLatencyMs"`
+	LastStatus     int       `json:"lastStatus"`
+	LastRequestAt  time.Time `json:"lastRequestAt"`
+
+	totalLatency time.Duration
+}
+
+type Metrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointMetrics
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{endpoints: make(map[string]*EndpointMetrics)}
+}
+
+func (m *Metrics) endpoint(name string) *EndpointMetrics {
+	e, ok := m.endpoints[name]
+	if !ok {
+		e = &EndpointMetrics{}
+		m.endpoints[name] = e
+	}
+	return e
+}
+
+// record counts one HTTP round trip; status is 0 when none completed.
+func (m *Metrics) record(name string, status int, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.endpoint(name)
+	e.Requests++
+	e.totalLatency += latency
+	e.LastStatus = status
+	e.LastRequestAt = time.Now().UTC()
+
+	switch {
+	case err != nil || status == 0:
+		e.Errors++
+	case status == 429:
+		e.Errors++
+		e.RateLimited++
+	case status >= 500:
+		e.Errors++
+		e.ServerErrors++
+	case status >= 300:
+		e.Errors++
+	}
+}
+
+func (m *Metrics) retry(name string) {
+	m.mu.Lock()
+	m.endpoint(name).Retries++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) rejected(name string) {
+	m.mu.Lock()
+	m.endpoint(name).CircuitRefused++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) Snapshot() map[string]EndpointMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]EndpointMetrics, len(m.endpoints))
+	for name, e := range m.endpoints {
+		s := *e
+		if s.Requests > 0 {
+			s.AvgLatencyMs = (s.totalLatency / time.Duration(s.Requests)).Milliseconds()
+		}
+		snapshot[name] = s
+	}
+	return snapshot
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 
 	"github.com/Sraiti/vesselTracker/api"
 	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/geocoding"
 	"github.com/Sraiti/vesselTracker/middleware"
 	"github.com/Sraiti/vesselTracker/seeder"
 	"github.com/Sraiti/vesselTracker/services"
@@ -30,36 +32,114 @@ func main() {
 	}
 	defer database.Close()
 
-	mux := http.NewServeMux()
+	// go run . seed [-file code-list.csv] [-release 2024-1] [-force]
+	// go run . import-wpi [-file UpdatedPub150.csv]
+	// go run . import-areas -file terminals.geojson [-source osm]
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "seed":
+			runSeedCommand(database, os.Args[2:])
+			return
+		case "import-wpi":
+			runImportWPICommand(database, os.Args[2:])
+			return
+		case "import-areas":
+			runImportAreasCommand(database, os.Args[2:])
+			return
+		}
+	}
+
+	// Seeding is otherwise left to the seed command and the admin endpoint;
+	// an unchanged file is skipped on its checksum, so this stays cheap
+	if os.Getenv("SEED_ON_START") == "true" {
+		go func() {
+			if _, _, err := seeder.Seed(database, seeder.Options{File: os.Getenv("UNLOCODE_FILE")}); err != nil {
+				log.Printf("Seeding on start failed: %v", err)
+			}
+		}()
+	}
+
+	// Initialize AIS streaming service
+	if err := initializeAISStreaming(database); err != nil {
+		log.Fatal(err)
+	}
+
+	// Anchorage and berth stays for the port congestion endpoint, and the
+	// voyages between berth stays
+	services.NewPortStayDetector(database).Start()
+	services.NewVoyageSegmenter(database).Start()
+
+	// AIS gaps and data-quality scores of tracked vessels
+	services.NewDataQualityMonitor(database).Start()
+
+	// Maersk location IDs and coordinates of the locations searched, and
+	// the writer storing fetched schedules with their version history
+	enricher := api.NewMaerskIDEnricher(database)
+	enricher.Start()
+	geocoder := geocoding.NewWorker(database, geocoding.GeocodersFromEnv(database))
+	geocoder.Start()
+	history := services.NewScheduleHistory(database, services.ScheduleNotifiersFromEnv())
+	writer := services.NewScheduleWriter(database, history)
+	writer.Start()
+
+	// Legacy query-string endpoints and the versioned /api/v1 surface.
+	// CORS wraps the whole mux so preflight requests are answered before
+	// method-aware routing would reject OPTIONS with a 405.
+	mux := api.NewRouter(database, enricher, geocoder, writer)
+
+	// Start the server
+	log.Fatal(http.ListenAndServe(":3058", middleware.CorsMiddleware(mux)))
+}
 
-	// cors.Default() setup the middleware with default options being
-	// all origins accepted with simple methods (GET, POST). See
-	// documentation below for more options.
+func runSeedCommand(database *sql.DB, args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	opts := seeder.Options{}
+	flags.StringVar(&opts.File, "file", os.Getenv("UNLOCODE_FILE"), "UN/LOCODE code list CSV (default code-list.csv)")
+	flags.StringVar(&opts.Release, "release", "", "release of the file, e.g. 2024-1 (detected when empty)")
+	flags.IntVar(&opts.BatchSize, "batch", seeder.DefaultBatchSize, "progress log interval in records")
+	flags.BoolVar(&opts.Force, "force", false, "apply even when the file is unchanged or deletes many locations")
+	flags.Parse(args)
 
-	log.Println("Seeding locations...")
-	metrics, err := seeder.SeedLocations(database, 12000)
+	metrics, run, err := seeder.Seed(database, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Seeding %s: release=%s inserted=%d updated=%d deleted=%d metrics=%+v",
+		run.Status, run.Release, run.Inserted, run.Updated, run.Deleted, metrics)
+}
 
-	log.Printf("Seeding completed: %+v", metrics)
+func runImportWPICommand(database *sql.DB, args []string) {
+	flags := flag.NewFlagSet("import-wpi", flag.ExitOnError)
+	file := flags.String("file", os.Getenv("WPI_FILE"), "World Port Index CSV (default UpdatedPub150.csv)")
+	flags.Parse(args)
 
-	// Initialize AIS streaming service
-	if err := initializeAISStreaming(database); err != nil {
+	stats, err := seeder.ImportWPI(database, *file)
+	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("WPI import: %+v", *stats)
+}
 
-	// Function to initialize AIS streaming
-	mux.Handle("/search", middleware.CorsMiddleware(http.HandlerFunc(api.FetchHandler(database))))
-	mux.Handle("/autocomplete", middleware.CorsMiddleware(http.HandlerFunc(api.AutoCompleteHandler(database))))
-	mux.Handle("/vessels/route", middleware.CorsMiddleware(http.HandlerFunc(api.GetVesselRoute(database))))
-	mux.Handle("/vessels/route/geojson", middleware.CorsMiddleware(http.HandlerFunc(api.GetVesselRouteGeoJSON(database))))
-	mux.Handle("/vessels/tracked", middleware.CorsMiddleware(http.HandlerFunc(api.GetTrackedVesselsHandler(database))))
-	mux.Handle("/vessels/last-known-position", middleware.CorsMiddleware(http.HandlerFunc(api.GetVesselLastKnownPosition(database))))
-	mux.Handle("/files", middleware.CorsMiddleware(http.HandlerFunc(api.FilesExaminerHandler(database))))
+func runImportAreasCommand(database *sql.DB, args []string) {
+	flags := flag.NewFlagSet("import-areas", flag.ExitOnError)
+	file := flags.String("file", "", "GeoJSON FeatureCollection of location polygons")
+	source := flags.String("source", "geojson", "where the polygons come from")
+	flags.Parse(args)
 
-	// Start the server
-	log.Fatal(http.ListenAndServe(":3058", mux))
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	stats, err := seeder.ImportAreas(database, f, *source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, skipped := range stats.Skipped {
+		log.Println("Skipped", skipped)
+	}
+	log.Printf("Imported %d/%d areas", stats.Imported, stats.Features)
 }
 
 func initializeAISStreaming(database *sql.DB) error {
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+// AdminAuth guards admin endpoints with the ADMIN_TOKEN bearer token. They
+// are disabled when ADMIN_TOKEN is not set.
+func AdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "admin endpoints are disabled, set ADMIN_TOKEN", http.StatusForbidden)
+			return
+		}
+
+		given := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,82 @@
+package models
+
+import "encoding/json"
+
+// DCSA Commercial Schedules 1.0, point-to-point routes
+// https://app.swaggerhub.com/apis/dcsaorg/DCSA_CS/1.0.0
+
+func UnmarshalDCSAPointToPoint(data []byte) ([]DCSAPointToPointRoute, error) {
+	var r []DCSAPointToPointRoute
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+type DCSAPointToPointRoute struct {
+	PlaceOfReceipt            DCSAPlace        `json:"placeOfReceipt"`
+	PlaceOfDelivery           DCSAPlace        `json:"placeOfDelivery"`
+	ReceiptTypeAtOrigin       string           `json:"receiptTypeAtOrigin"`
+	DeliveryTypeAtDestination string           `json:"deliveryTypeAtDestination"`
+	CutOffTimes               []DCSACutOffTime `json:"cutOffTimes"`
+	SolutionNumber            int              `json:"solutionNumber"`
+	RoutingReference          string           `json:"routingReference"`
+	// in days
+	TransitTime int       `json:"transitTime"`
+	Legs        []DCSALeg `json:"legs"`
+}
+
+type DCSAPlace struct {
+	FacilityTypeCode string       `json:"facilityTypeCode"`
+	Location         DCSALocation `json:"location"`
+	DateTime         CustomTime   `json:"dateTime"`
+}
+
+type DCSALocation struct {
+	LocationName             string `json:"locationName"`
+	UNLocationCode           string `json:"UNLocationCode"`
+	FacilityCode             string `json:"facilityCode"`
+	FacilityCodeListProvider string `json:"facilityCodeListProvider"`
+	Latitude                 string `json:"latitude"`
+	Longitude                string `json:"longitude"`
+}
+
+type DCSACutOffTime struct {
+	CutOffDateTimeCode string     `json:"cutOffDateTimeCode"`
+	CutOffDateTime     CustomTime `json:"cutOffDateTime"`
+}
+
+type DCSALeg struct {
+	SequenceNumber int           `json:"sequenceNumber"`
+	Transport      DCSATransport `json:"transport"`
+	Departure      DCSAPlace     `json:"departure"`
+	Arrival        DCSAPlace     `json:"arrival"`
+}
+
+type DCSATransport struct {
+	// VESSEL, RAIL, TRUCK or BARGE
+	ModeOfTransport                string               `json:"modeOfTransport"`
+	PortVisitReference             string               `json:"portVisitReference"`
+	TransportCallReference         string               `json:"transportCallReference"`
+	ServicePartners                []DCSAServicePartner `json:"servicePartners"`
+	UniversalServiceReference      string               `json:"universalServiceReference"`
+	UniversalExportVoyageReference string               `json:"universalExportVoyageReference"`
+	UniversalImportVoyageReference string               `json:"universalImportVoyageReference"`
+	Vessel                         DCSAVessel           `json:"vessel"`
+}
+
+type DCSAServicePartner struct {
+	CarrierCode               string `json:"carrierCode"`
+	CarrierCodeListProvider   string `json:"carrierCodeListProvider"`
+	CarrierServiceName        string `json:"carrierServiceName"`
+	CarrierServiceCode        string `json:"carrierServiceCode"`
+	CarrierImportVoyageNumber string `json:"carrierImportVoyageNumber"`
+	CarrierExportVoyageNumber string `json:"carrierExportVoyageNumber"`
+}
+
+type DCSAVessel struct {
+	VesselIMONumber                 string `json:"vesselIMONumber"`
+	Name                            string `json:"name"`
+	Flag                            string `json:"flag"`
+	CallSign                        string `json:"callSign"`
+	OperatorCarrierCode             string `json:"operatorCarrierCode"`
+	OperatorCarrierCodeListProvider string `json:"operatorCarrierCodeListProvider"`
+}
@@ -13,6 +13,9 @@ type CustomTime struct {
 func (ct *CustomTime) UnmarshalJSON(b []byte) error {
 	// Remove quotes from the string
 	str := string(b)
+	if str == "null" {
+		return nil
+	}
 	str = str[1 : len(str)-1]
 
 	// Try parsing with different time formats
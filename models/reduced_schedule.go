@@ -4,7 +4,9 @@ type ReducedOceanProduct struct {
 	ID int64
 	// maersk product id
 	// might b e empty for other companies
-	CarrierProductID     string
+	CarrierProductID string
+	// vessel operator, e.g. MAEU
+	CarrierCode          string
 	ProductValidToDate   CustomTime
 	ProductValidFromDate CustomTime
 	//origin
@@ -34,6 +36,11 @@ type ReducedOceanProduct struct {
 	TransitTime int32
 	//transport legs
 	TransportLegs []ReducedTransportLeg
+	// transfers between consecutive legs, see services.AnalyzeConnections
+	Connections      []Connection
+	ConnectionAtRisk bool
+	// on-time record of the service, nil without enough history
+	Reliability *ReliabilityBadge
 }
 
 type ReducedTransportLeg struct {
@@ -47,6 +54,18 @@ type ReducedTransportLeg struct {
 	VesselIMONumber   string
 	VesselMMSI        string
 	LastKnownPosition []float64
+	// ISO 3166 alpha-2 flag and call sign, when the carrier sends them
+	VesselFlag     string `json:",omitempty"`
+	VesselCallSign string `json:",omitempty"`
+	//service
+	// VESSEL, RAIL, TRUCK or BARGE
+	TransportMode                string
+	CarrierServiceCode           string
+	CarrierServiceName           string
+	CarrierDepartureVoyageNumber string
+	CarrierTradeLaneName         string
+	// direction of the service loop, e.g. E or W
+	LinkDirection string
 	//origin
 	OriginCity             string
 	OriginName             string
@@ -61,4 +80,49 @@ type ReducedTransportLeg struct {
 	DestinationPortUnLoCode     string
 	DestinationCarrierSiteGeoID string
 	DestinationCarrierCityGeoID string
+	// [lat, lon] when the carrier sends them, used to geocode locations
+	OriginCoordinates      []float64 `json:",omitempty"`
+	DestinationCoordinates []float64 `json:",omitempty"`
+}
+
+const (
+	ConnectionOK     = "OK"
+	ConnectionAtRisk = "AT_RISK" // window below the minimum connection time
+	ConnectionMissed = "MISSED"  // inbound arrives after the outbound departure
+)
+
+// Connection is the transfer between two legs, at a transshipment port or
+// between modes, e.g. vessel to rail.
+type Connection struct {
+	PortUnLoCode            string
+	PortName                string
+	InboundMode             string
+	OutboundMode            string
+	InboundVesselIMONumber  string
+	OutboundVesselIMONumber string
+	//time
+	ScheduledArrival   CustomTime
+	ScheduledDeparture CustomTime
+	// estimate from the inbound vessel position, nil until it is under way
+	EstimatedArrival *CustomTime
+	//window, in minutes like TransitTime
+	WindowMinutes  int32
+	MinimumMinutes int32
+	Status         string
+}
+
+const (
+	ReliabilityHigh   = "HIGH"   // at least 80% on time
+	ReliabilityMedium = "MEDIUM" // at least 60% on time
+	ReliabilityLow    = "LOW"
+)
+
+// ReliabilityBadge summarizes how often past sailings of a service, or of
+// the carrier when the service has too little history, arrived on time.
+type ReliabilityBadge struct {
+	Level         string
+	OnTimePercent float64
+	Samples       int
+	// SERVICE or CARRIER
+	Basis string
 }
@@ -0,0 +1,180 @@
+package seeder
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Kinds of location_areas rows, from the whole port down to a single berth
+const (
+	AreaPort      = "port"
+	AreaTerminal  = "terminal"
+	AreaBerth     = "berth"
+	AreaAnchorage = "anchorage"
+)
+
+var areaKinds = map[string]bool{AreaPort: true, AreaTerminal: true, AreaBerth: true, AreaAnchorage: true}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   json.RawMessage        `json:"geometry"`
+}
+
+func (f geoJSONFeature) geometryType() string {
+	var g struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(f.Geometry, &g); err != nil {
+		return ""
+	}
+	return g.Type
+}
+
+// AreaImport summarizes an ImportAreas run.
+type AreaImport struct {
+	Features int      `json:"features"`
+	Imported int      `json:"imported"`
+	Skipped  []string `json:"skipped"`
+}
+
+// ImportAreas reads a GeoJSON FeatureCollection of Polygon or MultiPolygon
+// features and upserts them into location_areas. Each feature names its
+// location in the unlocode property (aliases are followed), its kind in
+// kind (port, terminal, berth or anchorage; terminal by default) and its
+// name in name. Port and terminal names become alternate names of the
+// location, so autocomplete finds "Tanger Med 2". Features that cannot be
+// imported are reported and skipped.
+func ImportAreas(db *sql.DB, r io.Reader, source string) (*AreaImport, error) {
+	var fc geoJSONFeatureCollection
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("invalid GeoJSON: expected a FeatureCollection, got %q", fc.Type)
+	}
+	if source == "" {
+		source = "geojson"
+	}
+
+	stats := &AreaImport{Features: len(fc.Features), Skipped: []string{}}
+	for i, f := range fc.Features {
+		unlocode := strings.ToUpper(strings.ReplaceAll(stringProperty(f.Properties, "unlocode", "locode"), " ", ""))
+		kind := strings.ToLower(stringProperty(f.Properties, "kind"))
+		if kind == "" {
+			kind = AreaTerminal
+		}
+		name := stringProperty(f.Properties, "name")
+
+		skip := func(reason string) {
+			stats.Skipped = append(stats.Skipped, fmt.Sprintf("feature %d (%s %s): %s", i, unlocode, name, reason))
+		}
+		switch {
+		case unlocode == "":
+			skip("missing unlocode property")
+			continue
+		case !areaKinds[kind]:
+			skip(fmt.Sprintf("unknown kind %q", kind))
+			continue
+		case f.geometryType() != "Polygon" && f.geometryType() != "MultiPolygon":
+			skip(fmt.Sprintf("geometry must be a Polygon or MultiPolygon, got %q", f.geometryType()))
+			continue
+		}
+		if name == "" {
+			name = unlocode + " " + kind
+		}
+
+		properties, err := json.Marshal(f.Properties)
+		if err != nil {
+			skip(err.Error())
+			continue
+		}
+
+		if err := upsertArea(db, unlocode, kind, name, source, string(f.Geometry), string(properties)); err != nil {
+			skip(err.Error())
+			continue
+		}
+		stats.Imported++
+	}
+
+	log.Printf("Area import from %s completed: %d/%d features", source, stats.Imported, stats.Features)
+	return stats, nil
+}
+
+func upsertArea(db *sql.DB, unlocode, kind, name, source, geometry, properties string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var code string
+	err = tx.QueryRow(`
+		SELECT l.unlocode FROM locations l
+		WHERE l.unlocode = COALESCE((SELECT unlocode FROM location_aliases WHERE alias_code = $1), $1)`,
+		unlocode).Scan(&code)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("unknown UN/LOCODE")
+	}
+	if err != nil {
+		return err
+	}
+
+	// ST_MakeValid can split a self-intersecting ring into a collection
+	_, err = tx.Exec(`
+		INSERT INTO location_areas (unlocode, kind, name, source, area, properties)
+		VALUES ($1, $2, $3, $4,
+			ST_Multi(ST_CollectionExtract(ST_MakeValid(ST_SetSRID(ST_GeomFromGeoJSON($5), 4326)), 3))::geography,
+			$6::jsonb)
+		ON CONFLICT (unlocode, kind, name) DO UPDATE SET
+			source = EXCLUDED.source,
+			area = EXCLUDED.area,
+			properties = EXCLUDED.properties,
+			imported_at = NOW()`,
+		code, kind, name, source, geometry, properties)
+	if err != nil {
+		return fmt.Errorf("error saving area: %w", err)
+	}
+
+	if kind == AreaPort || kind == AreaTerminal {
+		_, err = tx.Exec(`
+			UPDATE locations l SET
+				alternate_names = CASE
+					WHEN lower(l.name) = lower($2) OR $2 = ANY (l.alternate_names) THEN l.alternate_names
+					ELSE l.alternate_names || $2::text
+				END,
+				area_centroid = (
+					SELECT ST_Centroid(ST_Collect(a.area::geometry))::geography
+					FROM location_areas a
+					WHERE a.unlocode = l.unlocode AND a.kind IN ('port', 'terminal')
+				)
+			WHERE l.unlocode = $1`,
+			code, name)
+		if err != nil {
+			return fmt.Errorf("error updating location from area: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// stringProperty returns the first non-empty string among keys, matched
+// case-insensitively.
+func stringProperty(properties map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		for k, v := range properties {
+			if s, ok := v.(string); ok && strings.EqualFold(k, key) && strings.TrimSpace(s) != "" {
+				return strings.TrimSpace(s)
+			}
+		}
+	}
+	return ""
+}
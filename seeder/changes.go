@@ -0,0 +1,133 @@
+package seeder
+
+import (
+	"regexp"
+	"strings"
+)
+
+// UN/LOCODE change indicators, column 0 of the code list
+const (
+	changeRemoved   = "X" // marked for deletion, still listed for one release
+	changeReference = "=" // "Alias = Target", points at another entry
+	// "+" added, "|" changed and "#" name changed entries are live
+)
+
+const (
+	AliasReference  = "reference"
+	AliasSuperseded = "superseded"
+)
+
+// Removed entries name their replacement in the remarks, e.g. "Use DEHAM"
+var supersededPattern = regexp.MustCompile(`(?i)\b(?:use|replaced by|see)\s+(?:code\s+)?([A-Z]{2})\s?([A-Z0-9]{3})\b`)
+
+// Alias maps a code that is no longer, or never was, a location of its own
+// onto the live UN/LOCODE.
+type Alias struct {
+	Code   string
+	Target string
+	Name   string
+	Reason string
+}
+
+// resolveChanges applies the change indicators: removed entries are
+// dropped, reference entries become alternate names of their target, and
+// codes they carry become aliases, as do removed codes whose remarks name a
+// replacement. Country header rows are dropped and a code listed twice keeps
+// its first entry, so every live location has its own UN/LOCODE.
+func resolveChanges(records []Location, metrics *SeederMetrics) ([]Location, []Alias) {
+	live := make([]Location, 0, len(records))
+	byCode := make(map[string]int)
+	byName := make(map[string]string)
+
+	for _, loc := range records {
+		switch {
+		case loc.Change == changeRemoved:
+			metrics.Removed++
+			continue
+		case loc.Change == changeReference:
+			continue
+		case len(loc.UnLoCode) != 5: // country header, e.g. ",AD,,.ANDORRA"
+			metrics.SkippedRecords++
+			continue
+		}
+
+		if i, dup := byCode[loc.UnLoCode]; dup {
+			live[i].AlternateNames = addName(live[i].AlternateNames, live[i].Name, loc.Name)
+			metrics.SkippedRecords++
+			continue
+		}
+
+		byCode[loc.UnLoCode] = len(live)
+		byName[nameKey(loc.CountryCode, loc.Name)] = loc.UnLoCode
+		for _, alt := range loc.AlternateNames {
+			if _, ok := byName[nameKey(loc.CountryCode, alt)]; !ok {
+				byName[nameKey(loc.CountryCode, alt)] = loc.UnLoCode
+			}
+		}
+		live = append(live, loc)
+	}
+
+	var aliases []Alias
+	for _, loc := range records {
+		switch loc.Change {
+		case changeReference:
+			aliasName, targetName, ok := strings.Cut(loc.Name, " = ")
+			if !ok {
+				metrics.SkippedRecords++
+				continue
+			}
+			aliasName, targetName = strings.TrimSpace(aliasName), strings.TrimSpace(targetName)
+
+			// A reference carrying the target's code only adds a name
+			target := ""
+			if _, ok := byCode[loc.UnLoCode]; ok {
+				target = loc.UnLoCode
+			} else if code, ok := byName[nameKey(loc.CountryCode, targetName)]; ok {
+				target = code
+			}
+			if target == "" {
+				metrics.SkippedRecords++
+				continue
+			}
+
+			i := byCode[target]
+			live[i].AlternateNames = addName(live[i].AlternateNames, live[i].Name, aliasName)
+			if len(loc.UnLoCode) == 5 && loc.UnLoCode != target {
+				aliases = append(aliases, Alias{Code: loc.UnLoCode, Target: target, Name: aliasName, Reason: AliasReference})
+			}
+
+		case changeRemoved:
+			if _, ok := byCode[loc.UnLoCode]; ok || len(loc.UnLoCode) != 5 {
+				continue
+			}
+			m := supersededPattern.FindStringSubmatch(loc.Remarks)
+			if m == nil {
+				continue
+			}
+			target := strings.ToUpper(m[1] + m[2])
+			if _, ok := byCode[target]; ok && target != loc.UnLoCode {
+				aliases = append(aliases, Alias{Code: loc.UnLoCode, Target: target, Name: loc.Name, Reason: AliasSuperseded})
+			}
+		}
+	}
+
+	return live, aliases
+}
+
+// addName appends name to names unless it is the location's own name or
+// already listed.
+func addName(names []string, own, name string) []string {
+	if name == "" || strings.EqualFold(name, own) {
+		return names
+	}
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+func nameKey(country, name string) string {
+	return country + "|" + strings.ToLower(strings.TrimSpace(name))
+}
@@ -2,7 +2,6 @@ package seeder
 
 import (
 	"bufio"
-	"database/sql"
 	"encoding/csv"
 	"fmt"
 	"log"
@@ -10,8 +9,6 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
-
-	"github.com/lib/pq"
 )
 
 type SeederMetrics struct {
@@ -22,62 +19,43 @@ type SeederMetrics struct {
 	ProcessingDuration time.Duration
 	DatabaseDuration   time.Duration
 	BatchSize          int
+	// entries marked X in the file
+	Removed int64
+	// changes applied to the locations table
+	Inserted int64
+	Updated  int64
+	Deleted  int64
+	Aliases  int64
 }
 
 type Location struct {
+	Change         string // change indicator, see resolveChanges
 	UnLoCode       string
 	Name           string
+	AlternateNames []string
 	CountryCode    string
-	IsPort         bool
-	IsAirport      bool
-	IsTrainStation bool
+	Subdivision    string
+	Status         string
+	IATACode       string
+	Remarks        string
+	Date           *time.Time
+	Functions
 	Latitude       float64
 	Longitude      float64
 	HasCoordinates bool
 }
 
-func SeedLocations(db *sql.DB, batchSize int) (*SeederMetrics, error) {
-	startTime := time.Now()
-	metrics := &SeederMetrics{BatchSize: batchSize}
-
-	// Process CSV
-	locations, err := ProcessCSV("code-list.csv", metrics)
-	if err != nil {
-		return metrics, fmt.Errorf("failed to process CSV: %w", err)
-	}
-
-	// Record processing duration
-	metrics.ProcessingDuration = time.Since(startTime)
-	log.Printf("CSV Processing completed: Records=%d, Valid Coordinates=%d, Processing Time=%v",
-		metrics.TotalRecords, metrics.ValidCoordinates, metrics.ProcessingDuration)
-
-	log.Printf("Seeding %d locations", len(locations))
-	// Start database operations
-	dbStart := time.Now()
-	totalLocations := len(locations)
-	processedLocations := 0
-
-	// Process in batches
-	for i := 0; i < len(locations); i += batchSize {
-		end := i + batchSize
-		if end > len(locations) {
-			end = len(locations)
-		}
-
-		batch := locations[i:end]
-		if err := bulkInsert(db, batch); err != nil {
-			return metrics, fmt.Errorf("failed to insert batch %d-%d: %w", i, end, err)
-		}
-
-		processedLocations += len(batch)
-		log.Printf("Progress: %d/%d locations inserted (%.1f%%)",
-			processedLocations, totalLocations,
-			float64(processedLocations)/float64(totalLocations)*100)
-	}
-
-	metrics.DatabaseDuration = time.Since(dbStart)
-	log.Printf("Seeding completed: %+v", metrics)
-	return metrics, nil
+// Functions are the transport functions of a UN/LOCODE entry.
+type Functions struct {
+	IsPort           bool // 1
+	IsTrainStation   bool // 2
+	IsRoadTerminal   bool // 3
+	IsAirport        bool // 4
+	IsPostalExchange bool // 5
+	IsMultimodal     bool // 6, inland clearance depots and ICDs
+	IsFixedTransport bool // 7, e.g. pipelines
+	IsInlandPort     bool // 8
+	IsBorderCrossing bool // B
 }
 
 func ProcessCSV(filePath string, metrics *SeederMetrics) ([]Location, error) {
@@ -154,14 +132,19 @@ func ProcessCSV(filePath string, metrics *SeederMetrics) ([]Location, error) {
 				}
 
 				funcStart := time.Now()
-				functionCode := record[7]
+				functions := parseFunctions(record[7])
 				location := Location{
+					Change:         strings.TrimSpace(record[0]),
 					UnLoCode:       record[1] + record[2],
 					Name:           record[3],
+					AlternateNames: alternateNames(record[3], record[4]),
 					CountryCode:    record[1],
-					IsPort:         strings.Contains(functionCode, "1"),
-					IsAirport:      strings.Contains(functionCode, "4"),
-					IsTrainStation: strings.Contains(functionCode, "2"),
+					Subdivision:    strings.TrimSpace(record[5]),
+					Status:         strings.TrimSpace(record[6]),
+					IATACode:       iataCode(record[2], record[9], functions.IsAirport),
+					Remarks:        strings.TrimSpace(record[11]),
+					Date:           parseDate(record[8]),
+					Functions:      functions,
 					Latitude:       lat,
 					Longitude:      lon,
 					HasCoordinates: valid,
@@ -217,6 +200,56 @@ func ProcessCSV(filePath string, metrics *SeederMetrics) ([]Location, error) {
 	return allLocations, nil
 }
 
+// alternateNames keeps the name without diacritics when it differs, so
+// "Goteborg" finds "Göteborg" even where unaccent does not apply.
+func alternateNames(name, nameWoDiacritics string) []string {
+	if nameWoDiacritics == "" || strings.EqualFold(name, nameWoDiacritics) {
+		return []string{}
+	}
+	return []string{nameWoDiacritics}
+}
+
+// parseFunctions reads the function classifier, e.g. "1-3-----" or
+// "--3----B". A leading 0 means the function is not known.
+func parseFunctions(code string) Functions {
+	return Functions{
+		IsPort:           strings.Contains(code, "1"),
+		IsTrainStation:   strings.Contains(code, "2"),
+		IsRoadTerminal:   strings.Contains(code, "3"),
+		IsAirport:        strings.Contains(code, "4"),
+		IsPostalExchange: strings.Contains(code, "5"),
+		IsMultimodal:     strings.Contains(code, "6"),
+		IsFixedTransport: strings.Contains(code, "7"),
+		IsInlandPort:     strings.Contains(code, "8"),
+		IsBorderCrossing: strings.Contains(code, "B"),
+	}
+}
+
+// iataCode is only listed when it differs from the location part of the
+// UN/LOCODE, airports otherwise share it.
+func iataCode(location, iata string, isAirport bool) string {
+	if iata = strings.TrimSpace(iata); iata != "" {
+		return iata
+	}
+	if isAirport {
+		return location
+	}
+	return ""
+}
+
+// parseDate reads the YYMM of the last change. Years from 69 on are read
+// as 19xx, which covers the list since its start.
+func parseDate(yymm string) *time.Time {
+	if len(yymm) != 4 {
+		return nil
+	}
+	t, err := time.Parse("0601", yymm)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
 func parseCoordinates(coord string) (float64, float64, bool) {
 
 	// Quick initial checks
@@ -269,87 +302,9 @@ func parseFloat(s string) float64 {
 	return val
 }
 
-func bulkInsert(db *sql.DB, locations []Location) error {
-
-	tx, err := db.Begin()
-
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-
-	defer tx.Rollback()
-
-	// Create temp table
-	_, err = tx.Exec(`
-	   CREATE TEMPORARY TABLE temp_locations (
-            unlocode TEXT NOT NULL,
-            name TEXT NOT NULL,
-            country_code TEXT NOT NULL,
-            location GEOGRAPHY(POINT, 4326),
-            is_port BOOLEAN DEFAULT FALSE,
-            is_airport BOOLEAN DEFAULT FALSE,
-            is_train_station BOOLEAN DEFAULT FALSE,
-            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-        ) ON COMMIT DROP
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create temp table: %w", err)
-	}
-
-	// Prepare COPY into temp table
-	stmt, err := tx.Prepare(pq.CopyIn(
-		"temp_locations",
-		"unlocode", "name", "country_code",
-		"location", "is_port", "is_airport", "is_train_station",
-	))
-	if err != nil {
-		return fmt.Errorf("failed to prepare COPY statement: %w", err)
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
 	}
-	defer stmt.Close()
-
-	for _, loc := range locations {
-		var point interface{}
-		if loc.HasCoordinates {
-			point = fmt.Sprintf("SRID=4326;POINT(%f %f)", loc.Longitude, loc.Latitude)
-		}
-
-		_, err := stmt.Exec(
-			loc.UnLoCode,
-			loc.Name,
-			loc.CountryCode,
-			point,
-			loc.IsPort,
-			loc.IsAirport,
-			loc.IsTrainStation,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to COPY location %s: %w", loc.UnLoCode, err)
-		}
-	}
-
-	if _, err := stmt.Exec(); err != nil {
-		return fmt.Errorf("failed to flush COPY buffer: %w", err)
-	}
-
-	_, err = tx.Exec(`
-		INSERT INTO locations (
-			unlocode, name, country_code,
-			location, is_port, is_airport, is_train_station
-		)
-		SELECT 
-			unlocode, name, country_code,
-			location, is_port, is_airport, is_train_station
-		FROM temp_locations
-		ON CONFLICT (unlocode, name) DO UPDATE SET
-			country_code = EXCLUDED.country_code,
-			location = COALESCE(EXCLUDED.location, locations.location),
-			is_port = EXCLUDED.is_port,
-			is_airport = EXCLUDED.is_airport,
-			is_train_station = EXCLUDED.is_train_station
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to insert from temp table: %w", err)
-	}
-
-	return tx.Commit()
+	return s
 }
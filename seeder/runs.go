@@ -0,0 +1,127 @@
+package seeder
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	RunApplied   = "applied"
+	RunUnchanged = "unchanged"
+	RunFailed    = "failed"
+)
+
+// Run is a row of seeding_runs.
+type Run struct {
+	ID                 int       `json:"id"`
+	FileName           string    `json:"file_name"`
+	Checksum           string    `json:"checksum"`
+	Release            string    `json:"release,omitempty"`
+	Status             string    `json:"status"`
+	TotalRecords       int64     `json:"total_records"`
+	ValidCoordinates   int64     `json:"valid_coordinates"`
+	InvalidCoordinates int64     `json:"invalid_coordinates"`
+	SkippedRecords     int       `json:"skipped_records"`
+	Inserted           int64     `json:"inserted"`
+	Updated            int64     `json:"updated"`
+	Deleted            int64     `json:"deleted"`
+	Removed            int64     `json:"removed"`
+	Aliases            int64     `json:"aliases"`
+	ProcessingMs       int64     `json:"processing_ms"`
+	DatabaseMs         int64     `json:"database_ms"`
+	Error              string    `json:"error,omitempty"`
+	StartedAt          time.Time `json:"started_at"`
+	FinishedAt         time.Time `json:"finished_at"`
+}
+
+func recordRun(db *sql.DB, run *Run, metrics *SeederMetrics) error {
+	run.TotalRecords = metrics.TotalRecords
+	run.ValidCoordinates = metrics.ValidCoordinates
+	run.InvalidCoordinates = metrics.InvalidCoordinates
+	run.SkippedRecords = metrics.SkippedRecords
+	run.Inserted = metrics.Inserted
+	run.Updated = metrics.Updated
+	run.Deleted = metrics.Deleted
+	run.Removed = metrics.Removed
+	run.Aliases = metrics.Aliases
+	run.ProcessingMs = metrics.ProcessingDuration.Milliseconds()
+	run.DatabaseMs = metrics.DatabaseDuration.Milliseconds()
+
+	err := db.QueryRow(`
+		INSERT INTO seeding_runs (
+			file_name, checksum, release, status,
+			total_records, valid_coordinates, invalid_coordinates, skipped_records,
+			inserted, updated, deleted, removed, aliases, processing_ms, database_ms, error, started_at
+		)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, NULLIF($16, ''), $17)
+		RETURNING id, finished_at`,
+		run.FileName, run.Checksum, run.Release, run.Status,
+		run.TotalRecords, run.ValidCoordinates, run.InvalidCoordinates, run.SkippedRecords,
+		run.Inserted, run.Updated, run.Deleted, run.Removed, run.Aliases,
+		run.ProcessingMs, run.DatabaseMs, run.Error, run.StartedAt,
+	).Scan(&run.ID, &run.FinishedAt)
+	if err != nil {
+		return fmt.Errorf("error recording seeding run: %w", err)
+	}
+	return nil
+}
+
+const runColumns = `id, file_name, checksum, COALESCE(release, ''), status,
+	total_records, valid_coordinates, invalid_coordinates, skipped_records,
+	inserted, updated, deleted, removed, aliases, processing_ms, database_ms, COALESCE(error, ''),
+	started_at, finished_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRun(row rowScanner) (Run, error) {
+	var r Run
+	err := row.Scan(
+		&r.ID, &r.FileName, &r.Checksum, &r.Release, &r.Status,
+		&r.TotalRecords, &r.ValidCoordinates, &r.InvalidCoordinates, &r.SkippedRecords,
+		&r.Inserted, &r.Updated, &r.Deleted, &r.Removed, &r.Aliases, &r.ProcessingMs, &r.DatabaseMs, &r.Error,
+		&r.StartedAt, &r.FinishedAt,
+	)
+	return r, err
+}
+
+func lastAppliedRun(db *sql.DB) (*Run, error) {
+	r, err := scanRun(db.QueryRow(`
+		SELECT `+runColumns+`
+		FROM seeding_runs
+		WHERE status = $1
+		ORDER BY started_at DESC
+		LIMIT 1`, RunApplied))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting last seeding run: %w", err)
+	}
+	return &r, nil
+}
+
+// ListRuns returns the most recent seeding runs first.
+func ListRuns(db *sql.DB, limit int) ([]Run, error) {
+	rows, err := db.Query(`
+		SELECT `+runColumns+`
+		FROM seeding_runs
+		ORDER BY started_at DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing seeding runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []Run{}
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
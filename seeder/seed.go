@@ -0,0 +1,411 @@
+package seeder
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	DefaultFile      = "code-list.csv"
+	DefaultBatchSize = 12000
+
+	// Arbitrary key of the advisory lock held while a diff is applied
+	seedLockKey = 4039
+	// A release rarely drops more than a few hundred codes, a larger drop
+	// points at a truncated or wrong file
+	maxDeleteShare = 0.1
+)
+
+var (
+	ErrSeedInProgress = errors.New("another seeding run is in progress")
+	ErrTooManyDeletes = errors.New("file would delete too many locations, use force to apply")
+)
+
+// UN/LOCODE releases are named after the year and issue, e.g. "2024-1 UNLOCODE CodeListPart1.csv"
+var releasePattern = regexp.MustCompile(`(19|20)\d{2}-\d`)
+
+type Options struct {
+	File string
+	// Release of the file, detected from the file name or the latest
+	// change date when empty
+	Release   string
+	BatchSize int
+	// Force applies the file even when it matches the last applied run, or
+	// when it would delete more than maxDeleteShare of the locations
+	Force bool
+}
+
+// Seed applies a UN/LOCODE code list to the locations table. Only the
+// differences with the stored locations are written: new entries are
+// inserted, changed ones updated and those gone from the file deleted, all
+// in one transaction. A file whose checksum matches the last applied run is
+// skipped. Every attempt is recorded in seeding_runs.
+func Seed(db *sql.DB, opts Options) (*SeederMetrics, *Run, error) {
+	if opts.File == "" {
+		opts.File = DefaultFile
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+
+	startTime := time.Now()
+	metrics := &SeederMetrics{BatchSize: opts.BatchSize}
+	run := &Run{FileName: filepath.Base(opts.File), Release: opts.Release, StartedAt: startTime}
+
+	checksum, err := fileChecksum(opts.File)
+	if err != nil {
+		// Nothing was read, there is nothing worth recording
+		return metrics, nil, fmt.Errorf("failed to read code list: %w", err)
+	}
+	run.Checksum = checksum
+
+	last, err := lastAppliedRun(db)
+	if err != nil {
+		return metrics, nil, err
+	}
+	if last != nil && last.Checksum == checksum && !opts.Force {
+		log.Printf("Code list %s unchanged since run %d, skipping", opts.File, last.ID)
+		run.Status = RunUnchanged
+		if run.Release == "" {
+			run.Release = last.Release
+		}
+		return metrics, run, recordRun(db, run, metrics)
+	}
+
+	records, err := ProcessCSV(opts.File, metrics)
+	if err != nil {
+		return metrics, run, failRun(db, run, metrics, fmt.Errorf("failed to process CSV: %w", err))
+	}
+	locations, aliases := resolveChanges(records, metrics)
+	metrics.ProcessingDuration = time.Since(startTime)
+	log.Printf("CSV Processing completed: Records=%d, Live=%d, Removed=%d, Aliases=%d, Valid Coordinates=%d, Processing Time=%v",
+		metrics.TotalRecords, len(locations), metrics.Removed, len(aliases), metrics.ValidCoordinates, metrics.ProcessingDuration)
+
+	if run.Release == "" {
+		run.Release = detectRelease(opts.File, records)
+	}
+	opts.Release = run.Release
+
+	dbStart := time.Now()
+	err = applyDiff(db, locations, aliases, metrics, opts)
+	metrics.DatabaseDuration = time.Since(dbStart)
+	if err != nil {
+		return metrics, run, failRun(db, run, metrics, err)
+	}
+
+	log.Printf("Seeding completed: release=%s inserted=%d updated=%d deleted=%d aliases=%d",
+		run.Release, metrics.Inserted, metrics.Updated, metrics.Deleted, metrics.Aliases)
+	run.Status = RunApplied
+	return metrics, run, recordRun(db, run, metrics)
+}
+
+func failRun(db *sql.DB, run *Run, metrics *SeederMetrics, err error) error {
+	run.Status = RunFailed
+	run.Error = err.Error()
+	if rerr := recordRun(db, run, metrics); rerr != nil {
+		log.Println(rerr)
+	}
+	return err
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// detectRelease takes the release from the file name, falling back to the
+// month of the most recent change in the list.
+func detectRelease(path string, locations []Location) string {
+	if release := releasePattern.FindString(filepath.Base(path)); release != "" {
+		return release
+	}
+	var latest time.Time
+	for _, loc := range locations {
+		if loc.Date != nil && loc.Date.After(latest) {
+			latest = *loc.Date
+		}
+	}
+	if latest.IsZero() {
+		return ""
+	}
+	return latest.Format("2006-01")
+}
+
+// applyDiff loads the file into a temporary table and reconciles locations
+// with it, then records the aliases. Locations are keyed on unlocode, a
+// renamed location keeps its former name as an alternate name.
+func applyDiff(db *sql.DB, locations []Location, aliases []Alias, metrics *SeederMetrics, opts Options) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, seedLockKey).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to take seeding lock: %w", err)
+	}
+	if !locked {
+		return ErrSeedInProgress
+	}
+
+	if err := copyToTemp(tx, locations, opts.BatchSize); err != nil {
+		return err
+	}
+
+	var stored, gone int64
+	err = tx.QueryRow(`
+		SELECT count(*),
+			   count(*) FILTER (WHERE NOT EXISTS (
+				   SELECT 1 FROM temp_locations t WHERE t.unlocode = l.unlocode
+			   ))
+		FROM locations l`).Scan(&stored, &gone)
+	if err != nil {
+		return fmt.Errorf("failed to count removed locations: %w", err)
+	}
+	if stored > 0 && float64(gone) > float64(stored)*maxDeleteShare && !opts.Force {
+		return fmt.Errorf("%w: %d of %d", ErrTooManyDeletes, gone, stored)
+	}
+
+	res, err := tx.Exec(`
+		DELETE FROM locations l
+		WHERE NOT EXISTS (
+			SELECT 1 FROM temp_locations t WHERE t.unlocode = l.unlocode
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to delete removed locations: %w", err)
+	}
+	metrics.Deleted, _ = res.RowsAffected()
+
+	// Coordinates found by the geocoders are kept when the file has none
+	res, err = tx.Exec(`
+		UPDATE locations l SET
+			name = t.name,
+			country_code = t.country_code,
+			subdivision = t.subdivision,
+			status = t.status,
+			iata_code = t.iata_code,
+			remarks = t.remarks,
+			unlocode_date = t.unlocode_date,
+			alternate_names = ARRAY(
+				SELECT DISTINCT n FROM unnest(l.alternate_names || t.alternate_names || l.name) n
+				WHERE n <> t.name
+			),
+			location = COALESCE(t.location, l.location),
+			coordinates_source = CASE WHEN t.location IS NOT NULL THEN 'unlocode' ELSE l.coordinates_source END,
+			coordinates_confidence = CASE WHEN t.location IS NOT NULL THEN 1 ELSE l.coordinates_confidence END,
+			is_port = t.is_port,
+			is_airport = t.is_airport,
+			is_train_station = t.is_train_station,
+			is_road_terminal = t.is_road_terminal,
+			is_postal_exchange = t.is_postal_exchange,
+			is_multimodal = t.is_multimodal,
+			is_fixed_transport = t.is_fixed_transport,
+			is_inland_port = t.is_inland_port,
+			is_border_crossing = t.is_border_crossing
+		FROM temp_locations t
+		WHERE t.unlocode = l.unlocode
+		AND (
+			(t.name, t.country_code, t.subdivision, t.status, t.iata_code, t.remarks, t.unlocode_date,
+			 t.is_port, t.is_airport, t.is_train_station, t.is_road_terminal, t.is_postal_exchange,
+			 t.is_multimodal, t.is_fixed_transport, t.is_inland_port, t.is_border_crossing)
+			IS DISTINCT FROM
+			(l.name, l.country_code, l.subdivision, l.status, l.iata_code, l.remarks, l.unlocode_date,
+			 l.is_port, l.is_airport, l.is_train_station, l.is_road_terminal, l.is_postal_exchange,
+			 l.is_multimodal, l.is_fixed_transport, l.is_inland_port, l.is_border_crossing)
+			OR NOT (t.alternate_names <@ l.alternate_names)
+			OR (t.location IS NOT NULL AND (
+				l.location IS NULL OR l.coordinates_source IS DISTINCT FROM 'unlocode'
+				OR NOT ST_Equals(t.location::geometry, l.location::geometry)
+			))
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to update changed locations: %w", err)
+	}
+	metrics.Updated, _ = res.RowsAffected()
+
+	res, err = tx.Exec(`
+		INSERT INTO locations (
+			unlocode, name, alternate_names, country_code,
+			subdivision, status, iata_code, remarks, unlocode_date,
+			location, is_port, is_airport, is_train_station,
+			is_road_terminal, is_postal_exchange, is_multimodal,
+			is_fixed_transport, is_inland_port, is_border_crossing,
+			coordinates_source, coordinates_confidence
+		)
+		SELECT DISTINCT ON (t.unlocode)
+			t.unlocode, t.name, t.alternate_names, t.country_code,
+			t.subdivision, t.status, t.iata_code, t.remarks, t.unlocode_date,
+			t.location, t.is_port, t.is_airport, t.is_train_station,
+			t.is_road_terminal, t.is_postal_exchange, t.is_multimodal,
+			t.is_fixed_transport, t.is_inland_port, t.is_border_crossing,
+			CASE WHEN t.location IS NOT NULL THEN 'unlocode' END,
+			CASE WHEN t.location IS NOT NULL THEN 1 END
+		FROM temp_locations t
+		WHERE NOT EXISTS (
+			SELECT 1 FROM locations l WHERE l.unlocode = t.unlocode
+		)
+		ORDER BY t.unlocode`)
+	if err != nil {
+		return fmt.Errorf("failed to insert new locations: %w", err)
+	}
+	metrics.Inserted, _ = res.RowsAffected()
+
+	if err := saveAliases(tx, aliases, metrics, opts.Release); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// saveAliases upserts the aliases of this file. Aliases are kept across
+// releases so superseded codes keep resolving once they leave the list,
+// unless the code comes back as a location of its own.
+func saveAliases(tx *sql.Tx, aliases []Alias, metrics *SeederMetrics, release string) error {
+	codes := make([]string, len(aliases))
+	targets := make([]string, len(aliases))
+	names := make([]string, len(aliases))
+	reasons := make([]string, len(aliases))
+	for i, a := range aliases {
+		codes[i], targets[i], names[i], reasons[i] = a.Code, a.Target, a.Name, a.Reason
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO location_aliases (alias_code, unlocode, alias_name, reason, release)
+		SELECT DISTINCT ON (a.alias_code) a.alias_code, a.unlocode, a.alias_name, a.reason, NULLIF($5, '')
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::text[]) AS a(alias_code, unlocode, alias_name, reason)
+		WHERE EXISTS (SELECT 1 FROM locations l WHERE l.unlocode = a.unlocode)
+		ORDER BY a.alias_code
+		ON CONFLICT (alias_code) DO UPDATE SET
+			unlocode = EXCLUDED.unlocode,
+			alias_name = EXCLUDED.alias_name,
+			reason = EXCLUDED.reason,
+			release = EXCLUDED.release,
+			updated_at = NOW()`,
+		pq.Array(codes), pq.Array(targets), pq.Array(names), pq.Array(reasons), release)
+	if err != nil {
+		return fmt.Errorf("failed to save location aliases: %w", err)
+	}
+	metrics.Aliases, _ = res.RowsAffected()
+
+	_, err = tx.Exec(`
+		DELETE FROM location_aliases a
+		WHERE EXISTS (SELECT 1 FROM locations l WHERE l.unlocode = a.alias_code);
+
+		-- a target superseded in turn points the alias at its replacement
+		UPDATE location_aliases a SET unlocode = b.unlocode, updated_at = NOW()
+		FROM location_aliases b
+		WHERE a.unlocode = b.alias_code;`)
+	if err != nil {
+		return fmt.Errorf("failed to clean up location aliases: %w", err)
+	}
+	return nil
+}
+
+func copyToTemp(tx *sql.Tx, locations []Location, batchSize int) error {
+	_, err := tx.Exec(`
+	   CREATE TEMPORARY TABLE temp_locations (
+            unlocode TEXT NOT NULL,
+            name TEXT NOT NULL,
+            alternate_names TEXT[] NOT NULL DEFAULT '{}',
+            country_code TEXT NOT NULL,
+            subdivision TEXT,
+            status TEXT,
+            iata_code TEXT,
+            remarks TEXT,
+            unlocode_date DATE,
+            location GEOGRAPHY(POINT, 4326),
+            is_port BOOLEAN DEFAULT FALSE,
+            is_airport BOOLEAN DEFAULT FALSE,
+            is_train_station BOOLEAN DEFAULT FALSE,
+            is_road_terminal BOOLEAN DEFAULT FALSE,
+            is_postal_exchange BOOLEAN DEFAULT FALSE,
+            is_multimodal BOOLEAN DEFAULT FALSE,
+            is_fixed_transport BOOLEAN DEFAULT FALSE,
+            is_inland_port BOOLEAN DEFAULT FALSE,
+            is_border_crossing BOOLEAN DEFAULT FALSE
+        ) ON COMMIT DROP
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create temp table: %w", err)
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn(
+		"temp_locations",
+		"unlocode", "name", "alternate_names", "country_code",
+		"subdivision", "status", "iata_code", "remarks", "unlocode_date",
+		"location", "is_port", "is_airport", "is_train_station",
+		"is_road_terminal", "is_postal_exchange", "is_multimodal",
+		"is_fixed_transport", "is_inland_port", "is_border_crossing",
+	))
+	if err != nil {
+		return fmt.Errorf("failed to prepare COPY statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, loc := range locations {
+		var point interface{}
+		if loc.HasCoordinates {
+			point = fmt.Sprintf("SRID=4326;POINT(%f %f)", loc.Longitude, loc.Latitude)
+		}
+
+		_, err := stmt.Exec(
+			loc.UnLoCode,
+			loc.Name,
+			pq.Array(loc.AlternateNames),
+			loc.CountryCode,
+			nullString(loc.Subdivision),
+			nullString(loc.Status),
+			nullString(loc.IATACode),
+			nullString(loc.Remarks),
+			loc.Date,
+			point,
+			loc.IsPort,
+			loc.IsAirport,
+			loc.IsTrainStation,
+			loc.IsRoadTerminal,
+			loc.IsPostalExchange,
+			loc.IsMultimodal,
+			loc.IsFixedTransport,
+			loc.IsInlandPort,
+			loc.IsBorderCrossing,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to COPY location %s: %w", loc.UnLoCode, err)
+		}
+
+		if (i+1)%batchSize == 0 {
+			log.Printf("Progress: %d/%d locations loaded (%.1f%%)",
+				i+1, len(locations), float64(i+1)/float64(len(locations))*100)
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		return fmt.Errorf("failed to flush COPY buffer: %w", err)
+	}
+
+	if _, err := tx.Exec(`ANALYZE temp_locations`); err != nil {
+		return fmt.Errorf("failed to analyze temp table: %w", err)
+	}
+	return nil
+}
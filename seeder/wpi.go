@@ -0,0 +1,240 @@
+package seeder
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	DefaultWPIFile = "UpdatedPub150.csv"
+
+	// WPI positions are charted, better than the town centre of most
+	// UN/LOCODE entries but not a geocoded terminal
+	wpiConfidence = 0.9
+	// Ports without a UN/LOCODE column link to the nearest port this close
+	wpiLinkRadiusMeters = 10000
+)
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]`)
+
+// WPIPort is an entry of the NGA World Port Index (Pub 150).
+type WPIPort struct {
+	Number          int
+	Name            string
+	Unlocode        string
+	Country         string
+	HarborSize      string
+	HarborType      string
+	MaxDraft        string
+	ChannelDepth    string
+	CargoPierDepth  string
+	MaxVesselLength string
+	Latitude        float64
+	Longitude       float64
+}
+
+// WPIImport summarizes an ImportWPI run.
+type WPIImport struct {
+	Records           int   `json:"records"`
+	Skipped           int   `json:"skipped"`
+	Linked            int64 `json:"linked"`
+	LinkedByDistance  int64 `json:"linked_by_distance"`
+	CoordinatesFilled int64 `json:"coordinates_filled"`
+}
+
+// LoadWPI reads the World Port Index CSV export. Columns are found by
+// header name, so the column order of a given edition does not matter.
+func LoadWPI(path string) ([]WPIPort, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("wpi %s: reading header: %w", path, err)
+	}
+
+	// "Maximum Vessel Draft (m)" -> "maximumvesseldraftm"
+	col := make(map[string]int)
+	for i, name := range header {
+		col[nonAlphanumeric.ReplaceAllString(strings.ToLower(name), "")] = i
+	}
+	for _, required := range []string{"worldportindexnumber", "mainportname", "latitude", "longitude"} {
+		if _, ok := col[required]; !ok {
+			return nil, 0, fmt.Errorf("wpi %s: missing column %s", path, required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := col[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var ports []WPIPort
+	skipped := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("wpi %s: %w", path, err)
+		}
+
+		number, errNum := strconv.Atoi(field(record, "worldportindexnumber"))
+		lat, errLat := strconv.ParseFloat(field(record, "latitude"), 64)
+		lon, errLon := strconv.ParseFloat(field(record, "longitude"), 64)
+		if errNum != nil || errLat != nil || errLon != nil {
+			skipped++
+			continue
+		}
+
+		ports = append(ports, WPIPort{
+			Number: number,
+			Name:   field(record, "mainportname"),
+			// written "US NYC" in some editions
+			Unlocode:        strings.ToUpper(strings.ReplaceAll(field(record, "unlocode"), " ", "")),
+			Country:         field(record, "countrycode"),
+			HarborSize:      field(record, "harborsize"),
+			HarborType:      field(record, "harbortype"),
+			MaxDraft:        field(record, "maximumvesseldraftm"),
+			ChannelDepth:    field(record, "channeldepthm"),
+			CargoPierDepth:  field(record, "cargopierdepthm"),
+			MaxVesselLength: field(record, "maximumvessellengthm"),
+			Latitude:        lat,
+			Longitude:       lon,
+		})
+	}
+	return ports, skipped, nil
+}
+
+// ImportWPI upserts the World Port Index and links each port to a
+// UN/LOCODE, by the port's own column when it names a known location, else
+// to the nearest UN/LOCODE port. Linked locations without coordinates take
+// the WPI position.
+func ImportWPI(db *sql.DB, path string) (*WPIImport, error) {
+	if path == "" {
+		path = DefaultWPIFile
+	}
+	ports, skipped, err := LoadWPI(path)
+	if err != nil {
+		return nil, err
+	}
+	stats := &WPIImport{Records: len(ports), Skipped: skipped}
+
+	n := len(ports)
+	numbers := make([]int64, n)
+	names, codes, countries := make([]string, n), make([]string, n), make([]string, n)
+	sizes, types := make([]string, n), make([]string, n)
+	drafts, channels, piers, lengths := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	lats, lons := make([]float64, n), make([]float64, n)
+	for i, p := range ports {
+		numbers[i], names[i], codes[i], countries[i] = int64(p.Number), p.Name, p.Unlocode, p.Country
+		sizes[i], types[i] = p.HarborSize, p.HarborType
+		drafts[i], channels[i], piers[i], lengths[i] = p.MaxDraft, p.ChannelDepth, p.CargoPierDepth, p.MaxVesselLength
+		lats[i], lons[i] = p.Latitude, p.Longitude
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO wpi_ports (
+			wpi_number, name, unlocode, country, harbor_size, harbor_type,
+			max_draft_m, channel_depth_m, cargo_pier_depth_m, max_vessel_length_m, location
+		)
+		SELECT DISTINCT ON (w.wpi_number)
+			w.wpi_number, w.name, NULLIF(w.unlocode, ''), NULLIF(w.country, ''),
+			NULLIF(w.harbor_size, ''), NULLIF(w.harbor_type, ''),
+			NULLIF(w.max_draft, '')::real, NULLIF(w.channel_depth, '')::real,
+			NULLIF(w.cargo_pier_depth, '')::real, NULLIF(w.max_vessel_length, '')::real,
+			ST_SetSRID(ST_MakePoint(w.lon, w.lat), 4326)::geography
+		FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[],
+			$7::text[], $8::text[], $9::text[], $10::text[], $11::float8[], $12::float8[])
+			AS w(wpi_number, name, unlocode, country, harbor_size, harbor_type,
+				 max_draft, channel_depth, cargo_pier_depth, max_vessel_length, lat, lon)
+		ORDER BY w.wpi_number
+		ON CONFLICT (wpi_number) DO UPDATE SET
+			name = EXCLUDED.name,
+			unlocode = EXCLUDED.unlocode,
+			linked_by = NULL,
+			country = EXCLUDED.country,
+			harbor_size = EXCLUDED.harbor_size,
+			harbor_type = EXCLUDED.harbor_type,
+			max_draft_m = EXCLUDED.max_draft_m,
+			channel_depth_m = EXCLUDED.channel_depth_m,
+			cargo_pier_depth_m = EXCLUDED.cargo_pier_depth_m,
+			max_vessel_length_m = EXCLUDED.max_vessel_length_m,
+			location = EXCLUDED.location,
+			imported_at = NOW()`,
+		pq.Array(numbers), pq.Array(names), pq.Array(codes), pq.Array(countries), pq.Array(sizes), pq.Array(types),
+		pq.Array(drafts), pq.Array(channels), pq.Array(piers), pq.Array(lengths), pq.Array(lats), pq.Array(lons))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert WPI ports: %w", err)
+	}
+
+	// Own column first, following UN/LOCODE aliases
+	res, err := tx.Exec(`
+		UPDATE wpi_ports w
+		SET unlocode = l.unlocode, linked_by = 'unlocode'
+		FROM locations l
+		WHERE w.linked_by IS NULL
+		AND l.unlocode = COALESCE((SELECT a.unlocode FROM location_aliases a WHERE a.alias_code = w.unlocode), w.unlocode)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link WPI ports: %w", err)
+	}
+	stats.Linked, _ = res.RowsAffected()
+
+	res, err = tx.Exec(`
+		UPDATE wpi_ports w
+		SET linked_by = 'nearest', unlocode = (
+			SELECT l.unlocode FROM locations l
+			WHERE l.is_port AND l.location IS NOT NULL
+			ORDER BY l.location <-> w.location
+			LIMIT 1
+		)
+		WHERE w.linked_by IS NULL
+		AND EXISTS (
+			SELECT 1 FROM locations l
+			WHERE l.is_port AND ST_DWithin(l.location, w.location, $1)
+		)`, wpiLinkRadiusMeters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link WPI ports by distance: %w", err)
+	}
+	stats.LinkedByDistance, _ = res.RowsAffected()
+
+	res, err = tx.Exec(`
+		UPDATE locations l
+		SET location = w.location, coordinates_source = 'wpi', coordinates_confidence = $1
+		FROM wpi_ports w
+		WHERE w.unlocode = l.unlocode AND w.linked_by = 'unlocode' AND l.location IS NULL`, wpiConfidence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fill coordinates from WPI: %w", err)
+	}
+	stats.CoordinatesFilled, _ = res.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("WPI import completed: %+v", *stats)
+	return stats, nil
+}
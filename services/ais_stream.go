@@ -169,6 +169,19 @@ func (a *AISStreamManager) handleMessages() {
 			log.Printf("Position report for MMSI %s: %+v", mmsi, positionReport)
 
 			go db.InsertPositionReport(a.db, mmsi, positionReport, timestamp)
+
+		case aisstream.SHIP_STATIC_DATA:
+			if msg.Message.ShipStaticData == nil {
+				continue
+			}
+			staticData := *msg.Message.ShipStaticData
+			log.Printf("Static data received for mmsi %s: %s, IMO %d", mmsi, staticData.Name, staticData.ImoNumber)
+
+			go func() {
+				if err := db.RecordShipStaticData(a.db, mmsi, staticData, timestamp); err != nil {
+					log.Printf("Error recording static data for mmsi %s: %v", mmsi, err)
+				}
+			}()
 		}
 
 	}
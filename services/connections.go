@@ -0,0 +1,202 @@
+package services
+
+import (
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+const (
+	defaultMinConnectionTime = 24 * time.Hour
+	// Speed assumed for the remaining distance of an inbound vessel
+	defaultETASpeedKnots = 14.0
+	// Great-circle distance understates the sailed distance around land
+	seaRouteFactor = 1.25
+	earthRadiusNM  = 3440.065
+	// A data quality score older than this many monitor runs is stale
+	dataQualityRunsValid = 3
+)
+
+// ConnectionPolicy holds the minimum connection times. Keys are an outbound
+// transport mode (VESSEL, RAIL, TRUCK, BARGE) or an inbound>outbound pair,
+// the pair taking precedence.
+type ConnectionPolicy struct {
+	Default       time.Duration
+	Minimums      map[string]time.Duration
+	ETASpeedKnots float64
+	// Age beyond which a vessel's data quality score no longer vouches for
+	// its position
+	MaxDataQualityAge time.Duration
+}
+
+// ConnectionPolicyFromEnv reads CONNECTION_MIN_TIME (default 24h) and
+// CONNECTION_MIN_TIMES, e.g. "VESSEL=24h,RAIL=12h,VESSEL>TRUCK=8h", and
+// AIS_QUALITY_INTERVAL to tell a current data quality score.
+func ConnectionPolicyFromEnv() ConnectionPolicy {
+	policy := ConnectionPolicy{
+		Default:           defaultMinConnectionTime,
+		Minimums:          make(map[string]time.Duration),
+		ETASpeedKnots:     defaultETASpeedKnots,
+		MaxDataQualityAge: dataQualityRunsValid * EnvDuration("AIS_QUALITY_INTERVAL", defaultDataQualityInterval),
+	}
+
+	if v := os.Getenv("CONNECTION_MIN_TIME"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			policy.Default = d
+		} else {
+			log.Printf("Invalid CONNECTION_MIN_TIME %q, using %v", v, policy.Default)
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("CONNECTION_MIN_TIMES"), ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			log.Printf("Invalid CONNECTION_MIN_TIMES entry %q: %v", entry, err)
+			continue
+		}
+		policy.Minimums[strings.ToUpper(strings.TrimSpace(key))] = d
+	}
+
+	return policy
+}
+
+func (p ConnectionPolicy) minimum(inbound, outbound string) time.Duration {
+	if d, ok := p.Minimums[inbound+">"+outbound]; ok {
+		return d
+	}
+	if d, ok := p.Minimums[outbound]; ok {
+		return d
+	}
+	return p.Default
+}
+
+// AnalyzeConnections finds the transfers between consecutive legs of a
+// product and flags the ones shorter than the policy allows. Consecutive
+// legs on the same vessel are a port call, not a transfer.
+func AnalyzeConnections(product *models.ReducedOceanProduct, policy ConnectionPolicy) {
+	product.Connections = []models.Connection{}
+	product.ConnectionAtRisk = false
+
+	legs := product.TransportLegs
+	for i := 0; i+1 < len(legs); i++ {
+		in, out := legs[i], legs[i+1]
+		if in.VesselIMONumber != "" && in.VesselIMONumber == out.VesselIMONumber {
+			continue
+		}
+
+		minimum := policy.minimum(in.TransportMode, out.TransportMode)
+		conn := models.Connection{
+			PortUnLoCode:            in.DestinationPortUnLoCode,
+			PortName:                in.DestinationName,
+			InboundMode:             in.TransportMode,
+			OutboundMode:            out.TransportMode,
+			InboundVesselIMONumber:  in.VesselIMONumber,
+			OutboundVesselIMONumber: out.VesselIMONumber,
+			ScheduledArrival:        in.ArrivalDateTime,
+			ScheduledDeparture:      out.DepartureDateTime,
+			MinimumMinutes:          int32(minimum / time.Minute),
+		}
+		conn.WindowMinutes, conn.Status = connectionWindow(in.ArrivalDateTime.Time, out.DepartureDateTime.Time, minimum)
+
+		product.Connections = append(product.Connections, conn)
+	}
+	product.ConnectionAtRisk = anyAtRisk(product.Connections)
+}
+
+// UpdateConnectionETAs re-evaluates the connections of a product against
+// the live position of each inbound vessel. ports holds [lat, lon] by
+// UN/LOCODE, quality the AIS data quality by MMSI. A vessel only counts once
+// its inbound leg has departed, before that its position belongs to a
+// previous voyage, and only while its AIS data can be trusted, see
+// ConnectionPolicy.TrustLiveETA. Estimates earlier than the schedule are ignored: the
+// straight-line ETA cannot tell a vessel ahead of time from one about to
+// call at other ports first.
+func UpdateConnectionETAs(product *models.ReducedOceanProduct, policy ConnectionPolicy, ports map[string][]float64, quality map[string]db.VesselDataQuality, now time.Time) {
+	if len(product.Connections) == 0 {
+		return
+	}
+
+	for i := range product.Connections {
+		conn := &product.Connections[i]
+
+		leg, ok := inboundLeg(product.TransportLegs, *conn)
+		if !ok || len(leg.LastKnownPosition) < 2 {
+			continue
+		}
+		if now.Before(leg.DepartureDateTime.Time) || !now.Before(conn.ScheduledDeparture.Time) {
+			continue
+		}
+		if q, ok := quality[leg.VesselMMSI]; !ok || !policy.TrustLiveETA(q, now) {
+			continue
+		}
+		port, ok := ports[conn.PortUnLoCode]
+		if !ok || len(port) < 2 {
+			continue
+		}
+
+		nm := greatCircleNM(leg.LastKnownPosition[0], leg.LastKnownPosition[1], port[0], port[1]) * seaRouteFactor
+		eta := now.Add(time.Duration(nm / policy.ETASpeedKnots * float64(time.Hour)))
+		if eta.Before(conn.ScheduledArrival.Time) {
+			eta = conn.ScheduledArrival.Time
+		}
+
+		conn.EstimatedArrival = &models.CustomTime{Time: eta}
+		minimum := time.Duration(conn.MinimumMinutes) * time.Minute
+		conn.WindowMinutes, conn.Status = connectionWindow(eta, conn.ScheduledDeparture.Time, minimum)
+	}
+	product.ConnectionAtRisk = anyAtRisk(product.Connections)
+}
+
+// TrustLiveETA reports whether the last known position of a vessel is good
+// enough to estimate its arrival: its data quality score is high enough,
+// it is not dark, and the score itself is recent.
+func (p ConnectionPolicy) TrustLiveETA(q db.VesselDataQuality, now time.Time) bool {
+	return q.TrustETA && q.DarkSince == nil && now.Sub(q.ComputedAt) < p.MaxDataQualityAge
+}
+
+func inboundLeg(legs []models.ReducedTransportLeg, conn models.Connection) (models.ReducedTransportLeg, bool) {
+	for _, leg := range legs {
+		if leg.DestinationPortUnLoCode == conn.PortUnLoCode && leg.ArrivalDateTime.Equal(conn.ScheduledArrival.Time) {
+			return leg, true
+		}
+	}
+	return models.ReducedTransportLeg{}, false
+}
+
+func connectionWindow(arrival, departure time.Time, minimum time.Duration) (int32, string) {
+	window := departure.Sub(arrival)
+	switch {
+	case window < 0:
+		return int32(window / time.Minute), models.ConnectionMissed
+	case window < minimum:
+		return int32(window / time.Minute), models.ConnectionAtRisk
+	}
+	return int32(window / time.Minute), models.ConnectionOK
+}
+
+func anyAtRisk(connections []models.Connection) bool {
+	for _, c := range connections {
+		if c.Status != models.ConnectionOK {
+			return true
+		}
+	}
+	return false
+}
+
+func greatCircleNM(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusNM * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,303 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+func TestConnectionWindow(t *testing.T) {
+	arrival := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		departure  time.Time
+		minimum    time.Duration
+		wantWindow int32
+		wantStatus string
+	}{
+		{"longer than the minimum", arrival.Add(30 * time.Hour), 24 * time.Hour, 30 * 60, models.ConnectionOK},
+		{"exactly the minimum", arrival.Add(24 * time.Hour), 24 * time.Hour, 24 * 60, models.ConnectionOK},
+		{"shorter than the minimum", arrival.Add(23*time.Hour + 59*time.Minute), 24 * time.Hour, 23*60 + 59, models.ConnectionAtRisk},
+		{"departs on arrival", arrival, 24 * time.Hour, 0, models.ConnectionAtRisk},
+		{"departs on arrival without a minimum", arrival, 0, 0, models.ConnectionOK},
+		{"departs before arrival", arrival.Add(-90 * time.Minute), 24 * time.Hour, -90, models.ConnectionMissed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, status := connectionWindow(arrival, tt.departure, tt.minimum)
+			if window != tt.wantWindow || status != tt.wantStatus {
+				t.Errorf("got %d minutes %s, want %d minutes %s", window, status, tt.wantWindow, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestConnectionPolicyMinimum(t *testing.T) {
+	policy := ConnectionPolicy{
+		Default: 24 * time.Hour,
+		Minimums: map[string]time.Duration{
+			"TRUCK":        12 * time.Hour,
+			"VESSEL>TRUCK": 8 * time.Hour,
+		},
+	}
+	tests := []struct {
+		inbound, outbound string
+		want              time.Duration
+	}{
+		{"VESSEL", "TRUCK", 8 * time.Hour},
+		{"RAIL", "TRUCK", 12 * time.Hour},
+		{"TRUCK", "VESSEL", 24 * time.Hour},
+		{"VESSEL", "VESSEL", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := policy.minimum(tt.inbound, tt.outbound); got != tt.want {
+			t.Errorf("minimum(%s, %s) = %v, want %v", tt.inbound, tt.outbound, got, tt.want)
+		}
+	}
+}
+
+func transferLeg(mode, imo, origin, destination string, departure, arrival time.Time) models.ReducedTransportLeg {
+	return models.ReducedTransportLeg{
+		TransportMode:           mode,
+		VesselIMONumber:         imo,
+		OriginPortUnLoCode:      origin,
+		DestinationPortUnLoCode: destination,
+		DepartureDateTime:       models.CustomTime{Time: departure},
+		ArrivalDateTime:         models.CustomTime{Time: arrival},
+	}
+}
+
+func TestAnalyzeConnections(t *testing.T) {
+	day := 24 * time.Hour
+	t0 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	policy := ConnectionPolicy{
+		Default:  24 * time.Hour,
+		Minimums: map[string]time.Duration{"TRUCK": 12 * time.Hour, "VESSEL>TRUCK": 8 * time.Hour},
+	}
+
+	tests := []struct {
+		name       string
+		legs       []models.ReducedTransportLeg
+		wantStatus []string
+		wantMin    []int32
+		wantRisk   bool
+	}{
+		{
+			name:       "direct sailing",
+			legs:       []models.ReducedTransportLeg{transferLeg("VESSEL", "9776183", "NLRTM", "CNSHA", t0, t0.Add(30*day))},
+			wantStatus: []string{},
+		},
+		{
+			name: "port call of the same vessel is no transfer",
+			legs: []models.ReducedTransportLeg{
+				transferLeg("VESSEL", "9776183", "NLRTM", "SGSIN", t0, t0.Add(20*day)),
+				transferLeg("VESSEL", "9776183", "SGSIN", "CNSHA", t0.Add(20*day+6*time.Hour), t0.Add(25*day)),
+			},
+			wantStatus: []string{},
+		},
+		{
+			name: "transshipment with time to spare",
+			legs: []models.ReducedTransportLeg{
+				transferLeg("VESSEL", "9776183", "NLRTM", "SGSIN", t0, t0.Add(20*day)),
+				transferLeg("VESSEL", "9619907", "SGSIN", "CNSHA", t0.Add(22*day), t0.Add(27*day)),
+			},
+			wantStatus: []string{models.ConnectionOK},
+			wantMin:    []int32{24 * 60},
+		},
+		{
+			name: "tight transshipment",
+			legs: []models.ReducedTransportLeg{
+				transferLeg("VESSEL", "9776183", "NLRTM", "SGSIN", t0, t0.Add(20*day)),
+				transferLeg("VESSEL", "9619907", "SGSIN", "CNSHA", t0.Add(20*day+10*time.Hour), t0.Add(25*day)),
+			},
+			wantStatus: []string{models.ConnectionAtRisk},
+			wantMin:    []int32{24 * 60},
+			wantRisk:   true,
+		},
+		{
+			name: "vessel to truck pair takes precedence over the truck minimum",
+			legs: []models.ReducedTransportLeg{
+				transferLeg("VESSEL", "9776183", "NLRTM", "DEHAM", t0, t0.Add(2*day)),
+				transferLeg("TRUCK", "", "DEHAM", "DEBER", t0.Add(2*day+10*time.Hour), t0.Add(3*day)),
+			},
+			wantStatus: []string{models.ConnectionOK},
+			wantMin:    []int32{8 * 60},
+		},
+		{
+			name: "rail to truck falls back on the truck minimum",
+			legs: []models.ReducedTransportLeg{
+				transferLeg("RAIL", "", "DEHAM", "DEMUC", t0, t0.Add(day)),
+				transferLeg("TRUCK", "", "DEMUC", "ATSZG", t0.Add(day+10*time.Hour), t0.Add(2*day)),
+			},
+			wantStatus: []string{models.ConnectionAtRisk},
+			wantMin:    []int32{12 * 60},
+			wantRisk:   true,
+		},
+		{
+			name: "onward leg leaves before the inbound arrives",
+			legs: []models.ReducedTransportLeg{
+				transferLeg("VESSEL", "9776183", "NLRTM", "SGSIN", t0, t0.Add(20*day)),
+				transferLeg("VESSEL", "9619907", "SGSIN", "CNSHA", t0.Add(19*day), t0.Add(25*day)),
+				transferLeg("VESSEL", "9811000", "CNSHA", "JPTYO", t0.Add(28*day), t0.Add(31*day)),
+			},
+			wantStatus: []string{models.ConnectionMissed, models.ConnectionOK},
+			wantMin:    []int32{24 * 60, 24 * 60},
+			wantRisk:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product := models.ReducedOceanProduct{TransportLegs: tt.legs, ConnectionAtRisk: !tt.wantRisk}
+			AnalyzeConnections(&product, policy)
+
+			if len(product.Connections) != len(tt.wantStatus) {
+				t.Fatalf("got %d connections, want %d", len(product.Connections), len(tt.wantStatus))
+			}
+			for i, conn := range product.Connections {
+				if conn.Status != tt.wantStatus[i] || conn.MinimumMinutes != tt.wantMin[i] {
+					t.Errorf("connection %d: %s with a minimum of %d minutes, want %s with %d",
+						i, conn.Status, conn.MinimumMinutes, tt.wantStatus[i], tt.wantMin[i])
+				}
+				if conn.PortUnLoCode != tt.legs[i].DestinationPortUnLoCode {
+					t.Errorf("connection %d at %s, want %s", i, conn.PortUnLoCode, tt.legs[i].DestinationPortUnLoCode)
+				}
+			}
+			if product.ConnectionAtRisk != tt.wantRisk {
+				t.Errorf("ConnectionAtRisk = %v, want %v", product.ConnectionAtRisk, tt.wantRisk)
+			}
+		})
+	}
+}
+
+func TestUpdateConnectionETAs(t *testing.T) {
+	now := time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC)
+	policy := ConnectionPolicy{
+		Default:           12 * time.Hour,
+		ETASpeedKnots:     14,
+		MaxDataQualityAge: 3 * time.Hour,
+	}
+	// on the equator a degree of longitude is the same distance everywhere
+	port := []float64{0, 100}
+	ports := map[string][]float64{"SGSIN": port}
+	hoursOut := func(hours float64) []float64 {
+		nm := hours * policy.ETASpeedKnots / seaRouteFactor
+		return []float64{0, port[1] - nm/(earthRadiusNM*math.Pi/180)}
+	}
+
+	scheduledArrival := now.Add(48 * time.Hour)
+	scheduledDeparture := now.Add(72 * time.Hour)
+	trusted := db.VesselDataQuality{TrustETA: true, ComputedAt: now.Add(-time.Hour)}
+	dark := trusted
+	darkSince := now.Add(-6 * time.Hour)
+	dark.DarkSince = &darkSince
+
+	tests := []struct {
+		name          string
+		position      []float64
+		inboundDepart time.Time
+		quality       map[string]db.VesselDataQuality
+		wantETA       *time.Time
+		wantStatus    string
+	}{
+		{
+			name:       "a little late",
+			position:   hoursOut(50),
+			quality:    map[string]db.VesselDataQuality{"219000001": trusted},
+			wantStatus: models.ConnectionOK,
+		},
+		{
+			name:       "late enough to put the connection at risk",
+			position:   hoursOut(66),
+			quality:    map[string]db.VesselDataQuality{"219000001": trusted},
+			wantStatus: models.ConnectionAtRisk,
+		},
+		{
+			name:       "arriving after the onward departure",
+			position:   hoursOut(80),
+			quality:    map[string]db.VesselDataQuality{"219000001": trusted},
+			wantStatus: models.ConnectionMissed,
+		},
+		{
+			name:       "an early estimate is ignored",
+			position:   hoursOut(2),
+			quality:    map[string]db.VesselDataQuality{"219000001": trusted},
+			wantETA:    &scheduledArrival,
+			wantStatus: models.ConnectionOK,
+		},
+		{
+			name:          "vessel still on its previous voyage",
+			position:      hoursOut(80),
+			inboundDepart: now.Add(time.Hour),
+			quality:       map[string]db.VesselDataQuality{"219000001": trusted},
+		},
+		{
+			name:     "no data quality score",
+			position: hoursOut(80),
+		},
+		{
+			name:     "data quality does not vouch for the ETA",
+			position: hoursOut(80),
+			quality:  map[string]db.VesselDataQuality{"219000001": {ComputedAt: now}},
+		},
+		{
+			name:     "vessel gone dark",
+			position: hoursOut(80),
+			quality:  map[string]db.VesselDataQuality{"219000001": dark},
+		},
+		{
+			name:     "stale data quality score",
+			position: hoursOut(80),
+			quality:  map[string]db.VesselDataQuality{"219000001": {TrustETA: true, ComputedAt: now.Add(-4 * time.Hour)}},
+		},
+		{
+			name:    "no position",
+			quality: map[string]db.VesselDataQuality{"219000001": trusted},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inboundDepart := tt.inboundDepart
+			if inboundDepart.IsZero() {
+				inboundDepart = now.Add(-10 * 24 * time.Hour)
+			}
+			inbound := transferLeg("VESSEL", "9776183", "NLRTM", "SGSIN", inboundDepart, scheduledArrival)
+			inbound.VesselMMSI = "219000001"
+			inbound.LastKnownPosition = tt.position
+			product := models.ReducedOceanProduct{TransportLegs: []models.ReducedTransportLeg{
+				inbound,
+				transferLeg("VESSEL", "9619907", "SGSIN", "CNSHA", scheduledDeparture, scheduledDeparture.Add(5*24*time.Hour)),
+			}}
+			AnalyzeConnections(&product, policy)
+			if product.Connections[0].Status != models.ConnectionOK {
+				t.Fatalf("scheduled connection is %s, want OK", product.Connections[0].Status)
+			}
+
+			UpdateConnectionETAs(&product, policy, ports, tt.quality, now)
+
+			conn := product.Connections[0]
+			if tt.wantStatus == "" {
+				if conn.EstimatedArrival != nil || conn.Status != models.ConnectionOK {
+					t.Errorf("connection moved to %s with ETA %v, want it left alone", conn.Status, conn.EstimatedArrival)
+				}
+				return
+			}
+			if conn.EstimatedArrival == nil {
+				t.Fatal("no estimated arrival")
+			}
+			if tt.wantETA != nil && !conn.EstimatedArrival.Equal(*tt.wantETA) {
+				t.Errorf("ETA = %v, want %v", conn.EstimatedArrival.Time, *tt.wantETA)
+			}
+			if conn.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", conn.Status, tt.wantStatus)
+			}
+			if product.ConnectionAtRisk != (tt.wantStatus != models.ConnectionOK) {
+				t.Errorf("ConnectionAtRisk = %v with a %s connection", product.ConnectionAtRisk, tt.wantStatus)
+			}
+		})
+	}
+}
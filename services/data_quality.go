@@ -0,0 +1,191 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+const (
+	defaultDataQualityInterval = time.Hour
+	defaultDataQualityWindow   = 7 * 24 * time.Hour
+	defaultAISGapThreshold     = 2 * time.Hour
+	// A position a container ship could not have reached from the previous
+	// one is an outlier
+	maxPlausibleSpeedKnots = 40.0
+	maxConsecutiveOutliers = 3
+	// Rate at which a vessel in coverage scores full marks
+	expectedMessagesPerHour = 6.0
+	// Below this score, or while the vessel is dark, a live ETA is a guess
+	trustETAMinScore = 60.0
+)
+
+// DataQualityMonitor records the AIS gaps of tracked vessels and scores
+// their coverage, telling a vessel missing from the map because we lost its
+// signal from one quietly at berth.
+type DataQualityMonitor struct {
+	database  *sql.DB
+	interval  time.Duration
+	window    time.Duration
+	threshold time.Duration
+}
+
+// NewDataQualityMonitor reads AIS_QUALITY_INTERVAL (default 1h),
+// AIS_QUALITY_WINDOW (default 168h) and AIS_GAP_THRESHOLD (default 2h).
+func NewDataQualityMonitor(database *sql.DB) *DataQualityMonitor {
+	return &DataQualityMonitor{
+		database:  database,
+		interval:  EnvDuration("AIS_QUALITY_INTERVAL", defaultDataQualityInterval),
+		window:    EnvDuration("AIS_QUALITY_WINDOW", defaultDataQualityWindow),
+		threshold: EnvDuration("AIS_GAP_THRESHOLD", defaultAISGapThreshold),
+	}
+}
+
+func (m *DataQualityMonitor) Start() {
+	go func() {
+		for {
+			m.run()
+			time.Sleep(m.interval)
+		}
+	}()
+}
+
+func (m *DataQualityMonitor) run() {
+	mmsis, err := db.GetTrackedMMSIs(m.database)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, mmsi := range mmsis {
+		points, err := db.GetTrackPoints(m.database, mmsi, now.Add(-m.window))
+		if err != nil {
+			log.Printf("Error scoring AIS data of %s: %v", mmsi, err)
+			continue
+		}
+		quality, gaps := assessTrack(mmsi, points, now.Add(-m.window), now, m.threshold)
+		if err := db.SaveDataQuality(m.database, quality, gaps); err != nil {
+			log.Printf("Error scoring AIS data of %s: %v", mmsi, err)
+		}
+	}
+	log.Printf("Scored AIS data quality of %d tracked vessels", len(mmsis))
+}
+
+// assessTrack finds the gaps longer than threshold in points, including the
+// silence since the last one, and scores the window from start to end: half
+// on the share of the window not in a gap, 30% on the message rate and 20%
+// on the share of positions that are not outliers.
+func assessTrack(mmsi string, points []db.TrackPoint, start, end time.Time, threshold time.Duration) (db.VesselDataQuality, []db.AISGap) {
+	q := db.VesselDataQuality{MMSI: mmsi, WindowStart: start, WindowEnd: end}
+	gaps := []db.AISGap{}
+	hours := end.Sub(start).Hours()
+
+	var gapTime time.Duration
+	var previous, accepted *db.TrackPoint
+	rejected := 0
+	for i := range points {
+		p := &points[i]
+		if !p.Timestamp.Before(start) {
+			q.PositionCount++
+		}
+		// Several rejections in a row mean the accepted position was the bad one
+		if outlier(accepted, p) && (rejected < maxConsecutiveOutliers || !validPosition(p)) {
+			if !p.Timestamp.Before(start) {
+				q.OutlierCount++
+			}
+			rejected++
+		} else {
+			accepted = p
+			rejected = 0
+		}
+
+		if previous != nil && p.Timestamp.Sub(previous.Timestamp) > threshold {
+			ended := p.Timestamp
+			distance := greatCircleNM(previous.Latitude, previous.Longitude, p.Latitude, p.Longitude)
+			gaps = append(gaps, db.AISGap{
+				MMSI:           mmsi,
+				StartedAt:      previous.Timestamp,
+				EndedAt:        &ended,
+				StartLatitude:  previous.Latitude,
+				StartLongitude: previous.Longitude,
+				EndLatitude:    &p.Latitude,
+				EndLongitude:   &p.Longitude,
+				DistanceNM:     &distance,
+				Hours:          ended.Sub(previous.Timestamp).Hours(),
+			})
+			gapTime += overlap(previous.Timestamp, ended, start, end)
+		}
+		previous = p
+	}
+
+	if previous != nil && end.Sub(previous.Timestamp) > threshold {
+		since := previous.Timestamp
+		q.DarkSince = &since
+		gaps = append(gaps, db.AISGap{
+			MMSI:           mmsi,
+			StartedAt:      since,
+			StartLatitude:  previous.Latitude,
+			StartLongitude: previous.Longitude,
+			Hours:          end.Sub(since).Hours(),
+		})
+		gapTime += overlap(since, end, start, end)
+	}
+
+	q.GapCount = len(gaps)
+	q.GapHours = gapTime.Hours()
+	if hours > 0 {
+		q.MessagesPerHour = float64(q.PositionCount) / hours
+		q.GapRatio = math.Min(q.GapHours/hours, 1)
+	}
+
+	if q.PositionCount > 0 {
+		rate := math.Min(q.MessagesPerHour/expectedMessagesPerHour, 1)
+		// 10% outliers is as bad as it gets
+		outliers := 1 - math.Min(float64(q.OutlierCount)/float64(q.PositionCount)*10, 1)
+		q.Score = math.Round(100*(0.5*(1-q.GapRatio)+0.3*rate+0.2*outliers)*10) / 10
+	}
+	q.TrustETA = q.Score >= trustETAMinScore && q.DarkSince == nil
+	return q, gaps
+}
+
+// outlier reports a position that is invalid or too far from the last
+// accepted one to have been sailed in the time between them.
+func outlier(accepted, p *db.TrackPoint) bool {
+	if !validPosition(p) {
+		return true
+	}
+	if accepted == nil {
+		return false
+	}
+	hours := p.Timestamp.Sub(accepted.Timestamp).Hours()
+	nm := greatCircleNM(accepted.Latitude, accepted.Longitude, p.Latitude, p.Longitude)
+	if hours <= 0 {
+		// Same timestamp, only a jump is suspicious
+		return nm > 1
+	}
+	return nm/hours > maxPlausibleSpeedKnots
+}
+
+// validPosition rejects out of range coordinates and the 0,0 of a receiver
+// without a fix.
+func validPosition(p *db.TrackPoint) bool {
+	return p.Latitude >= -90 && p.Latitude <= 90 && p.Longitude >= -180 && p.Longitude <= 180 &&
+		(p.Latitude != 0 || p.Longitude != 0)
+}
+
+func overlap(from, to, start, end time.Time) time.Duration {
+	if from.Before(start) {
+		from = start
+	}
+	if to.After(end) {
+		to = end
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
@@ -0,0 +1,23 @@
+package services
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// EnvDuration parses a Go duration such as 30m from the environment. The
+// durations configured this way are intervals and lifetimes, so anything
+// that is not positive falls back too.
+func EnvDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %v", name, v, fallback)
+		return fallback
+	}
+	return d
+}
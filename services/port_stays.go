@@ -0,0 +1,143 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+const (
+	defaultPortStayInterval = 10 * time.Minute
+	portStayBatchSize       = 5000
+	// A silence longer than this ends a stay even in the same zone
+	maxPortStayGap = 6 * time.Hour
+	// An anchorage stay ending this long before a berth stay at the same
+	// port is the wait for that berth
+	arrivalWindow = 12 * time.Hour
+	// Slower than this in the anchorage ring is waiting, faster is passing
+	anchorSpeedKnots = 1.0
+)
+
+// AIS navigational statuses of a vessel that is not under way
+const (
+	navStatusAtAnchor = 1
+	navStatusMoored   = 5
+)
+
+// PortStayDetector groups AIS positions into berth stays, inside a port
+// geofence, and anchorage stays, slow in the ring around it. Each vessel is
+// processed from where the previous run stopped, so a restart picks up
+// where it left off.
+type PortStayDetector struct {
+	database *sql.DB
+	interval time.Duration
+}
+
+// NewPortStayDetector reads PORT_STAYS_INTERVAL, a Go duration (default 10m).
+func NewPortStayDetector(database *sql.DB) *PortStayDetector {
+	return &PortStayDetector{
+		database: database,
+		interval: EnvDuration("PORT_STAYS_INTERVAL", defaultPortStayInterval),
+	}
+}
+
+func (d *PortStayDetector) Start() {
+	go func() {
+		for {
+			d.run()
+			time.Sleep(d.interval)
+		}
+	}()
+}
+
+func (d *PortStayDetector) run() {
+	mmsis, err := db.PortStayBacklog(d.database)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, mmsi := range mmsis {
+		if err := d.processVessel(mmsi); err != nil {
+			log.Printf("Error detecting port stays of %s: %v", mmsi, err)
+		}
+	}
+}
+
+func (d *PortStayDetector) processVessel(mmsi string) error {
+	for {
+		positions, err := db.ZonePositions(d.database, mmsi, portStayBatchSize)
+		if err != nil || len(positions) == 0 {
+			return err
+		}
+
+		open, err := db.GetOpenPortStay(d.database, mmsi)
+		if err != nil {
+			return err
+		}
+
+		stays := groupPortStays(mmsi, open, positions)
+		processedUntil := positions[len(positions)-1].Timestamp
+		if err := db.SavePortStays(d.database, mmsi, stays, processedUntil, arrivalWindow); err != nil {
+			return err
+		}
+
+		if len(positions) < portStayBatchSize {
+			return nil
+		}
+	}
+}
+
+// groupPortStays extends the open stay with the positions that continue
+// it and starts a stay whenever the vessel enters another zone. It returns
+// the stays to save, every one but the last closed.
+func groupPortStays(mmsi string, open *db.PortStay, positions []db.ZonedPosition) []db.PortStay {
+	var stays []db.PortStay
+	current := -1
+	if open != nil {
+		stays = append(stays, *open)
+		current = 0
+	}
+
+	for _, p := range positions {
+		kind := p.Kind
+		if kind == db.StayAnchorage && !waiting(p) {
+			kind = ""
+		}
+
+		if current >= 0 {
+			s := &stays[current]
+			if kind == s.Kind && p.Unlocode == s.Unlocode && p.Timestamp.Sub(s.EndedAt) <= maxPortStayGap {
+				s.EndedAt = p.Timestamp
+				s.PositionCount++
+				continue
+			}
+			s.Closed = true
+			current = -1
+		}
+
+		if kind == "" {
+			continue
+		}
+		stays = append(stays, db.PortStay{
+			MMSI:          mmsi,
+			Unlocode:      p.Unlocode,
+			Kind:          kind,
+			StartedAt:     p.Timestamp,
+			EndedAt:       p.Timestamp,
+			PositionCount: 1,
+		})
+		current = len(stays) - 1
+	}
+	return stays
+}
+
+// waiting tells a vessel at anchor or drifting from one passing through
+// the anchorage ring.
+func waiting(p db.ZonedPosition) bool {
+	if p.NavStatus != nil && (*p.NavStatus == navStatusAtAnchor || *p.NavStatus == navStatusMoored) {
+		return true
+	}
+	return p.Sog != nil && *p.Sog < anchorSpeedKnots
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// ScheduleChange is a new version of a sailing that differs from the one
+// seen before.
+type ScheduleChange struct {
+	SailingKey     string           `json:"sailing_key"`
+	Version        int              `json:"version"`
+	OceanProductID int64            `json:"ocean_product_id"`
+	CarrierCode    string           `json:"carrier_code"`
+	Origin         string           `json:"origin"`
+	Destination    string           `json:"destination"`
+	ObservedAt     time.Time        `json:"observed_at"`
+	Changes        []db.FieldChange `json:"changes"`
+}
+
+// ScheduleNotifier is told about every schedule change, e.g. to alert the
+// customers booked on the sailing.
+type ScheduleNotifier interface {
+	Name() string
+	Notify(ctx context.Context, change ScheduleChange) error
+}
+
+// LogNotifier writes schedule changes to the log.
+type LogNotifier struct{}
+
+func (LogNotifier) Name() string { return "log" }
+
+func (LogNotifier) Notify(_ context.Context, change ScheduleChange) error {
+	fields := make([]string, len(change.Changes))
+	for i, c := range change.Changes {
+		fields[i] = c.Field
+	}
+	log.Printf("Schedule %s changed (version %d): %s", change.SailingKey, change.Version, strings.Join(fields, ", "))
+	return nil
+}
+
+// WebhookNotifier POSTs each schedule change as JSON.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Name() string { return "webhook" }
+
+func (n WebhookNotifier) Notify(ctx context.Context, change ScheduleChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// ScheduleNotifiersFromEnv builds the notifiers named by SCHEDULE_NOTIFIERS,
+// by default "log". The webhook posts to SCHEDULE_WEBHOOK_URL and is skipped
+// when unset.
+func ScheduleNotifiersFromEnv() []ScheduleNotifier {
+	names := os.Getenv("SCHEDULE_NOTIFIERS")
+	if names == "" {
+		names = "log"
+	}
+
+	var notifiers []ScheduleNotifier
+	for _, name := range strings.Split(names, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "log":
+			notifiers = append(notifiers, LogNotifier{})
+		case "webhook":
+			url := os.Getenv("SCHEDULE_WEBHOOK_URL")
+			if url == "" {
+				log.Println("SCHEDULE_WEBHOOK_URL is not set, skipping the webhook notifier")
+				continue
+			}
+			notifiers = append(notifiers, WebhookNotifier{URL: url, Client: &http.Client{Timeout: notifyTimeout}})
+		default:
+			log.Printf("Unknown schedule notifier %q, skipping", name)
+		}
+	}
+	return notifiers
+}
+
+// ScheduleHistory keeps an append-only history of each sailing: a version
+// is written whenever a fetch returns it different from the last version,
+// with the field-level changes, and the notifiers are told.
+type ScheduleHistory struct {
+	database  *sql.DB
+	notifiers []ScheduleNotifier
+}
+
+func NewScheduleHistory(database *sql.DB, notifiers []ScheduleNotifier) *ScheduleHistory {
+	return &ScheduleHistory{database: database, notifiers: notifiers}
+}
+
+// Record compares the stored products with the latest version of their
+// sailing. Products without an ID were not stored and are skipped.
+func (h *ScheduleHistory) Record(products []models.ReducedOceanProduct) {
+	var changes []ScheduleChange
+	for _, p := range products {
+		if p.ID == 0 {
+			continue
+		}
+		change, err := h.record(p)
+		if err != nil {
+			log.Printf("Error recording schedule version of product %d: %v", p.ID, err)
+			continue
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	if len(changes) > 0 && len(h.notifiers) > 0 {
+		go h.notify(changes)
+	}
+}
+
+func (h *ScheduleHistory) record(p models.ReducedOceanProduct) (*ScheduleChange, error) {
+	key := SailingKey(p)
+	id := p.ID
+
+	snapshot, err := scheduleSnapshot(p)
+	if err != nil {
+		return nil, err
+	}
+
+	version := &db.ScheduleVersion{
+		SailingKey:          key,
+		Version:             1,
+		OceanProductID:      &id,
+		CarrierCode:         p.CarrierCode,
+		OriginUnLoCode:      p.OriginPortUnLoCode,
+		DestinationUnLoCode: p.DestinationPortUnLoCode,
+		DepartureDateTime:   optionalTime(p.DepartureDateTime),
+		ArrivalDateTime:     optionalTime(p.ArrivalDateTime),
+		VesselName:          p.DepartureVesselName,
+		VesselIMONumber:     p.DepartureVesselIMONumber,
+		Snapshot:            snapshot,
+		Changes:             []db.FieldChange{},
+	}
+
+	latest, err := db.GetLatestScheduleVersion(h.database, key)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+	if latest != nil {
+		version.Version = latest.Version + 1
+		version.Changes, err = diffSnapshots(latest.Snapshot, snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if len(version.Changes) == 0 {
+			return nil, db.SetSailingKey(h.database, &id, key)
+		}
+	}
+
+	inserted, err := db.InsertScheduleVersion(h.database, version)
+	if err != nil || !inserted || version.Version == 1 {
+		return nil, err
+	}
+	return &ScheduleChange{
+		SailingKey:     key,
+		Version:        version.Version,
+		OceanProductID: id,
+		CarrierCode:    p.CarrierCode,
+		Origin:         p.OriginPortUnLoCode,
+		Destination:    p.DestinationPortUnLoCode,
+		ObservedAt:     version.ObservedAt,
+		Changes:        version.Changes,
+	}, nil
+}
+
+func (h *ScheduleHistory) notify(changes []ScheduleChange) {
+	for _, change := range changes {
+		for _, n := range h.notifiers {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			if err := n.Notify(ctx, change); err != nil {
+				log.Printf("Schedule notifier %s failed for %s: %v", n.Name(), change.SailingKey, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// SailingKey identifies a sailing across fetches, so a delayed departure or
+// a swapped vessel is a new version of it rather than another sailing. The
+// service and carrier voyage of each vessel leg are stable, the ports it
+// transships at tell routings of those voyages apart. A vessel leg without a
+// voyage number is keyed on its vessel, a product without either on its
+// product ID; the departure date stays out of the key so that a moved date
+// is a change.
+func SailingKey(p models.ReducedOceanProduct) string {
+	var via []string
+	for _, leg := range p.TransportLegs {
+		if leg.DestinationPortUnLoCode != "" && leg.DestinationPortUnLoCode != p.DestinationPortUnLoCode {
+			via = append(via, leg.DestinationPortUnLoCode)
+		}
+	}
+	key := []string{p.CarrierCode, p.OriginPortUnLoCode, p.DestinationPortUnLoCode, strings.Join(via, ">")}
+
+	var voyages []string
+	for _, leg := range p.TransportLegs {
+		if leg.TransportMode != "" && leg.TransportMode != "VESSEL" {
+			continue
+		}
+		switch {
+		case leg.CarrierDepartureVoyageNumber != "":
+			voyages = append(voyages, leg.CarrierServiceCode, leg.CarrierDepartureVoyageNumber)
+		case leg.VesselIMONumber != "":
+			voyages = append(voyages, "IMO"+leg.VesselIMONumber)
+		}
+	}
+	if len(voyages) == 0 {
+		voyages = []string{p.CarrierProductID}
+	}
+	return strings.Join(append(key, voyages...), "|")
+}
+
+// unversionedFields are left out of the snapshots: carriers move the
+// validity window of a product on every answer.
+var unversionedFields = []string{"ProductValidFromDate", "ProductValidToDate"}
+
+// scheduleSnapshot is the product as the carrier returned it, without what
+// is computed or enriched on our side, nor the vessel flag and call sign,
+// which the vessel identity history follows, nor the unversionedFields.
+func scheduleSnapshot(p models.ReducedOceanProduct) (json.RawMessage, error) {
+	p.ID = 0
+	p.DepartureVesselMMSI = ""
+	p.LastKnownPosition = nil
+	p.Connections = nil
+	p.ConnectionAtRisk = false
+	p.Reliability = nil
+
+	legs := make([]models.ReducedTransportLeg, len(p.TransportLegs))
+	copy(legs, p.TransportLegs)
+	for i := range legs {
+		legs[i].VesselMMSI = ""
+		legs[i].LastKnownPosition = nil
+		legs[i].VesselFlag = ""
+		legs[i].VesselCallSign = ""
+	}
+	p.TransportLegs = legs
+
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	for _, f := range unversionedFields {
+		delete(fields, f)
+	}
+	return json.Marshal(fields)
+}
+
+// diffSnapshots compares two snapshots field by field, nested fields and
+// legs by their path.
+func diffSnapshots(previous, current json.RawMessage) ([]db.FieldChange, error) {
+	var before, after interface{}
+	if err := json.Unmarshal(previous, &before); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(current, &after); err != nil {
+		return nil, err
+	}
+
+	beforeFields, afterFields := map[string]interface{}{}, map[string]interface{}{}
+	flatten("", before, beforeFields)
+	flatten("", after, afterFields)
+	// versions stored before they were left out still hold them
+	for _, f := range unversionedFields {
+		delete(beforeFields, f)
+		delete(afterFields, f)
+	}
+
+	fields := make(map[string]struct{})
+	for f := range beforeFields {
+		fields[f] = struct{}{}
+	}
+	for f := range afterFields {
+		fields[f] = struct{}{}
+	}
+
+	changes := []db.FieldChange{}
+	for f := range fields {
+		if !reflect.DeepEqual(beforeFields[f], afterFields[f]) {
+			changes = append(changes, db.FieldChange{Field: f, Old: beforeFields[f], New: afterFields[f]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+func flatten(path string, v interface{}, out map[string]interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if path == "" {
+				flatten(k, child, out)
+			} else {
+				flatten(path+"."+k, child, out)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(fmt.Sprintf("%s[%d]", path, i), child, out)
+		}
+	default:
+		out[path] = v
+	}
+}
+
+func optionalTime(t models.CustomTime) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t.Time
+}
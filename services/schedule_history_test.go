@@ -0,0 +1,132 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+func vesselLeg(origin, destination, service, voyage string, departure time.Time) models.ReducedTransportLeg {
+	return models.ReducedTransportLeg{
+		TransportMode:                "VESSEL",
+		OriginPortUnLoCode:           origin,
+		DestinationPortUnLoCode:      destination,
+		CarrierServiceCode:           service,
+		CarrierDepartureVoyageNumber: voyage,
+		DepartureDateTime:            models.CustomTime{Time: departure},
+		ArrivalDateTime:              models.CustomTime{Time: departure.Add(5 * 24 * time.Hour)},
+	}
+}
+
+// sharedFirstLeg returns two products of one fetch that leave on the same
+// voyage and transship at the same port onto different onward voyages.
+func sharedFirstLeg(fetchedAt time.Time) []models.ReducedOceanProduct {
+	departure := time.Date(2024, 5, 3, 8, 0, 0, 0, time.UTC)
+	products := make([]models.ReducedOceanProduct, 2)
+	for i, onward := range []string{"421E", "425E"} {
+		connection := departure.Add(time.Duration(7+2*i) * 24 * time.Hour)
+		products[i] = models.ReducedOceanProduct{
+			ID:                      int64(i + 1),
+			CarrierProductID:        "P" + onward,
+			CarrierCode:             "MAEU",
+			OriginPortUnLoCode:      "NLRTM",
+			DestinationPortUnLoCode: "CNSHA",
+			DepartureDateTime:       models.CustomTime{Time: departure},
+			ArrivalDateTime:         models.CustomTime{Time: connection.Add(20 * 24 * time.Hour)},
+			ProductValidFromDate:    models.CustomTime{Time: fetchedAt},
+			ProductValidToDate:      models.CustomTime{Time: fetchedAt.Add(7 * 24 * time.Hour)},
+			TransportLegs: []models.ReducedTransportLeg{
+				vesselLeg("NLRTM", "SGSIN", "AE7", "418W", departure),
+				vesselLeg("SGSIN", "CNSHA", "AE1", onward, connection),
+			},
+		}
+	}
+	return products
+}
+
+func TestSailingKeyTellsOnwardVoyagesApart(t *testing.T) {
+	products := sharedFirstLeg(time.Now())
+	first, second := SailingKey(products[0]), SailingKey(products[1])
+	if first == second {
+		t.Fatalf("products with different onward voyages share the key %s", first)
+	}
+	if want := "MAEU|NLRTM|CNSHA|SGSIN|AE7|418W|AE1|421E"; first != want {
+		t.Errorf("key = %s, want %s", first, want)
+	}
+
+	noVoyage := products[0]
+	noVoyage.TransportLegs = []models.ReducedTransportLeg{{TransportMode: "VESSEL", VesselIMONumber: "9776183"}}
+	if got := SailingKey(noVoyage); got != "MAEU|NLRTM|CNSHA||IMO9776183" {
+		t.Errorf("key without voyage = %s", got)
+	}
+	noVoyage.TransportLegs = nil
+	if got := SailingKey(noVoyage); got != "MAEU|NLRTM|CNSHA||P421E" {
+		t.Errorf("key without legs = %s", got)
+	}
+}
+
+// TestRepeatedFetchRecordsNoChange replays what record does against the
+// latest version of each key: the same sailings fetched again, with the
+// validity window moved on, are no change.
+func TestRepeatedFetchRecordsNoChange(t *testing.T) {
+	latest := make(map[string]json.RawMessage)
+	fetchedAt := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	for fetch := 0; fetch < 3; fetch++ {
+		for _, p := range sharedFirstLeg(fetchedAt.Add(time.Duration(fetch) * time.Hour)) {
+			key := SailingKey(p)
+			snapshot, err := scheduleSnapshot(p)
+			if err != nil {
+				t.Fatalf("snapshot: %v", err)
+			}
+			if previous, ok := latest[key]; ok {
+				changes, err := diffSnapshots(previous, snapshot)
+				if err != nil {
+					t.Fatalf("diff: %v", err)
+				}
+				if len(changes) > 0 {
+					t.Errorf("fetch %d recorded changes for %s: %+v", fetch, key, changes)
+				}
+			} else if fetch > 0 {
+				t.Errorf("fetch %d found no version for %s", fetch, key)
+			}
+			latest[key] = snapshot
+		}
+	}
+	if len(latest) != 2 {
+		t.Errorf("got %d sailings, want 2", len(latest))
+	}
+}
+
+func TestDiffIgnoresValidityOfStoredVersions(t *testing.T) {
+	p := sharedFirstLeg(time.Now())[0]
+	current, err := scheduleSnapshot(p)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(current, &fields)
+	if _, ok := fields["ProductValidToDate"]; ok {
+		t.Error("snapshot holds the product validity")
+	}
+
+	// a version stored before the validity was left out
+	fields["ProductValidToDate"] = json.RawMessage(`"2024-01-01T00:00:00Z"`)
+	stored, _ := json.Marshal(fields)
+	changes, err := diffSnapshots(stored, current)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("changes = %+v, want none", changes)
+	}
+
+	p.ArrivalDateTime.Time = p.ArrivalDateTime.Add(24 * time.Hour)
+	moved, _ := scheduleSnapshot(p)
+	changes, _ = diffSnapshots(current, moved)
+	if len(changes) != 1 || changes[0].Field != "ArrivalDateTime" {
+		t.Errorf("changes = %+v, want the arrival", changes)
+	}
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+	"github.com/Sraiti/vesselTracker/models"
+)
+
+const (
+	scheduleWriteQueueSize = 100
+	scheduleWriteAttempts  = 3
+	firstScheduleWriteWait = 2 * time.Second
+)
+
+// ErrScheduleQueueFull is returned by Save when the writer is too far
+// behind to take another batch.
+var ErrScheduleQueueFull = errors.New("schedule write queue is full")
+
+// ScheduleWriteStatus reports how the writer is doing, for the admin
+// endpoint.
+type ScheduleWriteStatus struct {
+	Queued      int        `json:"queued"`
+	Batches     int64      `json:"batches"`
+	Products    int64      `json:"products"`
+	Retries     int64      `json:"retries"`
+	Failed      int64      `json:"failed"`
+	Dropped     int64      `json:"dropped"` // refused because the queue was full
+	LastWriteAt *time.Time `json:"last_write_at"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type scheduleWrite struct {
+	products []models.ReducedOceanProduct
+	done     func([]models.ReducedOceanProduct)
+}
+
+// ScheduleWriter stores fetched schedules off the request path. Batches are
+// written one at a time, in the order they were queued, each in a single
+// transaction retried with backoff. Once a batch is stored its sailings are
+// recorded in the schedule history and the caller's callback runs with the
+// products carrying their IDs. A batch that keeps failing is logged and
+// counted in the status.
+type ScheduleWriter struct {
+	database *sql.DB
+	history  *ScheduleHistory
+	queue    chan scheduleWrite
+
+	mu     sync.Mutex
+	status ScheduleWriteStatus
+}
+
+func NewScheduleWriter(database *sql.DB, history *ScheduleHistory) *ScheduleWriter {
+	return &ScheduleWriter{
+		database: database,
+		history:  history,
+		queue:    make(chan scheduleWrite, scheduleWriteQueueSize),
+	}
+}
+
+func (w *ScheduleWriter) Start() {
+	go func() {
+		for write := range w.queue {
+			w.write(write)
+		}
+	}()
+}
+
+// Save queues products for writing; done, which may be nil, is called once
+// they are stored, right away when there are none. The products are
+// copied, the caller keeps its slice.
+func (w *ScheduleWriter) Save(products []models.ReducedOceanProduct, done func([]models.ReducedOceanProduct)) error {
+	if len(products) == 0 {
+		if done != nil {
+			done(products)
+		}
+		return nil
+	}
+	batch := make([]models.ReducedOceanProduct, len(products))
+	copy(batch, products)
+
+	select {
+	case w.queue <- scheduleWrite{products: batch, done: done}:
+		return nil
+	default:
+		w.mu.Lock()
+		w.status.Dropped++
+		w.mu.Unlock()
+		return ErrScheduleQueueFull
+	}
+}
+
+// Status returns a snapshot of the writer's counters.
+func (w *ScheduleWriter) Status() ScheduleWriteStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := w.status
+	status.Queued = len(w.queue)
+	return status
+}
+
+func (w *ScheduleWriter) write(write scheduleWrite) {
+	start := time.Now()
+	wait := firstScheduleWriteWait
+
+	var ids []int64
+	var err error
+	for attempt := 1; attempt <= scheduleWriteAttempts; attempt++ {
+		if ids, err = db.SaveOceanProducts(w.database, write.products); err == nil {
+			break
+		}
+		if attempt < scheduleWriteAttempts {
+			log.Printf("Error writing %d ocean products (attempt %d), retrying in %v: %v", len(write.products), attempt, wait, err)
+			w.mu.Lock()
+			w.status.Retries++
+			w.mu.Unlock()
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+
+	now := time.Now().UTC()
+	w.mu.Lock()
+	w.status.Batches++
+	if err != nil {
+		w.status.Failed++
+		w.status.LastError = err.Error()
+		w.status.LastErrorAt = &now
+	} else {
+		w.status.Products += int64(len(write.products))
+		w.status.LastWriteAt = &now
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Giving up on writing %d ocean products: %v", len(write.products), err)
+		return
+	}
+	log.Printf("Wrote %d ocean products in %v", len(write.products), time.Since(start))
+
+	for i := range write.products {
+		write.products[i].ID = ids[i]
+	}
+	if w.history != nil {
+		w.history.Record(write.products)
+	}
+	if write.done != nil {
+		write.done(write.products)
+	}
+}
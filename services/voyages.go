@@ -0,0 +1,142 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/Sraiti/vesselTracker/db"
+)
+
+const (
+	defaultVoyageInterval = 30 * time.Minute
+	// Slower than this between two positions is stopped: drifting, waiting
+	// at anchor or held outside the port
+	stoppedSpeedKnots = 1.0
+	// How far a scheduled departure may be from the actual one for the leg
+	// to be the one the voyage fulfilled
+	legMatchTolerance = 3 * 24 * time.Hour
+	// Legs are fetched ahead of time, and again later; voyages older than
+	// this are not linked any more
+	legLinkLookback = 90 * 24 * time.Hour
+)
+
+// VoyageSegmenter splits the history of each vessel into voyages between
+// its berth stays at two ports, as detected by PortStayDetector, and links
+// them to the transport legs they fulfilled.
+type VoyageSegmenter struct {
+	database *sql.DB
+	interval time.Duration
+}
+
+// NewVoyageSegmenter reads VOYAGES_INTERVAL, a Go duration (default 30m).
+func NewVoyageSegmenter(database *sql.DB) *VoyageSegmenter {
+	return &VoyageSegmenter{
+		database: database,
+		interval: EnvDuration("VOYAGES_INTERVAL", defaultVoyageInterval),
+	}
+}
+
+func (s *VoyageSegmenter) Start() {
+	go func() {
+		for {
+			s.run()
+			time.Sleep(s.interval)
+		}
+	}()
+}
+
+func (s *VoyageSegmenter) run() {
+	mmsis, err := db.VoyageBacklog(s.database)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, mmsi := range mmsis {
+		if err := s.segment(mmsi); err != nil {
+			log.Printf("Error segmenting voyages of %s: %v", mmsi, err)
+		}
+	}
+
+	linked, err := db.LinkVoyages(s.database, legMatchTolerance, legLinkLookback)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if linked > 0 {
+		log.Printf("Linked %d voyages to transport legs", linked)
+	}
+}
+
+// segment records a voyage for each pair of consecutive berth stays at
+// different ports. Consecutive stays at the same port are a shift between
+// berths, the voyage leaves from the last of them.
+func (s *VoyageSegmenter) segment(mmsi string) error {
+	stays, err := db.GetBerthStaysSinceLastVoyage(s.database, mmsi)
+	if err != nil {
+		return err
+	}
+
+	from := 0
+	for i := 1; i < len(stays); i++ {
+		origin, destination := stays[from], stays[i]
+		from = i
+		if origin.Unlocode == destination.Unlocode {
+			continue
+		}
+
+		points, err := db.GetTrackBetween(s.database, mmsi, origin.EndedAt, destination.StartedAt)
+		if err != nil {
+			return err
+		}
+
+		v := measureVoyage(points, origin.EndedAt, destination.StartedAt)
+		v.MMSI = mmsi
+		v.FromUnlocode, v.ToUnlocode = origin.Unlocode, destination.Unlocode
+		v.FromStayID, v.ToStayID = &origin.ID, &destination.ID
+		if err := db.SaveVoyage(s.database, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// measureVoyage sums the distance between the positions of a voyage,
+// outliers left out, and the time spent stopped on the way. The average
+// speed is over the time under way.
+func measureVoyage(points []db.TrackPoint, departed, arrived time.Time) db.Voyage {
+	v := db.Voyage{DepartedAt: departed, ArrivedAt: arrived, PositionCount: len(points)}
+
+	var stopped time.Duration
+	var accepted *db.TrackPoint
+	rejected := 0
+	for i := range points {
+		p := &points[i]
+		if outlier(accepted, p) && (rejected < maxConsecutiveOutliers || !validPosition(p)) {
+			rejected++
+			continue
+		}
+		rejected = 0
+		if accepted != nil {
+			nm := greatCircleNM(accepted.Latitude, accepted.Longitude, p.Latitude, p.Longitude)
+			elapsed := p.Timestamp.Sub(accepted.Timestamp)
+			v.DistanceNM += nm
+
+			slow := accepted.Sog != nil && p.Sog != nil && *accepted.Sog < stoppedSpeedKnots && *p.Sog < stoppedSpeedKnots
+			if accepted.Sog == nil || p.Sog == nil {
+				slow = elapsed > 0 && nm/elapsed.Hours() < stoppedSpeedKnots
+			}
+			if slow {
+				stopped += elapsed
+			}
+		}
+		accepted = p
+	}
+
+	v.StoppedHours = stopped.Hours()
+	if underway := arrived.Sub(departed) - stopped; underway > 0 && v.DistanceNM > 0 {
+		speed := v.DistanceNM / underway.Hours()
+		v.AvgSpeedKnots = &speed
+	}
+	return v
+}
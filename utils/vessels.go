@@ -14,24 +14,50 @@ import (
 	"github.com/Sraiti/vesselTracker/models"
 )
 
-func addVesselToSet(imoSet map[string]db.Vessel, maerskVessel models.Vessel) {
-	if maerskVessel.VesselIMONumber != "" {
-		imoSet[maerskVessel.VesselIMONumber] = db.Vessel{
-			IMONumber:   maerskVessel.VesselIMONumber,
-			Name:        maerskVessel.VesselName,
-			CarrierCode: maerskVessel.CarrierVesselCode,
-		}
+// addVesselToSet adds a vessel by IMO number, filling in what an earlier
+// mention of it left blank.
+func addVesselToSet(imoSet map[string]db.Vessel, vessel db.Vessel) {
+	if vessel.IMONumber == "" {
+		return
+	}
+	existing, ok := imoSet[vessel.IMONumber]
+	if !ok {
+		imoSet[vessel.IMONumber] = vessel
+		return
+	}
+	if existing.Name == "" {
+		existing.Name = vessel.Name
 	}
+	if existing.CarrierCode == "" {
+		existing.CarrierCode = vessel.CarrierCode
+	}
+	if existing.Flag == "" {
+		existing.Flag = vessel.Flag
+	}
+	if existing.CallSign == "" {
+		existing.CallSign = vessel.CallSign
+	}
+	imoSet[vessel.IMONumber] = existing
 }
 
-func CollectUniqueVessels(data models.MaerskPointToPoint) map[string]db.Vessel {
+// CollectUniqueVessels gathers the departure and leg vessels of normalized
+// schedules, whichever carrier they came from, as the carriers describe them.
+func CollectUniqueVessels(products []models.ReducedOceanProduct) map[string]db.Vessel {
 	imoSet := make(map[string]db.Vessel)
-	for _, product := range data.OceanProducts {
-		for _, schedule := range product.TransportSchedules {
-			addVesselToSet(imoSet, schedule.FirstDepartureVessel)
-			for _, leg := range schedule.TransportLegs {
-				addVesselToSet(imoSet, leg.Transport.Vessel)
-			}
+	for _, product := range products {
+		addVesselToSet(imoSet, db.Vessel{
+			IMONumber:   product.DepartureVesselIMONumber,
+			Name:        product.DepartureVesselName,
+			CarrierCode: product.DepartureVesselCarrierCode,
+		})
+		for _, leg := range product.TransportLegs {
+			addVesselToSet(imoSet, db.Vessel{
+				IMONumber:   leg.VesselIMONumber,
+				Name:        leg.VesselName,
+				CarrierCode: leg.VesselCarrierCode,
+				Flag:        leg.VesselFlag,
+				CallSign:    leg.VesselCallSign,
+			})
 		}
 	}
 	return imoSet